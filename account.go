@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/bepass-org/warp-plus/warp"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+// accountInfo is an identity as printed by "account --json". It leaves out
+// the keys and tokens.
+type accountInfo struct {
+	ID          string `json:"id"`
+	Team        string `json:"team,omitempty"`
+	AccountType string `json:"account_type"`
+	WarpPlus    bool   `json:"warp_plus"`
+	PremiumData int64  `json:"premium_data"`
+	AddressV4   string `json:"address_v4"`
+	AddressV6   string `json:"address_v6"`
+	Endpoint    string `json:"endpoint"`
+	ClientID    string `json:"client_id"`
+	// Reserved is the client id decoded into the reserved header bytes, as
+	// other warp clients take it
+	Reserved [3]byte `json:"reserved"`
+}
+
+// runAccountCommand implements the "account" subcommand, which prints the
+// account of an identity and the reserved bytes other warp clients need to
+// use it.
+func runAccountCommand(args []string) error {
+	fs := ff.NewFlagSet("warp-plus account")
+	var (
+		dir     = fs.String('d', "dir", "./stuff/primary", "identity directory")
+		profile = fs.StringLong("profile", "", "profile whose primary identity is shown, in place of --dir")
+		jsonOut = fs.BoolLong("json", "print the account as JSON")
+	)
+
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("WARP_PLUS"))
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		return nil
+	case err != nil:
+		return err
+	}
+
+	path, err := primaryDir(*profile, *dir)
+	if err != nil {
+		return err
+	}
+
+	i, err := warp.LoadIdentity(path)
+	if err != nil {
+		return err
+	}
+	reserved, err := i.Config.Reserved()
+	if err != nil {
+		return err
+	}
+
+	info := accountInfo{
+		ID:          i.ID,
+		Team:        i.Team,
+		AccountType: i.Account.AccountType,
+		WarpPlus:    i.Account.WarpPlus,
+		PremiumData: i.Account.PremiumData,
+		AddressV4:   i.Config.Interface.Addresses.V4,
+		AddressV6:   i.Config.Interface.Addresses.V6,
+		ClientID:    i.Config.ClientID,
+		Reserved:    reserved,
+	}
+	if len(i.Config.Peers) > 0 {
+		info.Endpoint = i.Config.Peers[0].Endpoint.Host
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "id:\t%s\n", info.ID)
+	if info.Team != "" {
+		fmt.Fprintf(w, "team:\t%s\n", info.Team)
+	}
+	fmt.Fprintf(w, "account type:\t%s\n", info.AccountType)
+	fmt.Fprintf(w, "warp+:\t%t\n", info.WarpPlus)
+	fmt.Fprintf(w, "premium data:\t%d\n", info.PremiumData)
+	fmt.Fprintf(w, "addresses:\t%s, %s\n", info.AddressV4, info.AddressV6)
+	fmt.Fprintf(w, "endpoint:\t%s\n", info.Endpoint)
+	fmt.Fprintf(w, "client id:\t%s\n", info.ClientID)
+	fmt.Fprintf(w, "reserved:\t%d,%d,%d (0x%x)\n", reserved[0], reserved[1], reserved[2], reserved[:])
+	return w.Flush()
+}
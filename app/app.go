@@ -6,202 +6,653 @@ import (
 	"fmt"
 	"log/slog"
 	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
-	"github.com/bepass-org/warp-plus/psiphon"
 	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
 	"github.com/bepass-org/warp-plus/wiresocks"
 )
 
-const singleMTU = 1330
-const doubleMTU = 1280 // minimum mtu for IPv6, may cause frag reassembly somewhere
+// ErrNoPsiphon is returned for psiphon mode by builds without it, see the
+// minimal build tag.
+var ErrNoPsiphon = errors.New("psiphon is not included in this build")
 
 type WarpOptions struct {
-	Bind     netip.AddrPort
-	Endpoint string
-	License  string
-	Psiphon  *PsiphonOptions
-	Gool     bool
-	Scan     *wiresocks.ScanOptions
+	// Bind is the list of addresses the proxy listens on.
+	Bind      []netip.AddrPort
+	Endpoint  string
+	Endpoint2 string // inner endpoint in gool mode, defaults to Endpoint
+	// Endpoints, if set, are the endpoints of an endpoint list, which
+	// Endpoint and Endpoint2 should be taken from. Tunnels whose handshakes
+	// time out or that fail verification move to the next one, and so do the
+	// sessions restarted by failing probes.
+	Endpoints []string
+	License   string
+	Psiphon   *PsiphonOptions
+	Gool      bool
+	Scan      *wiresocks.ScanOptions
+	Proxy     wiresocks.ProxyOptions
+	// Multi runs the primary and secondary identities as two tunnels on
+	// Endpoint and Endpoint2 and spreads connections across them.
+	Multi bool
+	// Balance is how Multi mode spreads connections, one of
+	// wiresocks.BalanceModes; round robin if empty.
+	Balance string
+	// WireguardConfig, if set, is an existing wireguard profile to run in
+	// place of the primary identity. Registration is skipped.
+	WireguardConfig string
+	// IdentityDir is the directory the primary and secondary identities are
+	// kept in. Empty means "./stuff".
+	IdentityDir string
+	// SeparateIdentity registers a second device for the second tunnel of
+	// gool and multi mode. By default it runs on a clone of the primary
+	// identity, which leaves one device on the account.
+	SeparateIdentity bool
+	// Auto tries warp, gool and then psiphon (if Psiphon is set) and keeps
+	// the first mode that passes a connectivity probe.
+	Auto bool
+	// MTU overrides the mtu of the tunnels carried directly over the network.
+	// Zero means the default of 1330.
+	MTU int
+	// InnerMTU overrides the mtu of the inner tunnel in gool mode. Zero
+	// means the default of 1280.
+	InnerMTU int
+	// InnerRefresh, if set, is how often the inner endpoint of gool mode is
+	// measured through the outer tunnel. It is replaced once its handshake
+	// round trip has been above InnerMaxRTT a few times in a row.
+	InnerRefresh time.Duration
+	// InnerMaxRTT is the slowest inner endpoint kept by InnerRefresh. Zero
+	// means one second.
+	InnerMaxRTT time.Duration
+	// KeepAlive overrides the persistent keepalive interval in seconds of
+	// every tunnel. Zero means the defaults of 3, and 10 for the inner tunnel
+	// in gool mode.
+	KeepAlive int
+	// HandshakeTimeout bounds each handshake attempt of a tunnel, which is
+	// restarted up to HandshakeRetries times if it runs out. Zero leaves the
+	// handshake to ReadyTimeout.
+	HandshakeTimeout time.Duration
+	HandshakeRetries int
+	// Tricks shape the junk packets sent ahead of the handshakes and
+	// keepalives of the tunnels carried directly over the network.
+	Tricks wiresocks.TrickConfig
+	// FallbackEndpoint, if set, is an endpoint of the other IP family the
+	// primary tunnel switches to while handshakes with its endpoint time out.
+	FallbackEndpoint string
+	// Upstream, if set, is a socks5 proxy the tunnels carried directly over
+	// the network relay their datagrams through.
+	Upstream *wiresocks.UpstreamProxy
+	// PreferFamily, 4 or 6, is the IP family the tunnels dial the addresses
+	// of proxied destination hosts in first. Zero means IPv6 first.
+	PreferFamily int
+	// Reserved, if set, replaces the reserved header bytes of every peer,
+	// which otherwise come from the profiles, e.g. the client id of a warp
+	// identity.
+	Reserved *[3]byte
+	// ReadyTimeout bounds how long the tunnels may take to complete their
+	// handshakes once started. Zero means no limit.
+	ReadyTimeout time.Duration
+	// OnReady, if set, is called with the running session once the proxy is
+	// serving traffic.
+	OnReady func(Session)
+	// StatusInterval, if set, is how often the endpoint, last handshake age
+	// and traffic of every tunnel are logged.
+	StatusInterval time.Duration
+	// SkipVerify skips fetching cloudflare's trace endpoint through every
+	// tunnel once its handshake completes. The fetch must show traffic
+	// leaving through warp, or the tunnel is moved to another endpoint.
+	SkipVerify bool
+	// PreferColos, if set, are the cloudflare data centers, by IATA code,
+	// the traffic of the tunnels should leave through. A verified tunnel
+	// landing elsewhere is moved to other endpoints, the next scanned or
+	// listed ones first, until one lands in them or it has tried a few.
+	PreferColos []string
+	// UAPI, if set, exposes every tunnel on a uapi socket named UAPI-<tunnel>,
+	// e.g. wp-primary, for wg show.
+	UAPI string
+	// Stack tunes the TCP of the netstack every tunnel runs, e.g. its
+	// buffers for links with a large bandwidth-delay product.
+	Stack netstack.Tuning
+	// StatsPath, if set, is a JSON lines file each session's phase timings
+	// and outcome are appended to.
+	StatsPath string
+	// Probe, if set, has an Instance run synthetic transactions through the
+	// proxy and restart sessions they keep failing on. RunWarp ignores it.
+	Probe *ProbeOptions
+	// RekeyInterval, if set, has an Instance give the identities new keys
+	// this often, see Instance.Rekey. RunWarp ignores it.
+	RekeyInterval time.Duration
+	// Hooks, if set, are commands an Instance runs when the proxy becomes
+	// healthy and when it is lost. RunWarp ignores them.
+	Hooks *HookOptions
+}
+
+// Session describes a mode that is serving traffic.
+type Session struct {
+	Mode string
+	// Endpoints are the warp endpoints the tunnels connected to, empty if
+	// the endpoint came from a wireguard config.
+	Endpoints []string
+	// Addresses are the addresses the proxy listens on, with the actual
+	// ports for bind addresses with port 0.
+	Addresses []netip.AddrPort
+	// Sockets are the paths of the unix domain sockets the proxy listens
+	// on, see wiresocks.ProxyOptions.
+	Sockets []string
+	// Working is the endpoint, mtu, keepalive and trick parameters each
+	// tunnel connected with. It is also saved to the identity directory,
+	// see LoadWorkingConfig.
+	Working WorkingConfig
+
+	// tunnels are the wireguard tunnels of the session, the first one on
+	// the primary endpoint
+	tunnels []tunnel
+	// psiphon return the state of each of its psiphon tunnels
+	psiphon []func() PsiphonStatus
 }
 
 type PsiphonOptions struct {
+	Country                string
+	ConfigPath             string
+	EmbeddedServerListPath string
+	SponsorId              string
+	PropagationChannelId   string
+	TunnelProtocols        []string
+	// Regions are more countries served on their own addresses, each by
+	// its own psiphon tunnel through the same warp tunnel
+	Regions []PsiphonRegion
+	// DataDir is where the tunnels of Regions keep their files, one
+	// directory each, defaults to psiphon in the identity directory
+	DataDir string
+	// HTTPProxyPort, if set, also serves psiphon's own http proxy for
+	// Country on this port of localhost, next to the proxy on the bind
+	// address.
+	HTTPProxyPort int
+}
+
+// PsiphonRegion is a psiphon tunnel exiting in Country, served on Bind.
+type PsiphonRegion struct {
+	Bind    netip.AddrPort
 	Country string
 }
 
 func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
-	if opts.Psiphon != nil && opts.Gool {
-		return errors.New("can't use psiphon and gool at the same time")
+	if len(opts.Bind) == 0 && len(opts.Proxy.UnixSockets) == 0 {
+		return errors.New("must provide at least one bind address")
+	}
+
+	if opts.Auto && len(opts.Bind) == 0 {
+		return errors.New("auto mode probes the proxy on a bind address, it can't listen on unix sockets only")
+	}
+
+	if opts.Auto && opts.Gool {
+		return errors.New("can't use auto mode and gool at the same time")
+	}
+
+	if opts.Multi && (opts.Gool || opts.Psiphon != nil || opts.Auto) {
+		return errors.New("can't use multi with gool, psiphon or auto mode")
+	}
+
+	if opts.WireguardConfig != "" && (opts.Gool || opts.Multi || opts.Auto) {
+		return errors.New("a wireguard config can only be used in normal warp or psiphon mode")
+	}
+
+	if opts.Balance != "" && opts.Balance != wiresocks.BalanceRoundRobin && !opts.Multi {
+		return fmt.Errorf("%s balancing requires multi mode", opts.Balance)
+	}
+
+	if opts.KeepAlive < 0 || opts.KeepAlive > maxKeepAlive {
+		return fmt.Errorf("keepalive must be between 0 and %d seconds", maxKeepAlive)
+	}
+
+	if err := opts.Tricks.Validate(); err != nil {
+		return err
+	}
+
+	if opts.FallbackEndpoint != "" {
+		if err := checkFallbackEndpoint(opts.Endpoint, opts.FallbackEndpoint); err != nil {
+			return err
+		}
+	}
+
+	for _, endpoint := range opts.Endpoints {
+		if _, err := netip.ParseAddrPort(endpoint); err != nil {
+			return fmt.Errorf("invalid listed endpoint: %w", err)
+		}
+	}
+
+	if len(opts.PreferColos) > 0 && opts.SkipVerify {
+		return errors.New("preferring colos requires tunnel verification")
+	}
+
+	if opts.HandshakeRetries < 0 {
+		return errors.New("handshake retries can't be negative")
+	}
+
+	for _, mtu := range []int{opts.MTU, opts.InnerMTU} {
+		if mtu == 0 {
+			continue
+		}
+		if err := validateMTU(mtu); err != nil {
+			return err
+		}
 	}
 
 	if opts.Psiphon != nil && opts.Psiphon.Country == "" {
 		return errors.New("must provide country for psiphon")
 	}
 
-	// create identities
-	if err := createPrimaryAndSecondaryIdentities(l.With("subsystem", "warp/account"), opts.License); err != nil {
+	if opts.Psiphon != nil && !PsiphonSupported {
+		return ErrNoPsiphon
+	}
+
+	if opts.Psiphon != nil && !validPsiphonCountry(opts.Psiphon.Country) {
+		return fmt.Errorf("unsupported psiphon country %q, valid values: %s", opts.Psiphon.Country, strings.Join(PsiphonCountries(), ", "))
+	}
+
+	if opts.Psiphon != nil {
+		if err := validatePsiphonRegions(opts.Bind, opts.Psiphon.Regions); err != nil {
+			return err
+		}
+	}
+
+	if opts.Auto {
+		return runAuto(ctx, l, opts)
+	}
+
+	stats := newSessionStats()
+	switch {
+	case opts.Psiphon != nil && opts.Gool:
+		stats.Mode = "gool-psiphon"
+	case opts.Psiphon != nil:
+		stats.Mode = "psiphon"
+	case opts.Gool:
+		stats.Mode = "gool"
+	case opts.Multi:
+		stats.Mode = "multi"
+	default:
+		stats.Mode = "warp"
+	}
+
+	bound, err := runWarpSession(ctx, l, opts, stats)
+	if statsErr := stats.finish(opts.StatsPath, err); statsErr != nil {
+		l.Warn("failed to save session stats", "error", statsErr)
+	}
+	if err != nil {
 		return err
 	}
 
+	working, err := workingConfig(stats.Mode, stats.tunnels)
+	if err != nil {
+		l.Warn("failed to read working config", "error", err)
+	} else if err := saveWorkingConfig(identityDir(opts), working); err != nil {
+		l.Warn("failed to save working config", "error", err)
+	}
+
+	// the endpoints are reachable cloudflare addresses, better bets for
+	// api calls during the session than random fronting addresses
+	preferAPIEndpoints(stats.Endpoints)
+
+	if opts.StatusInterval > 0 && len(stats.tunnels) > 0 {
+		go reportStatus(ctx, l, opts.StatusInterval, stats.tunnels, stats.psiphon)
+	}
+
+	if opts.OnReady != nil {
+		opts.OnReady(Session{Mode: stats.Mode, Endpoints: stats.Endpoints, Addresses: bound, Sockets: opts.Proxy.UnixSockets, Working: working, tunnels: stats.tunnels, psiphon: stats.psiphon})
+	}
+
+	return nil
+}
+
+func runWarpSession(ctx context.Context, l *slog.Logger, opts WarpOptions, stats *sessionStats) ([]netip.AddrPort, error) {
+	dir := identityDir(opts)
+	profile := filepath.Join(dir, "primary", "wgcf-profile.ini")
+	if opts.WireguardConfig != "" {
+		l.Info("using wireguard config, skipping registration", "path", opts.WireguardConfig)
+		profile = opts.WireguardConfig
+	} else {
+		// create identities, the secondary one is only needed for a second tunnel
+		done := stats.phase("registration")
+		secondary := opts.Gool || opts.Multi
+		if err := createIdentities(ctx, l.With("subsystem", "warp/account"), dir, opts.License, secondary, !opts.SeparateIdentity); err != nil {
+			return nil, err
+		}
+		done()
+	}
+
 	// Decide Working Scenario
 	endpoints := []string{opts.Endpoint, opts.Endpoint}
+	if opts.Endpoint2 != "" {
+		endpoints[1] = opts.Endpoint2
+	}
 
 	if opts.Scan != nil {
-		res, err := wiresocks.RunScan(ctx, l, *opts.Scan)
+		done := stats.phase("scan")
+		scan := *opts.Scan
+		scan.Profile = profile
+		res, err := wiresocks.RunScan(ctx, l, scan)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		done()
 
 		l.Info("scan results", "endpoints", res)
 
+		// rescans merge the hotlist again, keep it fresh for them
+		if scan.Hotlist != nil {
+			go warp.RefreshHotlist(ctx, l.With("subsystem", "warp/hotlist"), *scan.Hotlist)
+		}
+
 		endpoints = make([]string, len(res))
 		for i := 0; i < len(res); i++ {
 			endpoints[i] = res[i].AddrPort.String()
 		}
+		preferAPIEndpoints(endpoints)
+	}
+	if opts.Scan != nil && len(opts.Endpoints) == 0 {
+		// tunnels move through the scanned endpoints like listed ones
+		opts.Endpoints = endpoints
+	}
+	if endpoints[0] != "" {
+		l.Info("using warp endpoints", "endpoints", endpoints)
+
+		stats.Endpoints = endpoints[:1]
+		if opts.Gool || opts.Multi {
+			stats.Endpoints = endpoints[:2]
+		}
+	}
+
+	// readyCtx only bounds the wait for handshakes, the tunnels themselves
+	// live as long as ctx.
+	readyCtx := ctx
+	if opts.ReadyTimeout > 0 {
+		var cancel context.CancelFunc
+		readyCtx, cancel = context.WithTimeout(ctx, opts.ReadyTimeout)
+		defer cancel()
+	}
+
+	tun := tunnelOptionsFrom(opts)
+
+	var (
+		bound   []netip.AddrPort
+		warpErr error
+	)
+	var psiphonOpts PsiphonOptions
+	if opts.Psiphon != nil {
+		psiphonOpts = *opts.Psiphon
+		if psiphonOpts.DataDir == "" {
+			psiphonOpts.DataDir = filepath.Join(identityDir(opts), "psiphon")
+		}
 	}
-	l.Info("using warp endpoints", "endpoints", endpoints)
 
-	var warpErr error
 	switch {
+	case opts.Psiphon != nil && opts.Gool:
+		l.Info("running in psiphon over warp-in-warp (gool) mode")
+		// run warp in warp on a random tcp port and run psiphon through it
+		// on bind address
+		bound, warpErr = runPsiphonOverGool(ctx, readyCtx, l, stats, opts.Bind, opts.Proxy, dir, endpoints, tun, psiphonOpts)
 	case opts.Psiphon != nil:
 		l.Info("running in Psiphon (cfon) mode")
 		// run primary warp on a random tcp port and run psiphon on bind address
-		warpErr = runWarpWithPsiphon(ctx, l, opts.Bind, endpoints[0], opts.Psiphon.Country)
+		bound, warpErr = runWarpWithPsiphon(ctx, readyCtx, l, stats, opts.Bind, opts.Proxy, profile, endpoints[0], tun, psiphonOpts)
 	case opts.Gool:
 		l.Info("running in warp-in-warp (gool) mode")
 		// run warp in warp
-		warpErr = runWarpInWarp(ctx, l, opts.Bind, endpoints)
+		bound, warpErr = runWarpInWarp(ctx, readyCtx, l, stats, opts.Bind, opts.Proxy, dir, endpoints, tun)
+	case opts.Multi:
+		l.Info("running in multi tunnel mode", "balance", opts.Balance)
+		// run primary and secondary warp side by side on bind address
+		bound, warpErr = runWarpMulti(ctx, readyCtx, l, stats, opts.Bind, opts.Proxy, dir, endpoints, tun, opts.Balance)
 	default:
 		l.Info("running in normal warp mode")
 		// just run primary warp on bindAddress
-		warpErr = runWarp(ctx, l, opts.Bind, endpoints[0])
+		bound, warpErr = runWarp(ctx, readyCtx, l, stats, opts.Bind, opts.Proxy, profile, endpoints[0], tun)
 	}
 
-	return warpErr
+	return bound, warpErr
 }
 
-func runWarp(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoint string) error {
-	conf, err := wiresocks.ParseConfig("./stuff/primary/wgcf-profile.ini", endpoint)
+func runWarp(ctx, readyCtx context.Context, l *slog.Logger, stats *sessionStats, bind []netip.AddrPort, proxyOpts wiresocks.ProxyOptions, profile, endpoint string, tun tunnelOptions) ([]netip.AddrPort, error) {
+	conf, err := wiresocks.ParseConfig(profile, endpoint)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	conf.Interface.MTU = singleMTU
+	conf.Interface.MTU = tun.mtu
+	conf.Upstream = tun.upstream
 
 	for i, peer := range conf.Peers {
 		peer.Trick = true
-		peer.KeepAlive = 3
+		peer.Tricks = tun.tricks
+		peer.KeepAlive = tun.keepAlive
+		peer.FallbackEndpoint = tun.fallbackEndpoint
 		conf.Peers[i] = peer
 	}
 
-	tnet, err := wiresocks.StartWireguard(ctx, l, conf)
+	tnet, err := startTunnel(ctx, readyCtx, l, stats, conf, "primary", tun)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = tnet.StartProxy(bind)
+	bound, err := tnet.StartProxy(bind, proxyOpts)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	l.Info("serving proxy", "address", bind)
+	l.Info("serving proxy", "addresses", bound)
 
-	return nil
+	return bound, nil
 }
 
-func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoint string, country string) error {
-	conf, err := wiresocks.ParseConfig("./stuff/primary/wgcf-profile.ini", endpoint)
-	if err != nil {
-		return err
-	}
-	conf.Interface.MTU = singleMTU
-
-	for i, peer := range conf.Peers {
-		peer.Trick = true
-		peer.KeepAlive = 3
-		conf.Peers[i] = peer
+func runWarpMulti(ctx, readyCtx context.Context, l *slog.Logger, stats *sessionStats, bind []netip.AddrPort, proxyOpts wiresocks.ProxyOptions, dir string, endpoints []string, tun tunnelOptions, balance string) ([]netip.AddrPort, error) {
+	identities := []string{"primary", "secondary"}
+	tunnels := make([]*wiresocks.VirtualTun, 0, len(identities))
+	stop := func() {
+		for _, tnet := range tunnels {
+			tnet.Stop()
+		}
 	}
 
-	tnet, err := wiresocks.StartWireguard(ctx, l, conf)
-	if err != nil {
-		return err
-	}
+	for i, name := range identities {
+		conf, err := wiresocks.ParseConfig(filepath.Join(dir, name, "wgcf-profile.ini"), endpoints[i])
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		conf.Interface.MTU = tun.mtu
+		conf.Upstream = tun.upstream
+
+		for i, peer := range conf.Peers {
+			peer.Trick = true
+			peer.Tricks = tun.tricks
+			peer.KeepAlive = tun.keepAlive
+			if name == "primary" {
+				peer.FallbackEndpoint = tun.fallbackEndpoint
+			}
+			conf.Peers[i] = peer
+		}
 
-	warpBind, err := tnet.StartProxy(netip.MustParseAddrPort("127.0.0.1:0"))
-	if err != nil {
-		return err
+		tnet, err := startTunnel(ctx, readyCtx, l.With("tunnel", name), stats, conf, name, tun)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		tunnels = append(tunnels, tnet)
 	}
 
-	// run psiphon
-	err = psiphon.RunPsiphon(ctx, l.With("subsystem", "psiphon"), warpBind.String(), bind.String(), country)
+	bound, err := wiresocks.StartBalancedProxy(ctx, l, bind, tunnels, balance, proxyOpts)
 	if err != nil {
-		return fmt.Errorf("unable to run psiphon %w", err)
+		stop()
+		return nil, err
 	}
 
-	l.Info("serving proxy", "address", bind)
+	l.Info("serving proxy", "addresses", bound)
 
-	return nil
+	return bound, nil
 }
 
-func runWarpInWarp(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoints []string) error {
+func runWarpInWarp(ctx, readyCtx context.Context, l *slog.Logger, stats *sessionStats, bind []netip.AddrPort, proxyOpts wiresocks.ProxyOptions, dir string, endpoints []string, tun tunnelOptions) ([]netip.AddrPort, error) {
 	// Run outer warp
-	conf, err := wiresocks.ParseConfig("./stuff/primary/wgcf-profile.ini", endpoints[0])
+	conf, err := wiresocks.ParseConfig(filepath.Join(dir, "primary", "wgcf-profile.ini"), endpoints[0])
 	if err != nil {
-		return err
+		return nil, err
 	}
-	conf.Interface.MTU = singleMTU
+	conf.Interface.MTU = tun.mtu
+	conf.Upstream = tun.upstream
 
 	for i, peer := range conf.Peers {
 		peer.Trick = true
-		peer.KeepAlive = 3
+		peer.Tricks = tun.tricks
+		peer.KeepAlive = tun.keepAlive
+		peer.FallbackEndpoint = tun.fallbackEndpoint
 		conf.Peers[i] = peer
 	}
 
-	tnet, err := wiresocks.StartWireguard(ctx, l.With("gool", "outer"), conf)
+	tnet, err := startTunnel(ctx, readyCtx, l.With("gool", "outer"), stats, conf, "outer", tun)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	outer := tnet
+
+	// Create a UDP port forward between localhost and the remote endpoint,
+	// which goes down with the outer tunnel
+	fwCtx, stopForwarder := context.WithCancel(ctx)
+	stop := func() {
+		stopForwarder()
+		outer.Stop()
 	}
 
-	// Create a UDP port forward between localhost and the remote endpoint
-	addr, err := wiresocks.NewVtunUDPForwarder(ctx, netip.MustParseAddrPort("127.0.0.1:0"), endpoints[1], tnet, singleMTU)
+	fw, err := wiresocks.NewVtunUDPForwarder(fwCtx, netip.MustParseAddrPort("127.0.0.1:0"), endpoints[1], tnet, tun.mtu)
 	if err != nil {
-		return err
+		stop()
+		return nil, err
 	}
 
 	// Run inner warp
-	conf, err = wiresocks.ParseConfig("./stuff/secondary/wgcf-profile.ini", addr.String())
+	conf, err = wiresocks.ParseConfig(filepath.Join(dir, "secondary", "wgcf-profile.ini"), fw.Addr().String())
 	if err != nil {
-		return err
+		stop()
+		return nil, err
 	}
-	conf.Interface.MTU = doubleMTU
+	conf.Interface.MTU = tun.innerMTU
 
 	for i, peer := range conf.Peers {
-		peer.KeepAlive = 10
+		peer.KeepAlive = tun.innerKeepAlive
 		conf.Peers[i] = peer
 	}
 
-	tnet, err = wiresocks.StartWireguard(ctx, l.With("gool", "inner"), conf)
+	tnet, err = startTunnel(ctx, readyCtx, l.With("gool", "inner"), stats, conf, "inner", tun)
 	if err != nil {
-		return err
+		stop()
+		return nil, err
 	}
+	stats.carry("inner", fw)
 
-	_, err = tnet.StartProxy(bind)
+	// the outer tunnel carries the inner one until it is down
+	inner := tnet
+	go func() {
+		<-inner.Done()
+		stop()
+	}()
+
+	if tun.innerRefresh > 0 {
+		go watchInnerEndpoint(ctx, l.With("gool", "inner"), outer, tnet, fw, filepath.Join(dir, "primary", "wgcf-profile.ini"), tun.innerRefresh, tun.innerMaxRTT)
+	}
+
+	bound, err := tnet.StartProxy(bind, proxyOpts)
 	if err != nil {
-		return err
+		inner.Stop()
+		stop()
+		return nil, err
 	}
 
-	l.Info("serving proxy", "address", bind)
+	l.Info("serving proxy", "addresses", bound)
+	return bound, nil
+}
+
+// checkFallbackEndpoint checks that fallback is an ip endpoint of the other
+// family than endpoint. An endpoint given by host name isn't checked, its
+// family is only known once it's resolved.
+func checkFallbackEndpoint(endpoint, fallback string) error {
+	f, err := netip.ParseAddrPort(fallback)
+	if err != nil {
+		return fmt.Errorf("invalid fallback endpoint: %w", err)
+	}
+	e, err := netip.ParseAddrPort(endpoint)
+	if err != nil {
+		return nil
+	}
+	if e.Addr().Unmap().Is4() == f.Addr().Unmap().Is4() {
+		return fmt.Errorf("fallback endpoint %s is of the same ip family as the endpoint %s", fallback, endpoint)
+	}
 	return nil
 }
 
-func createPrimaryAndSecondaryIdentities(l *slog.Logger, license string) error {
+// preferAPIEndpoints makes warp api calls prefer the addresses of endpoints,
+// see warp.PreferAPIAddrs. Host names are skipped.
+func preferAPIEndpoints(endpoints []string) {
+	var addrs []netip.Addr
+	for _, endpoint := range endpoints {
+		if addrPort, err := netip.ParseAddrPort(endpoint); err == nil {
+			addrs = append(addrs, addrPort.Addr())
+		}
+	}
+	if len(addrs) > 0 {
+		warp.PreferAPIAddrs(addrs...)
+	}
+}
+
+// validatePsiphonRegions checks the countries of regions and that their
+// addresses are distinct from each other and from bind.
+func validatePsiphonRegions(bind []netip.AddrPort, regions []PsiphonRegion) error {
+	used := slices.Clone(bind)
+	for _, region := range regions {
+		if !validPsiphonCountry(region.Country) {
+			return fmt.Errorf("unsupported psiphon country %q, valid values: %s", region.Country, strings.Join(PsiphonCountries(), ", "))
+		}
+		if region.Bind.Port() != 0 && slices.Contains(used, region.Bind) {
+			return fmt.Errorf("psiphon region %s: address %s is already in use", region.Country, region.Bind)
+		}
+		used = append(used, region.Bind)
+	}
+	return nil
+}
+
+// identityDir returns the directory the identities of opts are kept in.
+func identityDir(opts WarpOptions) string {
+	if opts.IdentityDir == "" {
+		return "./stuff"
+	}
+	return opts.IdentityDir
+}
+
+func createIdentities(ctx context.Context, l *slog.Logger, dir, license string, secondary, clone bool) error {
+	primaryDir, secondaryDir := filepath.Join(dir, "primary"), filepath.Join(dir, "secondary")
+
 	// make primary identity
-	err := warp.LoadOrCreateIdentity(l, "./stuff/primary", license)
+	err := warp.LoadOrCreateIdentity(ctx, l, primaryDir, license)
 	if err != nil {
 		l.Error("couldn't load primary warp identity")
 		return err
 	}
 
+	if !secondary {
+		return nil
+	}
+
+	if clone {
+		if err := warp.CloneIdentity(primaryDir, secondaryDir); err != nil {
+			l.Error("couldn't clone primary warp identity")
+			return err
+		}
+		return nil
+	}
+
 	// make secondary
-	err = warp.LoadOrCreateIdentity(l, "./stuff/secondary", license)
+	err = warp.LoadOrCreateIdentity(ctx, l, secondaryDir, license)
 	if err != nil {
 		l.Error("couldn't load secondary warp identity")
 		return err
@@ -0,0 +1,18 @@
+package app
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCheckFallbackEndpoint(t *testing.T) {
+	qt.Assert(t, checkFallbackEndpoint("162.159.192.1:2408", "[2606:4700:d0::1]:2408"), qt.IsNil)
+	qt.Assert(t, checkFallbackEndpoint("[2606:4700:d0::1]:2408", "162.159.192.1:2408"), qt.IsNil)
+	qt.Assert(t, checkFallbackEndpoint("162.159.192.1:2408", "188.114.96.3:2408"), qt.ErrorMatches, "fallback endpoint .* is of the same ip family .*")
+	qt.Assert(t, checkFallbackEndpoint("162.159.192.1:2408", "[::ffff:188.114.96.3]:2408"), qt.ErrorMatches, "fallback endpoint .* is of the same ip family .*")
+	qt.Assert(t, checkFallbackEndpoint("162.159.192.1:2408", "engage.cloudflareclient.com:2408"), qt.ErrorMatches, "invalid fallback endpoint: .*")
+
+	// the family of a host name is unknown until it's resolved
+	qt.Assert(t, checkFallbackEndpoint("engage.cloudflareclient.com:2408", "188.114.96.3:2408"), qt.IsNil)
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+const probeURL = "https://www.gstatic.com/generate_204"
+
+// runAuto tries plain warp, gool and psiphon in that order and keeps the
+// first mode whose proxy passes an end-to-end connectivity probe. Psiphon is
+// only tried if opts.Psiphon is set.
+func runAuto(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+	// scan once and share the results between all attempts
+	if opts.Scan != nil {
+		res, err := wiresocks.RunScan(ctx, l, *opts.Scan)
+		if err != nil {
+			return err
+		}
+		l.Info("scan results", "endpoints", res)
+
+		opts.Endpoint, opts.Endpoint2 = res[0].AddrPort.String(), res[1].AddrPort.String()
+		opts.Scan = nil
+		preferAPIEndpoints([]string{opts.Endpoint, opts.Endpoint2})
+	}
+
+	base := opts
+	base.Auto = false
+	base.Gool = false
+	base.Psiphon = nil
+
+	gool := base
+	gool.Gool = true
+
+	names := []string{"warp", "gool"}
+	attempts := []WarpOptions{base, gool}
+	if opts.Psiphon != nil {
+		cfon := base
+		cfon.Psiphon = opts.Psiphon
+		names = append(names, "psiphon")
+		attempts = append(attempts, cfon)
+	}
+
+	var errs []error
+	for i, attempt := range attempts {
+		l.Info("auto mode: trying", "mode", names[i])
+
+		var session Session
+		attempt.OnReady = func(s Session) {
+			session = s
+		}
+
+		attemptCtx, cancel := context.WithCancel(ctx)
+		err := RunWarp(attemptCtx, l, attempt)
+		if err == nil {
+			err = probeProxy(attemptCtx, session.Addresses[0], opts.Proxy)
+		}
+		if err != nil {
+			cancel()
+			// the next mode binds the same addresses
+			waitReleased(attempt, 5*time.Second)
+			l.Warn("auto mode: mode failed", "mode", names[i], "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", names[i], err))
+			continue
+		}
+
+		// keep the working mode running for the lifetime of ctx
+		go func() {
+			<-ctx.Done()
+			cancel()
+		}()
+
+		l.Info("auto mode: settled", "mode", names[i])
+		if opts.OnReady != nil {
+			opts.OnReady(session)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("auto mode: no working mode found: %w", errors.Join(errs...))
+}
+
+// probeProxy fetches probeURL through the socks proxy at bind and expects a
+// 204 response, authenticating with the credentials in proxyOpts if any.
+func probeProxy(ctx context.Context, bind netip.AddrPort, proxyOpts wiresocks.ProxyOptions) error {
+	client := ProxyClient(bind, proxyOpts)
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", probeURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("connectivity probe failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("connectivity probe failed, status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// ProxyClient returns an http client that goes through the socks proxy at
+// bind, authenticating with the credentials in proxyOpts if any.
+func ProxyClient(bind netip.AddrPort, proxyOpts wiresocks.ProxyOptions) *http.Client {
+	proxyURL := &url.URL{Scheme: "socks5", Host: localAddr(bind).String()}
+	if proxyOpts.Username != "" {
+		proxyURL.User = url.UserPassword(proxyOpts.Username, proxyOpts.Password)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+		},
+		Timeout: 15 * time.Second,
+	}
+}
+
+// localAddr returns the address to reach a listener on bind at, a loopback
+// address if bind is unspecified.
+func localAddr(bind netip.AddrPort) netip.AddrPort {
+	addr := bind.Addr()
+	if addr.IsUnspecified() {
+		addr = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+		if bind.Addr().Is6() {
+			addr = netip.IPv6Loopback()
+		}
+	}
+	return netip.AddrPortFrom(addr, bind.Port())
+}
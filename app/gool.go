@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+const (
+	// innerBadSamples is how many measurements in a row must be slow or fail
+	// before the inner endpoint of gool mode is replaced.
+	innerBadSamples = 3
+	// innerCandidates is how many random endpoints are measured to replace
+	// it.
+	innerCandidates = 5
+)
+
+// watchInnerEndpoint measures the inner endpoint of gool mode through outer
+// every interval until ctx is done. Once it has been slower than maxRTT, or
+// unreachable, innerBadSamples times in a row, fw is pointed at the fastest
+// of a few random endpoints and inner handshakes with it. The outer endpoint
+// is left alone.
+//
+// The measurements are warp handshakes to the peer key of the profile at
+// profile with a throwaway key, see VirtualTun.PingWarp, so neither tunnel
+// sees its key handshake from elsewhere.
+func watchInnerEndpoint(ctx context.Context, l *slog.Logger, outer, inner *wiresocks.VirtualTun, fw *wiresocks.UDPForwarder, profile string, interval, maxRTT time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	bad := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		current := fw.Dest()
+		rtt, err := outer.PingWarp(ctx, current, profile)
+		switch {
+		case err != nil:
+			l.Debug("failed to measure inner endpoint", "endpoint", current, "error", err)
+		case rtt > maxRTT:
+			l.Debug("inner endpoint is slow", "endpoint", current, "rtt", rtt)
+		default:
+			bad = 0
+			continue
+		}
+
+		if bad++; bad < innerBadSamples {
+			continue
+		}
+
+		next, nextRTT, err := pickInnerEndpoint(ctx, outer, current, profile, maxRTT)
+		if err != nil {
+			// keep the count, the next slow measurement tries again
+			l.Warn("inner endpoint degraded, keeping it", "endpoint", current, "error", err)
+			continue
+		}
+
+		l.Info("moving inner endpoint", "from", current, "to", next, "rtt", nextRTT)
+		fw.SetDest(next)
+		if err := inner.UpdateEndpoint(fw.Addr()); err != nil {
+			l.Warn("failed to restart inner handshake", "error", err)
+		}
+		bad = 0
+	}
+}
+
+// pickInnerEndpoint measures innerCandidates random warp endpoints of the
+// family of current through outer and returns the fastest, if it is within
+// maxRTT.
+func pickInnerEndpoint(ctx context.Context, outer *wiresocks.VirtualTun, current netip.AddrPort, profile string, maxRTT time.Duration) (netip.AddrPort, time.Duration, error) {
+	v4 := current.Addr().Unmap().Is4()
+
+	var best netip.AddrPort
+	var bestRTT time.Duration
+	for i := 0; i < innerCandidates; i++ {
+		candidate, err := warp.RandomWarpEndpoint(v4, !v4)
+		if err != nil {
+			return netip.AddrPort{}, 0, err
+		}
+		if candidate == current {
+			continue
+		}
+
+		rtt, err := outer.PingWarp(ctx, candidate, profile)
+		if err != nil {
+			continue
+		}
+		if !best.IsValid() || rtt < bestRTT {
+			best, bestRTT = candidate, rtt
+		}
+	}
+
+	if !best.IsValid() || bestRTT > maxRTT {
+		return netip.AddrPort{}, 0, fmt.Errorf("none of %d endpoints answered within %s", innerCandidates, maxRTT)
+	}
+	return best, bestRTT, nil
+}
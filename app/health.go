@@ -0,0 +1,100 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// handshakeStaleAfter is how old the last handshake of a peer may be before
+// its tunnel counts as down. Sessions are rekeyed every two minutes while
+// keepalives flow and rejected after three.
+const handshakeStaleAfter = 3 * time.Minute
+
+// Health is what an Instance reports to health checks.
+type Health struct {
+	State State
+	// Ready is whether the instance is running, every tunnel has a fresh
+	// handshake, every listener accepts connections and the latest probe,
+	// if any, succeeded.
+	Ready     bool
+	Tunnels   []TunnelHealth
+	Listeners []ListenerHealth
+	// Probe is the latest probe, nil if the instance doesn't probe or none
+	// ran yet.
+	Probe *ProbeResult
+}
+
+// TunnelHealth is the handshake freshness of a peer of a tunnel.
+type TunnelHealth struct {
+	Name     string
+	Endpoint string
+	// HandshakeAge is the time since the last handshake, negative if there
+	// never was one.
+	HandshakeAge time.Duration
+	Fresh        bool
+}
+
+// ListenerHealth is whether a proxy listener accepts connections.
+type ListenerHealth struct {
+	Addr  netip.AddrPort
+	Up    bool
+	Error string
+}
+
+// Health checks the tunnels and listeners of the running session.
+func (i *Instance) Health() Health {
+	i.mu.Lock()
+	status, probe := i.status, i.probe
+	i.mu.Unlock()
+
+	h := Health{State: status.State}
+	if status.State != StateRunning {
+		return h
+	}
+
+	h.Ready = true
+	if !probe.Time.IsZero() {
+		h.Probe = &probe
+		h.Ready = probe.Success
+	}
+	for _, tun := range status.Session.tunnels {
+		peers, err := tun.tnet.PeerStatus()
+		if err != nil {
+			h.Ready = false
+			h.Tunnels = append(h.Tunnels, TunnelHealth{Name: tun.name, HandshakeAge: -1})
+			continue
+		}
+
+		for _, peer := range peers {
+			th := TunnelHealth{Name: tun.name, Endpoint: peer.Endpoint, HandshakeAge: -1}
+			if !peer.LastHandshake.IsZero() {
+				th.HandshakeAge = time.Since(peer.LastHandshake)
+				th.Fresh = th.HandshakeAge < handshakeStaleAfter
+			}
+			h.Ready = h.Ready && th.Fresh
+			h.Tunnels = append(h.Tunnels, th)
+		}
+	}
+
+	for _, addr := range status.Session.Addresses {
+		lh := ListenerHealth{Addr: addr, Up: true}
+		if err := checkListener(addr); err != nil {
+			lh.Up, lh.Error = false, err.Error()
+			h.Ready = false
+		}
+		h.Listeners = append(h.Listeners, lh)
+	}
+
+	return h
+}
+
+// checkListener connects to the proxy listening on bind.
+func checkListener(bind netip.AddrPort) error {
+	c, err := net.DialTimeout("tcp", localAddr(bind).String(), 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("listener is down: %w", err)
+	}
+	return c.Close()
+}
@@ -0,0 +1,178 @@
+package app
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultHookInterval is how often the health of the session is checked
+	// for the hooks, unless HookOptions say otherwise.
+	defaultHookInterval = 5 * time.Second
+	// hookTimeout bounds how long a hook command may run.
+	hookTimeout = time.Minute
+)
+
+// HookOptions are commands an Instance runs when its proxy becomes healthy,
+// ready in terms of Health, and when it stops being so, e.g. to change routes,
+// send a notification or restart services that depend on the proxy.
+type HookOptions struct {
+	// Up and Down are run by the shell, sh or cmd on windows, with the
+	// WARP_PLUS_* variables of the event added to the environment, see
+	// hookEvent. Empty ones aren't run.
+	Up, Down string
+	// Interval is how often the health is checked. Zero means 5s.
+	Interval time.Duration
+}
+
+// hookEvent is what a hook runs about. Its fields are passed to the command
+// as WARP_PLUS_EVENT, WARP_PLUS_MODE, WARP_PLUS_ENDPOINT, WARP_PLUS_EGRESS_IP,
+// WARP_PLUS_PROXY, WARP_PLUS_SOCKS_PORT and WARP_PLUS_REASON.
+type hookEvent struct {
+	// event is "up" or "down"
+	event string
+	mode  string
+	// endpoint is the endpoint of the primary tunnel
+	endpoint string
+	// egressIP is the address traffic leaves cloudflare from, empty if the
+	// trace through the proxy failed
+	egressIP string
+	// proxy is the first address the proxy listens on, invalid if it only
+	// listens on unix sockets
+	proxy netip.AddrPort
+	// reason is why the proxy went down: "probe", "handshake", "listener" or
+	// the state the instance is in, e.g. "starting" while it restarts
+	reason string
+}
+
+func (e hookEvent) env() []string {
+	env := []string{
+		"WARP_PLUS_EVENT=" + e.event,
+		"WARP_PLUS_MODE=" + e.mode,
+		"WARP_PLUS_ENDPOINT=" + e.endpoint,
+		"WARP_PLUS_EGRESS_IP=" + e.egressIP,
+		"WARP_PLUS_REASON=" + e.reason,
+	}
+	if e.proxy.IsValid() {
+		env = append(env,
+			"WARP_PLUS_PROXY="+localAddr(e.proxy).String(),
+			"WARP_PLUS_SOCKS_PORT="+strconv.Itoa(int(e.proxy.Port())),
+		)
+	}
+	return env
+}
+
+// runHooks checks the health of the instance every interval, running the up
+// hook when it becomes ready and the down hook when it no longer is, until
+// it is stopped. A proxy that is up when the instance stops runs the down
+// hook one last time.
+func (i *Instance) runHooks(opts HookOptions) {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultHookInterval
+	}
+
+	t := time.NewTicker(opts.Interval)
+	defer t.Stop()
+
+	// up is the event the up hook last ran with, nil while the proxy is down
+	var up *hookEvent
+	for {
+		h := i.Health()
+		switch {
+		case h.Ready && up == nil:
+			e := i.upEvent(h)
+			i.l.Info("proxy is up", "endpoint", e.endpoint, "egress", e.egressIP)
+			i.runHook(opts.Up, e)
+			up = &e
+		case !h.Ready && up != nil:
+			e := *up
+			e.event, e.reason = "down", unhealthyReason(h)
+			i.l.Warn("proxy is down", "reason", e.reason)
+			i.runHook(opts.Down, e)
+			up = nil
+		}
+
+		if h.State == StateStopped {
+			return
+		}
+		select {
+		case <-i.done:
+		case <-t.C:
+		}
+	}
+}
+
+// upEvent describes the session running while the instance is healthy.
+func (i *Instance) upEvent(h Health) hookEvent {
+	i.mu.Lock()
+	session, proxyOpts := i.status.Session, i.opts.Proxy
+	i.mu.Unlock()
+
+	e := hookEvent{event: "up", mode: session.Mode}
+	switch {
+	case len(h.Tunnels) > 0:
+		e.endpoint = h.Tunnels[0].Endpoint
+	case len(session.Endpoints) > 0:
+		e.endpoint = session.Endpoints[0]
+	}
+
+	if len(session.Addresses) > 0 {
+		e.proxy = session.Addresses[0]
+
+		ctx, cancel := context.WithTimeout(i.ctx, verifyTimeout)
+		defer cancel()
+		if trace, err := RunTrace(ctx, e.proxy, proxyOpts); err == nil {
+			e.egressIP = trace.IP
+		} else {
+			i.l.Debug("failed to trace the egress address for the hooks", "error", err)
+		}
+	}
+	return e
+}
+
+// unhealthyReason returns why h isn't ready, see hookEvent.
+func unhealthyReason(h Health) string {
+	if h.State != StateRunning {
+		return h.State.String()
+	}
+	if h.Probe != nil && !h.Probe.Success {
+		return "probe"
+	}
+	for _, tun := range h.Tunnels {
+		if !tun.Fresh {
+			return "handshake"
+		}
+	}
+	return "listener"
+}
+
+// runHook runs command with the environment of e, logging its output if it
+// fails. It runs even once the instance is stopped, so the down hook can
+// undo what the up hook did.
+func (i *Instance) runHook(command string, e hookEvent) {
+	if command == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	cmd.Env = append(os.Environ(), e.env()...)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		i.l.Warn("hook failed", "event", e.event, "error", err, "output", strings.TrimSpace(string(out)))
+		return
+	}
+	i.l.Debug("hook ran", "event", e.event, "output", strings.TrimSpace(string(out)))
+}
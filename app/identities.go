@@ -0,0 +1,51 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// RemoveIdentities unregisters the devices of the primary and secondary
+// identities in dir and then removes dir, so throwaway identities don't pile
+// up under an account. dir is kept if a device can't be removed, letting a
+// later call retry.
+func RemoveIdentities(ctx context.Context, l *slog.Logger, dir string) error {
+	seen := make(map[string]bool)
+
+	var errs []error
+	for _, name := range []string{"primary", "secondary"} {
+		path := filepath.Join(dir, name)
+		i, err := warp.LoadIdentity(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+
+		// a cloned secondary identity shares the device of the primary
+		if seen[i.ID] {
+			continue
+		}
+		seen[i.ID] = true
+
+		if err := warp.RemoveDevice(ctx, l, i.ID, i.Token); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		l.Info("removed warp device", "identity", name, "id", i.ID)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
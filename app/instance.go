@@ -0,0 +1,583 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// State is the lifecycle state of an Instance.
+type State int
+
+const (
+	StateStarting State = iota
+	StateRunning
+	StateFailed
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateFailed:
+		return "failed"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// Status is a snapshot of an Instance.
+type Status struct {
+	State State
+	// Session is the running session, set while State is StateRunning.
+	Session Session
+	// Since is when the instance entered State.
+	Since time.Time
+	// Err is why the instance entered StateFailed.
+	Err error
+}
+
+// ErrStopped is returned by the methods of a stopped Instance.
+var ErrStopped = errors.New("instance is stopped")
+
+// Instance is a running warp-plus proxy that can be controlled in process.
+// It is safe for concurrent use.
+type Instance struct {
+	ctx  context.Context
+	l    *slog.Logger
+	opts WarpOptions
+	// scan are the scan options Rescan uses
+	scan *wiresocks.ScanOptions
+
+	// ctl serializes the operations that start sessions, it is taken before
+	// mu and held while a session connects, which mu never is
+	ctl sync.Mutex
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // stops the current session
+	status Status
+	events chan Status
+	// done is closed once the instance is stopped
+	done chan struct{}
+	// probe is the result of the latest probe, see runProbes
+	probe ProbeResult
+	// draining are the tunnels of the session running when the instance
+	// was stopped, see Wait
+	draining []tunnel
+	// hooksDone is closed once the hooks ran their last, see runHooks, nil
+	// if the instance runs no hooks
+	hooksDone chan struct{}
+}
+
+// StartWarp runs opts like RunWarp, but returns a handle to inspect and
+// control the proxy. The proxy stops when ctx is done or Stop is called.
+// Client traffic is counted even if opts.Proxy.Stats is nil, see Clients,
+// the proxy is probed if opts.Probe is set, the keys are rotated if
+// opts.RekeyInterval is and opts.Hooks run as the proxy goes up and down.
+func StartWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) (*Instance, error) {
+	if opts.RekeyInterval > 0 && opts.WireguardConfig != "" {
+		return nil, errors.New("can't rotate the key of a wireguard config")
+	}
+
+	if opts.Probe != nil && opts.Probe.Interval > 0 && len(opts.Bind) == 0 {
+		return nil, errors.New("probing needs a bind address, the proxy can't be probed on unix sockets")
+	}
+
+	if opts.Proxy.Stats == nil {
+		opts.Proxy.Stats = wiresocks.NewClientStats()
+	}
+
+	i := &Instance{
+		ctx:    ctx,
+		l:      l,
+		opts:   opts,
+		scan:   opts.Scan,
+		events: make(chan Status, 16),
+		done:   make(chan struct{}),
+	}
+
+	i.ctl.Lock()
+	defer i.ctl.Unlock()
+
+	if err := i.start(opts); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		i.Stop()
+	}()
+
+	if opts.Probe != nil && opts.Probe.Interval > 0 {
+		go i.runProbes(*opts.Probe)
+	}
+
+	if opts.RekeyInterval > 0 {
+		go i.runRekey(opts.RekeyInterval)
+	}
+
+	if opts.Hooks != nil {
+		i.hooksDone = make(chan struct{})
+		go func() {
+			i.runHooks(*opts.Hooks)
+			close(i.hooksDone)
+		}()
+	}
+
+	return i, nil
+}
+
+// Status returns the current status of the instance.
+func (i *Instance) Status() Status {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.status
+}
+
+// Tunnels returns the current setup of the tunnels of the running session,
+// which differs from Session.Working once a tunnel has switched to its
+// fallback endpoint.
+func (i *Instance) Tunnels() ([]WorkingTunnel, error) {
+	i.mu.Lock()
+	session, state := i.status.Session, i.status.State
+	i.mu.Unlock()
+
+	if state != StateRunning {
+		return nil, fmt.Errorf("instance is %s", state)
+	}
+
+	working, err := workingConfig(session.Mode, session.tunnels)
+	if err != nil {
+		return nil, err
+	}
+	return working.Tunnels, nil
+}
+
+// Events returns a channel every status change is sent to. Changes are
+// dropped while the channel is full, so slow readers should use Status to
+// resync. The channel is closed once the instance is stopped.
+func (i *Instance) Events() <-chan Status {
+	return i.events
+}
+
+// Stop stops the proxy and its tunnels, aborting a session that is still
+// connecting. It is safe to call more than once.
+func (i *Instance) Stop() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.status.State == StateStopped {
+		return
+	}
+
+	if i.cancel != nil {
+		i.cancel()
+	}
+	if i.status.State == StateRunning {
+		i.draining = i.status.Session.tunnels
+	}
+	i.setStatus(Status{State: StateStopped})
+	close(i.events)
+	close(i.done)
+}
+
+// Wait waits until the tunnels of a stopped instance are down, which they go
+// once the proxy connections through them finished or the drain timeout of
+// the proxy options passed, and its down hook has run, or until ctx is done.
+func (i *Instance) Wait(ctx context.Context) error {
+	i.mu.Lock()
+	stopped, tunnels := i.status.State == StateStopped, i.draining
+	i.mu.Unlock()
+
+	if !stopped {
+		return errors.New("instance is not stopped")
+	}
+
+	for _, tun := range tunnels {
+		select {
+		case <-tun.tnet.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if i.hooksDone != nil {
+		select {
+		case <-i.hooksDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Rescan restarts the proxy on freshly scanned endpoints, using the scan
+// options the instance was started with or, if it was started without
+// scanning, the defaults.
+func (i *Instance) Rescan() error {
+	return i.restart(func(opts *WarpOptions) {
+		opts.Scan = i.scan
+		if opts.Scan == nil {
+			opts.Scan = &wiresocks.ScanOptions{
+				V4:      true,
+				V6:      true,
+				MaxRTT:  time.Second,
+				Workers: 8,
+			}
+		}
+	})
+}
+
+// SwitchEndpoint moves the primary tunnel to endpoint, which replaces the
+// primary endpoint of the instance. A running tunnel is moved in place,
+// keeping the connections through it open; otherwise, or if endpoint is a
+// host name, the proxy is restarted.
+func (i *Instance) SwitchEndpoint(endpoint string) error {
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint: %w", err)
+	}
+
+	i.ctl.Lock()
+	defer i.ctl.Unlock()
+
+	i.mu.Lock()
+	if i.status.State == StateStopped {
+		i.mu.Unlock()
+		return ErrStopped
+	}
+	err := i.swapEndpoint(endpoint)
+	i.mu.Unlock()
+	if err == nil {
+		return nil
+	}
+	i.l.Info("can't switch endpoint in place, restarting", "endpoint", endpoint, "reason", err)
+
+	return i.restartLocked(func(opts *WarpOptions) {
+		opts.Endpoint = endpoint
+		opts.Scan = nil
+	})
+}
+
+// SwitchBind restarts the proxy listening on bind and the unix sockets at
+// sockets, which replace those of the instance. The tunnels reconnect to the
+// endpoints of the running session rather than scanning again.
+func (i *Instance) SwitchBind(bind []netip.AddrPort, sockets ...string) error {
+	if len(bind) == 0 && len(sockets) == 0 {
+		return errors.New("must provide at least one bind address")
+	}
+
+	i.mu.Lock()
+	probed := i.opts.Auto || i.opts.Probe != nil && i.opts.Probe.Interval > 0
+	i.mu.Unlock()
+	if probed && len(bind) == 0 {
+		return errors.New("the proxy is probed on a bind address, it can't listen on unix sockets only")
+	}
+
+	return i.restart(func(opts *WarpOptions) {
+		opts.Bind = bind
+		opts.Proxy.UnixSockets = sockets
+
+		if endpoints := i.status.Session.Endpoints; i.status.State == StateRunning && len(endpoints) > 0 {
+			opts.Endpoint = endpoints[0]
+			if len(endpoints) > 1 {
+				opts.Endpoint2 = endpoints[1]
+			}
+			opts.Scan = nil
+		}
+	})
+}
+
+// Country returns the psiphon exit country, or an empty string if the
+// instance doesn't run in psiphon mode.
+func (i *Instance) Country() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.opts.Psiphon == nil {
+		return ""
+	}
+	return i.opts.Psiphon.Country
+}
+
+// SwitchCountry restarts the proxy with country as the psiphon exit country.
+// It fails if the instance doesn't run in psiphon mode.
+func (i *Instance) SwitchCountry(country string) error {
+	if !PsiphonSupported {
+		return ErrNoPsiphon
+	}
+	if !validPsiphonCountry(country) {
+		return fmt.Errorf("unsupported psiphon country %q", country)
+	}
+
+	i.ctl.Lock()
+	defer i.ctl.Unlock()
+
+	i.mu.Lock()
+	stopped, psiphon := i.status.State == StateStopped, i.opts.Psiphon != nil
+	i.mu.Unlock()
+	if stopped {
+		return ErrStopped
+	}
+	if !psiphon {
+		return errors.New("not running in psiphon mode")
+	}
+
+	return i.restartLocked(func(opts *WarpOptions) {
+		p := *opts.Psiphon
+		p.Country = country
+		opts.Psiphon = &p
+	})
+}
+
+// Traffic returns the bytes received and sent through the tunnels of the
+// running session, zero if no session is running.
+func (i *Instance) Traffic() (rx, tx uint64, err error) {
+	i.mu.Lock()
+	tunnels := i.status.Session.tunnels
+	if i.status.State != StateRunning {
+		tunnels = nil
+	}
+	i.mu.Unlock()
+
+	for _, tun := range tunnels {
+		peers, err := tun.tnet.PeerStatus()
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, peer := range peers {
+			rx += peer.RxBytes
+			tx += peer.TxBytes
+		}
+	}
+	return rx, tx, nil
+}
+
+// Psiphon returns the state of the psiphon tunnels of the running session,
+// nil if no session is running or it doesn't run psiphon.
+func (i *Instance) Psiphon() []PsiphonStatus {
+	i.mu.Lock()
+	psiphon := i.status.Session.psiphon
+	if i.status.State != StateRunning {
+		psiphon = nil
+	}
+	i.mu.Unlock()
+
+	var statuses []PsiphonStatus
+	for _, status := range psiphon {
+		statuses = append(statuses, status())
+	}
+	return statuses
+}
+
+// PsiphonTraffic returns the bytes received and sent by the psiphon tunnels
+// since the process started, all of them together as psiphon doesn't report
+// them per tunnel. Both are zero if no session running psiphon is running.
+func (i *Instance) PsiphonTraffic() (rx, tx int64) {
+	i.mu.Lock()
+	running := i.status.State == StateRunning && len(i.status.Session.psiphon) > 0
+	i.mu.Unlock()
+
+	if !running {
+		return 0, 0
+	}
+	return psiphonTraffic()
+}
+
+// Clients returns the traffic of every proxy client since the instance
+// started, and of the open connections.
+func (i *Instance) Clients() ([]wiresocks.ClientTraffic, []wiresocks.ConnTraffic) {
+	i.mu.Lock()
+	stats := i.opts.Proxy.Stats
+	i.mu.Unlock()
+
+	return stats.Clients(), stats.Conns()
+}
+
+// swapEndpoint points the primary tunnel of the running session at endpoint.
+// i.mu must be held.
+func (i *Instance) swapEndpoint(endpoint string) error {
+	addr, err := netip.ParseAddrPort(endpoint)
+	if err != nil {
+		return err
+	}
+
+	session := i.status.Session
+	if i.status.State != StateRunning || len(session.tunnels) == 0 {
+		return errors.New("no running tunnel")
+	}
+
+	if err := session.tunnels[0].tnet.UpdateEndpoint(addr); err != nil {
+		return err
+	}
+
+	i.opts.Endpoint = endpoint
+	i.opts.Scan = nil
+
+	session.Endpoints = append([]string{endpoint}, session.Endpoints[min(1, len(session.Endpoints)):]...)
+	if working, err := workingConfig(session.Mode, session.tunnels); err == nil {
+		session.Working = working
+	}
+	i.setStatus(Status{State: StateRunning, Session: session})
+	if i.opts.OnReady != nil {
+		i.opts.OnReady(session)
+	}
+
+	return nil
+}
+
+// restart stops the current session and starts a new one with the options
+// of the instance changed by update. They become the options of the instance
+// if the session starts.
+func (i *Instance) restart(update func(*WarpOptions)) error {
+	i.ctl.Lock()
+	defer i.ctl.Unlock()
+
+	return i.restartLocked(update)
+}
+
+// restartLocked is restart with i.ctl held.
+func (i *Instance) restartLocked(update func(*WarpOptions)) error {
+	i.mu.Lock()
+	if i.status.State == StateStopped {
+		i.mu.Unlock()
+		return ErrStopped
+	}
+	opts := i.opts
+	update(&opts)
+	i.cancel()
+	var old []tunnel
+	if i.status.State == StateRunning {
+		old = i.status.Session.tunnels
+	}
+	i.mu.Unlock()
+
+	// only a shutdown drains the proxy connections, the old tunnels would
+	// keep handshaking with the same key and hold their uapi sockets while
+	// the new session connects
+	for _, tun := range old {
+		tun.tnet.Stop()
+	}
+
+	waitReleased(opts, 5*time.Second)
+
+	if err := i.start(opts); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	i.opts = opts
+	i.mu.Unlock()
+
+	return nil
+}
+
+// startSession runs the sessions of instances, replaced in tests.
+var startSession = RunWarp
+
+// start runs a session with opts. i.ctl must be held, i.mu is only taken
+// around the state changes so the instance can be inspected and stopped
+// while the session connects.
+func (i *Instance) start(opts WarpOptions) error {
+	i.mu.Lock()
+	if i.status.State == StateStopped {
+		i.mu.Unlock()
+		return ErrStopped
+	}
+	ctx, cancel := context.WithCancel(i.ctx)
+	i.cancel = cancel
+	i.setStatus(Status{State: StateStarting})
+	i.mu.Unlock()
+
+	var session Session
+	onReady := opts.OnReady
+	opts.OnReady = func(s Session) {
+		session = s
+	}
+
+	err := startSession(ctx, i.l, opts)
+
+	i.mu.Lock()
+	if i.status.State == StateStopped {
+		// stopped while connecting, the events channel is closed
+		i.mu.Unlock()
+		cancel()
+		return ErrStopped
+	}
+	if err != nil {
+		cancel()
+		i.setStatus(Status{State: StateFailed, Err: err})
+		i.mu.Unlock()
+		return err
+	}
+	i.setStatus(Status{State: StateRunning, Session: session})
+	i.mu.Unlock()
+
+	if onReady != nil {
+		onReady(session)
+	}
+
+	return nil
+}
+
+// setStatus records status and sends it to the events channel. i.mu must be
+// held.
+func (i *Instance) setStatus(status Status) {
+	status.Since = time.Now()
+	i.status = status
+
+	select {
+	case i.events <- status:
+	default:
+	}
+}
+
+// waitReleased waits up to timeout for the listeners of a stopped session
+// to let go of the bind addresses and unix sockets of opts, which happens
+// asynchronously.
+func waitReleased(opts WarpOptions, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, bind := range opts.Bind {
+		if bind.Port() == 0 {
+			continue
+		}
+
+		for {
+			ln, err := net.Listen("tcp", bind.String())
+			if err == nil {
+				_ = ln.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// a closed unix listener removes its socket file
+	for _, path := range opts.Proxy.UnixSockets {
+		for {
+			if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			if time.Now().After(deadline) {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
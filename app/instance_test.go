@@ -0,0 +1,278 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// fakeSessions replaces the sessions of instances with ones that connect
+// once connect returns nil, or fail with its error.
+func fakeSessions(t *testing.T, connect func(ctx context.Context) error) {
+	old := startSession
+	startSession = func(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+		if err := connect(ctx); err != nil {
+			return err
+		}
+		opts.OnReady(Session{Mode: "warp", Endpoints: []string{opts.Endpoint}})
+		return nil
+	}
+	t.Cleanup(func() { startSession = old })
+}
+
+func testInstance(t *testing.T) *Instance {
+	fakeSessions(t, func(ctx context.Context) error { return nil })
+
+	i, err := StartWarp(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), WarpOptions{Endpoint: "162.159.192.1:2408"})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, i.Status().State, qt.Equals, StateRunning)
+	return i
+}
+
+// within fails the test if f doesn't return within a second.
+func within(t *testing.T, what string, f func()) {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s blocked", what)
+	}
+}
+
+func TestInstanceInspectWhileConnecting(t *testing.T) {
+	i := testInstance(t)
+
+	connecting, release := make(chan struct{}), make(chan struct{})
+	fakeSessions(t, func(ctx context.Context) error {
+		close(connecting)
+		<-release
+		return nil
+	})
+
+	restarted := make(chan error)
+	go func() { restarted <- i.Rescan() }()
+	<-connecting
+
+	within(t, "Status", func() {
+		qt.Assert(t, i.Status().State, qt.Equals, StateStarting)
+	})
+	within(t, "Country", func() { i.Country() })
+	within(t, "Traffic", func() { _, _, _ = i.Traffic() })
+
+	close(release)
+	qt.Assert(t, <-restarted, qt.IsNil)
+	qt.Assert(t, i.Status().State, qt.Equals, StateRunning)
+	qt.Assert(t, i.opts.Scan, qt.IsNotNil)
+}
+
+func TestInstanceStopWhileConnecting(t *testing.T) {
+	i := testInstance(t)
+
+	connecting := make(chan struct{})
+	fakeSessions(t, func(ctx context.Context) error {
+		close(connecting)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	restarted := make(chan error)
+	go func() { restarted <- i.Rescan() }()
+	<-connecting
+
+	within(t, "Stop", i.Stop)
+	qt.Assert(t, <-restarted, qt.Equals, ErrStopped)
+	qt.Assert(t, i.Status().State, qt.Equals, StateStopped)
+
+	// the events end with the stop
+	var last Status
+	for status := range i.Events() {
+		last = status
+	}
+	qt.Assert(t, last.State, qt.Equals, StateStopped)
+
+	qt.Assert(t, i.Rescan(), qt.Equals, ErrStopped)
+}
+
+func TestInstanceFailedRestart(t *testing.T) {
+	i := testInstance(t)
+
+	failure := errors.New("no handshake")
+	fakeSessions(t, func(ctx context.Context) error { return failure })
+
+	qt.Assert(t, i.SwitchEndpoint("162.159.192.2:2408"), qt.Equals, failure)
+	status := i.Status()
+	qt.Assert(t, status.State, qt.Equals, StateFailed)
+	qt.Assert(t, status.Err, qt.Equals, failure)
+	// the options only change once a session starts with them
+	qt.Assert(t, i.opts.Endpoint, qt.Equals, "162.159.192.1:2408")
+
+	qt.Assert(t, i.SwitchCountry("DE"), qt.ErrorMatches, ".*psiphon.*")
+}
+
+func TestInstanceSwitchBind(t *testing.T) {
+	i := testInstance(t)
+	i.opts.Scan = &wiresocks.ScanOptions{V4: true}
+
+	bind := []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:0")}
+	qt.Assert(t, i.SwitchBind(bind), qt.IsNil)
+	qt.Assert(t, i.Status().State, qt.Equals, StateRunning)
+	qt.Assert(t, i.opts.Bind, qt.HasLen, 1)
+	qt.Assert(t, i.opts.Bind[0], qt.Equals, bind[0])
+	// the session keeps its endpoint instead of scanning again
+	qt.Assert(t, i.opts.Endpoint, qt.Equals, "162.159.192.1:2408")
+	qt.Assert(t, i.opts.Scan, qt.IsNil)
+
+	qt.Assert(t, i.SwitchBind(nil), qt.ErrorMatches, ".*bind address.*")
+}
+
+func TestInstanceUnixSocketsOnly(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sockets := wiresocks.ProxyOptions{UnixSockets: []string{filepath.Join(t.TempDir(), "wp.sock")}}
+
+	// auto mode and probing reach the proxy on its first bind address
+	_, err := StartWarp(context.Background(), l, WarpOptions{Auto: true, Proxy: sockets})
+	qt.Assert(t, err, qt.ErrorMatches, "auto mode .*unix sockets only")
+	_, err = StartWarp(context.Background(), l, WarpOptions{Proxy: sockets, Probe: &ProbeOptions{Interval: time.Second}})
+	qt.Assert(t, err, qt.ErrorMatches, "probing .*unix sockets")
+
+	i := testInstance(t)
+	i.opts.Probe = &ProbeOptions{Interval: time.Second}
+	qt.Assert(t, i.SwitchBind(nil, sockets.UnixSockets...), qt.ErrorMatches, ".*unix sockets only")
+	qt.Assert(t, i.Status().State, qt.Equals, StateRunning)
+}
+
+func TestInstanceProbeRestart(t *testing.T) {
+	i := testInstance(t)
+
+	restarted := make(chan struct{}, 1)
+	fakeSessions(t, func(ctx context.Context) error {
+		select {
+		case restarted <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+
+	// the fake session has no proxy address, so every probe fails
+	done := make(chan struct{})
+	go func() {
+		i.runProbes(ProbeOptions{Interval: 10 * time.Millisecond, Failures: 2})
+		close(done)
+	}()
+
+	select {
+	case <-restarted:
+	case <-time.After(time.Second):
+		t.Fatal("session wasn't restarted after failing probes")
+	}
+
+	res, ok := i.LastProbe()
+	qt.Assert(t, ok, qt.IsTrue)
+	qt.Assert(t, res.Success, qt.IsFalse)
+	qt.Assert(t, res.URL, qt.Equals, probeURL)
+
+	i.Stop()
+	within(t, "runProbes", func() { <-done })
+}
+
+func TestInstanceHealth(t *testing.T) {
+	i := testInstance(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	up := netip.MustParseAddrPort(ln.Addr().String())
+
+	i.mu.Lock()
+	i.status.Session.Addresses = []netip.AddrPort{up}
+	i.mu.Unlock()
+
+	h := i.Health()
+	qt.Assert(t, h.Ready, qt.IsTrue)
+	qt.Assert(t, h.Listeners, qt.HasLen, 1)
+	qt.Assert(t, h.Listeners[0], qt.Equals, ListenerHealth{Addr: up, Up: true})
+
+	// a failed probe or a closed listener make the instance unready
+	i.mu.Lock()
+	i.probe = ProbeResult{Time: time.Now(), Error: "timeout"}
+	i.mu.Unlock()
+	qt.Assert(t, i.Health().Ready, qt.IsFalse)
+
+	i.mu.Lock()
+	i.probe = ProbeResult{}
+	i.mu.Unlock()
+	qt.Assert(t, ln.Close(), qt.IsNil)
+	h = i.Health()
+	qt.Assert(t, h.Ready, qt.IsFalse)
+	qt.Assert(t, h.Listeners[0].Up, qt.IsFalse)
+
+	i.Stop()
+	qt.Assert(t, i.Health(), qt.DeepEquals, Health{State: StateStopped})
+}
+
+func TestInstanceHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are written for sh")
+	}
+	i := testInstance(t)
+
+	log := filepath.Join(t.TempDir(), "hooks.log")
+	hook := `echo "$WARP_PLUS_EVENT $WARP_PLUS_MODE $WARP_PLUS_ENDPOINT $WARP_PLUS_REASON" >> ` + log
+	done := make(chan struct{})
+	go func() {
+		i.runHooks(HookOptions{Up: hook, Down: hook, Interval: 10 * time.Millisecond})
+		close(done)
+	}()
+
+	// waitLines waits until the hooks logged n lines
+	waitLines := func(n int) []string {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+			b, _ := os.ReadFile(log)
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			if len(b) > 0 && len(lines) >= n {
+				return lines
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("hooks logged %q, want %d lines", b, n)
+			}
+		}
+	}
+
+	// the fake session has no tunnels or listeners to check, so it is up
+	// until a probe fails
+	waitLines(1)
+	i.mu.Lock()
+	i.probe = ProbeResult{Time: time.Now(), Error: "timeout"}
+	i.mu.Unlock()
+	waitLines(2)
+	i.mu.Lock()
+	i.probe = ProbeResult{}
+	i.mu.Unlock()
+	waitLines(3)
+
+	i.Stop()
+	within(t, "runHooks", func() { <-done })
+	qt.Assert(t, waitLines(4), qt.DeepEquals, []string{
+		"up warp 162.159.192.1:2408 ",
+		"down warp 162.159.192.1:2408 probe",
+		"up warp 162.159.192.1:2408 ",
+		"down warp 162.159.192.1:2408 stopped",
+	})
+}
@@ -0,0 +1,69 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// singleMTU is the default mtu of a tunnel carried directly over the
+	// network.
+	singleMTU = 1330
+	// doubleMTU is the default mtu of the inner tunnel in gool mode.
+	doubleMTU = 1280 // minimum mtu for IPv6, may cause frag reassembly somewhere
+
+	// minMTU is the smallest usable tunnel mtu. The tunnels carry IPv6, which
+	// requires every link to have an mtu of at least 1280 (RFC 8200).
+	minMTU = 1280
+	// maxMTU is the largest usable tunnel mtu: a 1500 byte ethernet frame
+	// less the 80 bytes of wireguard overhead over IPv6.
+	maxMTU = 1420
+)
+
+// mtuPresets are named mtus for networks known to need them.
+var mtuPresets = map[string]int{
+	// minimal works on carriers that drop anything above the IPv6 minimum,
+	// e.g. some mobile networks tunnelling over their own encapsulation.
+	"minimal": minMTU,
+	// wireguard is the default of the official clients, for clean ethernet
+	// paths.
+	"wireguard": maxMTU,
+}
+
+// MTUPresets returns the names of the mtu presets.
+func MTUPresets() []string {
+	names := make([]string, 0, len(mtuPresets))
+	for name := range mtuPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseMTU parses an mtu given as a number or as the name of a preset.
+func ParseMTU(s string) (int, error) {
+	if mtu, ok := mtuPresets[strings.ToLower(s)]; ok {
+		return mtu, nil
+	}
+
+	mtu, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mtu %q, must be a number or one of %s", s, strings.Join(MTUPresets(), ", "))
+	}
+
+	if err := validateMTU(mtu); err != nil {
+		return 0, err
+	}
+
+	return mtu, nil
+}
+
+// validateMTU checks that mtu is within [minMTU, maxMTU].
+func validateMTU(mtu int) error {
+	if mtu < minMTU || mtu > maxMTU {
+		return fmt.Errorf("invalid mtu %d, must be between %d and %d", mtu, minMTU, maxMTU)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// defaultProbeFailures is how many probes in a row must fail before the
+// session is restarted, unless ProbeOptions say otherwise.
+const defaultProbeFailures = 3
+
+// probeOutcomes counts the probes run through the proxy by outcome, "success"
+// or "failure". It is exposed through expvar under "warp_probes".
+var probeOutcomes = expvar.NewMap("warp_probes")
+
+// ProbeOptions configure the synthetic transactions an Instance runs through
+// its proxy to tell whether traffic actually gets through, which a fresh
+// handshake alone doesn't prove.
+type ProbeOptions struct {
+	// URLs are fetched in turn, one every Interval. Any status below 400
+	// counts as success. Empty means a 204 page of google's.
+	URLs     []string
+	Interval time.Duration
+	// Failures is how many probes in a row must fail before the session is
+	// restarted, which rescans when scanning and goes through the modes
+	// again in auto mode. Zero means 3.
+	Failures int
+	// StatsPath, if set, is a JSON lines file the outcome and latency of
+	// every probe are appended to.
+	StatsPath string
+}
+
+// ProbeResult is the outcome of a probe.
+type ProbeResult struct {
+	Time    time.Time `json:"time"`
+	Mode    string    `json:"mode"`
+	URL     string    `json:"url"`
+	Success bool      `json:"success"`
+	// LatencyMS is how long the request took, until the response headers
+	// came in.
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// runProbes probes the running session of the instance every interval until
+// it is stopped, restarting the session once opts.Failures probes in a row
+// have failed. A session that failed to restart counts as a failed probe, so
+// it is retried at the same pace.
+func (i *Instance) runProbes(opts ProbeOptions) {
+	if len(opts.URLs) == 0 {
+		opts.URLs = []string{probeURL}
+	}
+	if opts.Failures <= 0 {
+		opts.Failures = defaultProbeFailures
+	}
+
+	t := time.NewTicker(opts.Interval)
+	defer t.Stop()
+
+	failures, next := 0, 0
+	for {
+		select {
+		case <-i.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		i.mu.Lock()
+		status, proxyOpts := i.status, i.opts.Proxy
+		i.mu.Unlock()
+
+		switch status.State {
+		case StateStopped:
+			return
+		case StateStarting:
+			continue
+		case StateRunning:
+			url := opts.URLs[next%len(opts.URLs)]
+			next++
+
+			res := runProbe(i.ctx, status.Session, url, proxyOpts)
+			i.mu.Lock()
+			i.probe = res
+			i.mu.Unlock()
+
+			if err := appendJSONLine(opts.StatsPath, res); err != nil {
+				i.l.Warn("failed to save probe result", "error", err)
+			}
+
+			if res.Success {
+				i.l.Debug("probe succeeded", "url", url, "latency_ms", res.LatencyMS)
+				failures = 0
+				continue
+			}
+			i.l.Warn("probe failed", "url", url, "error", res.Error)
+		}
+
+		if failures++; failures < opts.Failures {
+			continue
+		}
+		failures = 0
+
+		i.l.Warn("probes keep failing, restarting the session", "failures", opts.Failures)
+		if err := i.restart(func(o *WarpOptions) {
+			o.Scan = i.scan
+			nextListedEndpoints(o)
+		}); err != nil {
+			i.l.Warn("failed to restart the session", "error", err)
+		}
+	}
+}
+
+// LastProbe returns the result of the latest probe, false if none ran yet.
+func (i *Instance) LastProbe() (ProbeResult, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.probe, !i.probe.Time.IsZero()
+}
+
+// runProbe fetches url through the proxy of session.
+func runProbe(ctx context.Context, session Session, url string, proxyOpts wiresocks.ProxyOptions) ProbeResult {
+	res := ProbeResult{Time: time.Now(), Mode: session.Mode, URL: url}
+	if len(session.Addresses) == 0 {
+		res.Error = "no proxy address"
+		probeOutcomes.Add("failure", 1)
+		return res
+	}
+
+	latency, err := fetchThrough(ctx, session.Addresses[0], proxyOpts, url)
+	res.LatencyMS = latency.Milliseconds()
+	if err != nil {
+		res.Error = err.Error()
+		probeOutcomes.Add("failure", 1)
+		return res
+	}
+
+	res.Success = true
+	probeOutcomes.Add("success", 1)
+	return res
+}
+
+// fetchThrough gets url through the proxy at bind and returns how long the
+// response took to arrive. Statuses of 400 and above are errors.
+func fetchThrough(ctx context.Context, bind netip.AddrPort, proxyOpts wiresocks.ProxyOptions, url string) (time.Duration, error) {
+	client := ProxyClient(bind, proxyOpts)
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	t0 := time.Now()
+	resp, err := client.Do(req)
+	latency := time.Since(t0)
+	if err != nil {
+		return latency, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 400 {
+		return latency, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return latency, nil
+}
@@ -0,0 +1,168 @@
+//go:build !minimal
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"github.com/bepass-org/warp-plus/psiphon"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// PsiphonSupported reports whether psiphon mode is included in this build,
+// see the minimal build tag.
+const PsiphonSupported = true
+
+// PsiphonCountries returns the countries psiphon mode can exit in, see
+// psiphon.Countries.
+func PsiphonCountries() []string {
+	return psiphon.Countries()
+}
+
+func validPsiphonCountry(country string) bool {
+	return psiphon.IsValidCountry(country)
+}
+
+// psiphonTraffic returns the bytes received and sent by every psiphon tunnel
+// of the process, see psiphon.ProcessTraffic.
+func psiphonTraffic() (rx, tx int64) {
+	t := psiphon.ProcessTraffic()
+	return t.BytesReceived, t.BytesSent
+}
+
+func runWarpWithPsiphon(ctx, readyCtx context.Context, l *slog.Logger, stats *sessionStats, bind []netip.AddrPort, proxyOpts wiresocks.ProxyOptions, profile, endpoint string, tun tunnelOptions, opts PsiphonOptions) ([]netip.AddrPort, error) {
+	conf, err := wiresocks.ParseConfig(profile, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	conf.Interface.MTU = tun.mtu
+	conf.Upstream = tun.upstream
+
+	for i, peer := range conf.Peers {
+		peer.Trick = true
+		peer.Tricks = tun.tricks
+		peer.KeepAlive = tun.keepAlive
+		peer.FallbackEndpoint = tun.fallbackEndpoint
+		conf.Peers[i] = peer
+	}
+
+	tnet, err := startTunnel(ctx, readyCtx, l, stats, conf, "primary", tun)
+	if err != nil {
+		return nil, err
+	}
+
+	warpBind, err := tnet.StartProxy([]netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:0")}, wiresocks.ProxyOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return servePsiphon(ctx, l, stats, warpBind[0], bind, proxyOpts, opts)
+}
+
+// runPsiphonOverGool runs warp in warp on a random local port and psiphon
+// through its inner tunnel, serving the proxy chained to psiphon on bind.
+// Psiphon only carries tcp, so the other order, warp inside psiphon, isn't
+// possible.
+func runPsiphonOverGool(ctx, readyCtx context.Context, l *slog.Logger, stats *sessionStats, bind []netip.AddrPort, proxyOpts wiresocks.ProxyOptions, dir string, endpoints []string, tun tunnelOptions, opts PsiphonOptions) ([]netip.AddrPort, error) {
+	warpBind, err := runWarpInWarp(ctx, readyCtx, l, stats, []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:0")}, wiresocks.ProxyOptions{}, dir, endpoints, tun)
+	if err != nil {
+		return nil, err
+	}
+
+	return servePsiphon(ctx, l, stats, warpBind[0], bind, proxyOpts, opts)
+}
+
+// servePsiphon runs the psiphon tunnels of opts through the warp proxy at
+// warpBind and serves the proxies chained to them, the main one on bind.
+func servePsiphon(ctx context.Context, l *slog.Logger, stats *sessionStats, warpBind netip.AddrPort, bind []netip.AddrPort, proxyOpts wiresocks.ProxyOptions, opts PsiphonOptions) ([]netip.AddrPort, error) {
+	mainOpts := psiphonOptions(opts, "")
+	mainOpts.HTTPProxyPort = opts.HTTPProxyPort
+	bound, err := startPsiphonProxy(ctx, l, stats, "psiphon", warpBind, bind, proxyOpts, opts.Country, mainOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// the unix sockets belong to the main tunnel, like bind
+	regionOpts := proxyOpts
+	regionOpts.UnixSockets = nil
+
+	// the other regions are started one after another, psiphon-tunnel-core
+	// has a single notice writer per process and a tunnel only sees the
+	// notices of its own start
+	for _, region := range opts.Regions {
+		dataDir := filepath.Join(opts.DataDir, fmt.Sprintf("%s-%d", region.Country, region.Bind.Port()))
+		if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
+			return nil, err
+		}
+
+		rl := l.With("region", region.Country)
+		regionBound, err := startPsiphonProxy(ctx, rl, stats, "psiphon-"+region.Country, warpBind, []netip.AddrPort{region.Bind}, regionOpts, region.Country, psiphonOptions(opts, dataDir))
+		if err != nil {
+			return nil, fmt.Errorf("psiphon region %s: %w", region.Country, err)
+		}
+		rl.Info("serving psiphon region", "addresses", regionBound)
+	}
+
+	l.Info("serving proxy", "addresses", bound)
+
+	return bound, nil
+}
+
+// psiphonOptions returns the psiphon options of a tunnel keeping its files in
+// dataDir.
+func psiphonOptions(opts PsiphonOptions, dataDir string) psiphon.Options {
+	return psiphon.Options{
+		ConfigPath:             opts.ConfigPath,
+		EmbeddedServerListPath: opts.EmbeddedServerListPath,
+		SponsorId:              opts.SponsorId,
+		PropagationChannelId:   opts.PropagationChannelId,
+		TunnelProtocols:        opts.TunnelProtocols,
+		DataDir:                dataDir,
+	}
+}
+
+// startPsiphonProxy runs a psiphon tunnel exiting in country through the warp
+// proxy at warpBind, and serves the mixed proxy chained to it on bind. The
+// tunnel is stopped once ctx is done. Its start is timed as phase, which also
+// names it in the session stats.
+func startPsiphonProxy(ctx context.Context, l *slog.Logger, stats *sessionStats, phase string, warpBind netip.AddrPort, bind []netip.AddrPort, proxyOpts wiresocks.ProxyOptions, country string, opts psiphon.Options) ([]netip.AddrPort, error) {
+	// run psiphon on a random local port
+	done := stats.phase(phase)
+	tunnel, err := psiphon.RunPsiphon(ctx, l.With("subsystem", "psiphon"), warpBind.String(), "127.0.0.1:0", country, opts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to run psiphon %w", err)
+	}
+	done()
+
+	stats.addPsiphon(func() PsiphonStatus {
+		return PsiphonStatus{
+			Name:          phase,
+			Country:       country,
+			ServerRegion:  tunnel.ServerRegion(),
+			HTTPProxyPort: tunnel.HTTPProxyPort,
+		}
+	})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-tunnel.Done():
+			l.Error("psiphon tunnel exited unexpectedly")
+		}
+		tunnel.Stop()
+	}()
+
+	// serve the mixed proxy on bind address and chain it to psiphon
+	psiphonBind := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(tunnel.SOCKSProxyPort))
+	bound, err := wiresocks.StartChainProxy(ctx, l, bind, psiphonBind, proxyOpts)
+	if err != nil {
+		tunnel.Stop()
+		return nil, err
+	}
+	return bound, nil
+}
@@ -0,0 +1,36 @@
+//go:build minimal
+
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// PsiphonSupported reports whether psiphon mode is included in this build,
+// see the minimal build tag.
+const PsiphonSupported = false
+
+// PsiphonCountries returns nil, psiphon isn't included in this build.
+func PsiphonCountries() []string {
+	return nil
+}
+
+func validPsiphonCountry(string) bool {
+	return false
+}
+
+func psiphonTraffic() (rx, tx int64) {
+	return 0, 0
+}
+
+func runWarpWithPsiphon(context.Context, context.Context, *slog.Logger, *sessionStats, []netip.AddrPort, wiresocks.ProxyOptions, string, string, tunnelOptions, PsiphonOptions) ([]netip.AddrPort, error) {
+	return nil, ErrNoPsiphon
+}
+
+func runPsiphonOverGool(context.Context, context.Context, *slog.Logger, *sessionStats, []netip.AddrPort, wiresocks.ProxyOptions, string, []string, tunnelOptions, PsiphonOptions) ([]netip.AddrPort, error) {
+	return nil, ErrNoPsiphon
+}
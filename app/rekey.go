@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// RotateKeys gives the primary and secondary identities in dir new keys, see
+// warp.RotateKey. A secondary identity cloned from the primary one gets the
+// new key of the primary, a separately registered one a key of its own. It
+// returns the new private keys by identity name.
+func RotateKeys(ctx context.Context, l *slog.Logger, dir string) (map[string]string, error) {
+	primaryDir, secondaryDir := filepath.Join(dir, "primary"), filepath.Join(dir, "secondary")
+
+	i, err := warp.RotateKey(ctx, l, primaryDir, secondaryDir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", primaryDir, err)
+	}
+	keys := map[string]string{"primary": i.PrivateKey}
+
+	secondary, err := warp.LoadIdentity(secondaryDir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return keys, nil
+	case err != nil:
+		return keys, fmt.Errorf("%s: %w", secondaryDir, err)
+	case secondary.ID != i.ID:
+		if secondary, err = warp.RotateKey(ctx, l, secondaryDir); err != nil {
+			return keys, fmt.Errorf("%s: %w", secondaryDir, err)
+		}
+	}
+	keys["secondary"] = secondary.PrivateKey
+	return keys, nil
+}
+
+// tunnelIdentity returns the name of the identity the tunnel name runs on.
+func tunnelIdentity(name string) string {
+	switch name {
+	case "secondary", "inner":
+		return "secondary"
+	default:
+		return "primary"
+	}
+}
+
+// Rekey gives the identities of the instance new keys, see RotateKeys, and
+// applies them to the tunnels of the running session in place. The proxy is
+// restarted if a tunnel can't take its new key, since its old one no longer
+// works.
+func (i *Instance) Rekey() error {
+	i.ctl.Lock()
+	defer i.ctl.Unlock()
+
+	i.mu.Lock()
+	opts, status := i.opts, i.status
+	i.mu.Unlock()
+
+	if status.State == StateStopped {
+		return ErrStopped
+	}
+	if opts.WireguardConfig != "" {
+		return errors.New("can't rotate the key of a wireguard config")
+	}
+
+	keys, err := RotateKeys(i.ctx, i.l, identityDir(opts))
+	if err != nil {
+		// the primary identity may have a new key already
+		if keys == nil {
+			return err
+		}
+		i.l.Warn("failed to rotate every key", "error", err)
+	}
+
+	if status.State == StateRunning {
+		if err := applyKeys(status.Session.tunnels, keys); err != nil {
+			i.l.Info("can't apply the new keys in place, restarting", "reason", err)
+			if err := i.restartLocked(func(*WarpOptions) {}); err != nil {
+				return err
+			}
+		}
+	}
+	return err
+}
+
+// applyKeys sets the private key of every tunnel to the key of its identity
+// in keys.
+func applyKeys(tunnels []tunnel, keys map[string]string) error {
+	for _, tun := range tunnels {
+		key, ok := keys[tunnelIdentity(tun.name)]
+		if !ok {
+			continue
+		}
+		if err := tun.tnet.SetPrivateKey(key); err != nil {
+			return fmt.Errorf("%s tunnel: %w", tun.name, err)
+		}
+	}
+	return nil
+}
+
+// runRekey rotates the keys of the instance every interval until it is
+// stopped.
+func (i *Instance) runRekey(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-i.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if err := i.Rekey(); errors.Is(err, ErrStopped) {
+			return
+		} else if err != nil {
+			i.l.Warn("failed to rotate keys", "error", err)
+		}
+	}
+}
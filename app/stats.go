@@ -0,0 +1,130 @@
+package app
+
+import (
+	"encoding/json"
+	"expvar"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// modeSessions counts finished sessions by mode and outcome, e.g.
+// "gool/success". It is exposed through expvar under "warp_mode_sessions".
+var modeSessions = expvar.NewMap("warp_mode_sessions")
+
+// sessionStats records how long each phase of bringing up a mode took.
+// Finished sessions are appended as JSON lines to the stats file so success
+// rates and timings can be compared across runs and networks.
+type sessionStats struct {
+	mu        sync.Mutex
+	Start     time.Time        `json:"start"`
+	Mode      string           `json:"mode"`
+	Endpoints []string         `json:"endpoints,omitempty"`
+	Success   bool             `json:"success"`
+	Error     string           `json:"error,omitempty"`
+	PhasesMS  map[string]int64 `json:"phases_ms"`
+
+	// tunnels are the tunnels that completed their handshake
+	tunnels []tunnel
+	// psiphon return the state of each psiphon tunnel that connected
+	psiphon []func() PsiphonStatus
+}
+
+func newSessionStats() *sessionStats {
+	return &sessionStats{
+		Start:    time.Now(),
+		PhasesMS: make(map[string]int64),
+	}
+}
+
+// phase starts timing the named phase; the returned func stops it.
+func (s *sessionStats) phase(name string) func() {
+	t0 := time.Now()
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.PhasesMS[name] = time.Since(t0).Milliseconds()
+	}
+}
+
+// replaceEndpoint records that a tunnel moved from endpoint from to to.
+func (s *sessionStats) replaceEndpoint(from, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, endpoint := range s.Endpoints {
+		if endpoint == from {
+			s.Endpoints[i] = to
+			return
+		}
+	}
+}
+
+// carry records that the tunnel name is carried through another by fw.
+func (s *sessionStats) carry(name string, fw *wiresocks.UDPForwarder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.tunnels {
+		if s.tunnels[i].name == name {
+			s.tunnels[i].forwarder = fw
+		}
+	}
+}
+
+// addPsiphon records a connected psiphon tunnel whose state status reports.
+func (s *sessionStats) addPsiphon(status func() PsiphonStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.psiphon = append(s.psiphon, status)
+}
+
+// finish records the outcome of the session and appends it to path, if set.
+func (s *sessionStats) finish(path string, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Success = err == nil
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	outcome := "success"
+	if !s.Success {
+		outcome = "failure"
+	}
+	modeSessions.Add(s.Mode+"/"+outcome, 1)
+
+	return appendJSONLine(path, s)
+}
+
+// appendJSONLine appends v as a JSON line to the file at path, creating it
+// if needed. An empty path is a no-op.
+func appendJSONLine(path string, v any) error {
+	if path == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
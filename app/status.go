@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// tunnel is a running wireguard tunnel of a session.
+type tunnel struct {
+	name string
+	tnet *wiresocks.VirtualTun
+	mtu  int
+	// forwarder, if set, carries the tunnel through another one, as the
+	// inner tunnel of gool mode
+	forwarder *wiresocks.UDPForwarder
+	// colo is the cloudflare data center the tunnel was verified through,
+	// empty if it wasn't verified
+	colo string
+}
+
+// PsiphonStatus is the state of a psiphon tunnel of a session.
+type PsiphonStatus struct {
+	// Name is "psiphon" for the tunnel of the exit country, or
+	// "psiphon-<country>" for those of the other regions.
+	Name    string
+	Country string
+	// ServerRegion is the region of the psiphon server the tunnel is
+	// connected to, see psiphon.Tunnel.ServerRegion.
+	ServerRegion string
+	// HTTPProxyPort is the port of psiphon's own http proxy, zero if it is
+	// disabled.
+	HTTPProxyPort int
+}
+
+// reportStatus logs the endpoint, last handshake age and traffic of every
+// peer of tunnels each interval until ctx is done, so a dead tunnel shows up
+// in the logs without probing through it. The forwarder of a tunnel carried
+// through another is logged too, its drops are the packets lost in between,
+// and so are the server region of every psiphon tunnel and the traffic of all
+// of them.
+func reportStatus(ctx context.Context, l *slog.Logger, interval time.Duration, tunnels []tunnel, psiphon []func() PsiphonStatus) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		for _, tun := range tunnels {
+			peers, err := tun.tnet.PeerStatus()
+			if err != nil {
+				l.Warn("failed to read tunnel status", "tunnel", tun.name, "error", err)
+				continue
+			}
+
+			for _, peer := range peers {
+				age := "never"
+				if !peer.LastHandshake.IsZero() {
+					age = time.Since(peer.LastHandshake).Round(time.Second).String()
+				}
+
+				l.Info("tunnel status",
+					"tunnel", tun.name,
+					"endpoint", peer.Endpoint,
+					"family", peer.Family(),
+					"handshake_age", age,
+					"rx_bytes", peer.RxBytes,
+					"tx_bytes", peer.TxBytes,
+				)
+			}
+
+			if tun.forwarder != nil {
+				fw := tun.forwarder.Stats()
+				l.Info("udp forwarder status", "tunnel", tun.name, "dest", tun.forwarder.Dest(), "up", fw.Up, "down", fw.Down)
+			}
+		}
+
+		for _, status := range psiphon {
+			p := status()
+			l.Info("psiphon status",
+				"tunnel", p.Name,
+				"country", p.Country,
+				"server_region", p.ServerRegion,
+			)
+		}
+		if len(psiphon) > 0 {
+			rx, tx := psiphonTraffic()
+			l.Info("psiphon traffic", "rx_bytes", rx, "tx_bytes", tx)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+const traceURL = "https://www.cloudflare.com/cdn-cgi/trace"
+
+// Trace is what cloudflare's trace endpoint reports about a connection.
+type Trace struct {
+	// IP is the address the request arrived from.
+	IP string
+	// Colo is the IATA code of the cloudflare data center that served it.
+	Colo string
+	// Location is the country of IP.
+	Location string
+	// Warp is "on", "plus" or "off".
+	Warp string
+	// RTT is how long the request took.
+	RTT time.Duration
+}
+
+// RunTrace fetches the trace endpoint through the proxy at bind.
+func RunTrace(ctx context.Context, bind netip.AddrPort, proxyOpts wiresocks.ProxyOptions) (Trace, error) {
+	client := ProxyClient(bind, proxyOpts)
+	defer client.CloseIdleConnections()
+
+	return fetchTrace(ctx, client)
+}
+
+// tunnelTrace fetches the trace endpoint through tnet directly, before any
+// proxy serves it.
+func tunnelTrace(ctx context.Context, tnet *wiresocks.VirtualTun) (Trace, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: tnet.Tnet.DialContext,
+		},
+		Timeout: verifyTimeout,
+	}
+	defer client.CloseIdleConnections()
+
+	return fetchTrace(ctx, client)
+}
+
+// fetchTrace fetches the trace endpoint with client.
+func fetchTrace(ctx context.Context, client *http.Client) (Trace, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", traceURL, nil)
+	if err != nil {
+		return Trace{}, err
+	}
+
+	t0 := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return Trace{}, fmt.Errorf("trace failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Trace{}, fmt.Errorf("trace failed, status %d", resp.StatusCode)
+	}
+
+	trace, err := parseTrace(resp.Body)
+	if err != nil {
+		return Trace{}, fmt.Errorf("trace failed: %w", err)
+	}
+	trace.RTT = time.Since(t0)
+
+	return trace, nil
+}
+
+// parseTrace reads the body of a trace response, a list of key=value lines.
+func parseTrace(r io.Reader) (Trace, error) {
+	var trace Trace
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		key, value, _ := strings.Cut(s.Text(), "=")
+		switch key {
+		case "ip":
+			trace.IP = value
+		case "colo":
+			trace.Colo = value
+		case "loc":
+			trace.Location = value
+		case "warp":
+			trace.Warp = value
+		}
+	}
+	return trace, s.Err()
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+const (
+	// defaultKeepAlive is the default persistent keepalive interval in
+	// seconds of a tunnel carried directly over the network. It is short to
+	// keep NAT mappings of mobile carriers alive.
+	defaultKeepAlive = 3
+	// defaultInnerKeepAlive is the default for the inner tunnel in gool mode,
+	// whose packets already keep the outer tunnel alive.
+	defaultInnerKeepAlive = 10
+	// maxKeepAlive is the largest keepalive wireguard accepts.
+	maxKeepAlive = 65535
+)
+
+// tunnelOptions are the settings shared by the tunnels of a session.
+type tunnelOptions struct {
+	mtu, innerMTU             int
+	keepAlive, innerKeepAlive int
+	// handshakeTimeout bounds each handshake attempt, zero leaves it to the
+	// ready timeout of the session.
+	handshakeTimeout time.Duration
+	// handshakeRetries is how often a tunnel that missed handshakeTimeout
+	// is restarted.
+	handshakeRetries int
+	// tricks shape the junk packets of the tunnels carried directly over
+	// the network
+	tricks wiresocks.TrickConfig
+	// fallbackEndpoint is the fallback endpoint of the primary tunnel
+	fallbackEndpoint string
+	// upstream relays the datagrams of the tunnels carried directly over
+	// the network
+	upstream *wiresocks.UpstreamProxy
+	// reserved, if set, replaces the reserved bytes of the peers of every
+	// tunnel
+	reserved *[3]byte
+	// preferFamily is the family of destination addresses dialed first
+	preferFamily int
+	// innerRefresh and innerMaxRTT drive the inner endpoint watch of gool
+	// mode, see watchInnerEndpoint
+	innerRefresh, innerMaxRTT time.Duration
+	// uapi prefixes the names of the uapi sockets of the tunnels, empty
+	// disables them
+	uapi string
+	// verify has every tunnel fetch the trace endpoint after its handshake,
+	// see verifyTunnel. verifyWarp also requires the trace to report warp
+	// and moves tunnels that fail to another warp endpoint.
+	verify, verifyWarp bool
+	// stack tunes the netstack of every tunnel
+	stack netstack.Tuning
+	// endpoints are the listed endpoints tunnels move through, see
+	// nextListed
+	endpoints []string
+	// preferColos are the cloudflare data centers verified tunnels are
+	// moved to another endpoint until they land in, see coloAttempts
+	preferColos []string
+}
+
+// tunnelOptionsFrom returns the tunnel settings of opts with the defaults
+// filled in.
+func tunnelOptionsFrom(opts WarpOptions) tunnelOptions {
+	tun := tunnelOptions{
+		mtu:              singleMTU,
+		innerMTU:         doubleMTU,
+		keepAlive:        defaultKeepAlive,
+		innerKeepAlive:   defaultInnerKeepAlive,
+		handshakeTimeout: opts.HandshakeTimeout,
+		handshakeRetries: opts.HandshakeRetries,
+		tricks:           opts.Tricks,
+		fallbackEndpoint: opts.FallbackEndpoint,
+		upstream:         opts.Upstream,
+		reserved:         opts.Reserved,
+		preferFamily:     opts.PreferFamily,
+		innerRefresh:     opts.InnerRefresh,
+		innerMaxRTT:      opts.InnerMaxRTT,
+		uapi:             opts.UAPI,
+		stack:            opts.Stack,
+		verify:           !opts.SkipVerify,
+		verifyWarp:       opts.WireguardConfig == "",
+		endpoints:        opts.Endpoints,
+		preferColos:      opts.PreferColos,
+	}
+	if opts.MTU != 0 {
+		tun.mtu = opts.MTU
+	}
+	if opts.InnerMTU != 0 {
+		tun.innerMTU = opts.InnerMTU
+	}
+	if tun.innerMaxRTT == 0 {
+		tun.innerMaxRTT = time.Second
+	}
+	if opts.KeepAlive != 0 {
+		tun.keepAlive, tun.innerKeepAlive = opts.KeepAlive, opts.KeepAlive
+	}
+	return tun
+}
+
+// startTunnel starts a tunnel from conf and waits for its handshake within
+// readyCtx, recording how long it took as the "<name>_handshake" phase. A
+// tunnel that misses tun.handshakeTimeout is restarted, which also gets it a
+// new source port, up to tun.handshakeRetries times, on the next listed
+// endpoint if its endpoint is listed.
+func startTunnel(ctx, readyCtx context.Context, l *slog.Logger, stats *sessionStats, conf *wiresocks.Configuration, name string, tun tunnelOptions) (*wiresocks.VirtualTun, error) {
+	if tun.reserved != nil {
+		if err := conf.SetReserved(*tun.reserved); err != nil {
+			return nil, err
+		}
+	}
+
+	conf.Interface.PreferFamily = tun.preferFamily
+	if tun.uapi != "" {
+		conf.UAPI = tun.uapi + "-" + name
+	}
+	conf.Stack = tun.stack
+
+	done := stats.phase(name + "_handshake")
+
+	var timeouts, unverified, misplaced int
+	for {
+		tnet, err := wiresocks.StartWireguard(ctx, l, conf)
+		if err != nil {
+			return nil, err
+		}
+
+		attemptCtx, cancel := readyCtx, context.CancelFunc(func() {})
+		if tun.handshakeTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(readyCtx, tun.handshakeTimeout)
+		}
+		err = tnet.WaitHandshake(attemptCtx)
+		cancel()
+
+		if err != nil {
+			tnet.Stop()
+			if readyCtx.Err() != nil || timeouts >= tun.handshakeRetries {
+				return nil, fmt.Errorf("%s warp did not complete handshake: %w", name, err)
+			}
+			timeouts++
+			if from, to, ok := moveToNextListed(conf, tun.endpoints); ok {
+				l.Warn("handshake timed out, moving to the next listed endpoint", "tunnel", name, "attempt", timeouts, "from", from, "to", to)
+				stats.replaceEndpoint(from, to)
+				continue
+			}
+			l.Warn("handshake timed out, restarting tunnel", "tunnel", name, "attempt", timeouts)
+			continue
+		}
+
+		var colo string
+		if tun.verify {
+			verified := stats.phase(name + "_verify")
+			trace, err := verifyTunnel(readyCtx, l, tnet, name, tun.verifyWarp)
+			if err != nil {
+				tnet.Stop()
+				if unverified++; readyCtx.Err() != nil || unverified >= verifyAttempts {
+					return nil, fmt.Errorf("%s warp failed verification: %w", name, err)
+				}
+
+				// a peer that isn't warp can't move to a warp endpoint,
+				// listed ones are tried before random ones
+				if from, to, moved := moveEndpoint(conf, tun); moved {
+					l.Warn("tunnel failed verification, moving to another endpoint", "tunnel", name, "from", from, "to", to, "error", err)
+					stats.replaceEndpoint(from, to)
+				} else {
+					l.Warn("tunnel failed verification, restarting it", "tunnel", name, "error", err)
+				}
+				continue
+			}
+			colo = trace.Colo
+
+			// keep looking for an endpoint that lands in a preferred colo,
+			// the inner tunnel of gool mode is carried by the outer one
+			if !preferredColo(tun.preferColos, colo) && !forwarded(conf) {
+				if misplaced++; misplaced < coloAttempts && readyCtx.Err() == nil {
+					if from, to, moved := moveEndpoint(conf, tun); moved {
+						tnet.Stop()
+						l.Info("tunnel landed outside of the preferred colos, moving to another endpoint", "tunnel", name, "colo", colo, "from", from, "to", to)
+						stats.replaceEndpoint(from, to)
+						continue
+					}
+				}
+				l.Warn("no endpoint landed in a preferred colo, keeping this one", "tunnel", name, "colo", colo, "attempts", misplaced)
+			}
+			verified()
+		}
+
+		done()
+
+		stats.mu.Lock()
+		stats.tunnels = append(stats.tunnels, tunnel{name: name, tnet: tnet, mtu: conf.Interface.MTU, colo: colo})
+		stats.mu.Unlock()
+		return tnet, nil
+	}
+}
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+const (
+	// verifyTimeout bounds the trace fetch that verifies a tunnel.
+	verifyTimeout = 10 * time.Second
+	// verifyAttempts is how often a tunnel is started, on another endpoint
+	// each time where possible, before it fails verification for good.
+	verifyAttempts = 3
+	// coloAttempts is how many endpoints a tunnel tries before it settles
+	// for one outside of the preferred colos.
+	coloAttempts = 10
+)
+
+// verifyTunnel fetches the trace endpoint through tnet, which must report
+// warp as on if requireWarp is set, logs the egress address and data center
+// and returns the trace. A completed handshake only shows that the endpoint
+// answers, not that it carries traffic.
+func verifyTunnel(ctx context.Context, l *slog.Logger, tnet *wiresocks.VirtualTun, name string, requireWarp bool) (Trace, error) {
+	trace, err := tunnelTrace(ctx, tnet)
+	if err != nil {
+		return Trace{}, err
+	}
+	if requireWarp && trace.Warp != "on" && trace.Warp != "plus" {
+		return Trace{}, fmt.Errorf("trace reports warp=%q", trace.Warp)
+	}
+
+	l.Info("tunnel verified", "tunnel", name, "egress", trace.IP, "colo", trace.Colo, "location", trace.Location, "warp", trace.Warp, "rtt", trace.RTT)
+	return trace, nil
+}
+
+// preferredColo reports whether colo is one of colos, or colos is empty.
+func preferredColo(colos []string, colo string) bool {
+	return len(colos) == 0 || slices.Contains(colos, strings.ToUpper(colo))
+}
+
+// ParseColos parses a list of cloudflare data centers by their IATA codes,
+// e.g. FRA, into upper case.
+func ParseColos(list []string) ([]string, error) {
+	colos := make([]string, 0, len(list))
+	for _, colo := range list {
+		colo = strings.ToUpper(strings.TrimSpace(colo))
+		if len(colo) != 3 || strings.Trim(colo, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return nil, fmt.Errorf("invalid colo %q, must be an IATA code like FRA", colo)
+		}
+		colos = append(colos, colo)
+	}
+	return colos, nil
+}
+
+// forwarded reports whether the peer of conf is at a loopback address, the
+// forwarder of the inner tunnel in gool mode.
+func forwarded(conf *wiresocks.Configuration) bool {
+	if len(conf.Peers) == 0 {
+		return false
+	}
+	endpoint, err := netip.ParseAddrPort(conf.Peers[0].Endpoint)
+	return err == nil && endpoint.Addr().IsLoopback()
+}
+
+// moveEndpoint moves the peer of conf to the next listed endpoint, or to a
+// random warp endpoint if it isn't listed and the peer is at warp, and
+// returns both.
+func moveEndpoint(conf *wiresocks.Configuration, tun tunnelOptions) (from, to string, ok bool) {
+	if from, to, ok = moveToNextListed(conf, tun.endpoints); ok || !tun.verifyWarp {
+		return from, to, ok
+	}
+	return failoverEndpoint(conf)
+}
+
+// failoverEndpoint moves the peer of conf to a random warp endpoint of the
+// family and port of its current one and returns both. It reports false if
+// the peer isn't at a warp address, e.g. at the forwarder of the inner
+// tunnel in gool mode or at a host name.
+func failoverEndpoint(conf *wiresocks.Configuration) (from, to string, ok bool) {
+	if len(conf.Peers) == 0 {
+		return "", "", false
+	}
+	from = conf.Peers[0].Endpoint
+	current, err := netip.ParseAddrPort(from)
+	if err != nil || current.Addr().IsLoopback() {
+		return "", "", false
+	}
+
+	v4 := current.Addr().Unmap().Is4()
+	for i := 0; i < 10; i++ {
+		candidate, err := warp.RandomWarpEndpoint(v4, !v4)
+		if err != nil {
+			return "", "", false
+		}
+		if candidate.Addr() == current.Addr() {
+			continue
+		}
+
+		to = netip.AddrPortFrom(candidate.Addr(), current.Port()).String()
+		conf.Peers[0].Endpoint = to
+		return from, to, true
+	}
+	return "", "", false
+}
+
+// nextListed returns the endpoint of list after current, wrapping around. It
+// reports false if current isn't listed, e.g. the forwarder of the inner
+// tunnel in gool mode, or is the only endpoint of list.
+func nextListed(list []string, current string) (string, bool) {
+	i := slices.Index(list, current)
+	if i < 0 || len(list) < 2 {
+		return "", false
+	}
+	return list[(i+1)%len(list)], true
+}
+
+// moveToNextListed moves the peer of conf to the endpoint of list after its
+// current one and returns both, see nextListed.
+func moveToNextListed(conf *wiresocks.Configuration, list []string) (from, to string, ok bool) {
+	if len(conf.Peers) == 0 {
+		return "", "", false
+	}
+	from = conf.Peers[0].Endpoint
+	if to, ok = nextListed(list, from); !ok {
+		return "", "", false
+	}
+	conf.Peers[0].Endpoint = to
+	return from, to, true
+}
+
+// nextListedEndpoints moves Endpoint of opts, and Endpoint2 if it is listed
+// too, on to the next listed endpoints, see nextListed.
+func nextListedEndpoints(opts *WarpOptions) {
+	next, ok := nextListed(opts.Endpoints, opts.Endpoint)
+	if !ok {
+		return
+	}
+	opts.Endpoint = next
+	if slices.Contains(opts.Endpoints, opts.Endpoint2) {
+		opts.Endpoint2, _ = nextListed(opts.Endpoints, next)
+	}
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseTrace(t *testing.T) {
+	body := "fl=29f1\nh=www.cloudflare.com\nip=104.28.1.2\nts=1700000000.1\ncolo=FRA\nloc=DE\nwarp=plus\ngateway=off\n"
+	trace, err := parseTrace(strings.NewReader(body))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, trace, qt.Equals, Trace{IP: "104.28.1.2", Colo: "FRA", Location: "DE", Warp: "plus"})
+}
+
+func TestFailoverEndpoint(t *testing.T) {
+	conf := &wiresocks.Configuration{Peers: []wiresocks.PeerConfig{{Endpoint: "162.159.192.1:4500"}}}
+	from, to, ok := failoverEndpoint(conf)
+	qt.Assert(t, ok, qt.IsTrue)
+	qt.Assert(t, from, qt.Equals, "162.159.192.1:4500")
+	qt.Assert(t, conf.Peers[0].Endpoint, qt.Equals, to)
+
+	moved := netip.MustParseAddrPort(to)
+	qt.Assert(t, moved.Addr().Is4(), qt.IsTrue)
+	qt.Assert(t, moved.Addr(), qt.Not(qt.Equals), netip.MustParseAddr("162.159.192.1"))
+	qt.Assert(t, moved.Port(), qt.Equals, uint16(4500))
+
+	// the forwarder of the inner gool tunnel stays
+	conf.Peers[0].Endpoint = "127.0.0.1:51820"
+	_, _, ok = failoverEndpoint(conf)
+	qt.Assert(t, ok, qt.IsFalse)
+	qt.Assert(t, conf.Peers[0].Endpoint, qt.Equals, "127.0.0.1:51820")
+}
+
+func TestNextListed(t *testing.T) {
+	list := []string{"162.159.192.1:2408", "162.159.195.2:500", "188.114.96.3:878"}
+
+	conf := &wiresocks.Configuration{Peers: []wiresocks.PeerConfig{{Endpoint: list[2]}}}
+	from, to, ok := moveToNextListed(conf, list)
+	qt.Assert(t, ok, qt.IsTrue)
+	qt.Assert(t, from, qt.Equals, list[2])
+	qt.Assert(t, to, qt.Equals, list[0])
+	qt.Assert(t, conf.Peers[0].Endpoint, qt.Equals, list[0])
+
+	// unlisted endpoints and single endpoint lists stay
+	conf.Peers[0].Endpoint = "127.0.0.1:51820"
+	_, _, ok = moveToNextListed(conf, list)
+	qt.Assert(t, ok, qt.IsFalse)
+	_, ok = nextListed(list[:1], list[0])
+	qt.Assert(t, ok, qt.IsFalse)
+
+	opts := WarpOptions{Endpoint: list[0], Endpoint2: list[1], Endpoints: list}
+	nextListedEndpoints(&opts)
+	qt.Assert(t, opts.Endpoint, qt.Equals, list[1])
+	qt.Assert(t, opts.Endpoint2, qt.Equals, list[2])
+}
+
+func TestParseColos(t *testing.T) {
+	colos, err := ParseColos([]string{"fra", " AMS"})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, colos, qt.DeepEquals, []string{"FRA", "AMS"})
+	qt.Assert(t, preferredColo(colos, "ams"), qt.IsTrue)
+	qt.Assert(t, preferredColo(colos, "LHR"), qt.IsFalse)
+	qt.Assert(t, preferredColo(nil, "LHR"), qt.IsTrue)
+
+	for _, invalid := range []string{"FRANKFURT", "F1A", ""} {
+		_, err := ParseColos([]string{invalid})
+		qt.Assert(t, err, qt.ErrorMatches, `invalid colo .*`)
+	}
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// workingFile is where the setup of the last session that connected is kept,
+// relative to the identity directory.
+const workingFile = "working.json"
+
+// WorkingConfig is the setup a session connected with, so a setup that works
+// on a network can be reproduced and shared.
+type WorkingConfig struct {
+	Mode    string          `json:"mode"`
+	Tunnels []WorkingTunnel `json:"tunnels"`
+	// Time is when the session connected.
+	Time time.Time `json:"time"`
+}
+
+// WorkingTunnel is the setup of one tunnel of a WorkingConfig, as reported
+// by its device.
+type WorkingTunnel struct {
+	Name string `json:"name"`
+	// Endpoint is where the tunnel's peer is reached, for a tunnel carried
+	// through another the endpoint its forwarder sends to rather than the
+	// forwarder itself.
+	Endpoint string `json:"endpoint"`
+	// Family is the IP family of Endpoint, "v4" or "v6".
+	Family           string `json:"family,omitempty"`
+	FallbackEndpoint string `json:"fallback_endpoint,omitempty"`
+	MTU              int    `json:"mtu"`
+	// KeepAlive is the persistent keepalive interval in seconds.
+	KeepAlive int `json:"keepalive"`
+	// Tricks are nil if the tunnel sends no junk packets.
+	Tricks *wiresocks.TrickConfig `json:"tricks,omitempty"`
+	// Colo is the cloudflare data center the tunnel's traffic left through
+	// when it was verified.
+	Colo string `json:"colo,omitempty"`
+}
+
+// workingConfig reads the setup in effect on tunnels.
+func workingConfig(mode string, tunnels []tunnel) (WorkingConfig, error) {
+	wc := WorkingConfig{Mode: mode, Time: time.Now()}
+	for _, tun := range tunnels {
+		peers, err := tun.tnet.PeerStatus()
+		if err != nil {
+			return WorkingConfig{}, fmt.Errorf("failed to read %s tunnel status: %w", tun.name, err)
+		}
+
+		for _, peer := range peers {
+			// the device of the inner gool tunnel only knows the local
+			// forwarder, which is of no use in another run
+			if tun.forwarder != nil {
+				peer.Endpoint = tun.forwarder.Dest().String()
+			}
+			wc.Tunnels = append(wc.Tunnels, WorkingTunnel{
+				Name:             tun.name,
+				Endpoint:         peer.Endpoint,
+				Family:           peer.Family(),
+				FallbackEndpoint: peer.FallbackEndpoint,
+				MTU:              tun.mtu,
+				KeepAlive:        peer.KeepAlive,
+				Tricks:           peer.Tricks,
+				Colo:             tun.colo,
+			})
+		}
+	}
+	return wc, nil
+}
+
+// saveWorkingConfig writes wc to the working file in dir.
+func saveWorkingConfig(dir string, wc WorkingConfig) error {
+	data, err := json.MarshalIndent(wc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, workingFile), append(data, '\n'), 0o600)
+}
+
+// LoadWorkingConfig returns the setup of the last session that connected
+// with the identities in dir, or "./stuff" if dir is empty.
+func LoadWorkingConfig(dir string) (WorkingConfig, error) {
+	if dir == "" {
+		dir = identityDir(WarpOptions{})
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, workingFile))
+	if err != nil {
+		return WorkingConfig{}, err
+	}
+
+	var wc WorkingConfig
+	if err := json.Unmarshal(data, &wc); err != nil {
+		return WorkingConfig{}, fmt.Errorf("invalid working config: %w", err)
+	}
+	return wc, nil
+}
@@ -0,0 +1,87 @@
+//go:build !minimal
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/bepass-org/warp-plus/psiphon"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+const cfonUsage = `usage: warp-plus cfon list-countries [flags]
+
+List the countries psiphon mode can exit in.`
+
+const (
+	// countriesMaxAge is how long a fetched psiphon country list is used
+	// before it is fetched again.
+	countriesMaxAge = 24 * time.Hour
+	countriesFetch  = 15 * time.Second
+)
+
+// runCfonCommand implements the "cfon list-countries" subcommand.
+func runCfonCommand(args []string) error {
+	if len(args) < 1 || args[0] != "list-countries" {
+		return errors.New(cfonUsage)
+	}
+
+	fs := ff.NewFlagSet("warp-plus cfon list-countries")
+	var (
+		dir     = fs.String('d', "dir", "./stuff", "directory the fetched country list is kept in")
+		refresh = fs.BoolLong("refresh", "fetch the country list even if the kept one is recent")
+		verbose = fs.Bool('v', "verbose", "enable verbose logging")
+	)
+
+	err := ff.Parse(fs, args[1:], ff.WithEnvVarPrefix("WARP_PLUS"))
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		return nil
+	case err != nil:
+		return err
+	}
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	l := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	maxAge := countriesMaxAge
+	if *refresh {
+		maxAge = 0
+	}
+
+	for _, code := range refreshCountries(l, &http.Client{Timeout: countriesFetch}, *dir, maxAge) {
+		name, ok := psiphon.CountryName(code)
+		if !ok {
+			name = "-"
+		}
+		fmt.Printf("%s\t%s\n", code, name)
+	}
+	return nil
+}
+
+// refreshCountries updates the psiphon country list kept in dir, fetching it
+// with c, see psiphon.RefreshCountries.
+func refreshCountries(l *slog.Logger, c *http.Client, dir string, maxAge time.Duration) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), countriesFetch)
+	defer cancel()
+
+	return psiphon.RefreshCountries(ctx, l, c, dir, maxAge)
+}
+
+// keptCountries returns the psiphon country list kept in dir without
+// fetching it, see psiphon.KeptCountries.
+func keptCountries(l *slog.Logger, dir string) []string {
+	return psiphon.KeptCountries(l, dir)
+}
@@ -0,0 +1,26 @@
+//go:build minimal
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bepass-org/warp-plus/app"
+)
+
+const countriesMaxAge = 24 * time.Hour
+
+// runCfonCommand fails, psiphon isn't included in this build.
+func runCfonCommand([]string) error {
+	return app.ErrNoPsiphon
+}
+
+func refreshCountries(*slog.Logger, *http.Client, string, time.Duration) []string {
+	return nil
+}
+
+func keptCountries(*slog.Logger, string) []string {
+	return nil
+}
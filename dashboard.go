@@ -0,0 +1,43 @@
+//go:build !minimal
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/dashboard"
+)
+
+// serveDashboard serves the dashboard of inst on addr until ctx is done.
+func serveDashboard(ctx context.Context, l *slog.Logger, addr string, inst *app.Instance) {
+	if ap, err := netip.ParseAddrPort(addr); err == nil && !ap.Addr().IsLoopback() {
+		l.Warn("the dashboard has no authentication and anyone who can reach it can control the proxy", "address", addr)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		l.Error("failed to start dashboard", "error", err)
+		return
+	}
+
+	srv := &http.Server{
+		Handler:           dashboard.Handler(l.With("subsystem", "dashboard"), inst),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	l.Info("serving dashboard", "address", "http://"+ln.Addr().String())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		l.Error("dashboard stopped", "error", err)
+	}
+}
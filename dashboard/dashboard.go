@@ -0,0 +1,378 @@
+// Package dashboard serves a small web page and JSON api to watch and
+// control a running warp-plus instance.
+package dashboard
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/app"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+// status is the body of GET /api/status.
+type status struct {
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	Error     string    `json:"error,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+	Endpoints []string  `json:"endpoints,omitempty"`
+	Addresses []string  `json:"addresses,omitempty"`
+	// Country is the psiphon exit country, empty outside psiphon mode.
+	Country string `json:"country,omitempty"`
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+	// Psiphon are the psiphon tunnels, empty outside psiphon mode.
+	Psiphon []psiphonTunnel `json:"psiphon,omitempty"`
+	// PsiphonRxBytes and PsiphonTxBytes are the traffic of all psiphon
+	// tunnels together, psiphon doesn't report it per tunnel.
+	PsiphonRxBytes int64 `json:"psiphon_rx_bytes,omitempty"`
+	PsiphonTxBytes int64 `json:"psiphon_tx_bytes,omitempty"`
+}
+
+// psiphonTunnel is an entry of the psiphon list of GET /api/status.
+type psiphonTunnel struct {
+	Name          string `json:"name"`
+	Country       string `json:"country"`
+	ServerRegion  string `json:"server_region,omitempty"`
+	HTTPProxyPort int    `json:"http_proxy_port,omitempty"`
+}
+
+// client is an entry of the clients list of GET /api/clients. RxBytes went
+// to the client, TxBytes came from it.
+type client struct {
+	Addr        string    `json:"addr"`
+	Active      int       `json:"active"`
+	Connections int       `json:"connections"`
+	RxBytes     uint64    `json:"rx_bytes"`
+	TxBytes     uint64    `json:"tx_bytes"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// connection is an entry of the connections list of GET /api/clients.
+type connection struct {
+	Client      string    `json:"client"`
+	Network     string    `json:"network"`
+	Destination string    `json:"destination"`
+	Started     time.Time `json:"started"`
+	RxBytes     uint64    `json:"rx_bytes"`
+	TxBytes     uint64    `json:"tx_bytes"`
+}
+
+// health is the body of GET /healthz and /readyz.
+type health struct {
+	State     string           `json:"state"`
+	Ready     bool             `json:"ready"`
+	Tunnels   []tunnelHealth   `json:"tunnels"`
+	Listeners []listenerHealth `json:"listeners"`
+	Probe     *app.ProbeResult `json:"probe,omitempty"`
+}
+
+// tunnelHealth is an entry of the tunnels list of health. HandshakeAge is
+// in seconds, -1 if the peer never completed a handshake.
+type tunnelHealth struct {
+	Name         string `json:"name"`
+	Endpoint     string `json:"endpoint,omitempty"`
+	HandshakeAge int64  `json:"handshake_age"`
+	Fresh        bool   `json:"fresh"`
+}
+
+// listenerHealth is an entry of the listeners list of health.
+type listenerHealth struct {
+	Addr  string `json:"addr"`
+	Up    bool   `json:"up"`
+	Error string `json:"error,omitempty"`
+}
+
+// Handler returns the dashboard of inst:
+//
+//	GET  /               the dashboard page
+//	GET  /healthz        200 unless the instance failed or stopped
+//	GET  /readyz         200 if the tunnels and listeners are up
+//	GET  /api/status     state, session and traffic of the instance
+//	GET  /api/clients    traffic of the proxy clients and open connections
+//	GET  /api/countries  the psiphon countries
+//	POST /api/rescan     restart on freshly scanned endpoints
+//	POST /api/country    switch the psiphon country, {"country": "DE"}
+//
+// Requests must name localhost or the address they came in on as their host,
+// see checkHost.
+func Handler(l *slog.Logger, inst *app.Instance) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(indexHTML)
+	})
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+
+		h := inst.Health()
+		code := http.StatusOK
+		if h.State == app.StateFailed || h.State == app.StateStopped {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, healthOf(h))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+
+		h := healthOf(inst.Health())
+		code := http.StatusOK
+		if !h.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, h)
+	})
+
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+
+		st := inst.Status()
+		resp := status{
+			State:     st.State.String(),
+			Since:     st.Since,
+			Mode:      st.Session.Mode,
+			Endpoints: st.Session.Endpoints,
+			Country:   inst.Country(),
+		}
+		if st.Err != nil {
+			resp.Error = st.Err.Error()
+		}
+		for _, addr := range st.Session.Addresses {
+			resp.Addresses = append(resp.Addresses, addr.String())
+		}
+
+		rx, tx, err := inst.Traffic()
+		if err != nil {
+			l.Debug("failed to read tunnel traffic", "error", err)
+		}
+		resp.RxBytes, resp.TxBytes = rx, tx
+
+		for _, p := range inst.Psiphon() {
+			resp.Psiphon = append(resp.Psiphon, psiphonTunnel{
+				Name:          p.Name,
+				Country:       p.Country,
+				ServerRegion:  p.ServerRegion,
+				HTTPProxyPort: p.HTTPProxyPort,
+			})
+		}
+		resp.PsiphonRxBytes, resp.PsiphonTxBytes = inst.PsiphonTraffic()
+
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc("/api/clients", func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+
+		clients, conns := inst.Clients()
+		resp := struct {
+			Clients     []client     `json:"clients"`
+			Connections []connection `json:"connections"`
+		}{
+			Clients:     make([]client, 0, len(clients)),
+			Connections: make([]connection, 0, len(conns)),
+		}
+		for _, c := range clients {
+			resp.Clients = append(resp.Clients, client{
+				Addr:        c.Addr.String(),
+				Active:      c.Active,
+				Connections: c.Connections,
+				RxBytes:     c.RxBytes,
+				TxBytes:     c.TxBytes,
+				LastSeen:    c.LastSeen,
+			})
+		}
+		for _, c := range conns {
+			resp.Connections = append(resp.Connections, connection{
+				Client:      c.Client.String(),
+				Network:     c.Network,
+				Destination: c.Destination,
+				Started:     c.Started,
+				RxBytes:     c.RxBytes,
+				TxBytes:     c.TxBytes,
+			})
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc("/api/countries", func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, app.PsiphonCountries())
+	})
+
+	mux.HandleFunc("/api/rescan", func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodPost) {
+			return
+		}
+
+		l.Info("dashboard: rescanning")
+		if err := inst.Rescan(); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/api/rekey", func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodPost) {
+			return
+		}
+
+		l.Info("dashboard: rotating keys")
+		if err := inst.Rekey(); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/api/country", func(w http.ResponseWriter, r *http.Request) {
+		if !allow(w, r, http.MethodPost) {
+			return
+		}
+
+		var req struct {
+			Country string `json:"country"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+
+		l.Info("dashboard: switching psiphon country", "country", req.Country)
+		if err := inst.SwitchCountry(req.Country); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return checkHost(mux)
+}
+
+// checkHost answers 403 to requests whose Host isn't localhost, a loopback
+// address or the address they came in on. Pages of other sites could reach
+// the dashboard otherwise by pointing their own name at its address, which
+// the browser then treats as the same site.
+func checkHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowedHost(r) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func allowedHost(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return false
+	}
+	if addr.IsLoopback() {
+		return true
+	}
+
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	ap, err := netip.ParseAddrPort(local.String())
+	return err == nil && ap.Addr().Unmap() == addr.Unmap()
+}
+
+// healthOf returns the body of the health endpoints for h.
+func healthOf(h app.Health) health {
+	resp := health{
+		State:     h.State.String(),
+		Ready:     h.Ready,
+		Tunnels:   make([]tunnelHealth, 0, len(h.Tunnels)),
+		Listeners: make([]listenerHealth, 0, len(h.Listeners)),
+		Probe:     h.Probe,
+	}
+	for _, t := range h.Tunnels {
+		age := int64(-1)
+		if t.HandshakeAge >= 0 {
+			age = int64(t.HandshakeAge / time.Second)
+		}
+		resp.Tunnels = append(resp.Tunnels, tunnelHealth{
+			Name:         t.Name,
+			Endpoint:     t.Endpoint,
+			HandshakeAge: age,
+			Fresh:        t.Fresh,
+		})
+	}
+	for _, ln := range h.Listeners {
+		resp.Listeners = append(resp.Listeners, listenerHealth{
+			Addr:  ln.Addr.String(),
+			Up:    ln.Up,
+			Error: ln.Error,
+		})
+	}
+	return resp
+}
+
+// allow reports whether r uses method, answering 405 if it doesn't. Posts
+// must be JSON, which browsers don't send cross site without a preflight
+// the dashboard never answers.
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	if method == http.MethodPost && !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, app.ErrStopped) {
+		code = http.StatusConflict
+	}
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,63 @@
+package dashboard
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/app"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestHandler(t *testing.T) {
+	h := Handler(slog.New(slog.NewTextHandler(io.Discard, nil)), new(app.Instance))
+
+	// serve sends a request to h as if it came in on local.
+	serve := func(method, host, path, contentType string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		r.Host = host
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		local := &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 8087}
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, host := range []string{"localhost:8087", "127.0.0.1:8087", "[::1]:8087", "192.168.1.2:8087", "192.168.1.2"} {
+		w := serve(http.MethodGet, host, "/api/status", "")
+		qt.Check(t, w.Code, qt.Equals, http.StatusOK, qt.Commentf("host %s", host))
+	}
+
+	// names other than localhost may have been pointed at the dashboard by
+	// any site, and so may other addresses
+	for _, host := range []string{"attacker.example:8087", "192.168.1.3:8087", ""} {
+		w := serve(http.MethodGet, host, "/api/status", "")
+		qt.Check(t, w.Code, qt.Equals, http.StatusForbidden, qt.Commentf("host %s", host))
+	}
+	qt.Assert(t, serve(http.MethodGet, "attacker.example", "/", "").Code, qt.Equals, http.StatusForbidden)
+
+	w := serve(http.MethodGet, "localhost", "/", "")
+	qt.Assert(t, w.Code, qt.Equals, http.StatusOK)
+	qt.Assert(t, w.Header().Get("Content-Type"), qt.Equals, "text/html; charset=utf-8")
+
+	w = serve(http.MethodPost, "localhost", "/api/status", "application/json")
+	qt.Assert(t, w.Code, qt.Equals, http.StatusMethodNotAllowed)
+	qt.Assert(t, w.Header().Get("Allow"), qt.Equals, http.MethodGet)
+
+	// posts that aren't JSON could come from forms of other sites
+	w = serve(http.MethodPost, "localhost", "/api/country", "text/plain")
+	qt.Assert(t, w.Code, qt.Equals, http.StatusUnsupportedMediaType)
+
+	// the instance hasn't started, so it isn't ready
+	qt.Assert(t, serve(http.MethodGet, "localhost", "/readyz", "").Code, qt.Equals, http.StatusServiceUnavailable)
+}
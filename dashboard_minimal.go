@@ -0,0 +1,16 @@
+//go:build minimal
+
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/bepass-org/warp-plus/app"
+)
+
+// serveDashboard only reports the dashboard is missing, it isn't included in
+// this build.
+func serveDashboard(_ context.Context, l *slog.Logger, _ string, _ *app.Instance) {
+	l.Error("the dashboard is not included in this build")
+}
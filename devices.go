@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+const devicesUsage = `usage: warp-plus devices <list|prune> [flags]
+
+List the devices bound to the warp account of an identity, or remove the
+leftover registrations of warp-plus runs that failed or were reset.`
+
+// runDevicesCommand implements the "devices list" and "devices prune"
+// subcommands.
+func runDevicesCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New(devicesUsage)
+	}
+
+	fs := ff.NewFlagSet("warp-plus devices " + args[0])
+	var (
+		dir     = fs.String('d', "dir", "./stuff/primary", "identity directory whose account is used")
+		profile = fs.StringLong("profile", "", "profile whose primary identity is used, in place of --dir")
+		jsonOut = fs.BoolLong("json", "print the devices as JSON")
+		minAge  = fs.DurationLong("min-age", 24*time.Hour, "only prune devices registered at least this long ago")
+		keep    = fs.StringListLong("keep", "id of a device never to prune, besides the local identities (repeatable)")
+		yes     = fs.BoolLong("yes", "remove the devices prune finds, which it only prints without it")
+	)
+
+	err := ff.Parse(fs, args[1:], ff.WithEnvVarPrefix("WARP_PLUS"))
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if *dir, err = primaryDir(*profile, *dir); err != nil {
+		return err
+	}
+
+	i, err := warp.LoadIdentity(*dir)
+	if err != nil {
+		return err
+	}
+
+	l := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	devices, err := warp.ListDevices(context.Background(), l, i.ID, i.Token)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		account, err := warp.GetAccount(context.Background(), l, i.ID, i.Token)
+		if err != nil {
+			return err
+		}
+		return printDevices(account, devices, i.ID, *jsonOut)
+	case "prune":
+		kept := append(localDeviceIDs(filepath.Dir(*dir)), i.ID)
+		kept = append(kept, *keep...)
+		stale := warp.StaleDevices(devices, kept, *minAge, time.Now())
+		if len(stale) == 0 {
+			fmt.Fprintf(os.Stderr, "no stale devices among the %d of the account\n", len(devices))
+			return nil
+		}
+
+		if !*yes {
+			for _, d := range stale {
+				fmt.Printf("%s\tregistered %s\n", d.ID, d.Created)
+			}
+			fmt.Fprintf(os.Stderr, "%d stale devices, run again with --yes to remove them\n", len(stale))
+			return nil
+		}
+
+		for _, d := range stale {
+			if err := warp.RemoveBoundDevice(context.Background(), l, i.ID, i.Token, d.ID); err != nil {
+				return err
+			}
+			fmt.Printf("removed %s\tregistered %s\n", d.ID, d.Created)
+		}
+	default:
+		return errors.New(devicesUsage)
+	}
+
+	return nil
+}
+
+// printDevices prints the quota of account and its devices, marking self.
+func printDevices(account warp.IdentityAccount, devices []warp.Device, self string, jsonOut bool) error {
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			AccountType string        `json:"account_type"`
+			PremiumData int64         `json:"premium_data"`
+			Quota       int64         `json:"quota"`
+			Usage       int64         `json:"usage"`
+			Devices     []warp.Device `json:"devices"`
+		}{account.AccountType, account.PremiumData, account.Quota, account.Usage, devices})
+	}
+
+	fmt.Printf("account type: %s, premium data: %d, quota: %d, usage: %d\n\n", account.AccountType, account.PremiumData, account.Quota, account.Usage)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tMODEL\tNAME\tROLE\tACTIVE\tCREATED")
+	for _, d := range devices {
+		id := d.ID
+		if id == self {
+			id += " (this)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\t%s\n", id, d.Type, d.Model, d.Name, d.Role, d.Active, d.Created)
+	}
+	return w.Flush()
+}
+
+// localDeviceIDs returns the device ids of the identities in dir and of
+// every profile, which prune never removes.
+func localDeviceIDs(dir string) []string {
+	dirs := []string{dir}
+	if names, err := warp.Profiles("./stuff"); err == nil {
+		for _, name := range names {
+			if pdir, err := profileDir(name); err == nil {
+				dirs = append(dirs, pdir)
+			}
+		}
+	}
+
+	var ids []string
+	for _, dir := range dirs {
+		for _, identity := range []string{"primary", "secondary"} {
+			if i, err := warp.LoadIdentity(filepath.Join(dir, identity)); err == nil {
+				ids = append(ids, i.ID)
+			}
+		}
+	}
+	return ids
+}
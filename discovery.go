@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// discoveryPath is where the proxy addresses are written when a bind address
+// asks for a random port, so wrapper scripts and GUIs can find the proxy.
+const discoveryPath = "./stuff/proxy-address"
+
+// hasRandomPort reports whether any of addrs asks for a random port.
+func hasRandomPort(addrs []netip.AddrPort) bool {
+	for _, addr := range addrs {
+		if addr.Port() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDiscovery writes addrs to the discovery file, one per line, and prints
+// a "WARP_PLUS_PROXY=<address>" line for each to stdout.
+func writeDiscovery(addrs []netip.AddrPort) error {
+	var b strings.Builder
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, "%s\n", addr)
+		fmt.Printf("WARP_PLUS_PROXY=%s\n", addr)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(discoveryPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so readers never see a partial file
+	tmp := discoveryPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, discoveryPath)
+}
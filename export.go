@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/bepass-org/warp-plus/warp"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+// runExportCommand implements the "export" subcommand, which prints the
+// wireguard profile of an identity for use with the official WireGuard apps.
+func runExportCommand(args []string) error {
+	fs := ff.NewFlagSet("warp-plus export")
+	var (
+		file    = fs.String('f', "file", "", "write the profile to this file instead of stdout")
+		dir     = fs.String('d', "dir", "./stuff/primary", "identity directory")
+		profile = fs.StringLong("profile", "", "profile whose primary identity is exported, in place of --dir")
+	)
+
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("WARP_PLUS"))
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if *dir, err = primaryDir(*profile, *dir); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return warp.ExportProfile(*dir, os.Stdout)
+	}
+
+	f, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if err := warp.ExportProfile(*dir, f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/bepass-org/warp-plus/warp"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+const identityUsage = `usage: warp-plus identity <export|import|restore|enroll> [flags]
+
+Move a registered warp identity between machines without registering a new device,
+restore one of the backups taken before an identity is replaced, or enroll a device
+in a Cloudflare Zero Trust organization.`
+
+// runIdentityCommand implements the "identity export", "identity import",
+// "identity restore" and "identity enroll" subcommands.
+func runIdentityCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New(identityUsage)
+	}
+
+	fs := ff.NewFlagSet("warp-plus identity " + args[0])
+	var (
+		file     = fs.String('f', "file", "", "path of the identity bundle")
+		dir      = fs.String('d', "dir", "./stuff/primary", "identity directory")
+		profile  = fs.StringLong("profile", "", "profile whose primary identity is used, in place of --dir")
+		password = fs.String('p', "password", "", "encrypt or decrypt the bundle with this password")
+		backup   = fs.String('b', "backup", "", "backup to restore, default the newest")
+		list     = fs.BoolLong("list", "list the backups instead of restoring one")
+		team     = fs.StringLong("team", "", "zero trust team name to enroll in, as in <team>.cloudflareaccess.com")
+		token    = fs.StringLong("token", "", "enrollment token from the team login page, or the com.cloudflare.warp:// link it opens")
+	)
+
+	err := ff.Parse(fs, args[1:], ff.WithEnvVarPrefix("WARP_PLUS"))
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if *dir, err = primaryDir(*profile, *dir); err != nil {
+		return err
+	}
+
+	if *file == "" && (args[0] == "export" || args[0] == "import") {
+		return errors.New("must provide the bundle file with --file")
+	}
+
+	switch args[0] {
+	case "export":
+		f, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+
+		if err := warp.ExportIdentity(*dir, f, *password); err != nil {
+			f.Close()
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "identity in %s exported to %s\n", *dir, *file)
+	case "import":
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := warp.ImportIdentity(*dir, f, *password); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "identity from %s imported into %s\n", *file, *dir)
+	case "restore":
+		if *list {
+			backups, err := warp.Backups(*dir)
+			if err != nil {
+				return err
+			}
+			for _, name := range backups {
+				fmt.Println(name)
+			}
+			return nil
+		}
+
+		name, err := warp.RestoreIdentity(*dir, *backup)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "identity in %s restored from backup %s\n", *dir, name)
+	case "enroll":
+		if *team == "" {
+			return errors.New("must provide the zero trust team name with --team")
+		}
+		if *token == "" {
+			return fmt.Errorf("must provide an enrollment token with --token: log in at %s and copy the token, or the link of the \"Open Cloudflare WARP\" button", warp.TeamEnrollURL(*team))
+		}
+
+		jwt, err := warp.ParseTeamToken(*token)
+		if err != nil {
+			return err
+		}
+
+		l := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+		i, err := warp.EnrollTeam(context.Background(), l, *dir, *team, jwt)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "device %s enrolled in team %s, identity saved to %s\n", i.ID, *team, *dir)
+	default:
+		return errors.New(identityUsage)
+	}
+
+	return nil
+}
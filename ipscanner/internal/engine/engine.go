@@ -2,34 +2,114 @@ package engine
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner/internal/iterator"
 	"github.com/bepass-org/warp-plus/ipscanner/internal/ping"
 	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+	"golang.org/x/time/rate"
 )
 
+const (
+	// expireInterval is how often a full queue is checked for expired IPs.
+	expireInterval = 200 * time.Millisecond
+	// maxBatchSize bounds the number of IPs generated at once.
+	maxBatchSize = 256
+	// generateRetryDelay is how long to wait after a transient error
+	// generating IPs.
+	generateRetryDelay = 2 * time.Second
+)
+
+// errAllSkipped is returned when a batch only had excluded or bad IPs. More
+// rounds may find scannable IPs, so it is not fatal.
+var errAllSkipped = errors.New("all generated IPs are excluded or known to be bad")
+
 type Engine struct {
-	generator *iterator.IpGenerator
-	ipQueue   *IPQueue
-	ping      func(netip.Addr) (statute.IPInfo, error)
-	log       *slog.Logger
+	generator   *iterator.IpGenerator
+	genErr      error // why generator is nil
+	ipQueue     *IPQueue
+	ping        func(netip.Addr) (statute.IPInfo, error)
+	log         *slog.Logger
+	concurrency int
+	limiter     *rate.Limiter
+	failures    *failureAggregator
+	// pinged and succeeded count pings to estimate the success rate batches
+	// are sized by
+	pinged    atomic.Int64
+	succeeded atomic.Int64
+	// started and rtts are kept for the summary of the scan
+	started atomic.Value
+	rtts    rttSamples
+	// seeds are pinged before the generated IPs
+	seeds []netip.Addr
+	// ports counts the successful pings per prefix and port
+	ports *portStats
+	// exclude and bad are skipped when generating IPs
+	exclude   []netip.Prefix
+	bad       *badIPs
+	statePath string
 }
 
 func NewScannerEngine(opts *statute.ScannerOptions) *Engine {
 	queue := NewIPQueue(opts)
+	ports := newPortStats(opts.CidrList)
 
 	p := ping.Ping{
-		Options: opts,
+		Options:   opts,
+		WarpPorts: ports.Ports,
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
 	}
-	return &Engine{
-		ipQueue:   queue,
-		ping:      p.DoPing,
-		generator: iterator.NewIterator(opts),
-		log:       opts.Logger.With(slog.String("subsystem", "scanner/engine")),
+
+	// a non-positive rate disables rate limiting
+	limit := rate.Inf
+	if opts.PingRate > 0 {
+		limit = rate.Limit(opts.PingRate)
+	}
+
+	generator, genErr := iterator.NewIterator(opts)
+
+	l := opts.Logger.With(slog.String("subsystem", "scanner/engine"))
+	e := &Engine{
+		ipQueue:     queue,
+		ping:        p.DoPing,
+		generator:   generator,
+		genErr:      genErr,
+		log:         l,
+		concurrency: concurrency,
+		limiter:     rate.NewLimiter(limit, concurrency),
+		failures:    newFailureAggregator(l),
+		exclude:     opts.ExcludeList,
+		seeds:       seedIPs(opts),
+		bad:         newBadIPs(nil),
+		ports:       ports,
+		statePath:   opts.StatePath,
 	}
+
+	if e.statePath != "" {
+		state, err := loadState(e.statePath)
+		if err != nil {
+			l.Warn("failed to load scan state, starting from scratch", "error", err)
+		} else {
+			if e.generator != nil {
+				restored := e.generator.Restore(state.Iterator)
+				l.Debug("restored scan state", "ranges", restored, "bad_ips", len(state.BadIPs))
+			}
+			e.bad = newBadIPs(state.BadIPs)
+			e.ports.restore(state.Ports)
+		}
+	}
+
+	return e
 }
 
 func (e *Engine) GetAvailableIPs(desc bool) []statute.IPInfo {
@@ -39,38 +119,196 @@ func (e *Engine) GetAvailableIPs(desc bool) []statute.IPInfo {
 	return nil
 }
 
-func (e *Engine) Run(ctx context.Context) {
+// Run scans until ctx is done, which returns nil, or the IPs to scan run out,
+// which returns an error wrapping iterator.ErrExhausted.
+func (e *Engine) Run(ctx context.Context) error {
+	if e.generator == nil {
+		return fmt.Errorf("can't generate IPs: %w", e.genErr)
+	}
+
+	e.started.Store(time.Now())
+	ips := make(chan netip.Addr)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e.failures.Run(ctx, failureReportInterval)
+	}()
+	for i := 0; i < e.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.worker(ctx, ips)
+		}()
+	}
+	defer func() {
+		close(ips)
+		wg.Wait()
+		e.saveState()
+	}()
+
+	if seeds := e.seedBatch(); len(seeds) > 0 {
+		e.log.Debug("pinging seed IPs", "size", len(seeds))
+		for _, ip := range seeds {
+			select {
+			case <-ctx.Done():
+				return nil
+			case ips <- ip:
+			}
+		}
+	}
+
+	lastSave := time.Now()
 	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-e.ipQueue.available:
-			e.log.Debug("Started new scanning round")
-			batch, err := e.generator.NextBatch()
-			if err != nil {
-				e.log.Error("Error while generating IP: %v", err)
-				// in case of disastrous error, to prevent resource draining wait for 2 seconds and try again
-				time.Sleep(2 * time.Second)
-				continue
+		// block instead of scanning IPs the queue has no room for
+		if err := e.ipQueue.WaitForSpace(ctx, expireInterval); err != nil {
+			return nil
+		}
+
+		batch, err := e.nextBatch(e.batchSize())
+		if errors.Is(err, iterator.ErrExhausted) {
+			e.log.Error("no IPs left to scan", "error", err)
+			return fmt.Errorf("can't generate IPs: %w", err)
+		}
+		if err != nil {
+			e.log.Warn("failed to generate IPs, retrying", "error", err, "delay", generateRetryDelay)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(generateRetryDelay):
+			}
+			continue
+		}
+
+		e.log.Debug("Started new scanning round", "size", len(batch))
+		for _, ip := range batch {
+			select {
+			case <-ctx.Done():
+				return nil
+			case ips <- ip:
+			}
+		}
+
+		if time.Since(lastSave) > stateSaveInterval {
+			e.saveState()
+			lastSave = time.Now()
+		}
+	}
+}
+
+// saveState saves the scan position and the bad IPs to the state file, if
+// enabled. Nothing is saved if no ping succeeded, as the network itself is
+// then more likely at fault than the IPs.
+func (e *Engine) saveState() {
+	if e.statePath == "" || e.succeeded.Load() == 0 {
+		return
+	}
+
+	state := scanState{Iterator: e.generator.State(), BadIPs: e.bad.List(), Ports: e.ports.List()}
+	if err := saveState(e.statePath, state); err != nil {
+		e.log.Warn("failed to save scan state", "error", err)
+	}
+}
+
+// seedIPs returns the seed IPs of opts of the enabled IP versions.
+func seedIPs(opts *statute.ScannerOptions) []netip.Addr {
+	var seeds []netip.Addr
+	for _, ip := range opts.SeedIPs {
+		if ip.Is4() && opts.UseIPv4 || ip.Is6() && opts.UseIPv6 {
+			seeds = append(seeds, ip)
+		}
+	}
+	return seeds
+}
+
+// seedBatch returns the seed IPs that are not skipped.
+func (e *Engine) seedBatch() []netip.Addr {
+	var batch []netip.Addr
+	for _, ip := range e.seeds {
+		if !e.skip(ip) {
+			batch = append(batch, ip)
+		}
+	}
+	return batch
+}
+
+// skip reports whether ip is excluded or known to be bad.
+func (e *Engine) skip(ip netip.Addr) bool {
+	if e.bad.Contains(ip) {
+		return true
+	}
+	for _, prefix := range e.exclude {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// batchSize estimates how many IPs must be pinged to fill the free slots of
+// the queue, from the share of pings that succeeded so far. Small batches
+// near a full queue avoid pinging IPs that would be discarded.
+func (e *Engine) batchSize() int {
+	free := max(e.ipQueue.Free(), 1)
+
+	// add one to both counts so the estimate starts at 1 and never divides
+	// by zero
+	pinged, succeeded := e.pinged.Load()+1, e.succeeded.Load()+1
+	n := int(int64(free) * pinged / succeeded)
+
+	return min(max(n, 1), maxBatchSize)
+}
+
+// nextBatch generates at least n IPs that are not skipped, in whole rounds
+// over the ranges.
+func (e *Engine) nextBatch(n int) ([]netip.Addr, error) {
+	var batch []netip.Addr
+	// bound the rounds in case most IPs are skipped
+	for rounds := 0; len(batch) < n && rounds < maxBatchSize; rounds++ {
+		round, err := e.generator.NextBatch()
+		if err != nil {
+			if len(batch) > 0 {
+				return batch, nil
 			}
-			for _, ip := range batch {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					e.log.Debug("pinging IP", "addr", ip)
-					if ipInfo, err := e.ping(ip); err == nil {
-						e.log.Debug("ping success", "addr", ipInfo.AddrPort, "rtt", ipInfo.RTT)
-						e.ipQueue.Enqueue(ipInfo)
-					} else {
-						e.log.Error("ping error", "addr", ip, "error", err)
-					}
-				}
+			return nil, err
+		}
+		for _, ip := range round {
+			if !e.skip(ip) {
+				batch = append(batch, ip)
 			}
-		default:
-			e.log.Debug("calling expire")
-			e.ipQueue.Expire()
-			time.Sleep(200 * time.Millisecond)
+		}
+	}
+	if len(batch) == 0 {
+		return nil, errAllSkipped
+	}
+	return batch, nil
+}
+
+// worker pings the IPs it receives until ips is closed or ctx is canceled.
+// Every ping waits on the shared limiter so the total ping rate stays bounded
+// regardless of the number of workers.
+func (e *Engine) worker(ctx context.Context, ips <-chan netip.Addr) {
+	for ip := range ips {
+		if err := e.limiter.Wait(ctx); err != nil {
+			return
+		}
+
+		e.log.Debug("pinging IP", "addr", ip)
+		e.pinged.Add(1)
+		if ipInfo, err := e.ping(ip); err == nil {
+			e.succeeded.Add(1)
+			e.generator.Record(ip, ipInfo.RTT, true)
+			e.bad.Remove(ip)
+			e.ports.Add(ipInfo.AddrPort)
+			e.rtts.Add(ipInfo.RTT)
+			e.log.Debug("ping success", "addr", ipInfo.AddrPort, "rtt", ipInfo.RTT, "jitter", ipInfo.Jitter, "loss", ipInfo.Loss)
+			e.ipQueue.Enqueue(ipInfo)
+		} else {
+			e.log.Debug("ping error", "addr", ip, "error", err)
+			e.failures.Add(ip, err)
+			e.generator.Record(ip, 0, false)
+			e.bad.Add(ip)
 		}
 	}
 }
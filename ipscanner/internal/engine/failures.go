@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+)
+
+// pingErrors counts ping failures by error kind for the lifetime of the process.
+// It is exposed through expvar (/debug/vars) under "scanner_ping_errors".
+var pingErrors = expvar.NewMap("scanner_ping_errors")
+
+const failureReportInterval = 10 * time.Second
+
+type failureKey struct {
+	prefix netip.Prefix
+	kind   string
+}
+
+// failureAggregator collects ping failures and periodically logs one summary
+// line per prefix and error kind instead of one line per failed ping.
+type failureAggregator struct {
+	mu     sync.Mutex
+	counts map[failureKey]int
+	// totals counts the failures by kind since the start, for the summary
+	totals map[string]int64
+	log    *slog.Logger
+}
+
+func newFailureAggregator(l *slog.Logger) *failureAggregator {
+	return &failureAggregator{
+		counts: make(map[failureKey]int),
+		totals: make(map[string]int64),
+		log:    l,
+	}
+}
+
+// Add records a failed ping of ip.
+func (f *failureAggregator) Add(ip netip.Addr, err error) {
+	kind := classifyPingError(err)
+	pingErrors.Add(kind, 1)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.counts[failureKey{prefix: aggregatePrefix(ip), kind: kind}]++
+	f.totals[kind]++
+}
+
+// Totals returns the number of failures by kind since the start.
+func (f *failureAggregator) Totals() map[string]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return maps.Clone(f.totals)
+}
+
+// Run flushes the collected failures every interval until ctx is canceled.
+func (f *failureAggregator) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			f.Flush(interval)
+			return
+		case <-t.C:
+			f.Flush(interval)
+		}
+	}
+}
+
+// Flush logs and resets the failures collected so far.
+func (f *failureAggregator) Flush(interval time.Duration) {
+	f.mu.Lock()
+	counts := f.counts
+	f.counts = make(map[failureKey]int)
+	f.mu.Unlock()
+
+	keys := make([]failureKey, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].prefix != keys[j].prefix {
+			return keys[i].prefix.Addr().Less(keys[j].prefix.Addr())
+		}
+		return keys[i].kind < keys[j].kind
+	})
+
+	for _, k := range keys {
+		f.log.Warn("ping failures", "prefix", k.prefix, "error", k.kind, "count", counts[k], "interval", interval)
+	}
+}
+
+// aggregatePrefix returns the /24 (IPv4) or /64 (IPv6) network containing ip.
+func aggregatePrefix(ip netip.Addr) netip.Prefix {
+	bits := 64
+	if ip.Is4() {
+		bits = 24
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix
+}
+
+// classifyPingError maps a ping error to a short, stable kind used as a
+// counter name.
+func classifyPingError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, statute.ErrSPKIPinMismatch):
+		return "pin_mismatch"
+	case errors.Is(err, statute.ErrRTTBudget):
+		return "rtt_budget"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/bepass-org/warp-plus/warp"
+)
+
+// maxPortWeight bounds how many times more often a port that worked in a
+// prefix is picked than one that didn't.
+const maxPortWeight = 8
+
+// prefixPorts is how many pings into a prefix succeeded on each port.
+type prefixPorts struct {
+	Prefix netip.Prefix   `json:"prefix"`
+	Ports  map[uint16]int `json:"ports"`
+}
+
+// portStats counts the successful pings per scanned prefix and port, so later
+// pings into a prefix, in this run or the next, favor the ports that got
+// through before.
+type portStats struct {
+	mu       sync.Mutex
+	prefixes []netip.Prefix
+	ok       map[netip.Prefix]map[uint16]int
+}
+
+func newPortStats(prefixes []netip.Prefix) *portStats {
+	return &portStats{prefixes: prefixes, ok: make(map[netip.Prefix]map[uint16]int)}
+}
+
+// restore adds the saved counts of the prefixes that are still scanned.
+func (s *portStats) restore(saved []prefixPorts) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range saved {
+		if slices.Contains(s.prefixes, p.Prefix) && len(p.Ports) > 0 {
+			s.ok[p.Prefix] = p.Ports
+		}
+	}
+}
+
+// prefix returns the scanned prefix ip is in.
+func (s *portStats) prefix(ip netip.Addr) (netip.Prefix, bool) {
+	for _, p := range s.prefixes {
+		if p.Contains(ip) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Add records a successful ping of addr.
+func (s *portStats) Add(addr netip.AddrPort) {
+	p, ok := s.prefix(addr.Addr())
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ok[p] == nil {
+		s.ok[p] = make(map[uint16]int)
+	}
+	s.ok[p][addr.Port()]++
+}
+
+// Ports returns ports, the built-in warp ports if empty, with every port that
+// worked in the prefix of ip repeated by how often it did, so a uniform pick
+// favors it while still trying the others.
+func (s *portStats) Ports(ip netip.Addr, ports []uint16) []uint16 {
+	if len(ports) == 0 {
+		ports = warp.WarpPorts()
+	}
+	p, ok := s.prefix(ip)
+	if !ok {
+		return ports
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hits := s.ok[p]
+	if len(hits) == 0 {
+		return ports
+	}
+
+	weighted := make([]uint16, 0, len(ports))
+	for _, port := range ports {
+		for i := 0; i < 1+min(hits[port], maxPortWeight-1); i++ {
+			weighted = append(weighted, port)
+		}
+	}
+	return weighted
+}
+
+// List returns the counts to save, by prefix.
+func (s *portStats) List() []prefixPorts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]prefixPorts, 0, len(s.ok))
+	for _, p := range s.prefixes {
+		if hits := s.ok[p]; len(hits) > 0 {
+			list = append(list, prefixPorts{Prefix: p, Ports: maps.Clone(hits)})
+		}
+	}
+	return list
+}
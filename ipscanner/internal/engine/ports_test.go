@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestPortStats(t *testing.T) {
+	prefix := netip.MustParsePrefix("162.159.192.0/24")
+	s := newPortStats([]netip.Prefix{prefix})
+
+	ip := netip.MustParseAddr("162.159.192.7")
+	ports := []uint16{500, 854, 2408}
+	qt.Assert(t, s.Ports(ip, ports), qt.DeepEquals, ports)
+
+	s.Add(netip.AddrPortFrom(netip.MustParseAddr("162.159.192.1"), 854))
+	s.Add(netip.AddrPortFrom(netip.MustParseAddr("162.159.192.2"), 854))
+	// outside the scanned prefixes
+	s.Add(netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), 500))
+
+	qt.Assert(t, s.Ports(ip, ports), qt.DeepEquals, []uint16{500, 854, 854, 854, 2408})
+	qt.Assert(t, s.Ports(netip.MustParseAddr("192.0.2.1"), ports), qt.DeepEquals, ports)
+
+	for i := 0; i < 20; i++ {
+		s.Add(netip.AddrPortFrom(ip, 2408))
+	}
+	weighted := s.Ports(ip, ports)
+	qt.Assert(t, weighted, qt.HasLen, 1+3+maxPortWeight)
+
+	// the counts survive a restart of the scan
+	path := filepath.Join(t.TempDir(), "state.json")
+	qt.Assert(t, saveState(path, scanState{Ports: s.List()}), qt.IsNil)
+	state, err := loadState(path)
+	qt.Assert(t, err, qt.IsNil)
+
+	restored := newPortStats([]netip.Prefix{prefix})
+	restored.restore(state.Ports)
+	qt.Assert(t, restored.Ports(ip, ports), qt.DeepEquals, weighted)
+
+	// unless the prefix is no longer scanned
+	other := newPortStats([]netip.Prefix{netip.MustParsePrefix("188.114.96.0/24")})
+	other.restore(state.Ports)
+	qt.Assert(t, other.List(), qt.HasLen, 0)
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"log/slog"
 	"sort"
 	"sync"
@@ -13,12 +14,15 @@ type IPQueue struct {
 	queue        []statute.IPInfo
 	maxQueueSize int
 	mu           sync.Mutex
-	available    chan struct{}
+	space        chan struct{} // signalled when the queue leaves ideal mode
 	maxTTL       time.Duration
 	rttThreshold time.Duration
 	inIdealMode  bool
 	log          *slog.Logger
 	reserved     statute.IPInfQueue
+	// dualStack limits the IPs of either family in a full queue to half of
+	// it, see evict
+	dualStack bool
 }
 
 func NewIPQueue(opts *statute.ScannerOptions) *IPQueue {
@@ -28,9 +32,10 @@ func NewIPQueue(opts *statute.ScannerOptions) *IPQueue {
 		maxQueueSize: opts.IPQueueSize,
 		maxTTL:       opts.IPQueueTTL,
 		rttThreshold: opts.MaxDesirableRTT,
-		available:    make(chan struct{}, opts.IPQueueSize),
+		space:        make(chan struct{}, 1),
 		log:          opts.Logger.With(slog.String("subsystem", "engine/queue")),
 		reserved:     reserved,
+		dualStack:    opts.UseIPv4 && opts.UseIPv6,
 	}
 }
 
@@ -46,13 +51,15 @@ func (q *IPQueue) Enqueue(info statute.IPInfo) bool {
 				"created", ipInfo.CreatedAt,
 				"addr", ipInfo.AddrPort,
 				"rtt", ipInfo.RTT,
+				"jitter", ipInfo.Jitter,
+				"loss", ipInfo.Loss,
 			)
 		}
 	}()
 
-	q.log.Debug("Enqueue: Sorting queue by RTT")
+	q.log.Debug("Enqueue: Sorting queue by score")
 	sort.Slice(q.queue, func(i, j int) bool {
-		return q.queue[i].RTT < q.queue[j].RTT
+		return q.queue[i].Score() < q.queue[j].Score()
 	})
 
 	if len(q.queue) == 0 {
@@ -63,12 +70,12 @@ func (q *IPQueue) Enqueue(info statute.IPInfo) bool {
 
 	if info.RTT <= q.rttThreshold {
 		q.log.Debug("Enqueue: the new item's RTT is less than at least one of the members.")
-		if len(q.queue) >= q.maxQueueSize && info.RTT < q.queue[len(q.queue)-1].RTT {
-			q.log.Debug("Enqueue: the queue is full, remove the item with the highest RTT.")
-			q.queue = q.queue[:len(q.queue)-1]
-		} else if len(q.queue) < q.maxQueueSize {
+		if len(q.queue) >= q.maxQueueSize && q.evict(info) {
+			q.log.Debug("Enqueue: the queue is full, removed an item with a higher score.")
+		}
+		if len(q.queue) < q.maxQueueSize {
 			q.log.Debug("Enqueue: Insert the new item in a sorted position.")
-			index := sort.Search(len(q.queue), func(i int) bool { return q.queue[i].RTT > info.RTT })
+			index := sort.Search(len(q.queue), func(i int) bool { return q.queue[i].Score() > info.Score() })
 			q.queue = append(q.queue[:index], append([]statute.IPInfo{info}, q.queue[index:]...)...)
 		} else {
 			q.log.Debug("Enqueue: The Queue is full but we keep the new item in the reserved queue.")
@@ -95,6 +102,36 @@ func (q *IPQueue) Enqueue(info statute.IPInfo) bool {
 	return true
 }
 
+// evict makes room in the full, sorted queue for info by removing the item
+// with the highest score of the same IP family, if info scores lower. When
+// scanning both families, an item of the other family makes room instead
+// while the family of info holds less than half of the queue, so IPs of the
+// faster family can't crowd out those of the slower one. q.mu must be held.
+func (q *IPQueue) evict(info statute.IPInfo) bool {
+	is4 := info.AddrPort.Addr().Unmap().Is4()
+
+	same := 0
+	for _, member := range q.queue {
+		if member.AddrPort.Addr().Unmap().Is4() == is4 {
+			same++
+		}
+	}
+	// evict the worst member of the other family, or of the same one
+	evictSame := !q.dualStack || same >= (q.maxQueueSize+1)/2
+
+	for i := len(q.queue) - 1; i >= 0; i-- {
+		if (q.queue[i].AddrPort.Addr().Unmap().Is4() == is4) != evictSame {
+			continue
+		}
+		if evictSame && info.Score() >= q.queue[i].Score() {
+			return false
+		}
+		q.queue = append(q.queue[:i], q.queue[i+1:]...)
+		return true
+	}
+	return false
+}
+
 func (q *IPQueue) Dequeue() (statute.IPInfo, bool) {
 	defer func() {
 		q.log.Debug("queue change", "len", len(q.queue))
@@ -104,6 +141,8 @@ func (q *IPQueue) Dequeue() (statute.IPInfo, bool) {
 				"created", ipInfo.CreatedAt,
 				"addr", ipInfo.AddrPort,
 				"rtt", ipInfo.RTT,
+				"jitter", ipInfo.Jitter,
+				"loss", ipInfo.Loss,
 			)
 		}
 	}()
@@ -117,7 +156,8 @@ func (q *IPQueue) Dequeue() (statute.IPInfo, bool) {
 	info := q.queue[len(q.queue)-1]
 	q.queue = q.queue[0 : len(q.queue)-1]
 
-	q.available <- struct{}{}
+	q.inIdealMode = false
+	q.notifySpace()
 
 	return info, true
 }
@@ -128,7 +168,6 @@ func (q *IPQueue) Expire() {
 
 	if !q.inIdealMode {
 		q.log.Debug("Expire: Not in ideal mode")
-		q.available <- struct{}{}
 		return
 	}
 
@@ -141,6 +180,8 @@ func (q *IPQueue) Expire() {
 				"created", ipInfo.CreatedAt,
 				"addr", ipInfo.AddrPort,
 				"rtt", ipInfo.RTT,
+				"jitter", ipInfo.Jitter,
+				"loss", ipInfo.Loss,
 			)
 		}
 	}()
@@ -161,10 +202,48 @@ func (q *IPQueue) Expire() {
 		q.queue = append(q.queue, q.reserved.Dequeue())
 	}
 	if shouldStartNewScan {
-		q.available <- struct{}{}
+		q.inIdealMode = false
+		q.notifySpace()
 	}
 }
 
+// notifySpace wakes up WaitForSpace without blocking. q.mu must be held.
+func (q *IPQueue) notifySpace() {
+	select {
+	case q.space <- struct{}{}:
+	default:
+	}
+}
+
+// WaitForSpace blocks while the queue is full of desirable IPs, expiring
+// stale ones every interval, so no IPs are scanned only to be discarded.
+func (q *IPQueue) WaitForSpace(ctx context.Context, interval time.Duration) error {
+	for {
+		q.Expire()
+
+		q.mu.Lock()
+		ideal := q.inIdealMode
+		q.mu.Unlock()
+		if !ideal {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.space:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Free returns the number of free slots in the queue.
+func (q *IPQueue) Free() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.maxQueueSize - len(q.queue)
+}
+
 func (q *IPQueue) AvailableIPs(desc bool) []statute.IPInfo {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -173,12 +252,12 @@ func (q *IPQueue) AvailableIPs(desc bool) []statute.IPInfo {
 	sortedQueue := make([]statute.IPInfo, len(q.queue))
 	copy(sortedQueue, q.queue)
 
-	// Sort by RTT ascending/descending
+	// Sort by score ascending/descending
 	sort.Slice(sortedQueue, func(i, j int) bool {
 		if desc {
-			return sortedQueue[i].RTT > sortedQueue[j].RTT
+			return sortedQueue[i].Score() > sortedQueue[j].Score()
 		}
-		return sortedQueue[i].RTT < sortedQueue[j].RTT
+		return sortedQueue[i].Score() < sortedQueue[j].Score()
 	})
 
 	return sortedQueue
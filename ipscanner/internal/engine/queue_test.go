@@ -0,0 +1,188 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func testQueue(size int, ttl time.Duration) *IPQueue {
+	return NewIPQueue(&statute.ScannerOptions{
+		IPQueueSize:     size,
+		IPQueueTTL:      ttl,
+		MaxDesirableRTT: 100 * time.Millisecond,
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+}
+
+func fastIP(addr string, created time.Time) statute.IPInfo {
+	return statute.IPInfo{
+		AddrPort:  netip.MustParseAddrPort(addr),
+		RTT:       10 * time.Millisecond,
+		CreatedAt: created,
+	}
+}
+
+// waitForSpace runs q.WaitForSpace in the background and returns its result
+// channel.
+func waitForSpace(ctx context.Context, q *IPQueue) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- q.WaitForSpace(ctx, 10*time.Millisecond) }()
+	return done
+}
+
+func TestWaitForSpaceNotFull(t *testing.T) {
+	q := testQueue(2, time.Hour)
+	q.Enqueue(fastIP("192.0.2.1:2408", time.Now()))
+
+	select {
+	case err := <-waitForSpace(context.Background(), q):
+		qt.Assert(t, err, qt.IsNil)
+	case <-time.After(time.Second):
+		t.Fatal("WaitForSpace blocked on a queue with free slots")
+	}
+}
+
+func TestWaitForSpaceBlocksUntilDequeue(t *testing.T) {
+	q := testQueue(2, time.Hour)
+	q.Enqueue(fastIP("192.0.2.1:2408", time.Now()))
+	q.Enqueue(fastIP("192.0.2.2:2408", time.Now()))
+	qt.Assert(t, q.Free(), qt.Equals, 0)
+
+	done := waitForSpace(context.Background(), q)
+	select {
+	case <-done:
+		t.Fatal("WaitForSpace returned while the queue is full of desirable IPs")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, ok := q.Dequeue()
+	qt.Assert(t, ok, qt.IsTrue)
+	select {
+	case err := <-done:
+		qt.Assert(t, err, qt.IsNil)
+	case <-time.After(time.Second):
+		t.Fatal("WaitForSpace still blocked after a dequeue")
+	}
+}
+
+func TestWaitForSpaceExpires(t *testing.T) {
+	q := testQueue(2, 50*time.Millisecond)
+	q.Enqueue(fastIP("192.0.2.1:2408", time.Now()))
+	q.Enqueue(fastIP("192.0.2.2:2408", time.Now()))
+
+	select {
+	case err := <-waitForSpace(context.Background(), q):
+		qt.Assert(t, err, qt.IsNil)
+	case <-time.After(time.Second):
+		t.Fatal("WaitForSpace still blocked after the IPs expired")
+	}
+	qt.Assert(t, q.Free(), qt.Equals, 2)
+}
+
+func TestWaitForSpaceCanceled(t *testing.T) {
+	q := testQueue(2, time.Hour)
+	q.Enqueue(fastIP("192.0.2.1:2408", time.Now()))
+	q.Enqueue(fastIP("192.0.2.2:2408", time.Now()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := waitForSpace(ctx, q)
+	cancel()
+
+	select {
+	case err := <-done:
+		qt.Assert(t, err, qt.ErrorIs, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("WaitForSpace ignored the canceled context")
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	tests := []struct {
+		name              string
+		queued            int
+		pinged, succeeded int64
+		want              int
+	}{{
+		name: "no pings yet",
+		want: 4,
+	}, {
+		name:      "one in ten succeed",
+		pinged:    99,
+		succeeded: 9,
+		want:      40,
+	}, {
+		name:      "nearly full queue",
+		queued:    3,
+		pinged:    99,
+		succeeded: 9,
+		want:      10,
+	}, {
+		name:   "nothing succeeds",
+		pinged: 1000,
+		want:   maxBatchSize,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := testQueue(4, time.Hour)
+			for i := 0; i < test.queued; i++ {
+				q.Enqueue(fastIP(fmt.Sprintf("192.0.2.%d:2408", i+1), time.Now()))
+			}
+
+			e := &Engine{ipQueue: q}
+			e.pinged.Store(test.pinged)
+			e.succeeded.Store(test.succeeded)
+			qt.Assert(t, e.batchSize(), qt.Equals, test.want)
+		})
+	}
+}
+
+func TestEnqueueKeepsBothFamilies(t *testing.T) {
+	q := NewIPQueue(&statute.ScannerOptions{
+		UseIPv4:         true,
+		UseIPv6:         true,
+		IPQueueSize:     4,
+		IPQueueTTL:      time.Hour,
+		MaxDesirableRTT: 100 * time.Millisecond,
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	for i := 0; i < 4; i++ {
+		q.Enqueue(fastIP(fmt.Sprintf("192.0.2.%d:2408", i+1), time.Now()))
+	}
+
+	// slower IPv6 IPs take the slots of the worst IPv4 ones up to half
+	for i := 0; i < 3; i++ {
+		info := fastIP(fmt.Sprintf("[2001:db8::%d]:2408", i+1), time.Now())
+		info.RTT = 50 * time.Millisecond
+		q.Enqueue(info)
+	}
+
+	var v4, v6 int
+	for _, info := range q.AvailableIPs(false) {
+		if info.AddrPort.Addr().Is4() {
+			v4++
+		} else {
+			v6++
+		}
+	}
+	qt.Assert(t, v4, qt.Equals, 2)
+	qt.Assert(t, v6, qt.Equals, 2)
+
+	// a faster IPv4 IP replaces the worst IPv4 one only
+	better := fastIP("192.0.2.9:2408", time.Now())
+	better.RTT = time.Millisecond
+	q.Enqueue(better)
+	ips := q.AvailableIPs(false)
+	qt.Assert(t, ips[0].AddrPort, qt.Equals, better.AddrPort)
+	qt.Assert(t, ips, qt.HasLen, 4)
+	qt.Assert(t, ips[3].AddrPort.Addr().Is6(), qt.IsTrue)
+}
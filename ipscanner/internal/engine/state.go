@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/iterator"
+)
+
+const (
+	stateVersion = 2
+	// maxBadIPs bounds the number of bad IPs kept, the oldest are dropped
+	// first.
+	maxBadIPs = 10000
+	// badIPFailures is how many pings of an IP must fail in a row before it
+	// is skipped, so a single lost packet doesn't rule it out.
+	badIPFailures = 3
+	// badIPTTL is how long a bad IP is skipped after its last failure.
+	badIPTTL = 24 * time.Hour
+	// stateSaveInterval is how often the state is saved during a scan.
+	stateSaveInterval = 30 * time.Second
+)
+
+// scanState is what is kept across runs in the state file.
+type scanState struct {
+	Version  int            `json:"version"`
+	Iterator iterator.State `json:"iterator"`
+	BadIPs   []badIP        `json:"bad_ips"`
+	// Ports are the ports that worked in each prefix, see portStats
+	Ports []prefixPorts `json:"ports,omitempty"`
+}
+
+// badIP is an IP whose last pings failed.
+type badIP struct {
+	Addr     netip.Addr `json:"addr"`
+	Failures int        `json:"failures"` // in a row
+	Last     time.Time  `json:"last"`     // of the last failure
+}
+
+// badIPs is a bounded set of IPs whose pings failed.
+type badIPs struct {
+	mu    sync.Mutex
+	set   map[netip.Addr]*badIP
+	order []netip.Addr
+	now   func() time.Time
+}
+
+func newBadIPs(ips []badIP) *badIPs {
+	b := &badIPs{set: make(map[netip.Addr]*badIP), now: time.Now}
+	for _, ip := range ips {
+		if b.expired(ip) {
+			continue
+		}
+		b.push(ip)
+	}
+	return b
+}
+
+// expired reports whether the failures of ip are too old to count.
+func (b *badIPs) expired(ip badIP) bool {
+	return b.now().Sub(ip.Last) >= badIPTTL
+}
+
+// push adds ip, dropping the oldest entry if the set is full. b.mu must be
+// held.
+func (b *badIPs) push(ip badIP) {
+	if len(b.order) >= maxBadIPs {
+		delete(b.set, b.order[0])
+		b.order = b.order[1:]
+	}
+	b.set[ip.Addr] = &ip
+	b.order = append(b.order, ip.Addr)
+}
+
+// Add records a failed ping of ip. Failures older than badIPTTL start a new
+// count.
+func (b *badIPs) Add(ip netip.Addr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	entry, ok := b.set[ip]
+	if !ok {
+		b.push(badIP{Addr: ip, Failures: 1, Last: now})
+		return
+	}
+	if b.expired(*entry) {
+		entry.Failures = 0
+	}
+	entry.Failures++
+	entry.Last = now
+}
+
+// Remove forgets the failures of ip, after a successful ping.
+func (b *badIPs) Remove(ip netip.Addr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.set[ip]; !ok {
+		return
+	}
+	delete(b.set, ip)
+	b.order = slices.DeleteFunc(b.order, func(a netip.Addr) bool { return a == ip })
+}
+
+// Contains reports whether ip failed badIPFailures pings in a row within
+// badIPTTL.
+func (b *badIPs) Contains(ip netip.Addr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.set[ip]
+	return ok && entry.Failures >= badIPFailures && !b.expired(*entry)
+}
+
+// List returns the IPs with recent failures, oldest first.
+func (b *badIPs) List() []badIP {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := make([]badIP, 0, len(b.order))
+	for _, ip := range b.order {
+		if entry := b.set[ip]; !b.expired(*entry) {
+			list = append(list, *entry)
+		}
+	}
+	return list
+}
+
+// loadState reads the state file at path. A missing file is an empty state.
+func loadState(path string) (scanState, error) {
+	var state scanState
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return scanState{}, fmt.Errorf("malformed scan state %s: %w", path, err)
+	}
+	if state.Version != stateVersion {
+		return scanState{}, fmt.Errorf("scan state %s: unsupported version %d", path, state.Version)
+	}
+
+	return state, nil
+}
+
+// saveState writes state to path, through a temporary file so an interrupted
+// write never leaves a truncated state behind.
+func saveState(path string, state scanState) error {
+	state.Version = stateVersion
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
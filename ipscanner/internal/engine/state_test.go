@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestBadIPsRepeatedFailures(t *testing.T) {
+	b := newBadIPs(nil)
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	for i := 1; i < badIPFailures; i++ {
+		b.Add(ip)
+		qt.Assert(t, b.Contains(ip), qt.IsFalse, qt.Commentf("after %d failures", i))
+	}
+	b.Add(ip)
+	qt.Assert(t, b.Contains(ip), qt.IsTrue)
+
+	// a successful ping clears the failures
+	b.Remove(ip)
+	qt.Assert(t, b.Contains(ip), qt.IsFalse)
+	qt.Assert(t, b.List(), qt.HasLen, 0)
+	b.Add(ip)
+	qt.Assert(t, b.Contains(ip), qt.IsFalse)
+}
+
+func TestBadIPsExpire(t *testing.T) {
+	now := time.Now()
+	b := newBadIPs(nil)
+	b.now = func() time.Time { return now }
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	for i := 0; i < badIPFailures; i++ {
+		b.Add(ip)
+	}
+	qt.Assert(t, b.Contains(ip), qt.IsTrue)
+
+	now = now.Add(badIPTTL)
+	qt.Assert(t, b.Contains(ip), qt.IsFalse)
+	qt.Assert(t, b.List(), qt.HasLen, 0)
+
+	// old failures don't count towards a new streak
+	b.Add(ip)
+	qt.Assert(t, b.Contains(ip), qt.IsFalse)
+}
+
+func TestBadIPsBounded(t *testing.T) {
+	b := newBadIPs(nil)
+	first := netip.MustParseAddr("10.0.0.0")
+	ip := first
+	for i := 0; i < maxBadIPs+1; i++ {
+		b.Add(ip)
+		ip = ip.Next()
+	}
+
+	list := b.List()
+	qt.Assert(t, list, qt.HasLen, maxBadIPs)
+	qt.Assert(t, list[0].Addr, qt.Equals, first.Next())
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	state, err := loadState(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, state.BadIPs, qt.HasLen, 0)
+
+	recent, old := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	err = saveState(path, scanState{BadIPs: []badIP{
+		{Addr: recent, Failures: badIPFailures, Last: time.Now()},
+		{Addr: old, Failures: badIPFailures, Last: time.Now().Add(-badIPTTL)},
+	}})
+	qt.Assert(t, err, qt.IsNil)
+
+	state, err = loadState(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, state.BadIPs, qt.HasLen, 2)
+
+	b := newBadIPs(state.BadIPs)
+	qt.Assert(t, b.Contains(recent), qt.IsTrue)
+	qt.Assert(t, b.Contains(old), qt.IsFalse)
+	qt.Assert(t, b.List(), qt.HasLen, 1)
+}
@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRTTSamples bounds the RTTs of successful pings kept for the summary.
+const maxRTTSamples = 4096
+
+// Summary describes a scan, to troubleshoot scans that find nothing.
+type Summary struct {
+	Duration  time.Duration    `json:"duration_ns"`
+	Pinged    int64            `json:"pinged"`
+	Succeeded int64            `json:"succeeded"`
+	Failures  map[string]int64 `json:"failures"` // failed pings by kind
+	RTT       RTTSummary       `json:"rtt"`      // of the successful pings
+}
+
+// RTTSummary is the distribution of the RTTs of successful pings.
+type RTTSummary struct {
+	Min    time.Duration `json:"min_ns"`
+	Median time.Duration `json:"median_ns"`
+	P90    time.Duration `json:"p90_ns"`
+	Max    time.Duration `json:"max_ns"`
+}
+
+// LogValue logs the summary as a group of its fields.
+func (s Summary) LogValue() slog.Value {
+	failures := make([]slog.Attr, 0, len(s.Failures))
+	for kind, n := range s.Failures {
+		failures = append(failures, slog.Int64(kind, n))
+	}
+	slices.SortFunc(failures, func(a, b slog.Attr) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return slog.GroupValue(
+		slog.Duration("duration", s.Duration),
+		slog.Int64("pinged", s.Pinged),
+		slog.Int64("succeeded", s.Succeeded),
+		slog.Attr{Key: "failures", Value: slog.GroupValue(failures...)},
+		slog.Group("rtt",
+			slog.Duration("min", s.RTT.Min),
+			slog.Duration("median", s.RTT.Median),
+			slog.Duration("p90", s.RTT.P90),
+			slog.Duration("max", s.RTT.Max),
+		),
+	)
+}
+
+// rttSamples keeps the first maxRTTSamples RTTs of successful pings.
+type rttSamples struct {
+	mu      sync.Mutex
+	samples []time.Duration
+}
+
+func (r *rttSamples) Add(rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.samples) < maxRTTSamples {
+		r.samples = append(r.samples, rtt)
+	}
+}
+
+// Summary returns the distribution of the samples so far.
+func (r *rttSamples) Summary() RTTSummary {
+	r.mu.Lock()
+	samples := slices.Clone(r.samples)
+	r.mu.Unlock()
+
+	if len(samples) == 0 {
+		return RTTSummary{}
+	}
+
+	slices.Sort(samples)
+	return RTTSummary{
+		Min:    samples[0],
+		Median: samples[len(samples)/2],
+		P90:    samples[len(samples)*9/10],
+		Max:    samples[len(samples)-1],
+	}
+}
+
+// Summary returns a summary of the scan so far.
+func (e *Engine) Summary() Summary {
+	var duration time.Duration
+	if started, ok := e.started.Load().(time.Time); ok {
+		duration = time.Since(started).Round(time.Millisecond)
+	}
+
+	return Summary{
+		Duration:  duration,
+		Pinged:    e.pinged.Load(),
+		Succeeded: e.succeeded.Load(),
+		Failures:  e.failures.Totals(),
+		RTT:       e.rtts.Summary(),
+	}
+}
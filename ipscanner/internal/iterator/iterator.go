@@ -6,11 +6,16 @@ import (
 	"math/big"
 	"net"
 	"net/netip"
+	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner/internal/cache"
 	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
 )
 
+// ErrExhausted is returned when there are no IPs to generate, e.g. because
+// every range is excluded. Unlike other errors it is permanent.
+var ErrExhausted = errors.New("no more IP addresses")
+
 // LCG represents a linear congruential generator with full period.
 type LCG struct {
 	modulus    *big.Int
@@ -87,11 +92,12 @@ func (lcg *LCG) Next() *big.Int {
 }
 
 type ipRange struct {
-	lcg   *LCG
-	start netip.Addr
-	stop  netip.Addr
-	size  *big.Int
-	index *big.Int
+	prefix netip.Prefix
+	lcg    *LCG
+	start  netip.Addr
+	stop   netip.Addr
+	size   *big.Int
+	index  *big.Int
 }
 
 func newIPRange(cidr netip.Prefix) (ipRange, error) {
@@ -99,11 +105,12 @@ func newIPRange(cidr netip.Prefix) (ipRange, error) {
 	stopIP := lastIP(cidr)
 	size := ipRangeSize(cidr)
 	return ipRange{
-		start: startIP,
-		stop:  stopIP,
-		size:  size,
-		index: big.NewInt(0),
-		lcg:   NewLCG(size),
+		prefix: cidr,
+		start:  startIP,
+		stop:   stopIP,
+		size:   size,
+		index:  big.NewInt(0),
+		lcg:    NewLCG(size),
 	}, nil
 }
 
@@ -176,8 +183,8 @@ func bigIntToIP(n *big.Int) netip.Addr {
 }
 
 func addIP(ip netip.Addr, num *big.Int) netip.Addr {
-	ipInt := ipToBigInt(ip)
-	ipInt.Add(ipInt, num)
+	// don't modify the cached value, the result must only depend on ip and num
+	ipInt := new(big.Int).Add(ipToBigInt(ip), num)
 	return bigIntToIP(ipInt)
 }
 
@@ -198,11 +205,27 @@ func ipRangeSize(prefix netip.Prefix) *big.Int {
 
 type IpGenerator struct {
 	ipRanges []ipRange
+	// sampler picks the range of every IP, see Record
+	sampler *sampler
 }
 
+// NextBatch generates as many IPs as there are ranges with IPs left in the
+// current cycle, each from a range the sampler picks. When ranges of both IP
+// families are open, the IPs alternate between them, see families.
 func (g *IpGenerator) NextBatch() ([]netip.Addr, error) {
-	var results []netip.Addr
+	var open []int
 	for i, r := range g.ipRanges {
+		if r.index.Cmp(r.size) < 0 {
+			open = append(open, i)
+		}
+	}
+
+	families := g.families(open)
+	var results []netip.Addr
+	for n := range open {
+		i := g.sampler.pick(families[n%len(families)])
+		r := &g.ipRanges[i]
+		// a range this batch exhausted waits for the next cycle
 		if r.index.Cmp(r.size) >= 0 {
 			continue
 		}
@@ -211,7 +234,7 @@ func (g *IpGenerator) NextBatch() ([]netip.Addr, error) {
 			continue
 		}
 		results = append(results, addIP(r.start, shuffleIndex))
-		g.ipRanges[i].index.Add(g.ipRanges[i].index, big.NewInt(1))
+		r.index.Add(r.index, big.NewInt(1))
 	}
 	if len(results) == 0 {
 		okFlag := false
@@ -228,12 +251,32 @@ func (g *IpGenerator) NextBatch() ([]netip.Addr, error) {
 			}
 			return g.NextBatch()
 		} else {
-			return nil, errors.New("no more IP addresses")
+			return nil, ErrExhausted
 		}
 	}
 	return results, nil
 }
 
+// families splits open, indexes of ranges, by IP family. Otherwise the few
+// IPv6 ranges would get as few IPs as their share of the ranges, or fewer once
+// the IPv4 ones had their first fast hits. Once the sampler finds every range
+// of a family dead, e.g. on a network without IPv6, all of open is sampled
+// together again, so the dead family only gets the occasional IP.
+func (g *IpGenerator) families(open []int) [][]int {
+	var v4, v6 []int
+	for _, i := range open {
+		if g.ipRanges[i].prefix.Addr().Is4() {
+			v4 = append(v4, i)
+		} else {
+			v6 = append(v6, i)
+		}
+	}
+	if len(v4) == 0 || len(v6) == 0 || g.sampler.dead(v4) || g.sampler.dead(v6) {
+		return [][]int{open}
+	}
+	return [][]int{v4, v6}
+}
+
 // shuffleSubnetsIpRange shuffles a slice of ipRange using crypto/rand
 func shuffleSubnetsIpRange(subnets []ipRange) error {
 	for i := range subnets {
@@ -248,7 +291,7 @@ func shuffleSubnetsIpRange(subnets []ipRange) error {
 	return nil
 }
 
-func NewIterator(opts *statute.ScannerOptions) *IpGenerator {
+func NewIterator(opts *statute.ScannerOptions) (*IpGenerator, error) {
 	var ranges []ipRange
 	for _, cidr := range opts.CidrList {
 		if !opts.UseIPv6 && cidr.Addr().Is6() {
@@ -257,6 +300,9 @@ func NewIterator(opts *statute.ScannerOptions) *IpGenerator {
 		if !opts.UseIPv4 && cidr.Addr().Is4() {
 			continue
 		}
+		if covered(cidr, opts.ExcludeList) {
+			continue
+		}
 
 		ipRange, err := newIPRange(cidr)
 		if err != nil {
@@ -266,15 +312,28 @@ func NewIterator(opts *statute.ScannerOptions) *IpGenerator {
 		ranges = append(ranges, ipRange)
 	}
 	if len(ranges) == 0 {
-		// TODO
-		return nil
+		return nil, ErrExhausted
 	}
 	err := shuffleSubnetsIpRange(ranges)
 	if err != nil {
-		// TODO
-		return nil
+		return nil, err
 	}
 	return &IpGenerator{
 		ipRanges: ranges,
+		sampler:  newSampler(len(ranges), opts.MaxDesirableRTT),
+	}, nil
+}
+
+// Record feeds the outcome of a ping of ip, which succeeded within rtt or
+// failed if not ok, to the sampler, so later batches favor the ranges with
+// fast hits. IPs outside the ranges are ignored.
+func (g *IpGenerator) Record(ip netip.Addr, rtt time.Duration, ok bool) {
+	// only the prefix is read, NextBatch replaces the rest of the ranges
+	// while the pings of its IPs run
+	for i := range g.ipRanges {
+		if g.ipRanges[i].prefix.Contains(ip) {
+			g.sampler.record(i, rtt, ok)
+			return
+		}
 	}
 }
@@ -0,0 +1,139 @@
+package iterator
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// maxArmPulls bounds the pings an arm remembers, older ones count half
+	// every time it is reached so the estimate follows the recent pings.
+	maxArmPulls = 1000
+	// defaultRTTScale is the RTT a hit is worth half a fast hit at, if the
+	// scanner has no desirable RTT.
+	defaultRTTScale = 500 * time.Millisecond
+	// deadPulls is how many pings into the ranges of an IP family must fail
+	// before the family is no longer given its share of the IPs.
+	deadPulls = 64
+)
+
+// arm is what the sampler knows about one range.
+type arm struct {
+	// pulls is the number of pings into the range, reward the part of them
+	// that were fast hits
+	pulls, reward float64
+}
+
+// sampler picks the range each generated IP comes from. The ranges are the
+// arms of a multi-armed bandit whose reward is a fast successful ping, played
+// by Thompson sampling: for every IP, a plausible hit rate is drawn for every
+// range from the pings into it so far and the range with the highest one is
+// picked. Ranges that yield fast hits are sampled more heavily, while dead or
+// barely known ranges still get the occasional ping in case they are better
+// than they look.
+type sampler struct {
+	mu       sync.Mutex
+	arms     []arm
+	rttScale time.Duration
+}
+
+func newSampler(ranges int, rttScale time.Duration) *sampler {
+	if rttScale <= 0 {
+		rttScale = defaultRTTScale
+	}
+	return &sampler{arms: make([]arm, ranges), rttScale: rttScale}
+}
+
+// pick returns the one of candidates, indexes of arms, to generate the next
+// IP from.
+func (s *sampler) pick(candidates []int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	best, bestDraw := candidates[0], -1.0
+	for _, i := range candidates {
+		a := s.arms[i]
+		if draw := betaSample(1+a.reward, 1+a.pulls-a.reward); draw > bestDraw {
+			best, bestDraw = i, draw
+		}
+	}
+	return best
+}
+
+// dead reports whether the arms at indexes had at least deadPulls pings
+// between them and not a single hit.
+func (s *sampler) dead(indexes []int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pulls, reward float64
+	for _, i := range indexes {
+		pulls += s.arms[i].pulls
+		reward += s.arms[i].reward
+	}
+	return pulls >= deadPulls && reward == 0
+}
+
+// record adds a ping into the range at index that succeeded within rtt, or
+// failed if not ok.
+func (s *sampler) record(index int, rtt time.Duration, ok bool) {
+	var reward float64
+	if ok {
+		// a hit at the desirable RTT is worth half a fast one, and slower
+		// ones quickly fall off, as the queue won't take them
+		r := float64(rtt) / float64(s.rttScale)
+		reward = 1 / (1 + r*r)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := &s.arms[index]
+	if a.pulls >= maxArmPulls {
+		a.pulls, a.reward = a.pulls/2, a.reward/2
+	}
+	a.pulls++
+	a.reward += reward
+}
+
+// get returns the arm at index.
+func (s *sampler) get(index int) arm {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.arms[index]
+}
+
+// set replaces the arm at index.
+func (s *sampler) set(index int, a arm) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.arms[index] = a
+}
+
+// betaSample draws from the beta distribution with shapes a and b, both at
+// least 1.
+func betaSample(a, b float64) float64 {
+	x, y := gammaSample(a), gammaSample(b)
+	return x / (x + y)
+}
+
+// gammaSample draws from the gamma distribution with shape k of at least 1
+// and scale 1, with the method of Marsaglia and Tsang.
+func gammaSample(k float64) float64 {
+	d := k - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rand.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rand.Float64()
+		if u < 1-0.0331*x*x*x*x || math.Log(u) < 0.5*x*x+d*(1-v+math.Log(v)) {
+			return d * v
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package iterator
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestSamplerFavorsFastHits(t *testing.T) {
+	good, dead := netip.MustParsePrefix("162.159.192.0/24"), netip.MustParsePrefix("188.114.96.0/24")
+	g, err := NewIterator(&statute.ScannerOptions{
+		UseIPv4:         true,
+		CidrList:        []netip.Prefix{good, dead},
+		MaxDesirableRTT: 400 * time.Millisecond,
+	})
+	qt.Assert(t, err, qt.IsNil)
+
+	for i := 0; i < 50; i++ {
+		g.Record(good.Addr().Next(), 50*time.Millisecond, true)
+		g.Record(dead.Addr().Next(), 0, false)
+	}
+
+	var fromGood, total int
+	for total < 200 {
+		batch, err := g.NextBatch()
+		qt.Assert(t, err, qt.IsNil)
+		for _, ip := range batch {
+			if good.Contains(ip) {
+				fromGood++
+			}
+			total++
+		}
+	}
+	qt.Assert(t, fromGood > total*9/10, qt.IsTrue, qt.Commentf("%d of %d from the good range", fromGood, total))
+
+	// every IP of both ranges still comes up
+	seen := make(map[netip.Addr]bool)
+	for len(seen) < 512 {
+		batch, err := g.NextBatch()
+		qt.Assert(t, err, qt.IsNil)
+		for _, ip := range batch {
+			seen[ip] = true
+		}
+	}
+}
+
+func TestSamplerState(t *testing.T) {
+	opts := &statute.ScannerOptions{UseIPv4: true, CidrList: []netip.Prefix{netip.MustParsePrefix("162.159.192.0/24")}}
+	g, err := NewIterator(opts)
+	qt.Assert(t, err, qt.IsNil)
+	g.Record(netip.MustParseAddr("162.159.192.1"), 0, true)
+	g.Record(netip.MustParseAddr("162.159.192.2"), 0, false)
+	// outside the ranges
+	g.Record(netip.MustParseAddr("1.1.1.1"), 0, true)
+
+	restored, err := NewIterator(opts)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, restored.Restore(g.State()), qt.Equals, 1)
+	qt.Assert(t, restored.sampler.get(0), qt.Equals, arm{pulls: 2, reward: 1})
+}
+
+func TestSamplerDecay(t *testing.T) {
+	s := newSampler(1, time.Second)
+	for i := 0; i < maxArmPulls+1; i++ {
+		s.record(0, 0, true)
+	}
+	a := s.get(0)
+	qt.Assert(t, a.pulls, qt.Equals, float64(maxArmPulls/2+1))
+	qt.Assert(t, a.reward, qt.Equals, a.pulls)
+
+	s.record(0, time.Second, true)
+	qt.Assert(t, s.get(0).reward, qt.Equals, a.reward+0.5)
+}
+
+func TestNextBatchBalancesFamilies(t *testing.T) {
+	v6 := netip.MustParsePrefix("2606:4700:d0::/120")
+	cidrs := []netip.Prefix{v6}
+	for i := 0; i < 7; i++ {
+		cidrs = append(cidrs, netip.PrefixFrom(netip.AddrFrom4([4]byte{162, 159, byte(192 + i), 0}), 24))
+	}
+	g, err := NewIterator(&statute.ScannerOptions{UseIPv4: true, UseIPv6: true, CidrList: cidrs})
+	qt.Assert(t, err, qt.IsNil)
+
+	// the first IPv4 hits don't starve the IPv6 range
+	for i := 1; i < 8; i++ {
+		g.Record(cidrs[i].Addr().Next(), 50*time.Millisecond, true)
+	}
+	count := func() (v6IPs, total int) {
+		for total < 400 {
+			batch, err := g.NextBatch()
+			qt.Assert(t, err, qt.IsNil)
+			for _, ip := range batch {
+				if ip.Is6() {
+					v6IPs++
+				}
+				total++
+			}
+		}
+		return v6IPs, total
+	}
+	fromV6, total := count()
+	qt.Assert(t, fromV6 >= total*2/5, qt.IsTrue, qt.Commentf("%d of %d from the IPv6 range", fromV6, total))
+
+	// a dead family loses its share
+	for i := 0; i < deadPulls; i++ {
+		g.Record(v6.Addr().Next(), 0, false)
+	}
+	fromV6, total = count()
+	qt.Assert(t, fromV6 < total/10, qt.IsTrue, qt.Commentf("%d of %d from the dead IPv6 range", fromV6, total))
+}
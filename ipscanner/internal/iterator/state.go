@@ -0,0 +1,93 @@
+package iterator
+
+import (
+	"math/big"
+	"net/netip"
+)
+
+// RangeState is the position of the generator in one range.
+type RangeState struct {
+	Multiplier string `json:"multiplier"`
+	Increment  string `json:"increment"`
+	Current    string `json:"current"`
+	Index      string `json:"index"`
+	// Pulls and Reward are the pings into the range and the part of them
+	// that were fast hits, see sampler
+	Pulls  float64 `json:"pulls,omitempty"`
+	Reward float64 `json:"reward,omitempty"`
+}
+
+// State is the position of the generator in every range, keyed by prefix.
+type State map[string]RangeState
+
+// State returns the current position of the generator.
+func (g *IpGenerator) State() State {
+	state := make(State, len(g.ipRanges))
+	for i, r := range g.ipRanges {
+		a := g.sampler.get(i)
+		state[r.prefix.String()] = RangeState{
+			Multiplier: r.lcg.multiplier.String(),
+			Increment:  r.lcg.increment.String(),
+			Current:    r.lcg.current.String(),
+			Index:      r.index.String(),
+			Pulls:      a.pulls,
+			Reward:     a.reward,
+		}
+	}
+	return state
+}
+
+// Restore moves the generator to the positions in state and gives the sampler
+// back what it knew about the ranges. Ranges without a valid entry in state
+// keep their fresh position, so a state saved for a different list of
+// prefixes is partially or not at all applied. Restore returns the number of
+// ranges restored.
+func (g *IpGenerator) Restore(state State) int {
+	restored := 0
+	for i, r := range g.ipRanges {
+		rs, ok := state[r.prefix.String()]
+		if !ok {
+			continue
+		}
+
+		if rs.Reward >= 0 && rs.Reward <= rs.Pulls && rs.Pulls <= maxArmPulls {
+			g.sampler.set(i, arm{pulls: rs.Pulls, reward: rs.Reward})
+		}
+
+		multiplier, ok1 := new(big.Int).SetString(rs.Multiplier, 10)
+		increment, ok2 := new(big.Int).SetString(rs.Increment, 10)
+		current, ok3 := new(big.Int).SetString(rs.Current, 10)
+		index, ok4 := new(big.Int).SetString(rs.Index, 10)
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			continue
+		}
+
+		// the saved sequence must be a full period sequence over this range
+		if current.Sign() < 0 || current.Cmp(r.size) >= 0 ||
+			index.Sign() < 0 || index.Cmp(r.size) > 0 ||
+			multiplier.Cmp(r.size) >= 0 || increment.Cmp(r.size) >= 0 ||
+			!checkHullDobell(r.size, multiplier, increment) {
+			continue
+		}
+
+		g.ipRanges[i].lcg = &LCG{
+			modulus:    new(big.Int).Set(r.size),
+			multiplier: multiplier,
+			increment:  increment,
+			current:    current,
+		}
+		g.ipRanges[i].index = index
+		restored++
+	}
+	return restored
+}
+
+// covered reports whether prefix lies entirely within one of excluded.
+func covered(prefix netip.Prefix, excluded []netip.Prefix) bool {
+	for _, e := range excluded {
+		if e.Bits() <= prefix.Bits() && e.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+)
+
+type IcmpPingResult struct {
+	Addr netip.Addr
+	RTT  time.Duration
+	Err  error
+}
+
+func (ip *IcmpPingResult) Result() statute.IPInfo {
+	return statute.IPInfo{AddrPort: netip.AddrPortFrom(ip.Addr, 0), RTT: ip.RTT, CreatedAt: time.Now()}
+}
+
+func (ip *IcmpPingResult) Error() error {
+	return ip.Err
+}
+
+func (ip *IcmpPingResult) String() string {
+	if ip.Err != nil {
+		return fmt.Sprintf("%s", ip.Err)
+	} else {
+		return fmt.Sprintf("%s: time=%d ms", ip.Addr, ip.RTT.Milliseconds())
+	}
+}
+
+// errICMPUnavailable is returned when no ICMP socket can be opened, e.g.
+// for lack of permissions.
+var errICMPUnavailable = errors.New("icmp unavailable")
+
+// IcmpPing sends an ICMP echo request and waits for the reply. It is much
+// cheaper than the other pings and is meant to pre-filter candidate IPs.
+type IcmpPing struct {
+	ip netip.Addr
+
+	opts statute.ScannerOptions
+}
+
+func (ip *IcmpPing) Ping() statute.IPingResult {
+	return ip.PingContext(context.Background())
+}
+
+func (ip *IcmpPing) PingContext(ctx context.Context) statute.IPingResult {
+	if !ip.ip.IsValid() {
+		return &IcmpPingResult{Err: errors.New("no IP specified")}
+	}
+
+	timeout := ip.opts.ConnectionTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+
+	rtt, err := icmpEcho(ip.ip, timeout, ip.opts.SocketControl)
+	if err != nil {
+		return &IcmpPingResult{Addr: ip.ip, Err: err}
+	}
+
+	return &IcmpPingResult{Addr: ip.ip, RTT: rtt}
+}
+
+func NewIcmpPing(ip netip.Addr, opts *statute.ScannerOptions) *IcmpPing {
+	return &IcmpPing{
+		ip:   ip,
+		opts: *opts,
+	}
+}
+
+var (
+	_ statute.IPing       = (*IcmpPing)(nil)
+	_ statute.IPingResult = (*IcmpPingResult)(nil)
+)
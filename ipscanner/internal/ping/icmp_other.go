@@ -0,0 +1,147 @@
+//go:build !windows
+
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	icmpSeq atomic.Uint32
+	// icmpUnprivileged is set once a raw socket was refused, so later pings
+	// go straight to unprivileged datagram sockets.
+	icmpUnprivileged atomic.Bool
+)
+
+// icmpListen opens an ICMP socket for ip with control applied, if set. It
+// tries a raw socket, which needs root or CAP_NET_RAW, and falls back to an
+// unprivileged datagram socket, available on macOS and on Linux within
+// net.ipv4.ping_group_range.
+func icmpListen(ip netip.Addr, control statute.TControlFunc) (net.PacketConn, bool, error) {
+	rawNetwork, dgramNetwork, laddr := "ip4:icmp", "udp4", "0.0.0.0"
+	if ip.Is6() {
+		rawNetwork, dgramNetwork, laddr = "ip6:ipv6-icmp", "udp6", "::"
+	}
+
+	if !icmpUnprivileged.Load() {
+		lc := net.ListenConfig{Control: control}
+		c, err := lc.ListenPacket(context.Background(), rawNetwork, laddr)
+		if err == nil {
+			return c, false, nil
+		}
+		if !errors.Is(err, os.ErrPermission) {
+			return nil, false, fmt.Errorf("%w: %w", errICMPUnavailable, err)
+		}
+		icmpUnprivileged.Store(true)
+	}
+
+	// the datagram sockets of the icmp package can't be controlled before
+	// they are bound
+	if control != nil {
+		c, err := listenICMPDatagram(dgramNetwork, laddr, control)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: needs a raw socket or unprivileged ping sockets: %w", errICMPUnavailable, err)
+		}
+		return c, true, nil
+	}
+
+	c, err := icmp.ListenPacket(dgramNetwork, laddr)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: needs a raw socket or unprivileged ping sockets: %w", errICMPUnavailable, err)
+	}
+	return c, true, nil
+}
+
+func icmpEcho(ip netip.Addr, timeout time.Duration, control statute.TControlFunc) (time.Duration, error) {
+	c, dgram, err := icmpListen(ip, control)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	var (
+		echoType  icmp.Type = ipv4.ICMPTypeEcho
+		replyType icmp.Type = ipv4.ICMPTypeEchoReply
+		proto               = 1
+	)
+	if ip.Is6() {
+		echoType, replyType, proto = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, 58
+	}
+
+	// the kernel picks the id of datagram sockets, only the sequence number
+	// identifies the reply there
+	id := os.Getpid() & 0xffff
+	seq := int(icmpSeq.Add(1) & 0xffff)
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("warp-plus")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var dst net.Addr = &net.IPAddr{IP: ip.AsSlice()}
+	if dgram {
+		dst = &net.UDPAddr{IP: ip.AsSlice()}
+	}
+
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+
+	t0 := time.Now()
+	if _, err := c.WriteTo(b, dst); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := c.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		if peerAddr(peer) != ip.Unmap() {
+			continue
+		}
+
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || (!dgram && echo.ID != id) {
+			continue
+		}
+
+		return time.Since(t0), nil
+	}
+}
+
+// peerAddr returns the address of a raw or datagram ICMP peer.
+func peerAddr(peer net.Addr) netip.Addr {
+	var ip net.IP
+	switch a := peer.(type) {
+	case *net.IPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
@@ -0,0 +1,70 @@
+package ping
+
+import (
+	"errors"
+	"net/netip"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestIcmpPingResultString(t *testing.T) {
+	r := &IcmpPingResult{Addr: netip.MustParseAddr("162.159.192.1"), RTT: 42 * time.Millisecond}
+	qt.Assert(t, r.String(), qt.Equals, "162.159.192.1: time=42 ms")
+}
+
+func TestIcmpPingSocketControl(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("icmp sockets are only controlled on linux")
+	}
+
+	errControl := errors.New("controlled")
+	var networks []string
+	opts := &statute.ScannerOptions{
+		ConnectionTimeout: time.Second,
+		SocketControl: func(network, address string, c syscall.RawConn) error {
+			networks = append(networks, network)
+			return errControl
+		},
+	}
+
+	// whichever socket the ping gets, control is applied to it
+	r := NewIcmpPing(netip.MustParseAddr("127.0.0.1"), opts).Ping()
+	qt.Assert(t, r.Error(), qt.ErrorIs, errControl)
+	qt.Assert(t, r.Error(), qt.ErrorIs, errICMPUnavailable)
+	qt.Assert(t, networks, qt.Not(qt.HasLen), 0)
+
+	// and the ping goes through once control lets the socket be
+	networks = nil
+	errControl = nil
+	r = NewIcmpPing(netip.MustParseAddr("127.0.0.1"), opts).Ping()
+	if errors.Is(r.Error(), errICMPUnavailable) {
+		t.Skip("no icmp sockets here:", r.Error())
+	}
+	qt.Assert(t, r.Error(), qt.IsNil)
+	qt.Assert(t, networks, qt.Not(qt.HasLen), 0)
+}
+
+func TestListenICMPDatagramControl(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("icmp sockets are only controlled on linux")
+	}
+
+	var called bool
+	c, err := listenICMPDatagram("udp4", "0.0.0.0", func(network, address string, rc syscall.RawConn) error {
+		called = true
+		qt.Check(t, network, qt.Equals, "udp4")
+		return nil
+	})
+	if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM) {
+		t.Skip("unprivileged ping sockets aren't allowed here:", err)
+	}
+	qt.Assert(t, err, qt.IsNil)
+	defer c.Close()
+	qt.Assert(t, called, qt.IsTrue)
+}
@@ -0,0 +1,98 @@
+package ping
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+	"unsafe"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+	"golang.org/x/sys/windows"
+)
+
+// Raw ICMP sockets need administrator rights on Windows, the IP helper API
+// doesn't.
+var (
+	iphlpapi            = windows.NewLazySystemDLL("iphlpapi.dll")
+	procIcmpCreateFile  = iphlpapi.NewProc("IcmpCreateFile")
+	procIcmp6CreateFile = iphlpapi.NewProc("Icmp6CreateFile")
+	procIcmpCloseHandle = iphlpapi.NewProc("IcmpCloseHandle")
+	procIcmpSendEcho    = iphlpapi.NewProc("IcmpSendEcho")
+	procIcmp6SendEcho2  = iphlpapi.NewProc("Icmp6SendEcho2")
+)
+
+const (
+	ipSuccess = 0
+	// offsets of Status in ICMP_ECHO_REPLY and ICMPV6_ECHO_REPLY, whose
+	// packed 26 byte address is padded to 28
+	icmpStatusOffset   = 4
+	icmpv6StatusOffset = 28
+)
+
+func icmpEcho(ip netip.Addr, timeout time.Duration, control statute.TControlFunc) (time.Duration, error) {
+	// the IP helper API opens its sockets itself
+	if control != nil {
+		return 0, fmt.Errorf("%w: sockets of windows icmp pings can't be controlled", errICMPUnavailable)
+	}
+
+	data := []byte("warp-plus")
+	reply := make([]byte, 256+len(data))
+	timeoutMS := uintptr(max(timeout.Milliseconds(), 1))
+
+	create := procIcmpCreateFile
+	if ip.Is6() {
+		create = procIcmp6CreateFile
+	}
+	h, _, err := create.Call()
+	if windows.Handle(h) == windows.InvalidHandle {
+		return 0, fmt.Errorf("%w: icmp create file: %w", errICMPUnavailable, err)
+	}
+	defer procIcmpCloseHandle.Call(h)
+
+	t0 := time.Now()
+	var n uintptr
+	if ip.Is4() || ip.Is4In6() {
+		dst := ip.Unmap().As4()
+		n, _, err = procIcmpSendEcho.Call(
+			h,
+			uintptr(*(*uint32)(unsafe.Pointer(&dst[0]))), // network byte order
+			uintptr(unsafe.Pointer(&data[0])),
+			uintptr(len(data)),
+			0,
+			uintptr(unsafe.Pointer(&reply[0])),
+			uintptr(len(reply)),
+			timeoutMS,
+		)
+	} else {
+		src := windows.RawSockaddrInet6{Family: windows.AF_INET6}
+		dst := windows.RawSockaddrInet6{Family: windows.AF_INET6, Addr: ip.As16()}
+		n, _, err = procIcmp6SendEcho2.Call(
+			h,
+			0, 0, 0,
+			uintptr(unsafe.Pointer(&src)),
+			uintptr(unsafe.Pointer(&dst)),
+			uintptr(unsafe.Pointer(&data[0])),
+			uintptr(len(data)),
+			0,
+			uintptr(unsafe.Pointer(&reply[0])),
+			uintptr(len(reply)),
+			timeoutMS,
+		)
+	}
+	elapsed := time.Since(t0)
+	if n == 0 {
+		return 0, fmt.Errorf("icmp send echo: %w", err)
+	}
+
+	statusOffset := icmpStatusOffset
+	if !ip.Is4() && !ip.Is4In6() {
+		statusOffset = icmpv6StatusOffset
+	}
+	if status := binary.LittleEndian.Uint32(reply[statusOffset:]); status != ipSuccess {
+		return 0, fmt.Errorf("icmp echo failed with status %d", status)
+	}
+
+	// the reply only has millisecond resolution, measure the rtt instead
+	return elapsed, nil
+}
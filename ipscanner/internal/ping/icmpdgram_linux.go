@@ -0,0 +1,40 @@
+package ping
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+)
+
+// listenICMPDatagram opens an unprivileged ICMP datagram socket like
+// icmp.ListenPacket does for network, but applies control before binding it
+// to laddr.
+func listenICMPDatagram(network, laddr string, control statute.TControlFunc) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	var sa syscall.Sockaddr = &syscall.SockaddrInet4{}
+	if network == "udp6" {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		sa = &syscall.SockaddrInet6{}
+	}
+
+	s, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	f := os.NewFile(uintptr(s), "datagram-oriented icmp")
+	defer f.Close()
+
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	if err := control(network, laddr, rc); err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(s, sa); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return net.FilePacketConn(f)
+}
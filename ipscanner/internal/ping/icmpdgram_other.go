@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+
+package ping
+
+import (
+	"errors"
+	"net"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+)
+
+// listenICMPDatagram fails, unprivileged ICMP sockets are only controlled on
+// linux, where iputils.SocketControl has something to apply.
+func listenICMPDatagram(string, string, statute.TControlFunc) (net.PacketConn, error) {
+	return nil, errors.New("unprivileged icmp sockets can only be controlled on linux")
+}
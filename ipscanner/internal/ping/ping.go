@@ -4,58 +4,187 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
 )
 
 type Ping struct {
 	Options *statute.ScannerOptions
+	// WarpPorts, if set, returns the ports a warp ping of ip picks from,
+	// given the configured ones.
+	WarpPorts func(ip netip.Addr, ports []uint16) []uint16
 }
 
-// DoPing performs a ping on the given IP address.
+// DoPing performs a ping on the given IP address by running it through the
+// stages of the ping pipeline. Every stage but the last pings once and rejects
+// the IP if the ping fails or takes longer than the RTT budget of the stage.
+// The last stage is repeated Options.PingSamples times and the samples are
+// folded into a single IPInfo carrying the mean RTT, jitter and loss
+// percentage. Pre-filter stages whose ping isn't available at all, such as
+// ICMP without the needed privileges, are skipped.
+//
+// Without an explicit Options.Pipeline the stages follow SelectedOps: if ICMP
+// is selected along with another operation, IPs that don't answer a single
+// echo request are rejected before the other operation runs.
 func (p *Ping) DoPing(ip netip.Addr) (statute.IPInfo, error) {
-	if p.Options.SelectedOps&statute.HTTPPing > 0 {
-		res, err := p.httpPing(ip)
+	stages, err := p.pipeline()
+	if err != nil {
+		return statute.IPInfo{}, err
+	}
+
+	last := len(stages) - 1
+	for _, stage := range stages[:last] {
+		op, err := p.operation(stage.Op)
 		if err != nil {
 			return statute.IPInfo{}, err
 		}
 
-		return res, nil
-	}
-	if p.Options.SelectedOps&statute.TLSPing > 0 {
-		res, err := p.tlsPing(ip)
+		info, err := op(ip)
+		if errors.Is(err, errICMPUnavailable) {
+			continue
+		}
 		if err != nil {
-			return statute.IPInfo{}, err
+			return statute.IPInfo{}, fmt.Errorf("%s stage: %w", opName(stage.Op), err)
+		}
+		if stage.MaxRTT > 0 && info.RTT > stage.MaxRTT {
+			return statute.IPInfo{}, fmt.Errorf("%s stage: %w: %s", opName(stage.Op), statute.ErrRTTBudget, info.RTT)
 		}
+	}
 
-		return res, nil
+	return p.sample(ip, stages[last])
+}
+
+// pipeline returns the stages every IP goes through, the last one being the
+// ping whose result is reported.
+func (p *Ping) pipeline() ([]statute.PingStage, error) {
+	if len(p.Options.Pipeline) > 0 {
+		return p.Options.Pipeline, nil
 	}
-	if p.Options.SelectedOps&statute.TCPPing > 0 {
-		res, err := p.tcpPing(ip)
-		if err != nil {
-			return statute.IPInfo{}, err
-		}
 
-		return res, nil
+	ops := p.Options.SelectedOps
+	var stages []statute.PingStage
+	if ops&statute.ICMPPing > 0 && ops != statute.ICMPPing {
+		stages = append(stages, statute.PingStage{Op: statute.ICMPPing})
 	}
-	if p.Options.SelectedOps&statute.QUICPing > 0 {
-		res, err := p.quicPing(ip)
-		if err != nil {
-			return statute.IPInfo{}, err
+
+	for _, op := range []int{
+		statute.HTTPPing,
+		statute.TLSPing,
+		statute.TCPPing,
+		statute.QUICPing,
+		statute.WARPPing,
+		statute.ICMPPing,
+	} {
+		if ops&op > 0 {
+			return append(stages, statute.PingStage{Op: op}), nil
 		}
+	}
+
+	return nil, errors.New("no ping operation selected")
+}
+
+// sample runs the ping of stage Options.PingSamples times.
+func (p *Ping) sample(ip netip.Addr, stage statute.PingStage) (statute.IPInfo, error) {
+	op, err := p.operation(stage.Op)
+	if err != nil {
+		return statute.IPInfo{}, err
+	}
 
-		return res, nil
+	samples := p.Options.PingSamples
+	if samples < 1 {
+		samples = 1
 	}
-	if p.Options.SelectedOps&statute.WARPPing > 0 {
-		res, err := p.warpPing(ip)
+
+	var (
+		res     statute.IPInfo
+		rtts    []time.Duration
+		lastErr error
+	)
+	for i := 0; i < samples; i++ {
+		info, err := op(ip)
 		if err != nil {
-			return statute.IPInfo{}, err
+			lastErr = err
+			continue
+		}
+		if len(rtts) == 0 {
+			res = info
 		}
+		rtts = append(rtts, info.RTT)
+	}
 
-		return res, nil
+	if len(rtts) == 0 {
+		return statute.IPInfo{}, lastErr
 	}
 
-	return statute.IPInfo{}, errors.New("no ping operation selected")
+	res.RTT, res.Jitter = rttStats(rtts)
+	res.Loss = float64(samples-len(rtts)) / float64(samples) * 100
+	if stage.MaxRTT > 0 && res.RTT > stage.MaxRTT {
+		return statute.IPInfo{}, fmt.Errorf("%s stage: %w: %s", opName(stage.Op), statute.ErrRTTBudget, res.RTT)
+	}
+	return res, nil
+}
+
+// operation returns the ping function of op, which must be a single
+// operation.
+func (p *Ping) operation(op int) (func(netip.Addr) (statute.IPInfo, error), error) {
+	switch op {
+	case statute.HTTPPing:
+		return p.httpPing, nil
+	case statute.TLSPing:
+		return p.tlsPing, nil
+	case statute.TCPPing:
+		return p.tcpPing, nil
+	case statute.QUICPing:
+		return p.quicPing, nil
+	case statute.WARPPing:
+		return p.warpPing, nil
+	case statute.ICMPPing:
+		return p.icmpPing, nil
+	}
+
+	return nil, fmt.Errorf("unknown ping operation %d", op)
+}
+
+func opName(op int) string {
+	switch op {
+	case statute.HTTPPing:
+		return "http"
+	case statute.TLSPing:
+		return "tls"
+	case statute.TCPPing:
+		return "tcp"
+	case statute.QUICPing:
+		return "quic"
+	case statute.WARPPing:
+		return "warp"
+	case statute.ICMPPing:
+		return "icmp"
+	default:
+		return "unknown"
+	}
+}
+
+// rttStats returns the mean of rtts and the mean absolute difference between
+// consecutive samples.
+func rttStats(rtts []time.Duration) (mean, jitter time.Duration) {
+	var sum, diffs time.Duration
+	for i, rtt := range rtts {
+		sum += rtt
+		if i > 0 {
+			d := rtt - rtts[i-1]
+			if d < 0 {
+				d = -d
+			}
+			diffs += d
+		}
+	}
+
+	mean = sum / time.Duration(len(rtts))
+	if len(rtts) > 1 {
+		jitter = diffs / time.Duration(len(rtts)-1)
+	}
+	return mean, jitter
 }
 
 func (p *Ping) httpPing(ip netip.Addr) (statute.IPInfo, error) {
@@ -75,7 +204,11 @@ func (p *Ping) httpPing(ip netip.Addr) (statute.IPInfo, error) {
 }
 
 func (p *Ping) warpPing(ip netip.Addr) (statute.IPInfo, error) {
-	return p.calc(NewWarpPing(ip, p.Options))
+	w := NewWarpPing(ip, p.Options)
+	if p.WarpPorts != nil {
+		w.Ports = p.WarpPorts(ip, w.Ports)
+	}
+	return p.calc(w)
 }
 
 func (p *Ping) tlsPing(ip netip.Addr) (statute.IPInfo, error) {
@@ -96,6 +229,10 @@ func (p *Ping) quicPing(ip netip.Addr) (statute.IPInfo, error) {
 	)
 }
 
+func (p *Ping) icmpPing(ip netip.Addr) (statute.IPInfo, error) {
+	return p.calc(NewIcmpPing(ip, p.Options))
+}
+
 func (p *Ping) calc(tp statute.IPing) (statute.IPInfo, error) {
 	pr := tp.Ping()
 	err := pr.Error()
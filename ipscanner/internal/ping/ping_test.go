@@ -0,0 +1,135 @@
+package ping
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestPipelineFromSelectedOps(t *testing.T) {
+	tests := []struct {
+		ops  int
+		want []statute.PingStage
+	}{{
+		ops:  statute.TCPPing,
+		want: []statute.PingStage{{Op: statute.TCPPing}},
+	}, {
+		ops:  statute.ICMPPing,
+		want: []statute.PingStage{{Op: statute.ICMPPing}},
+	}, {
+		ops:  statute.ICMPPing | statute.WARPPing,
+		want: []statute.PingStage{{Op: statute.ICMPPing}, {Op: statute.WARPPing}},
+	}, {
+		ops:  statute.TLSPing | statute.TCPPing,
+		want: []statute.PingStage{{Op: statute.TLSPing}},
+	}}
+
+	for _, test := range tests {
+		p := Ping{Options: &statute.ScannerOptions{SelectedOps: test.ops}}
+		stages, err := p.pipeline()
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, stages, qt.DeepEquals, test.want, qt.Commentf("ops %b", test.ops))
+	}
+
+	p := Ping{Options: &statute.ScannerOptions{}}
+	_, err := p.pipeline()
+	qt.Assert(t, err, qt.IsNotNil)
+}
+
+// fakeDialer answers TCP pings after delay, failing the dials for which fail
+// returns true. It counts the dials in n.
+type fakeDialer struct {
+	delay time.Duration
+	fail  func(n int) bool
+	n     int
+}
+
+func (d *fakeDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.n++
+	time.Sleep(d.delay)
+	if d.fail != nil && d.fail(d.n) {
+		return nil, syscall.ECONNREFUSED
+	}
+	c, s := net.Pipe()
+	s.Close()
+	return c, nil
+}
+
+func testPing(d *fakeDialer, samples int, stages ...statute.PingStage) *Ping {
+	return &Ping{Options: &statute.ScannerOptions{
+		RawDialerFunc: d.dial,
+		Port:          443,
+		PingSamples:   samples,
+		Pipeline:      stages,
+	}}
+}
+
+var testIP = netip.MustParseAddr("192.0.2.1")
+
+func TestDoPingStageFails(t *testing.T) {
+	d := &fakeDialer{fail: func(n int) bool { return n == 1 }}
+	p := testPing(d, 3, statute.PingStage{Op: statute.TCPPing}, statute.PingStage{Op: statute.TCPPing})
+
+	_, err := p.DoPing(testIP)
+	qt.Assert(t, err, qt.ErrorIs, syscall.ECONNREFUSED)
+	qt.Assert(t, err, qt.ErrorMatches, "tcp stage: .*")
+	// the samples of the last stage are never sent
+	qt.Assert(t, d.n, qt.Equals, 1)
+}
+
+func TestDoPingStageBudget(t *testing.T) {
+	d := &fakeDialer{delay: 20 * time.Millisecond}
+	p := testPing(d, 3,
+		statute.PingStage{Op: statute.TCPPing, MaxRTT: time.Millisecond},
+		statute.PingStage{Op: statute.TCPPing},
+	)
+
+	_, err := p.DoPing(testIP)
+	qt.Assert(t, err, qt.ErrorIs, statute.ErrRTTBudget)
+	qt.Assert(t, d.n, qt.Equals, 1)
+
+	// the budget of the last stage applies to the mean of its samples
+	d = &fakeDialer{delay: 20 * time.Millisecond}
+	p = testPing(d, 2, statute.PingStage{Op: statute.TCPPing, MaxRTT: time.Millisecond})
+	_, err = p.DoPing(testIP)
+	qt.Assert(t, err, qt.ErrorIs, statute.ErrRTTBudget)
+	qt.Assert(t, d.n, qt.Equals, 2)
+}
+
+func TestDoPingSamples(t *testing.T) {
+	// the pre-filter stage is the first dial, then every other sample fails
+	d := &fakeDialer{fail: func(n int) bool { return n > 1 && n%2 == 0 }}
+	p := testPing(d, 4,
+		statute.PingStage{Op: statute.TCPPing, MaxRTT: time.Second},
+		statute.PingStage{Op: statute.TCPPing, MaxRTT: time.Second},
+	)
+
+	info, err := p.DoPing(testIP)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, d.n, qt.Equals, 5)
+	qt.Assert(t, info.Loss, qt.Equals, 50.0)
+	qt.Assert(t, info.AddrPort, qt.Equals, netip.AddrPortFrom(testIP, 443))
+
+	d = &fakeDialer{fail: func(int) bool { return true }}
+	p = testPing(d, 3, statute.PingStage{Op: statute.TCPPing})
+	_, err = p.DoPing(testIP)
+	qt.Assert(t, err, qt.ErrorIs, syscall.ECONNREFUSED)
+	qt.Assert(t, d.n, qt.Equals, 3)
+}
+
+func TestRTTStats(t *testing.T) {
+	mean, jitter := rttStats([]time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 15 * time.Millisecond})
+	qt.Assert(t, mean, qt.Equals, 15*time.Millisecond)
+	qt.Assert(t, jitter, qt.Equals, 7500*time.Microsecond)
+
+	mean, jitter = rttStats([]time.Duration{10 * time.Millisecond})
+	qt.Assert(t, mean, qt.Equals, 10*time.Millisecond)
+	qt.Assert(t, jitter, qt.Equals, time.Duration(0))
+}
@@ -1,7 +1,10 @@
+//go:build !minimal
+
 package ping
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/netip"
@@ -17,12 +20,19 @@ type QuicPingResult struct {
 	AddrPort    netip.AddrPort
 	QUICVersion quic.VersionNumber
 	TLSVersion  uint16
+	ALPN        string
+	ZeroRTT     bool
 	RTT         time.Duration
 	Err         error
 }
 
 func (h *QuicPingResult) Result() statute.IPInfo {
-	return statute.IPInfo{AddrPort: h.AddrPort, RTT: h.RTT, CreatedAt: time.Now()}
+	return statute.IPInfo{
+		AddrPort:  h.AddrPort,
+		RTT:       h.RTT,
+		CreatedAt: time.Now(),
+		QUIC:      &statute.QUICInfo{Version: uint32(h.QUICVersion), ALPN: h.ALPN, ZeroRTT: h.ZeroRTT},
+	}
 }
 
 func (h *QuicPingResult) Error() error {
@@ -34,7 +44,7 @@ func (h *QuicPingResult) String() string {
 		return fmt.Sprintf("%s", h.Err)
 	}
 
-	return fmt.Sprintf("%s: quic=%s, tls=%s, time=%d ms", h.AddrPort, quic.VersionNumber(h.QUICVersion), statute.TlsVersionToString(h.TLSVersion), h.RTT)
+	return fmt.Sprintf("%s: quic=%s, tls=%s, alpn=%s, 0-rtt=%t, time=%d ms", h.AddrPort, quic.VersionNumber(h.QUICVersion), statute.TlsVersionToString(h.TLSVersion), h.ALPN, h.ZeroRTT, h.RTT)
 }
 
 type QuicPing struct {
@@ -56,24 +66,101 @@ func (h *QuicPing) PingContext(ctx context.Context) statute.IPingResult {
 
 	addr := netip.AddrPortFrom(h.IP, h.Port)
 
+	tlsCfg := statute.QUICTLSConfig(addr.String())
+	var tickets *ticketCache
+	if h.opts.QUICCheck0RTT {
+		tickets = newTicketCache()
+		tlsCfg.ClientSessionCache = tickets
+	}
+
 	t0 := time.Now()
-	conn, err := h.opts.QuicDialerFunc(ctx, addr.String(), nil, nil)
+	conn, err := h.opts.QuicDialerFunc(ctx, addr.String(), tlsCfg, statute.QUICConfig())
 	if err != nil {
 		return h.errorResult(err)
 	}
+	rtt := time.Since(t0)
+	defer conn.CloseWithError(quic.ApplicationErrorCode(uint64(http3.ErrCodeNoError)), "")
 
+	if err := waitHandshake(ctx, conn); err != nil {
+		return h.errorResult(err)
+	}
+	state := conn.ConnectionState()
 	res := QuicPingResult{
 		AddrPort:    addr,
-		RTT:         time.Since(t0),
-		QUICVersion: conn.ConnectionState().Version,
-		TLSVersion:  conn.ConnectionState().TLS.Version,
+		RTT:         rtt,
+		QUICVersion: state.Version,
+		TLSVersion:  state.TLS.Version,
+		ALPN:        state.TLS.NegotiatedProtocol,
 		Err:         nil,
 	}
 
-	defer conn.CloseWithError(quic.ApplicationErrorCode(uint64(http3.ErrCodeNoError)), "")
+	if tickets != nil {
+		res.ZeroRTT, err = h.check0RTT(ctx, addr.String(), tlsCfg, tickets)
+		if err != nil {
+			return h.errorResult(err)
+		}
+	}
+
 	return &res
 }
 
+// check0RTT waits for a session ticket of the connection to addr that stores
+// its tickets in tickets, then resumes it and reports whether the 0-RTT data
+// of the new connection was accepted.
+func (h *QuicPing) check0RTT(ctx context.Context, addr string, tlsCfg *tls.Config, tickets *ticketCache) (bool, error) {
+	select {
+	case <-tickets.stored:
+	case <-time.After(h.opts.HandshakeTimeout):
+		// no ticket, nothing to resume
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	conn, err := h.opts.QuicDialerFunc(ctx, addr, tlsCfg, statute.QUICConfig())
+	if err != nil {
+		return false, fmt.Errorf("resuming: %w", err)
+	}
+	defer conn.CloseWithError(quic.ApplicationErrorCode(uint64(http3.ErrCodeNoError)), "")
+
+	if err := waitHandshake(ctx, conn); err != nil {
+		return false, fmt.Errorf("resuming: %w", err)
+	}
+	return conn.ConnectionState().Used0RTT, nil
+}
+
+// waitHandshake waits for the handshake of conn to complete.
+func waitHandshake(ctx context.Context, conn quic.EarlyConnection) error {
+	select {
+	case <-conn.HandshakeComplete():
+		return nil
+	case <-conn.Context().Done():
+		return context.Cause(conn.Context())
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ticketCache is a session cache signaling when it stores a ticket.
+type ticketCache struct {
+	tls.ClientSessionCache
+	stored chan struct{}
+}
+
+func newTicketCache() *ticketCache {
+	return &ticketCache{ClientSessionCache: tls.NewLRUClientSessionCache(1), stored: make(chan struct{}, 1)}
+}
+
+func (c *ticketCache) Put(key string, cs *tls.ClientSessionState) {
+	c.ClientSessionCache.Put(key, cs)
+	if cs != nil {
+		select {
+		case c.stored <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func NewQuicPing(ip netip.Addr, host string, port uint16, opts *statute.ScannerOptions) *QuicPing {
 	return &QuicPing{
 		IP:   ip,
@@ -0,0 +1,52 @@
+//go:build minimal
+
+package ping
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+)
+
+type QuicPingResult struct {
+	AddrPort netip.AddrPort
+	Err      error
+}
+
+func (h *QuicPingResult) Result() statute.IPInfo {
+	return statute.IPInfo{AddrPort: h.AddrPort, CreatedAt: time.Now()}
+}
+
+func (h *QuicPingResult) Error() error {
+	return h.Err
+}
+
+func (h *QuicPingResult) String() string {
+	return h.Err.Error()
+}
+
+// QuicPing fails every ping with statute.ErrNoQUIC, minimal builds leave
+// out QUIC.
+type QuicPing struct {
+	IP   netip.Addr
+	Port uint16
+}
+
+func (h *QuicPing) Ping() statute.IPingResult {
+	return h.PingContext(context.Background())
+}
+
+func (h *QuicPing) PingContext(context.Context) statute.IPingResult {
+	return &QuicPingResult{AddrPort: netip.AddrPortFrom(h.IP, h.Port), Err: statute.ErrNoQUIC}
+}
+
+func NewQuicPing(ip netip.Addr, _ string, port uint16, _ *statute.ScannerOptions) *QuicPing {
+	return &QuicPing{IP: ip, Port: port}
+}
+
+var (
+	_ statute.IPing       = (*QuicPing)(nil)
+	_ statute.IPingResult = (*QuicPingResult)(nil)
+)
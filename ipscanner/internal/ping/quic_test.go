@@ -0,0 +1,27 @@
+//go:build !minimal
+
+package ping
+
+import (
+	"crypto/tls"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestTicketCache(t *testing.T) {
+	c := newTicketCache()
+
+	c.Put("example.com", nil)
+	select {
+	case <-c.stored:
+		t.Fatal("removing a ticket signaled a stored one")
+	default:
+	}
+
+	c.Put("example.com", &tls.ClientSessionState{})
+	c.Put("example.com", &tls.ClientSessionState{})
+	<-c.stored
+	_, ok := c.Get("example.com")
+	qt.Assert(t, ok, qt.IsTrue)
+}
@@ -46,6 +46,7 @@ type WarpPing struct {
 	PrivateKey    string
 	PeerPublicKey string
 	PresharedKey  string
+	Ports         []uint16
 	IP            netip.Addr
 
 	opts statute.ScannerOptions
@@ -55,13 +56,22 @@ func (h *WarpPing) Ping() statute.IPingResult {
 	return h.PingContext(context.Background())
 }
 
-func (h *WarpPing) PingContext(_ context.Context) statute.IPingResult {
-	addr := netip.AddrPortFrom(h.IP, warp.RandomWarpPort())
+func (h *WarpPing) PingContext(ctx context.Context) statute.IPingResult {
+	port := warp.RandomWarpPort()
+	if len(h.Ports) > 0 {
+		port = h.Ports[randomInt(0, len(h.Ports)-1)]
+	}
+
+	addr := netip.AddrPortFrom(h.IP, port)
 	rtt, err := initiateHandshake(
+		ctx,
 		addr,
 		h.PrivateKey,
 		h.PeerPublicKey,
 		h.PresharedKey,
+		h.opts.SocketControl,
+		h.opts.PacketListenFunc,
+		h.opts.WarpValidateSource,
 	)
 	if err != nil {
 		return h.errorResult(err)
@@ -125,7 +135,11 @@ func randomInt(min, max int) int {
 	return int(nBig.Int64()) + min
 }
 
-func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64 string) (time.Duration, error) {
+// initiateHandshake completes a warp handshake with serverAddr and returns
+// its round trip time. With a valid dataSource, the endpoint must also answer
+// a ping from that interface address through the tunnel, see
+// validateDataChannel.
+func initiateHandshake(ctx context.Context, serverAddr netip.AddrPort, privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64 string, control statute.TControlFunc, listen statute.TPacketListenFunc, dataSource netip.Addr) (time.Duration, error) {
 	staticKeyPair, err := staticKeypair(privateKeyBase64)
 	if err != nil {
 		return 0, err
@@ -183,7 +197,7 @@ func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKe
 
 	initiationPacket := new(bytes.Buffer)
 	binary.Write(initiationPacket, binary.BigEndian, []byte{0x01, 0x00, 0x00, 0x00})
-	binary.Write(initiationPacket, binary.BigEndian, uint32ToBytes(28))
+	binary.Write(initiationPacket, binary.BigEndian, uint32ToBytes(warpSenderIndex))
 	binary.Write(initiationPacket, binary.BigEndian, msg)
 
 	macKey := blake2s.Sum256(append([]byte("mac1----"), peerPublicKey...))
@@ -201,7 +215,7 @@ func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKe
 	binary.Write(initiationPacket, binary.BigEndian, initiationPacketMAC[:16])
 	binary.Write(initiationPacket, binary.BigEndian, [16]byte{})
 
-	conn, err := net.Dial("udp", serverAddr.String())
+	conn, err := dialUDP(ctx, serverAddr, control, listen)
 	if err != nil {
 		return 0, err
 	}
@@ -253,14 +267,14 @@ func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKe
 
 	// Extract sender and receiver index from the response
 	// peer index
-	_ = binary.LittleEndian.Uint32(response[4:8])
-	// our index(we set it to 28)
+	peerIndex := binary.LittleEndian.Uint32(response[4:8])
+	// our index(we set it to warpSenderIndex)
 	ourIndex := binary.LittleEndian.Uint32(response[8:12])
-	if ourIndex != 28 { // Check if the response corresponds to our sender index
+	if ourIndex != warpSenderIndex { // Check if the response corresponds to our sender index
 		return 0, errors.New("invalid sender index in response")
 	}
 
-	payload, _, _, err := hs.ReadMessage(nil, response[12:60])
+	payload, send, recv, err := hs.ReadMessage(nil, response[12:60])
 	if err != nil {
 		return 0, err
 	}
@@ -270,14 +284,68 @@ func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKe
 		return 0, errors.New("unexpected payload in response")
 	}
 
+	if dataSource.IsValid() {
+		if err := validateDataChannel(ctx, conn, dataSource, peerIndex, send, recv); err != nil {
+			return 0, err
+		}
+	}
+
 	return rtt, nil
 }
 
+// WarpHandshake completes a warp handshake with serverAddr over a socket
+// opened by listen and returns its round trip time.
+func WarpHandshake(ctx context.Context, serverAddr netip.AddrPort, privateKeyBase64, peerPublicKeyBase64 string, listen statute.TPacketListenFunc) (time.Duration, error) {
+	return initiateHandshake(ctx, serverAddr, privateKeyBase64, peerPublicKeyBase64, "", nil, listen, netip.Addr{})
+}
+
+// dialUDP connects a UDP socket to addr, one opened by listen if it is set.
+func dialUDP(ctx context.Context, addr netip.AddrPort, control statute.TControlFunc, listen statute.TPacketListenFunc) (net.Conn, error) {
+	if listen == nil {
+		d := net.Dialer{Control: control}
+		return d.DialContext(ctx, "udp", addr.String())
+	}
+
+	pc, err := listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{PacketConn: pc, remote: net.UDPAddrFromAddrPort(addr)}, nil
+}
+
+// packetConn is a PacketConn connected to remote: it only sends there and
+// drops datagrams from elsewhere.
+type packetConn struct {
+	net.PacketConn
+	remote *net.UDPAddr
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if addr.String() == c.remote.String() {
+			return n, nil
+		}
+	}
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.remote)
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
 func NewWarpPing(ip netip.Addr, opts *statute.ScannerOptions) *WarpPing {
 	return &WarpPing{
 		PrivateKey:    opts.WarpPrivateKey,
 		PeerPublicKey: opts.WarpPeerPublicKey,
 		PresharedKey:  opts.WarpPresharedKey,
+		Ports:         opts.WarpPorts,
 		IP:            ip,
 
 		opts: *opts,
@@ -0,0 +1,53 @@
+package ping
+
+import (
+	"context"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/warptest"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestInitiateHandshake(t *testing.T) {
+	network, err := warptest.NewNetwork()
+	qt.Assert(t, err, qt.IsNil)
+	privateKey, err := warptest.NewPrivateKey()
+	qt.Assert(t, err, qt.IsNil)
+
+	live := netip.MustParseAddrPort("192.0.2.1:2408")
+	blocked := netip.MustParseAddrPort("192.0.2.2:2408")
+	endpoint := network.Add(live)
+	network.Add(blocked).DropData = true
+
+	source := netip.MustParseAddr("100.96.0.7")
+	endpoint.Address = source
+
+	handshake := func(ctx context.Context, addr netip.AddrPort, dataSource netip.Addr) error {
+		_, err := initiateHandshake(ctx, addr, privateKey, network.PublicKey(), "", nil, network.Listen, dataSource)
+		return err
+	}
+
+	qt.Assert(t, handshake(context.Background(), live, netip.Addr{}), qt.IsNil)
+	qt.Assert(t, handshake(context.Background(), live, source), qt.IsNil)
+	qt.Assert(t, endpoint.Handshakes(), qt.Equals, 2)
+
+	// the handshake goes through, the ping after it doesn't
+	qt.Assert(t, handshake(context.Background(), blocked, netip.Addr{}), qt.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	qt.Assert(t, handshake(ctx, blocked, source), qt.ErrorIs, context.DeadlineExceeded)
+	qt.Assert(t, time.Since(start) < dataChannelTimeout, qt.IsTrue)
+
+	// warp only answers pings from the address it gave the identity
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	qt.Assert(t, handshake(ctx, live, netip.MustParseAddr("172.16.0.2")), qt.ErrorIs, context.DeadlineExceeded)
+
+	err = handshake(context.Background(), netip.MustParseAddrPort("192.0.2.3:2408"), netip.Addr{})
+	qt.Assert(t, err, qt.ErrorIs, syscall.ECONNREFUSED)
+}
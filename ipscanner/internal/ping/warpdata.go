@@ -0,0 +1,162 @@
+package ping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/flynn/noise"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// warpSenderIndex is the sender index of the handshake initiation of a warp
+// ping, which the endpoint addresses its packets to.
+const warpSenderIndex = 28
+
+// tunnelEchoDest is what the data channel check pings through the tunnel.
+var tunnelEchoDest = netip.MustParseAddr("1.1.1.1")
+
+// dataChannelTimeout bounds how long the data channel check waits for the
+// reply, unless ctx ends sooner.
+const dataChannelTimeout = 5 * time.Second
+
+// validateDataChannel sends an ICMP echo request from source, the interface
+// address of the identity, through the session a handshake on conn
+// established and waits for the reply until ctx is done or
+// dataChannelTimeout passed. Some networks let handshakes through but drop
+// the data packets after them, which leaves an endpoint that pings fine but
+// carries nothing.
+func validateDataChannel(ctx context.Context, conn net.Conn, source netip.Addr, peerIndex uint32, send, recv *noise.CipherState) error {
+	if !source.Is4() {
+		return fmt.Errorf("data channel check needs an ipv4 interface address, not %s", source)
+	}
+
+	id := uint16(randomInt(1, 0xffff))
+	packet, err := sealTransport(peerIndex, send, tunnelEchoRequest(source, id))
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(packet); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(dataChannelTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetReadDeadline(deadline)
+	// cancellation unblocks the read too
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			// the read deadline may pass just before ctx notices its own
+			if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+				return context.DeadlineExceeded
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("no reply on the data channel: %w", err)
+		}
+
+		// skip keepalives, junk and retransmitted handshake responses
+		payload, err := openTransport(buf[:n], recv)
+		if err != nil || !isTunnelEchoReply(payload, id) {
+			continue
+		}
+		return nil
+	}
+}
+
+// sealTransport encrypts payload, padded to 16 bytes as wireguard does, into
+// a transport data message to the peer at receiver.
+func sealTransport(receiver uint32, send *noise.CipherState, payload []byte) ([]byte, error) {
+	if r := len(payload) % 16; r != 0 {
+		payload = append(payload, make([]byte, 16-r)...)
+	}
+
+	header := make([]byte, 16, 16+len(payload)+16)
+	header[0] = 4
+	binary.LittleEndian.PutUint32(header[4:8], receiver)
+	binary.LittleEndian.PutUint64(header[8:16], send.Nonce())
+	return send.Encrypt(header, nil, payload)
+}
+
+// openTransport decrypts a transport data message to warpSenderIndex.
+func openTransport(packet []byte, recv *noise.CipherState) ([]byte, error) {
+	if len(packet) < 32 || packet[0] != 4 {
+		return nil, errors.New("not a transport data message")
+	}
+	if binary.LittleEndian.Uint32(packet[4:8]) != warpSenderIndex {
+		return nil, errors.New("transport data message to another receiver")
+	}
+
+	recv.SetNonce(binary.LittleEndian.Uint64(packet[8:16]))
+	return recv.Decrypt(nil, nil, packet[16:])
+}
+
+// tunnelEchoRequest returns an IPv4 packet with an ICMP echo request from
+// source to tunnelEchoDest.
+func tunnelEchoRequest(source netip.Addr, id uint16) []byte {
+	msg, _ := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: int(id), Seq: 1, Data: []byte("warp-plus")},
+	}).Marshal(nil)
+
+	src, dst := source.As4(), tunnelEchoDest.As4()
+	packet := make([]byte, ipv4.HeaderLen, ipv4.HeaderLen+len(msg))
+	packet[0] = 4<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(packet[2:4], uint16(ipv4.HeaderLen+len(msg)))
+	packet[8] = 64 // ttl
+	packet[9] = 1  // icmp
+	copy(packet[12:16], src[:])
+	copy(packet[16:20], dst[:])
+	binary.BigEndian.PutUint16(packet[10:12], ipChecksum(packet))
+
+	return append(packet, msg...)
+}
+
+// isTunnelEchoReply reports whether packet is an IPv4 packet with the ICMP
+// echo reply to the request with id.
+func isTunnelEchoReply(packet []byte, id uint16) bool {
+	// parsed by hand, ipv4.ParseHeader expects the byte order of raw
+	// sockets on some platforms
+	if len(packet) < ipv4.HeaderLen || packet[0]>>4 != 4 || packet[9] != 1 {
+		return false
+	}
+	hdrLen, totalLen := int(packet[0]&0x0f)*4, int(binary.BigEndian.Uint16(packet[2:4]))
+	if hdrLen < ipv4.HeaderLen || totalLen > len(packet) || hdrLen > totalLen {
+		return false
+	}
+
+	msg, err := icmp.ParseMessage(1, packet[hdrLen:totalLen])
+	if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+		return false
+	}
+	echo, ok := msg.Body.(*icmp.Echo)
+	return ok && echo.ID == int(id)
+}
+
+// ipChecksum returns the internet checksum of b.
+func ipChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
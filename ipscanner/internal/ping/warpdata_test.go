@@ -0,0 +1,76 @@
+package ping
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/flynn/noise"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// testSession returns the cipher states an initiator sends with and a
+// responder receives with.
+func testSession(t *testing.T) (send, recv *noise.CipherState) {
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	initiator, err := noise.NewHandshakeState(noise.Config{CipherSuite: cs, Pattern: noise.HandshakeNN, Initiator: true, Random: rand.Reader})
+	qt.Assert(t, err, qt.IsNil)
+	responder, err := noise.NewHandshakeState(noise.Config{CipherSuite: cs, Pattern: noise.HandshakeNN, Random: rand.Reader})
+	qt.Assert(t, err, qt.IsNil)
+
+	msg, _, _, err := initiator.WriteMessage(nil, nil)
+	qt.Assert(t, err, qt.IsNil)
+	_, _, _, err = responder.ReadMessage(nil, msg)
+	qt.Assert(t, err, qt.IsNil)
+	msg, recv, _, err = responder.WriteMessage(nil, nil)
+	qt.Assert(t, err, qt.IsNil)
+	_, send, _, err = initiator.ReadMessage(nil, msg)
+	qt.Assert(t, err, qt.IsNil)
+	return send, recv
+}
+
+func TestTransportRoundTrip(t *testing.T) {
+	send, recv := testSession(t)
+
+	request := tunnelEchoRequest(netip.MustParseAddr("172.16.0.2"), 42)
+	qt.Assert(t, ipChecksum(request[:ipv4.HeaderLen]), qt.Equals, uint16(0))
+
+	// the second packet must open even if the first one was lost
+	_, err := sealTransport(warpSenderIndex, send, request)
+	qt.Assert(t, err, qt.IsNil)
+	packet, err := sealTransport(warpSenderIndex, send, request)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, packet[0], qt.Equals, byte(4))
+	qt.Assert(t, binary.LittleEndian.Uint64(packet[8:16]), qt.Equals, uint64(1))
+	qt.Assert(t, (len(packet)-32)%16, qt.Equals, 0)
+
+	payload, err := openTransport(packet, recv)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, payload[:len(request)], qt.DeepEquals, request)
+
+	binary.LittleEndian.PutUint32(packet[4:8], 7)
+	_, err = openTransport(packet, recv)
+	qt.Assert(t, err, qt.ErrorMatches, ".*another receiver")
+}
+
+func TestTunnelEchoReply(t *testing.T) {
+	request := tunnelEchoRequest(netip.MustParseAddr("172.16.0.2"), 42)
+	qt.Assert(t, isTunnelEchoReply(request, 42), qt.IsFalse)
+
+	reply, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: 42, Seq: 1, Data: []byte("warp-plus")},
+	}).Marshal(nil)
+	qt.Assert(t, err, qt.IsNil)
+	packet := append(append([]byte(nil), request[:ipv4.HeaderLen]...), reply...)
+	// padded like the payload of a transport message
+	packet = append(packet, make([]byte, 7)...)
+
+	qt.Assert(t, isTunnelEchoReply(packet, 42), qt.IsTrue)
+	qt.Assert(t, isTunnelEchoReply(packet, 43), qt.IsFalse)
+	qt.Assert(t, isTunnelEchoReply(packet[:10], 42), qt.IsFalse)
+}
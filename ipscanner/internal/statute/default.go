@@ -2,18 +2,24 @@ package statute
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"net"
 	"net/http"
 	"net/netip"
+	"slices"
 	"time"
-
-	"github.com/quic-go/quic-go"
-	"github.com/quic-go/quic-go/http3"
 )
 
 var FinalOptions *ScannerOptions
 
+// ErrSPKIPinMismatch is returned by TLS and QUIC pings when SPKI pinning is
+// enabled and the peer's certificate chain has none of the pinned keys, which
+// usually means the connection was terminated by an interception device.
+var ErrSPKIPinMismatch = errors.New("certificate does not match any pinned public key")
+
 func DefaultHTTPClientFunc(rawDialer TDialerFunc, tlsDialer TDialerFunc, quicDialer TQuicDialerFunc, targetAddr ...string) *http.Client {
 	var defaultDialer TDialerFunc
 	if rawDialer == nil {
@@ -27,25 +33,10 @@ func DefaultHTTPClientFunc(rawDialer TDialerFunc, tlsDialer TDialerFunc, quicDia
 	} else {
 		defaultTLSDialer = tlsDialer
 	}
-	var defaultQuicDialer TQuicDialerFunc
-	if quicDialer == nil {
-		defaultQuicDialer = DefaultQuicDialerFunc
-	} else {
-		defaultQuicDialer = quicDialer
-	}
 
 	var transport http.RoundTripper
 	if FinalOptions.UseHTTP3 {
-		transport = &http3.RoundTripper{
-			DisableCompression: FinalOptions.DisableCompression,
-			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
-				dest := addr
-				if len(targetAddr) > 0 {
-					dest = targetAddr[0]
-				}
-				return defaultQuicDialer(ctx, dest, tlsCfg, cfg)
-			},
-		}
+		transport = http3Transport(quicDialer, targetAddr)
 	} else {
 		trans := &http.Transport{
 			DialContext:         defaultDialer,
@@ -73,6 +64,7 @@ func DefaultHTTPClientFunc(rawDialer TDialerFunc, tlsDialer TDialerFunc, quicDia
 func DefaultDialerFunc(ctx context.Context, network, addr string) (net.Conn, error) {
 	d := &net.Dialer{
 		Timeout: FinalOptions.ConnectionTimeout, // Connection timeout
+		Control: FinalOptions.SocketControl,
 		// Add other custom settings as needed
 	}
 	return d.DialContext(ctx, network, addr)
@@ -108,13 +100,33 @@ func defaultTLSConfig(addr string) *tls.Config {
 	}
 
 	// Initiate a TLS handshake over the connection
-	return &tls.Config{
+	cfg := &tls.Config{
 		InsecureSkipVerify: allowInsecure || FinalOptions.InsecureSkipVerify,
 		ServerName:         sni,
 		MinVersion:         FinalOptions.TlsVersion,
 		MaxVersion:         FinalOptions.TlsVersion,
 		NextProtos:         alpnProtocols,
 	}
+
+	// VerifyConnection runs even if InsecureSkipVerify is set, so pinning
+	// works without trusting the system roots.
+	if len(FinalOptions.SPKIPins) > 0 {
+		cfg.VerifyConnection = verifySPKIPins
+	}
+
+	return cfg
+}
+
+// verifySPKIPins accepts the connection if any certificate in the peer's
+// chain has a pinned public key.
+func verifySPKIPins(cs tls.ConnectionState) error {
+	for _, cert := range cs.PeerCertificates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if slices.Contains(FinalOptions.SPKIPins, base64.StdEncoding.EncodeToString(sum[:])) {
+			return nil
+		}
+	}
+	return ErrSPKIPinMismatch
 }
 
 // DefaultTLSDialerFunc is a custom TLS dialer function
@@ -158,14 +170,6 @@ func DefaultTLSDialerFunc(ctx context.Context, network, addr string) (net.Conn,
 	return tlsClientConn, nil
 }
 
-func DefaultQuicDialerFunc(ctx context.Context, addr string, _ *tls.Config, _ *quic.Config) (quic.EarlyConnection, error) {
-	quicConfig := &quic.Config{
-		MaxIdleTimeout:       FinalOptions.ConnectionTimeout,
-		HandshakeIdleTimeout: FinalOptions.HandshakeTimeout,
-	}
-	return quic.DialAddrEarly(ctx, addr, defaultTLSConfig(addr), quicConfig)
-}
-
 func DefaultCFRanges() []netip.Prefix {
 	return []netip.Prefix{
 		netip.MustParsePrefix("103.21.244.0/22"),
@@ -3,9 +3,14 @@ package statute
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 )
 
+// ErrRTTBudget is returned when a ping succeeds but takes longer than the
+// RTT budget of its pipeline stage.
+var ErrRTTBudget = errors.New("rtt over stage budget")
+
 type IPingResult interface {
 	Result() IPInfo
 	Error() error
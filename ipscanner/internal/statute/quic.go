@@ -0,0 +1,114 @@
+//go:build !minimal
+
+package statute
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// TQuicDialerFunc opens the QUIC connections of QUIC pings and HTTP/3
+// requests.
+type TQuicDialerFunc func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error)
+
+// http3Transport returns the HTTP/3 transport of DefaultHTTPClientFunc,
+// dialing targetAddr, if set, in place of the request's address.
+func http3Transport(quicDialer TQuicDialerFunc, targetAddr []string) http.RoundTripper {
+	if quicDialer == nil {
+		quicDialer = DefaultQuicDialerFunc
+	}
+
+	return &http3.RoundTripper{
+		DisableCompression: FinalOptions.DisableCompression,
+		// the round tripper sets the h3 ALPN itself
+		TLSClientConfig: defaultTLSConfig(net.JoinHostPort(FinalOptions.Hostname, strconv.Itoa(int(FinalOptions.Port)))),
+		QuicConfig:      QUICConfig(),
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			dest := addr
+			if len(targetAddr) > 0 {
+				dest = targetAddr[0]
+			}
+			return quicDialer(ctx, dest, tlsCfg, cfg)
+		},
+	}
+}
+
+// QUICTLSConfig returns the TLS config of QUIC pings to addr, that of TLS
+// pings with the ALPN and server name of QUIC pings. QUIC always runs TLS 1.3.
+func QUICTLSConfig(addr string) *tls.Config {
+	cfg := defaultTLSConfig(addr)
+	cfg.MinVersion, cfg.MaxVersion = tls.VersionTLS13, tls.VersionTLS13
+	cfg.NextProtos = []string{"h3"}
+	if len(FinalOptions.QUICALPN) > 0 {
+		cfg.NextProtos = FinalOptions.QUICALPN
+	}
+	if FinalOptions.QUICServerName != "" {
+		cfg.ServerName = FinalOptions.QUICServerName
+	}
+	return cfg
+}
+
+// QUICConfig returns the quic config of QUIC pings and HTTP/3 requests.
+func QUICConfig() *quic.Config {
+	idle := FinalOptions.QUICIdleTimeout
+	if idle <= 0 {
+		idle = FinalOptions.ConnectionTimeout
+	}
+	return &quic.Config{
+		MaxIdleTimeout:       idle,
+		HandshakeIdleTimeout: FinalOptions.HandshakeTimeout,
+	}
+}
+
+// DefaultQuicDialerFunc dials addr with tlsCfg and cfg, or QUICTLSConfig and
+// QUICConfig if they are nil.
+func DefaultQuicDialerFunc(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	if tlsCfg == nil {
+		tlsCfg = QUICTLSConfig(addr)
+	}
+	if cfg == nil {
+		cfg = QUICConfig()
+	}
+	if FinalOptions.SocketControl == nil {
+		return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+	}
+
+	// quic-go only applies socket options to connections it doesn't own, so
+	// create the socket here and close it along with the connection
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := net.ListenConfig{Control: FinalOptions.SocketControl}
+	pconn, err := lc.ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := quic.DialEarly(ctx, pconn, udpAddr, tlsCfg, cfg)
+	if err != nil {
+		_ = pconn.Close()
+		return nil, err
+	}
+
+	return &packetConnClosingConn{EarlyConnection: conn, pconn: pconn}, nil
+}
+
+// packetConnClosingConn closes the underlying socket with the connection.
+type packetConnClosingConn struct {
+	quic.EarlyConnection
+	pconn net.PacketConn
+}
+
+func (c *packetConnClosingConn) CloseWithError(code quic.ApplicationErrorCode, desc string) error {
+	err := c.EarlyConnection.CloseWithError(code, desc)
+	_ = c.pconn.Close()
+	return err
+}
@@ -0,0 +1,29 @@
+//go:build minimal
+
+package statute
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrNoQUIC is returned by QUIC pings and HTTP/3 requests of minimal builds,
+// which leave out QUIC.
+var ErrNoQUIC = errors.New("quic is not included in this build")
+
+// TQuicDialerFunc is a placeholder in minimal builds, nothing calls it.
+type TQuicDialerFunc func()
+
+// DefaultQuicDialerFunc is nil in minimal builds.
+var DefaultQuicDialerFunc TQuicDialerFunc
+
+// http3Transport returns a transport failing every request with ErrNoQUIC.
+func http3Transport(TQuicDialerFunc, []string) http.RoundTripper {
+	return noQUICTransport{}
+}
+
+type noQUICTransport struct{}
+
+func (noQUICTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, ErrNoQUIC
+}
@@ -2,22 +2,22 @@ package statute
 
 import (
 	"context"
-	"crypto/tls"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/netip"
+	"syscall"
 	"time"
-
-	"github.com/quic-go/quic-go"
 )
 
 type TIPQueueChangeCallback func(ips []IPInfo)
 
 type (
 	TDialerFunc     func(ctx context.Context, network, addr string) (net.Conn, error)
-	TQuicDialerFunc func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error)
 	THTTPClientFunc func(rawDialer TDialerFunc, tlsDialer TDialerFunc, quicDialer TQuicDialerFunc, targetAddr ...string) *http.Client
+	TControlFunc    func(network, address string, c syscall.RawConn) error
+	// TPacketListenFunc opens a UDP socket, e.g. one relayed by a proxy
+	TPacketListenFunc func(ctx context.Context) (net.PacketConn, error)
 )
 
 var (
@@ -26,26 +26,62 @@ var (
 	TCPPing  = 1 << 3
 	QUICPing = 1 << 4
 	WARPPing = 1 << 5
+	ICMPPing = 1 << 6 // on its own or as a pre-filter for any other ping
 )
 
+// PingStage is one step of a ping pipeline. An IP moves on to the next stage
+// only if Op succeeds within MaxRTT.
+type PingStage struct {
+	Op     int           // a single ping operation, e.g. TCPPing
+	MaxRTT time.Duration // zero means no budget
+}
+
 type IPInfo struct {
 	AddrPort  netip.AddrPort
-	RTT       time.Duration
+	RTT       time.Duration // mean RTT of the successful samples
+	Jitter    time.Duration // mean deviation between consecutive samples
+	Loss      float64       // percentage of failed samples
 	CreatedAt time.Time
+	QUIC      *QUICInfo // what a QUIC ping negotiated, nil for other pings
+}
+
+// QUICInfo is what a QUIC ping negotiated with an IP.
+type QUICInfo struct {
+	Version uint32 // QUIC version
+	ALPN    string // application protocol
+	// ZeroRTT is whether a resumed connection had its 0-RTT data accepted,
+	// only checked with ScannerOptions.QUICCheck0RTT.
+	ZeroRTT bool
+}
+
+// lossPenalty is the score added for every percent of lost samples.
+const lossPenalty = 10 * time.Millisecond
+
+// Score ranks an IP for endpoint selection, lower is better. Jitter and loss
+// are weighted in so that a stable endpoint outranks a slightly faster but
+// flaky one.
+func (i IPInfo) Score() time.Duration {
+	return i.RTT + 2*i.Jitter + time.Duration(i.Loss*float64(lossPenalty))
 }
 
 type ScannerOptions struct {
 	UseIPv4               bool
 	UseIPv6               bool
 	CidrList              []netip.Prefix // CIDR ranges to scan
+	SeedIPs               []netip.Addr   // IPs pinged before any IP of CidrList
 	SelectedOps           int
 	Logger                *slog.Logger
 	InsecureSkipVerify    bool
+	SPKIPins              []string // base64 sha256 hashes of accepted certificate public keys, empty disables pinning
 	RawDialerFunc         TDialerFunc
 	TLSDialerFunc         TDialerFunc
 	QuicDialerFunc        TQuicDialerFunc
 	HttpClientFunc        THTTPClientFunc
 	UseHTTP3              bool
+	QUICALPN              []string      // application protocols of QUIC pings, empty means h3
+	QUICServerName        string        // sni of QUIC pings, empty means Hostname
+	QUICIdleTimeout       time.Duration // idle timeout of QUIC connections, zero means ConnectionTimeout
+	QUICCheck0RTT         bool          // QUIC pings resume their connection to check for 0-RTT
 	UseHTTP2              bool
 	DisableCompression    bool
 	HTTPPath              string
@@ -55,6 +91,8 @@ type ScannerOptions struct {
 	WarpPrivateKey        string
 	WarpPeerPublicKey     string
 	WarpPresharedKey      string
+	WarpPorts             []uint16   // candidate ports for warp ping, empty means warp.WarpPorts()
+	WarpValidateSource    netip.Addr // if valid, warp pings must also get an answer through the tunnel to a ping from this interface address, not just a handshake
 	Port                  uint16
 	IPQueueSize           int
 	IPQueueTTL            time.Duration
@@ -63,4 +101,12 @@ type ScannerOptions struct {
 	ConnectionTimeout     time.Duration
 	HandshakeTimeout      time.Duration
 	TlsVersion            uint16
+	Concurrency           int               // number of parallel ping workers
+	PingRate              float64           // maximum pings per second across all workers
+	PingSamples           int               // number of pings sent to each IP
+	SocketControl         TControlFunc      // applied to every ping socket, e.g. to bind it to an interface
+	PacketListenFunc      TPacketListenFunc // opens the sockets of warp pings in place of dialing directly, nil dials directly
+	ExcludeList           []netip.Prefix    // prefixes never to scan
+	StatePath             string            // file the scan position and bad IPs are kept in across runs, empty disables it
+	Pipeline              []PingStage       // chained pings, overrides SelectedOps when set
 }
@@ -0,0 +1,394 @@
+// Package warptest runs fake warp endpoints on an in-memory network, so the
+// scanner can be tested end to end without reaching cloudflare. The endpoints
+// complete the responder side of the wireguard handshake a warp ping
+// initiates and answer the ICMP echo of its data channel check.
+package warptest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	initiationSize = 148
+	responseSize   = 92
+	// handshakeMessageEnd is where the noise message of an initiation ends
+	// and its macs start
+	handshakeMessageEnd = 116
+)
+
+var cipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+
+// Network is an in-memory UDP network of fake endpoints that share a key, as
+// the warp endpoints do. Datagrams to addresses without an endpoint fail with
+// ECONNREFUSED, as an ICMP port unreachable would make them, so the pings of
+// dead IPs fail at once instead of waiting for their timeout.
+type Network struct {
+	key noise.DHKey
+
+	mu        sync.Mutex
+	endpoints map[netip.AddrPort]*Endpoint
+	// nextPort is the port of the next socket Listen opens
+	nextPort uint16
+}
+
+// NewNetwork returns a network without endpoints.
+func NewNetwork() (*Network, error) {
+	key, err := cipherSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Network{
+		key:       key,
+		endpoints: make(map[netip.AddrPort]*Endpoint),
+		nextPort:  10000,
+	}, nil
+}
+
+// PublicKey returns the public key of the endpoints, base64 encoded like the
+// peer key of a warp profile.
+func (n *Network) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(n.key.Public)
+}
+
+// Add adds an endpoint answering on addr and returns it. Its fields may be
+// changed until the first datagram reaches it.
+func (n *Network) Add(addr netip.AddrPort) *Endpoint {
+	e := &Endpoint{key: n.key, sessions: make(map[uint32]*session)}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.endpoints[addr] = e
+	return e
+}
+
+// Listen opens a socket on the network, for ipscanner.WithPacketListener.
+func (n *Network) Listen(ctx context.Context) (net.PacketConn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.nextPort++
+	return &conn{
+		n:      n,
+		local:  netip.AddrPortFrom(netip.MustParseAddr("198.51.100.1"), n.nextPort),
+		in:     make(chan datagram, 16),
+		closed: make(chan struct{}),
+	}, nil
+}
+
+func (n *Network) endpoint(addr netip.AddrPort) *Endpoint {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.endpoints[addr]
+}
+
+// Endpoint is a fake warp endpoint.
+type Endpoint struct {
+	// Delay is how long the endpoint takes to answer a datagram.
+	Delay time.Duration
+	// DropData drops the data packets after the handshake, like networks
+	// that let handshakes through but nothing after them.
+	DropData bool
+	// Address is the interface address the endpoint gave the initiator,
+	// echo requests from other addresses go unanswered. Invalid answers
+	// any.
+	Address netip.Addr
+
+	key noise.DHKey
+
+	mu         sync.Mutex
+	handshakes int
+	// sessions are the sessions of completed handshakes by the index the
+	// endpoint gave them
+	sessions map[uint32]*session
+}
+
+// session is the state of a completed handshake.
+type session struct {
+	// peerIndex is the sender index of the initiator, which the endpoint
+	// sends its transport messages to
+	peerIndex  uint32
+	send, recv *noise.CipherState
+}
+
+// Handshakes returns how many handshakes the endpoint completed.
+func (e *Endpoint) Handshakes() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.handshakes
+}
+
+// answer returns the answer of the endpoint to packet, nil if it has none.
+// Anything but handshake initiations and transport messages of its sessions,
+// e.g. the junk packets sent ahead of handshakes, is ignored.
+func (e *Endpoint) answer(packet []byte) []byte {
+	switch {
+	case len(packet) == initiationSize && packet[0] == 1:
+		reply, err := e.respond(packet)
+		if err != nil {
+			return nil
+		}
+		return reply
+	case len(packet) >= 32 && packet[0] == 4 && !e.DropData:
+		reply, err := e.echo(packet)
+		if err != nil {
+			return nil
+		}
+		return reply
+	}
+	return nil
+}
+
+// respond completes the handshake packet initiates and returns the
+// handshake response.
+func (e *Endpoint) respond(packet []byte) ([]byte, error) {
+	if !validMAC(packet[handshakeMessageEnd:handshakeMessageEnd+16], packet[:handshakeMessageEnd], e.key.Public) {
+		return nil, errors.New("invalid mac1")
+	}
+
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:           cipherSuite,
+		Pattern:               noise.HandshakeIK,
+		StaticKeypair:         e.key,
+		Prologue:              []byte("WireGuard v1 zx2c4 Jason@zx2c4.com"),
+		PresharedKey:          make([]byte, 32),
+		PresharedKeyPlacement: 2,
+		Random:                rand.Reader,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, _, _, err := hs.ReadMessage(nil, packet[8:handshakeMessageEnd]); err != nil {
+		return nil, err
+	}
+	msg, recv, send, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make([]byte, 4)
+	if _, err := rand.Read(index); err != nil {
+		return nil, err
+	}
+	s := &session{peerIndex: binary.LittleEndian.Uint32(packet[4:8]), send: send, recv: recv}
+
+	reply := make([]byte, 12, responseSize)
+	reply[0] = 2
+	copy(reply[4:8], index)
+	binary.LittleEndian.PutUint32(reply[8:12], s.peerIndex)
+	reply = append(reply, msg...)
+	reply = append(reply, mac(reply, hs.PeerStatic())...)
+	reply = append(reply, make([]byte, 16)...)
+
+	e.mu.Lock()
+	e.handshakes++
+	e.sessions[binary.LittleEndian.Uint32(index)] = s
+	e.mu.Unlock()
+
+	return reply, nil
+}
+
+// echo answers the ICMP echo request in the transport message packet with a
+// transport message carrying the echo reply.
+func (e *Endpoint) echo(packet []byte) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, ok := e.sessions[binary.LittleEndian.Uint32(packet[4:8])]
+	if !ok {
+		return nil, errors.New("unknown session")
+	}
+
+	s.recv.SetNonce(binary.LittleEndian.Uint64(packet[8:16]))
+	request, err := s.recv.Decrypt(nil, nil, packet[16:])
+	if err != nil {
+		return nil, err
+	}
+	if e.Address.IsValid() && (len(request) < ipv4.HeaderLen || netip.AddrFrom4([4]byte(request[12:16])) != e.Address) {
+		return nil, errors.New("echo request from another address")
+	}
+	reply, err := echoReply(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if r := len(reply) % 16; r != 0 {
+		reply = append(reply, make([]byte, 16-r)...)
+	}
+	header := make([]byte, 16, 16+len(reply)+16)
+	header[0] = 4
+	binary.LittleEndian.PutUint32(header[4:8], s.peerIndex)
+	binary.LittleEndian.PutUint64(header[8:16], s.send.Nonce())
+	return s.send.Encrypt(header, nil, reply)
+}
+
+// echoReply returns the IPv4 packet answering the ICMP echo request in
+// packet, which may be padded.
+func echoReply(packet []byte) ([]byte, error) {
+	if len(packet) < ipv4.HeaderLen || packet[0]>>4 != 4 || packet[9] != 1 {
+		return nil, errors.New("not an icmp packet")
+	}
+	hdrLen, totalLen := int(packet[0]&0x0f)*4, int(binary.BigEndian.Uint16(packet[2:4]))
+	if hdrLen < ipv4.HeaderLen || totalLen > len(packet) || hdrLen > totalLen {
+		return nil, errors.New("invalid ipv4 header")
+	}
+
+	msg, err := icmp.ParseMessage(1, packet[hdrLen:totalLen])
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != ipv4.ICMPTypeEcho {
+		return nil, errors.New("not an echo request")
+	}
+	body, err := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: msg.Body}).Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// swapping the addresses keeps the header checksum
+	reply := append([]byte(nil), packet[:hdrLen]...)
+	copy(reply[12:16], packet[16:20])
+	copy(reply[16:20], packet[12:16])
+	return append(reply, body...), nil
+}
+
+// mac returns the mac1 of msg to the peer with publicKey.
+func mac(msg, publicKey []byte) []byte {
+	key := blake2s.Sum256(append([]byte("mac1----"), publicKey...))
+	h, _ := blake2s.New128(key[:])
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// validMAC reports whether sum is the mac1 of msg to the peer with
+// publicKey.
+func validMAC(sum, msg, publicKey []byte) bool {
+	return string(sum) == string(mac(msg, publicKey))
+}
+
+// NewPrivateKey returns a new private key for the initiator, base64 encoded
+// like the private key of a warp profile.
+func NewPrivateKey() (string, error) {
+	key, err := cipherSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Private), nil
+}
+
+// datagram is a datagram delivered to a socket.
+type datagram struct {
+	b    []byte
+	from netip.AddrPort
+}
+
+// conn is a socket of a Network.
+type conn struct {
+	n     *Network
+	local netip.AddrPort
+	in    chan datagram
+
+	mu       sync.Mutex
+	deadline time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case d := <-c.in:
+		return copy(b, d.b), net.UDPAddrFromAddrPort(d.from), nil
+	case <-timeout:
+		return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+	case <-c.closed:
+		return 0, nil, c.opError("read", nil, net.ErrClosed)
+	}
+}
+
+func (c *conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", addr, net.ErrClosed)
+	default:
+	}
+
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.opError("write", addr, syscall.EINVAL)
+	}
+	dst := netip.AddrPortFrom(to.AddrPort().Addr().Unmap(), to.AddrPort().Port())
+	e := c.n.endpoint(dst)
+	if e == nil {
+		return 0, c.opError("write", addr, syscall.ECONNREFUSED)
+	}
+
+	packet := append([]byte(nil), b...)
+	go func() {
+		time.Sleep(e.Delay)
+		reply := e.answer(packet)
+		if reply == nil {
+			return
+		}
+		select {
+		case c.in <- datagram{b: reply, from: dst}:
+		case <-c.closed:
+		}
+	}()
+	return len(b), nil
+}
+
+func (c *conn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: err}
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.local)
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+var _ net.PacketConn = (*conn)(nil)
@@ -3,11 +3,15 @@ package ipscanner
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"log/slog"
+	"net"
 	"net/netip"
+	"syscall"
 	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner/internal/engine"
+	"github.com/bepass-org/warp-plus/ipscanner/internal/ping"
 	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
 )
 
@@ -15,6 +19,9 @@ type IPScanner struct {
 	options statute.ScannerOptions
 	log     *slog.Logger
 	engine  *engine.Engine
+
+	done chan struct{}
+	err  error
 }
 
 func NewScanner(options ...Option) *IPScanner {
@@ -47,6 +54,9 @@ func NewScanner(options ...Option) *IPScanner {
 			ConnectionTimeout:  1 * time.Second,
 			HandshakeTimeout:   1 * time.Second,
 			TlsVersion:         tls.VersionTLS13,
+			Concurrency:        8,
+			PingRate:           20,
+			PingSamples:        3,
 		},
 		log: slog.Default(),
 	}
@@ -139,12 +149,32 @@ func WithLogger(logger *slog.Logger) Option {
 	}
 }
 
+// WithSocketControl applies control to every socket the pings open, e.g. to
+// bind them to an interface or set a firewall mark.
+func WithSocketControl(control func(network, address string, c syscall.RawConn) error) Option {
+	return func(i *IPScanner) {
+		i.options.SocketControl = control
+	}
+}
+
+// WithInsecureSkipVerify controls whether TLS and QUIC pings verify the
+// certificate chain against the system roots.
 func WithInsecureSkipVerify(insecureSkipVerify bool) Option {
 	return func(i *IPScanner) {
 		i.options.InsecureSkipVerify = insecureSkipVerify
 	}
 }
 
+// WithSPKIPins makes TLS and QUIC pings fail unless the certificate chain
+// contains one of the given public keys, each a base64 encoded sha256 hash of
+// a SubjectPublicKeyInfo. Pinning works independently of
+// WithInsecureSkipVerify.
+func WithSPKIPins(pins ...string) Option {
+	return func(i *IPScanner) {
+		i.options.SPKIPins = pins
+	}
+}
+
 func WithHostname(hostname string) Option {
 	return func(i *IPScanner) {
 		i.options.Hostname = hostname
@@ -163,6 +193,40 @@ func WithCidrList(cidrList []netip.Prefix) Option {
 	}
 }
 
+// WithSeedIPs pings ips, e.g. endpoints known to have worked, before any IP
+// of the CIDR list. Seeds of a disabled IP version or in the exclude list are
+// skipped.
+func WithSeedIPs(ips ...netip.Addr) Option {
+	return func(i *IPScanner) {
+		i.options.SeedIPs = ips
+	}
+}
+
+// WithExcludeList skips IPs in any of prefixes.
+func WithExcludeList(prefixes []netip.Prefix) Option {
+	return func(i *IPScanner) {
+		i.options.ExcludeList = prefixes
+	}
+}
+
+// WithPacketListener makes warp pings send their datagrams through the
+// sockets listen opens, e.g. ones relayed by a proxy, instead of dialing
+// directly.
+func WithPacketListener(listen func(ctx context.Context) (net.PacketConn, error)) Option {
+	return func(i *IPScanner) {
+		i.options.PacketListenFunc = listen
+	}
+}
+
+// WithStateFile keeps the scan position and the IPs whose pings failed in the
+// file at path, so the next scan resumes where this one stopped and skips the
+// known bad IPs. An IP is bad once three pings in a row failed, for a day.
+func WithStateFile(path string) Option {
+	return func(i *IPScanner) {
+		i.options.StatePath = path
+	}
+}
+
 func WithHTTPPing() Option {
 	return func(i *IPScanner) {
 		i.options.SelectedOps |= statute.HTTPPing
@@ -181,6 +245,38 @@ func WithQUICPing() Option {
 	}
 }
 
+// WithQUICALPN sets the application protocols QUIC pings offer, h3 by
+// default.
+func WithQUICALPN(protocols ...string) Option {
+	return func(i *IPScanner) {
+		i.options.QUICALPN = protocols
+	}
+}
+
+// WithQUICServerName sets the sni of QUIC pings in place of the hostname.
+func WithQUICServerName(serverName string) Option {
+	return func(i *IPScanner) {
+		i.options.QUICServerName = serverName
+	}
+}
+
+// WithQUICIdleTimeout sets the idle timeout of QUIC connections, the
+// connection timeout by default.
+func WithQUICIdleTimeout(timeout time.Duration) Option {
+	return func(i *IPScanner) {
+		i.options.QUICIdleTimeout = timeout
+	}
+}
+
+// WithQUIC0RTTCheck makes QUIC pings resume their connection with the session
+// ticket it got and record, in IPInfo.QUIC, whether the server accepted 0-RTT
+// data on it.
+func WithQUIC0RTTCheck() Option {
+	return func(i *IPScanner) {
+		i.options.QUICCheck0RTT = true
+	}
+}
+
 func WithTCPPing() Option {
 	return func(i *IPScanner) {
 		i.options.SelectedOps |= statute.TCPPing
@@ -193,6 +289,57 @@ func WithTLSPing() Option {
 	}
 }
 
+// WithICMPPing selects the ICMP echo ping. Combined with another ping it
+// pre-filters IPs, which must answer an echo request before the heavier ping
+// is tried.
+func WithICMPPing() Option {
+	return func(i *IPScanner) {
+		i.options.SelectedOps |= statute.ICMPPing
+	}
+}
+
+// Stage is one step of a ping pipeline, see WithPingPipeline.
+type Stage = statute.PingStage
+
+// ICMPStage, TCPStage, TLSStage, HTTPStage, QUICStage and WarpStage return a
+// pipeline stage of the matching ping with an RTT budget of maxRTT, zero
+// meaning no budget.
+func ICMPStage(maxRTT time.Duration) Stage {
+	return Stage{Op: statute.ICMPPing, MaxRTT: maxRTT}
+}
+
+func TCPStage(maxRTT time.Duration) Stage {
+	return Stage{Op: statute.TCPPing, MaxRTT: maxRTT}
+}
+
+func TLSStage(maxRTT time.Duration) Stage {
+	return Stage{Op: statute.TLSPing, MaxRTT: maxRTT}
+}
+
+func HTTPStage(maxRTT time.Duration) Stage {
+	return Stage{Op: statute.HTTPPing, MaxRTT: maxRTT}
+}
+
+func QUICStage(maxRTT time.Duration) Stage {
+	return Stage{Op: statute.QUICPing, MaxRTT: maxRTT}
+}
+
+func WarpStage(maxRTT time.Duration) Stage {
+	return Stage{Op: statute.WARPPing, MaxRTT: maxRTT}
+}
+
+// WithPingPipeline chains pings: an IP goes through the stages in order and
+// is dropped at the first one that fails or exceeds its RTT budget. Cheap
+// stages up front, e.g. a TCP ping before a warp handshake, keep the heavy
+// ping for the IPs that are likely to pass. Only the last stage is sampled
+// and reported. The pipeline replaces the pings selected with the other
+// options.
+func WithPingPipeline(stages ...Stage) Option {
+	return func(i *IPScanner) {
+		i.options.Pipeline = stages
+	}
+}
+
 func WithIPQueueSize(size int) Option {
 	return func(i *IPScanner) {
 		i.options.IPQueueSize = size
@@ -247,17 +394,75 @@ func WithWarpPreSharedKey(presharedKey string) Option {
 	}
 }
 
+func WithConcurrency(n int) Option {
+	return func(i *IPScanner) {
+		i.options.Concurrency = n
+	}
+}
+
+func WithPingRate(perSecond float64) Option {
+	return func(i *IPScanner) {
+		i.options.PingRate = perSecond
+	}
+}
+
+func WithPingSamples(n int) Option {
+	return func(i *IPScanner) {
+		i.options.PingSamples = n
+	}
+}
+
+func WithWarpPorts(ports []uint16) Option {
+	return func(i *IPScanner) {
+		i.options.WarpPorts = ports
+	}
+}
+
+// WithFullWarpValidation makes a warp ping succeed only once the endpoint
+// also answers a ping sent through the tunnel after the handshake, dropping
+// endpoints on networks that let handshakes through but not the data after
+// them. source is the IPv4 interface address of the identity whose keys the
+// pings use, warp drops packets from any other.
+func WithFullWarpValidation(source netip.Addr) Option {
+	return func(i *IPScanner) {
+		i.options.WarpValidateSource = source
+	}
+}
+
 // run engine and in case of new event call onChange callback also if it gets canceled with context
 // cancel all operations
 
 func (i *IPScanner) Run(ctx context.Context) {
 	statute.FinalOptions = &i.options
+	i.done = make(chan struct{})
 	if !i.options.UseIPv4 && !i.options.UseIPv6 {
 		i.log.Error("Fatal: both IPv4 and IPv6 are disabled, nothing to do")
+		i.err = errors.New("both IPv4 and IPv6 are disabled")
+		close(i.done)
 		return
 	}
 	i.engine = engine.NewScannerEngine(&i.options)
-	go i.engine.Run(ctx)
+	go func() {
+		i.err = i.engine.Run(ctx)
+		close(i.done)
+	}()
+}
+
+// Done returns a channel that is closed once the scan started by Run stops,
+// because its context is done or it failed.
+func (i *IPScanner) Done() <-chan struct{} {
+	return i.done
+}
+
+// Err returns why the scan stopped, once Done is closed. It is nil while the
+// scan runs and if it stopped because its context is done.
+func (i *IPScanner) Err() error {
+	select {
+	case <-i.done:
+		return i.err
+	default:
+		return nil
+	}
 }
 
 func (i *IPScanner) GetAvailableIPs() []statute.IPInfo {
@@ -267,4 +472,27 @@ func (i *IPScanner) GetAvailableIPs() []statute.IPInfo {
 	return nil
 }
 
-type IPInfo = statute.IPInfo
+// Summary returns counts of the pings, their failures by kind and the RTT
+// distribution of the scan so far.
+func (i *IPScanner) Summary() Summary {
+	if i.engine != nil {
+		return i.engine.Summary()
+	}
+	return Summary{}
+}
+
+type (
+	IPInfo   = statute.IPInfo
+	QUICInfo = statute.QUICInfo
+)
+
+type (
+	Summary    = engine.Summary
+	RTTSummary = engine.RTTSummary
+)
+
+// PingWarp completes a single warp handshake with addr, over a socket opened
+// by listen if it is set, and returns its round trip time.
+func PingWarp(ctx context.Context, addr netip.AddrPort, privateKey, peerPublicKey string, listen func(ctx context.Context) (net.PacketConn, error)) (time.Duration, error) {
+	return ping.WarpHandshake(ctx, addr, privateKey, peerPublicKey, listen)
+}
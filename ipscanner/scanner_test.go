@@ -0,0 +1,82 @@
+package ipscanner
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/warptest"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// TestScanFakeEndpoints scans a prefix with a few fake warp endpoints in it,
+// through the warp ping, iterator and queue the real scans use.
+func TestScanFakeEndpoints(t *testing.T) {
+	network, err := warptest.NewNetwork()
+	qt.Assert(t, err, qt.IsNil)
+	privateKey, err := warptest.NewPrivateKey()
+	qt.Assert(t, err, qt.IsNil)
+
+	fast := netip.MustParseAddrPort("192.0.2.5:2408")
+	slow := netip.MustParseAddrPort("192.0.2.9:2408")
+	network.Add(fast)
+	network.Add(slow).Delay = 100 * time.Millisecond
+	// answers on a port the scan doesn't ping
+	network.Add(netip.MustParseAddrPort("192.0.2.12:500"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	scanner := NewScanner(
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithWarpPing(),
+		WithFullWarpValidation(netip.MustParseAddr("172.16.0.2")),
+		WithWarpPrivateKey(privateKey),
+		WithWarpPeerPublicKey(network.PublicKey()),
+		WithWarpPorts([]uint16{2408}),
+		WithPacketListener(network.Listen),
+		WithUseIPv6(false),
+		WithCidrList([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/28")}),
+		WithPingSamples(1),
+		WithPingRate(0),
+	)
+	scanner.Run(ctx)
+
+	// found returns the endpoints in the queue, best first, without the
+	// repeated pings of an IP the queue keeps as well
+	found := func() []netip.AddrPort {
+		var addrs []netip.AddrPort
+		for _, info := range scanner.GetAvailableIPs() {
+			addr := netip.AddrPortFrom(info.AddrPort.Addr().Unmap(), info.AddrPort.Port())
+			if !slices.Contains(addrs, addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+		return addrs
+	}
+
+	for len(found()) < 2 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("scan found %v", found())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	cancel()
+	<-scanner.Done()
+
+	addrs := found()
+	qt.Assert(t, addrs, qt.HasLen, 2)
+	qt.Assert(t, addrs[0], qt.Equals, fast)
+	qt.Assert(t, addrs[1], qt.Equals, slow)
+	for _, info := range scanner.GetAvailableIPs() {
+		if info.AddrPort.Addr().Unmap() == slow.Addr() {
+			qt.Assert(t, info.RTT > 100*time.Millisecond, qt.IsTrue)
+		}
+	}
+}
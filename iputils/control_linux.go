@@ -0,0 +1,38 @@
+package iputils
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SocketControl returns a net.Dialer / net.ListenConfig control function
+// that binds sockets to the network interface iface and sets the firewall
+// mark on them. Empty iface and zero mark leave the socket untouched.
+func SocketControl(iface string, mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	if iface == "" && mark == 0 {
+		return nil, nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		ctrlErr := c.Control(func(fd uintptr) {
+			if iface != "" {
+				if err = unix.BindToDevice(int(fd), iface); err != nil {
+					err = fmt.Errorf("failed to bind socket to %s: %w", iface, err)
+					return
+				}
+			}
+			if mark != 0 {
+				if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark); err != nil {
+					err = fmt.Errorf("failed to set fwmark %d: %w", mark, err)
+				}
+			}
+		})
+		if ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}, nil
+}
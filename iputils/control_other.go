@@ -0,0 +1,17 @@
+//go:build !linux
+
+package iputils
+
+import (
+	"errors"
+	"syscall"
+)
+
+// SocketControl is only supported on linux, elsewhere it fails if an
+// interface or mark is requested.
+func SocketControl(iface string, mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	if iface == "" && mark == 0 {
+		return nil, nil
+	}
+	return nil, errors.New("binding to an interface and fwmark are only supported on linux")
+}
@@ -0,0 +1,70 @@
+package iputils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// WellKnownNAT64Prefix is the NAT64 prefix from RFC 6052.
+var WellKnownNAT64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// ipv4OnlyArpa resolves to these addresses on networks with DNS64 (RFC 7050).
+var ipv4OnlyArpa = []netip.Addr{
+	netip.MustParseAddr("192.0.0.170"),
+	netip.MustParseAddr("192.0.0.171"),
+}
+
+// DetectIPStack reports whether the host has a route to the IPv4 and the
+// IPv6 internet. No packets are sent.
+func DetectIPStack() (v4, v6 bool) {
+	return hasRoute("udp4", "1.1.1.1:53"), hasRoute("udp6", "[2606:4700:4700::1111]:53")
+}
+
+func hasRoute(network, addr string) bool {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// DetectNAT64Prefix discovers the network's NAT64 prefix by resolving
+// ipv4only.arpa as described in RFC 7050. Only /96 prefixes are supported.
+func DetectNAT64Prefix(ctx context.Context) (netip.Prefix, error) {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip6", "ipv4only.arpa")
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	for _, addr := range addrs {
+		if !addr.Is6() || addr.Is4In6() {
+			continue
+		}
+
+		b := addr.As16()
+		v4 := netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]})
+		for _, known := range ipv4OnlyArpa {
+			if v4 == known {
+				return netip.PrefixFrom(addr, 96).Masked(), nil
+			}
+		}
+	}
+
+	return netip.Prefix{}, errors.New("no nat64 prefix found")
+}
+
+// SynthesizeNAT64 embeds the IPv4 address addr into the /96 NAT64 prefix.
+// Other addresses are returned unchanged.
+func SynthesizeNAT64(prefix netip.Prefix, addr netip.Addr) netip.Addr {
+	if !addr.Is4() || !prefix.Addr().Is6() || prefix.Bits() != 96 {
+		return addr
+	}
+
+	b := prefix.Masked().Addr().As16()
+	v4 := addr.As4()
+	copy(b[12:], v4[:])
+	return netip.AddrFrom16(b)
+}
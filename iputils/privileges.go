@@ -0,0 +1,102 @@
+package iputils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+
+	"golang.org/x/net/icmp"
+)
+
+// ErrNotPermitted is wrapped by the errors of the privilege checks when the
+// process lacks the privileges for a feature. Their message says how to get
+// them.
+var ErrNotPermitted = errors.New("not permitted")
+
+// CheckSocketControl checks that the sockets of SocketControl can be bound
+// to iface and marked with mark, which needs CAP_NET_RAW or CAP_NET_ADMIN.
+func CheckSocketControl(iface string, mark int) error {
+	control, err := SocketControl(iface, mark)
+	if err != nil || control == nil {
+		return err
+	}
+
+	lc := net.ListenConfig{Control: control}
+	c, err := lc.ListenPacket(context.Background(), "udp", ":0")
+	if err != nil {
+		capability := "CAP_NET_RAW"
+		if mark != 0 {
+			capability = "CAP_NET_ADMIN"
+		}
+		return privilegeError(capability, err)
+	}
+	return c.Close()
+}
+
+// CheckICMP checks that ICMP echo requests can be sent, through a raw socket
+// or an unprivileged ping socket.
+func CheckICMP() error {
+	// windows pings through the ICMP helper API, which needs no privileges
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	c, rawErr := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if rawErr == nil {
+		return c.Close()
+	}
+	c, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err == nil {
+		return c.Close()
+	}
+
+	err = privilegeError("CAP_NET_RAW", rawErr)
+	if runtime.GOOS == "linux" && errors.Is(err, ErrNotPermitted) {
+		return fmt.Errorf(`%w, or allow unprivileged pings with "sysctl -w net.ipv4.ping_group_range='0 2147483647'"`, err)
+	}
+	return err
+}
+
+// CheckBind checks that a listener can be bound to addr, whose port may be
+// reserved to privileged processes.
+func CheckBind(addr netip.AddrPort) error {
+	if addr.Port() == 0 || addr.Port() >= 1024 {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		err = privilegeError("CAP_NET_BIND_SERVICE", err)
+		if runtime.GOOS == "linux" && errors.Is(err, ErrNotPermitted) {
+			return fmt.Errorf(`%w, or allow low ports with "sysctl -w net.ipv4.ip_unprivileged_port_start=%d"`, err, addr.Port())
+		}
+		return err
+	}
+	return ln.Close()
+}
+
+// privilegeError explains how to get the privileges to avoid err, if it is
+// a permission error, capability being the linux capability needed.
+func privilegeError(capability string, err error) error {
+	if !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+
+	switch runtime.GOOS {
+	case "linux":
+		exe, exeErr := os.Executable()
+		if exeErr != nil {
+			exe = "warp-plus"
+		}
+		return fmt.Errorf(`%w, needs %s: run as root or grant it with "sudo setcap %s+ep %s"`, ErrNotPermitted, capability, strings.ToLower(capability), exe)
+	case "windows":
+		return fmt.Errorf("%w: run as administrator", ErrNotPermitted)
+	default:
+		return fmt.Errorf("%w: run as root", ErrNotPermitted)
+	}
+}
@@ -0,0 +1,122 @@
+package iputils
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"slices"
+	"syscall"
+)
+
+// IPv6 source address modes, see V6Source.
+const (
+	// V6SourceOS leaves the source address to the operating system.
+	V6SourceOS = "os"
+	// V6SourceRotate picks one of the host's global IPv6 addresses.
+	V6SourceRotate = "rotate"
+	// V6SourceRandom picks a random address in one of the host's /64
+	// prefixes. The prefix must be routed to the host, e.g. with
+	// "ip -6 route add local <prefix> dev lo", for replies to arrive.
+	V6SourceRandom = "random"
+)
+
+// V6SourceModes returns the valid modes of V6Source.
+func V6SourceModes() []string {
+	return []string{V6SourceOS, V6SourceRotate, V6SourceRandom}
+}
+
+// V6Source returns a function picking a fresh IPv6 source address for each
+// new socket according to mode, and a control function those sockets have to
+// be opened with. Both are nil for V6SourceOS.
+func V6Source(mode string) (func() (netip.Addr, error), func(network, address string, c syscall.RawConn) error, error) {
+	if mode == V6SourceOS || mode == "" {
+		return nil, nil, nil
+	}
+
+	addrs, err := hostV6Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, nil, errors.New("no global IPv6 address found to pick source addresses from")
+	}
+
+	switch mode {
+	case V6SourceRotate:
+		return func() (netip.Addr, error) {
+			return pick(addrs)
+		}, nil, nil
+	case V6SourceRandom:
+		control, err := freebindControl()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		prefixes := make([]netip.Prefix, 0, len(addrs))
+		for _, addr := range addrs {
+			prefix := netip.PrefixFrom(addr, 64).Masked()
+			if !slices.Contains(prefixes, prefix) {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+
+		return func() (netip.Addr, error) {
+			prefix, err := pick(prefixes)
+			if err != nil {
+				return netip.Addr{}, err
+			}
+			return randomInterfaceID(prefix)
+		}, control, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown ipv6 source mode %q", mode)
+	}
+}
+
+// hostV6Addrs returns the global unicast IPv6 addresses of the host,
+// leaving out unique local ones.
+func hostV6Addrs() ([]netip.Addr, error) {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.Addr
+	for _, a := range ifaceAddrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok || !addr.Is6() || addr.Is4In6() || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// randomInterfaceID returns an address of the /64 prefix with random
+// interface bits, never the all-zero subnet-router anycast address.
+func randomInterfaceID(prefix netip.Prefix) (netip.Addr, error) {
+	b := prefix.Addr().As16()
+	for {
+		if _, err := rand.Read(b[8:]); err != nil {
+			return netip.Addr{}, err
+		}
+		if addr := netip.AddrFrom16(b); addr != prefix.Addr() {
+			return addr, nil
+		}
+	}
+}
+
+func pick[T any](s []T) (T, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(s))))
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return s[n.Int64()], nil
+}
@@ -0,0 +1,29 @@
+package iputils
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// freebindControl lets IPv6 sockets bind to addresses not assigned to the
+// host.
+func freebindControl() (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		if network != "udp6" && network != "tcp6" {
+			return nil
+		}
+
+		var err error
+		ctrlErr := c.Control(func(fd uintptr) {
+			if err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_FREEBIND, 1); err != nil {
+				err = fmt.Errorf("failed to set IPV6_FREEBIND: %w", err)
+			}
+		})
+		if ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package iputils
+
+import (
+	"errors"
+	"syscall"
+)
+
+// freebindControl is only supported on linux.
+func freebindControl() (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("random ipv6 source addresses are only supported on linux")
+}
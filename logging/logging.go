@@ -0,0 +1,133 @@
+// Package logging filters log records by the subsystem of the logger that
+// emits them, so e.g. the scanner can log at debug level while the wireguard
+// device stays at warn.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// SubsystemKey is the attribute loggers are tagged with their subsystem by,
+// e.g. l.With(SubsystemKey, "scanner").
+const SubsystemKey = "subsystem"
+
+// Levels are the minimum levels of records, by subsystem. A subsystem without
+// a level of its own uses that of its parent, "scanner" for
+// "scanner/engine", then the default. Levels may change while in use.
+type Levels struct {
+	mu         sync.RWMutex
+	def        slog.Level
+	subsystems map[string]slog.Level
+}
+
+// NewLevels returns levels with def for every subsystem.
+func NewLevels(def slog.Level) *Levels {
+	return &Levels{def: def}
+}
+
+// SetDefault sets the level of the subsystems without one of their own.
+func (l *Levels) SetDefault(def slog.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.def = def
+}
+
+// SetSubsystems replaces the levels of the subsystems.
+func (l *Levels) SetSubsystems(subsystems map[string]slog.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subsystems = subsystems
+}
+
+// Level returns the level of records of a logger tagged with subsystems, the
+// innermost last. The innermost subsystem with a level wins.
+func (l *Levels) Level(subsystems []string) slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for i := len(subsystems) - 1; i >= 0; i-- {
+		for s := subsystems[i]; ; {
+			if level, ok := l.subsystems[s]; ok {
+				return level
+			}
+			parent := strings.LastIndex(s, "/")
+			if parent < 0 {
+				break
+			}
+			s = s[:parent]
+		}
+	}
+	return l.def
+}
+
+// ParseLevels parses levels like "debug" or "scanner=debug", comma separated
+// or repeated. It returns the default level, nil if none is given, and the
+// levels of the subsystems.
+func ParseLevels(specs []string) (*slog.Level, map[string]slog.Level, error) {
+	var def *slog.Level
+	subsystems := make(map[string]slog.Level)
+	for _, spec := range specs {
+		for _, s := range strings.Split(spec, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+
+			name, value, ok := strings.Cut(s, "=")
+			if !ok {
+				name, value = "", s
+			}
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(value)); err != nil {
+				return nil, nil, fmt.Errorf("invalid log level %q: %w", s, err)
+			}
+
+			if name = strings.TrimSpace(name); name == "" {
+				def = &level
+				continue
+			}
+			subsystems[name] = level
+		}
+	}
+	return def, subsystems, nil
+}
+
+// handler passes the records of enabled levels on to the handler it wraps,
+// whose own level isn't consulted.
+type handler struct {
+	inner      slog.Handler
+	levels     *Levels
+	subsystems []string
+}
+
+// NewHandler returns a handler that writes the records levels lets through
+// with inner.
+func NewHandler(inner slog.Handler, levels *Levels) slog.Handler {
+	return &handler{inner: inner, levels: levels}
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.levels.Level(h.subsystems)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	subsystems := h.subsystems
+	for _, a := range attrs {
+		if a.Key == SubsystemKey {
+			subsystems = append(subsystems[:len(subsystems):len(subsystems)], a.Value.String())
+		}
+	}
+	return &handler{inner: h.inner.WithAttrs(attrs), levels: h.levels, subsystems: subsystems}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{inner: h.inner.WithGroup(name), levels: h.levels, subsystems: h.subsystems}
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseLevels(t *testing.T) {
+	def, subsystems, err := ParseLevels([]string{"scanner=debug, wireguard-go=warn", "info", "proxy=INFO"})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, *def, qt.Equals, slog.LevelInfo)
+	qt.Assert(t, subsystems, qt.DeepEquals, map[string]slog.Level{
+		"scanner":      slog.LevelDebug,
+		"wireguard-go": slog.LevelWarn,
+		"proxy":        slog.LevelInfo,
+	})
+
+	def, _, err = ParseLevels(nil)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, def, qt.IsNil)
+
+	_, _, err = ParseLevels([]string{"scanner=loud"})
+	qt.Assert(t, err, qt.ErrorMatches, `invalid log level "scanner=loud": .*`)
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	levels := NewLevels(slog.LevelInfo)
+	levels.SetSubsystems(map[string]slog.Level{
+		"scanner":      slog.LevelDebug,
+		"wireguard-go": slog.LevelWarn,
+	})
+	l := slog.New(NewHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}), levels))
+
+	scanner := l.With(SubsystemKey, "scanner")
+	tests := []struct {
+		name    string
+		l       *slog.Logger
+		level   slog.Level
+		enabled bool
+	}{
+		{"default", l, slog.LevelDebug, false},
+		{"default info", l, slog.LevelInfo, true},
+		{"subsystem", scanner, slog.LevelDebug, true},
+		{"child", l.With(SubsystemKey, "scanner/engine"), slog.LevelDebug, true},
+		{"nested", scanner.With(SubsystemKey, "engine/queue"), slog.LevelDebug, true},
+		{"quieter", l.With(SubsystemKey, "wireguard-go"), slog.LevelInfo, false},
+		{"grouped", scanner.WithGroup("g"), slog.LevelDebug, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			tt.l.Log(context.Background(), tt.level, "hello")
+			qt.Assert(t, buf.Len() > 0, qt.Equals, tt.enabled)
+		})
+	}
+
+	levels.SetDefault(slog.LevelDebug)
+	buf.Reset()
+	l.Debug("hello")
+	qt.Assert(t, buf.String(), qt.Equals, "level=DEBUG msg=hello\n")
+}
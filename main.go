@@ -8,13 +8,21 @@ import (
 	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	_ "net/http/pprof"
-
 	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/iputils"
+	"github.com/bepass-org/warp-plus/logging"
+	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
+	"github.com/bepass-org/warp-plus/sysproxy"
 	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
 	"github.com/bepass-org/warp-plus/wiresocks"
 
 	"github.com/peterbourgon/ff/v4"
@@ -22,54 +30,159 @@ import (
 	"github.com/peterbourgon/ff/v4/ffjson"
 )
 
-var psiphonCountries = []string{
-	"AT",
-	"BE",
-	"BG",
-	"BR",
-	"CA",
-	"CH",
-	"CZ",
-	"DE",
-	"DK",
-	"EE",
-	"ES",
-	"FI",
-	"FR",
-	"GB",
-	"HU",
-	"IE",
-	"IN",
-	"IT",
-	"JP",
-	"LV",
-	"NL",
-	"NO",
-	"PL",
-	"RO",
-	"RS",
-	"SE",
-	"SG",
-	"SK",
-	"UA",
-	"US",
-}
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExportCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "account" {
+		if err := runAccountCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "cfon" {
+		if err := runCfonCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		if err := runIdentityCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "profile" {
+		if err := runProfileCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "devices" {
+		if err := runDevicesCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "scan" {
+		if err := runScanCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	fs := ff.NewFlagSet("warp-plus")
 	var (
-		v4       = fs.BoolShort('4', "only use IPv4 for random warp endpoint")
-		v6       = fs.BoolShort('6', "only use IPv6 for random warp endpoint")
-		verbose  = fs.Bool('v', "verbose", "enable verbose logging")
-		bind     = fs.String('b', "bind", "127.0.0.1:8086", "socks bind address")
-		endpoint = fs.String('e', "endpoint", "", "warp endpoint")
-		key      = fs.String('k', "key", "", "warp key")
-		gool     = fs.BoolLong("gool", "enable gool mode (warp in warp)")
-		psiphon  = fs.BoolLong("cfon", "enable psiphon mode (must provide country as well)")
-		country  = fs.StringEnumLong("country", fmt.Sprintf("psiphon country code (valid values: %s)", psiphonCountries), psiphonCountries...)
-		scan     = fs.BoolLong("scan", "enable warp scanning")
-		rtt      = fs.DurationLong("rtt", 1000*time.Millisecond, "scanner rtt limit")
-		_        = fs.String('c', "config", "", "path to config file")
+		v4        = fs.BoolShort('4', "only use IPv4 for random warp endpoint")
+		v6        = fs.BoolShort('6', "only use IPv6 for random warp endpoint")
+		verbose   = fs.Bool('v', "verbose", "enable verbose logging")
+		logLevel  = fs.StringListLong("log-level", "log level, of every subsystem or of one, e.g. warn,scanner=debug; subsystems are scanner, wireguard-go, vtun, proxy, warp/account, warp/hotlist, psiphon and dashboard (repeatable, comma separated)")
+		logFormat = fs.StringEnumLong("log-format", "format of the log records (valid values: text, json)", "text", "json")
+		logFile   = fs.StringLong("log-file", "", "append the log to this file instead of writing it to stdout")
+		bind      = fs.StringList('b', "bind", "socks bind address or unix:PATH socket, default 127.0.0.1:8086 (repeatable, comma separated)")
+		endpoint  = fs.String('e', "endpoint", "", "warp endpoint")
+		fallback  = fs.StringLong("fallback-endpoint", "", "endpoint of the other ip family the primary tunnel switches to while handshakes time out, auto picks a random one")
+		endpoint2 = fs.StringLong("endpoint2", "", "second warp endpoint in gool and multi mode (defaults to a different random endpoint)")
+		epFile    = fs.StringLong("endpoint-file", "", "endpoint list, e.g. from warp-plus scan --output, whose endpoints the tunnels start on and move through when they fail")
+		warpPorts = fs.StringListLong("ports", "ports random endpoints are picked from and the scanner pings, instead of the built-in warp ports (repeatable, comma separated)")
+		key       = fs.String('k', "key", "", "warp key")
+		apiPrefix = fs.StringListLong("api-prefix", "cidrs the warp api is reached through, retries rotate across them, default 141.101.113.0/24 (repeatable, comma separated)")
+		apiSNI    = fs.StringLong("api-sni", "", "sni sent to the warp api in place of its host name")
+		apiFP     = fs.StringEnumLong("api-fingerprint", fmt.Sprintf("tls fingerprint of warp api connections (valid values: %s)", warp.Fingerprints()), warp.Fingerprints()...)
+		bootstrap = fs.StringLong("bootstrap-proxy", "", "socks5 or http proxy url used only for the warp api calls of registration and license updates, e.g. socks5://127.0.0.1:1080")
+		sysProxy  = fs.BoolLong("system-proxy", "send the warp api calls through the system proxy, from HTTPS_PROXY and HTTP_PROXY or the windows proxy settings, unless --bootstrap-proxy or --upstream-proxy is set")
+		setProxy  = fs.BoolLong("set-system-proxy", "point the proxy settings of windows or macos at the first bind address while running and restore them on exit, not with --proxy-user")
+		upstream  = fs.StringLong("upstream-proxy", "", "socks5 proxy url the warp api calls, scanner and tunnels reach the network through, the tunnels need udp associate support, e.g. socks5://127.0.0.1:1080")
+		gool      = fs.BoolLong("gool", "enable gool mode (warp in warp)")
+		cfon      = fs.BoolLong("cfon", "enable psiphon mode (must provide country as well)")
+		multi     = fs.BoolLong("multi", "run two warp tunnels on different endpoints and spread connections across them")
+		balance   = fs.StringEnumLong("balance", fmt.Sprintf("how multi mode spreads connections: in turn, by destination host, or by the latency and recent failures of each tunnel, keeping a host on its tunnel (valid values: %s)", wiresocks.BalanceModes()), wiresocks.BalanceModes()...)
+		affinity  = fs.BoolLong("affinity", "same as --balance affinity")
+		separate  = fs.BoolLong("separate-identity", "register another device for the second tunnel of gool and multi mode instead of running it on a clone of the primary identity")
+		auto      = fs.BoolLong("auto", "try warp, gool and psiphon in turn and keep the first working mode")
+		country   = fs.StringLong("country", "AT", "psiphon country code, see warp-plus cfon list-countries")
+		cfonConf  = fs.StringLong("cfon-config", "", "path to a psiphon config JSON whose keys are set over the built-in config")
+		cfonList  = fs.StringLong("cfon-server-list", "", "path to an encoded psiphon server list imported before connecting")
+		cfonSpons = fs.StringLong("cfon-sponsor-id", "", "psiphon sponsor id, overrides the one of the config")
+		cfonChan  = fs.StringLong("cfon-propagation-channel-id", "", "psiphon propagation channel id, overrides the one of the config")
+		cfonProto = fs.StringListLong("cfon-protocols", "limit psiphon to these tunnel protocols, e.g. QUIC-OSSH (repeatable, comma separated)")
+		cfonRegs  = fs.StringListLong("cfon-regions", "in psiphon mode, also serve these countries on their own ports, e.g. 8088=US or 0.0.0.0:8088=US (repeatable, comma separated)")
+		cfonHTTP  = fs.IntLong("cfon-http-port", 0, "in psiphon mode, also serve psiphon's own http proxy on this port of localhost, 0 disables")
+		scan      = fs.BoolLong("scan", "enable warp scanning")
+		rtt       = fs.DurationLong("rtt", 1000*time.Millisecond, "scanner rtt limit")
+		mtu       = fs.StringLong("mtu", "", fmt.Sprintf("tunnel mtu, a number or a preset (%s), default 1330", strings.Join(app.MTUPresets(), ", ")))
+		innerMTU  = fs.StringLong("gool-mtu", "", "mtu of the inner tunnel in gool mode, a number or a preset, default 1280")
+		goolRefr  = fs.DurationLong("gool-refresh", 0, "in gool mode, measure the inner endpoint through the outer tunnel at this interval and move to another one when it stays slower than --gool-max-rtt, 0 disables")
+		goolRTT   = fs.DurationLong("gool-max-rtt", time.Second, "slowest inner endpoint handshake kept by --gool-refresh")
+		keepalive = fs.IntLong("keepalive", 0, "persistent keepalive interval of the tunnels in seconds, default 3 (10 for the inner tunnel in gool mode)")
+		hsTimeout = fs.DurationLong("handshake-timeout", 0, "restart a tunnel that hasn't completed its handshake after this long, 0 waits up to the ready timeout")
+		hsRetries = fs.IntLong("handshake-retries", 0, "how often a tunnel is restarted after a handshake timeout")
+		trickN    = fs.StringLong("trick-count", "", "junk packets sent ahead of each handshake and keepalive, a min-max range or a number, default 8-15")
+		trickSize = fs.StringLong("trick-size", "", "size of each junk packet in bytes, a min-max range or a number, default 40-100")
+		trickGap  = fs.StringLong("trick-delay", "", "milliseconds between junk packets, a min-max range or a number, default 20-250")
+		family    = fs.StringLong("prefer-family", "auto", "ip family the addresses of proxied destination hosts are dialed in first, 4, 6 or auto for ipv6 first")
+		tcpBuffer = fs.StringLong("tcp-buffer", "", "largest tcp receive buffer and the send buffer of the tunnels' netstack, e.g. 16M for links with a large bandwidth-delay product, default 1M")
+		tcpCC     = fs.StringEnumLong("tcp-congestion", fmt.Sprintf("tcp congestion control of the tunnels' netstack (valid values: %s)", netstack.CongestionControls()), netstack.CongestionControls()...)
+		tcpNoSACK = fs.BoolLong("tcp-no-sack", "turn off tcp selective acknowledgements in the tunnels' netstack")
+		tunConns  = fs.IntLong("tunnel-max-conns", 0, "refuse proxy connections through each tunnel beyond this many open at once, not counting the inner tunnel of gool mode, 0 means no limit")
+		reserved  = fs.StringLong("reserved", "", "reserved header bytes sent to the peers, three numbers like 12,34,56 or a base64 client id, default the client id of the identity, 0,0,0 sends none")
+		ready     = fs.DurationLong("ready-timeout", 1*time.Minute, "maximum time to wait for the tunnels to become ready")
+		noVerify  = fs.BoolLong("no-verify", "skip fetching cloudflare's trace through each tunnel after its handshake, which must otherwise report warp on or the tunnel moves to another endpoint")
+		colos     = fs.StringListLong("prefer-colo", "cloudflare data centers the tunnels should exit through, e.g. FRA,AMS; tunnels landing elsewhere move to other endpoints until one lands in them (repeatable, comma separated)")
+		dashAddr  = fs.StringLong("dashboard", "", "serve a web dashboard to watch and control the proxy on this address, e.g. 127.0.0.1:8087")
+		uapi      = fs.StringLong("uapi", "", "expose each tunnel on a wireguard uapi socket named <value>-<tunnel>, e.g. --uapi wp for wg show wp-primary (needs write access to /var/run/wireguard, administrator on windows)")
+		status    = fs.DurationLong("status-interval", 0, "log the endpoint, last handshake age and traffic of each tunnel, and the drops and jitter between the gool tunnels, at this interval, 0 disables")
+		probeURLs = fs.StringListLong("probe-url", "url fetched through the proxy by --probe-interval, in turn if repeated, default a google 204 page (repeatable, comma separated)")
+		probeIntv = fs.DurationLong("probe-interval", 0, "fetch a --probe-url through the proxy at this interval and restart the tunnels after --probe-failures failures in a row, 0 disables")
+		probeFail = fs.IntLong("probe-failures", 3, "failed probes in a row that restart the tunnels")
+		onUp      = fs.StringLong("on-up", "", "command run by the shell when the proxy becomes healthy, with WARP_PLUS_* variables naming the endpoint, egress ip and proxy port")
+		onDown    = fs.StringLong("on-down", "", "command run by the shell when the proxy stops being healthy or warp-plus exits, with the variables of --on-up and WARP_PLUS_REASON")
+		rekey     = fs.DurationLong("rekey-interval", 0, "give the identities new keys at this interval, sent to their existing registrations and applied to the running tunnels in place, 0 disables")
+		workers   = fs.IntLong("scan-workers", 8, "number of parallel scanner workers")
+		cidrs     = fs.StringListLong("scan-cidr", "prefix to scan instead of the built-in warp prefixes (repeatable)")
+		excludes  = fs.StringListLong("scan-exclude", "prefix never to scan (repeatable)")
+		ports     = fs.StringListLong("scan-ports", "ports to scan instead of --ports or the built-in warp ports (repeatable, comma separated)")
+		scanICMP  = fs.BoolLong("scan-icmp", "skip IPs that don't answer an ICMP echo before the warp handshake ping")
+		scanValid = fs.BoolLong("scan-validate", "require an answer through the tunnel after the handshake, skipping endpoints whose data packets are dropped")
+		hotlist   = fs.StringLong("scan-hotlist", "", "url of a signed warp prefix/port hotlist merged into the built-in ranges, fetched again daily while running")
+		hotlistPK = fs.StringLong("scan-hotlist-key", "", "base64 ed25519 public key the hotlist is signed with")
+		hint      = fs.StringLong("country-hint", "", "favor the warp ports that worked in earlier runs with this country code when scanning and picking endpoints, learned into ./stuff/countryports.json")
+		iface     = fs.StringLong("interface", "", "bind outbound warp and scanner sockets to this network interface (linux only)")
+		fwmark    = fs.IntLong("fwmark", 0, "set this firewall mark on outbound warp and scanner sockets (linux only)")
+		v6src     = fs.StringEnumLong("v6-source", fmt.Sprintf("ipv6 source address of the tunnel sockets: the os default, rotated among the host's addresses or random in its /64 (linux only, the /64 must be routed to the host) (valid values: %s)", iputils.V6SourceModes()), iputils.V6SourceModes()...)
+		coalesce  = fs.BoolLong("coalesce", "share pooled upstream connections between plain http proxy requests")
+		proxyUser = fs.StringLong("proxy-user", "", "require this username from socks5 and http proxy clients")
+		proxyPass = fs.StringLong("proxy-pass", "", "require this password from socks5 and http proxy clients")
+		rateUp    = fs.StringLong("rate-limit-up", "", "cap what proxy clients send to this many bytes per second, e.g. 512K or 2M")
+		rateDown  = fs.StringLong("rate-limit-down", "", "cap what proxy clients receive to this many bytes per second, e.g. 512K or 2M")
+		ratePerCl = fs.BoolLong("rate-limit-per-client", "apply the rate limits to every client address on its own instead of to all clients together")
+		maxConns  = fs.IntLong("max-conns", 0, "refuse proxy connections beyond this many at once, 0 means no limit")
+		maxPerIP  = fs.IntLong("max-conns-per-ip", 0, "refuse proxy connections beyond this many at once from one client address, 0 means no limit")
+		idleTime  = fs.DurationLong("idle-timeout", 0, "close proxy connections, including socks5 udp associations, idle for this long, 0 disables")
+		drainTime = fs.DurationLong("drain-timeout", 10*time.Second, "on shutdown, stop accepting proxy connections but keep the tunnels up this long for open ones to finish, a second signal exits at once")
+		dnsRedir  = fs.StringEnumLong("dns-redirect", fmt.Sprintf("send dns queries of proxy clients (port 53) to the tunnel's resolvers or to 1.1.1.1 in the tunnel, whatever resolver they ask for (valid values: %s)", wiresocks.DNSRedirectModes()), wiresocks.DNSRedirectModes()...)
+		once      = fs.BoolLong("once", "connect, print a JSON connectivity report and exit with status 0 on success or 1 on failure")
+		ephemeral = fs.BoolLong("ephemeral", "register throwaway identities that are removed from the account on exit")
+		profile   = fs.StringLong("profile", "", "run the identities of this profile, see warp-plus profile list")
+		backups   = fs.IntLong("identity-backups", 5, "backups kept of each identity before it is replaced, restore them with warp-plus identity restore, 0 disables")
+		wgconf    = fs.StringLong("wgconf", "", "run from an existing wireguard/wgcf config file instead of registering")
+		config    = fs.String('c', "config", "", "path to config file, reloaded on SIGHUP or when it changes: the endpoint, bind addresses and log levels apply at once, other flags need a restart")
 	)
 
 	err := ff.Parse(
@@ -87,14 +200,59 @@ func main() {
 		os.Exit(1)
 	}
 
-	l := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	// keep stdout clean for the report in once mode
+	logOut := os.Stdout
+	if *once {
+		logOut = os.Stderr
+	}
+	if *logFile != "" {
+		if logOut, err = os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
+	// the levels can change when the config file is reloaded
+	levels := logging.NewLevels(slog.LevelInfo)
 	if *verbose {
-		l = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		levels.SetDefault(slog.LevelDebug)
+	}
+	if err := applyLogLevels(levels, *logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	var logHandler slog.Handler = slog.NewTextHandler(logOut, nil)
+	if *logFormat == "json" {
+		logHandler = slog.NewJSONHandler(logOut, nil)
+	}
+	l := slog.New(logging.NewHandler(logHandler, levels))
+
+	// what the config file said at startup, reloads apply the differences
+	var configAtStart configValues
+	if *config != "" {
+		if configAtStart, err = readConfig(*config); err != nil {
+			fatal(l, err)
+		}
 	}
 
-	if *psiphon && *gool {
-		fatal(l, errors.New("can't use cfon and gool at the same time"))
+	if *auto && (*cfon || *gool) {
+		fatal(l, errors.New("can't use auto with cfon or gool"))
+	}
+
+	if (*proxyUser == "") != (*proxyPass == "") {
+		fatal(l, errors.New("proxy-user and proxy-pass must be used together"))
+	}
+
+	var upRate, downRate int
+	if *rateUp != "" {
+		if upRate, err = wiresocks.ParseRate(*rateUp); err != nil {
+			fatal(l, err)
+		}
+	}
+	if *rateDown != "" {
+		if downRate, err = wiresocks.ParseRate(*rateDown); err != nil {
+			fatal(l, err)
+		}
 	}
 
 	if *v4 && *v6 {
@@ -103,47 +261,689 @@ func main() {
 
 	if !*v4 && !*v6 {
 		*v4, *v6 = true, true
+
+		// On IPv6-only networks prefer v6 endpoints and reach the v4-only
+		// warp API through NAT64, if the network provides it.
+		if hasV4, hasV6 := iputils.DetectIPStack(); !hasV4 && hasV6 {
+			l.Info("IPv6-only network detected, using IPv6 endpoints")
+			*v4 = false
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			prefix, err := iputils.DetectNAT64Prefix(ctx)
+			cancel()
+			if err != nil {
+				l.Warn("no nat64 prefix found, warp registration may fail", "error", err)
+			} else {
+				l.Info("using nat64", "prefix", prefix)
+				warp.UseNAT64(prefix)
+			}
+		}
+	}
+
+	fronting := warp.FrontingOptions{SNI: *apiSNI, Fingerprint: *apiFP}
+	for _, v := range splitList(*apiPrefix) {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid api prefix: %w", err))
+		}
+		fronting.Prefixes = append(fronting.Prefixes, prefix)
+	}
+	if err := warp.UseFronting(fronting); err != nil {
+		fatal(l, err)
+	}
+
+	if *bootstrap != "" {
+		if err := warp.UseBootstrapProxy(*bootstrap); err != nil {
+			fatal(l, err)
+		}
+		l.Info("using bootstrap proxy for warp api calls")
+	}
+
+	if *backups < 0 {
+		fatal(l, errors.New("identity-backups must not be negative"))
+	}
+	warp.KeepBackups(*backups)
+
+	bindAddrPorts, sockets, err := parseBindAddresses(*bind)
+	if err != nil {
+		fatal(l, err)
+	}
+
+	var upstreamProxy *wiresocks.UpstreamProxy
+	if *upstream != "" {
+		if upstreamProxy, err = wiresocks.ParseUpstreamProxy(*upstream); err != nil {
+			fatal(l, err)
+		}
+		// an explicit bootstrap proxy still wins for the api calls
+		if *bootstrap == "" {
+			if err := warp.UseBootstrapProxy(*upstream); err != nil {
+				fatal(l, err)
+			}
+		}
+		l.Info("using upstream proxy", "address", upstreamProxy.Addr)
 	}
 
-	bindAddrPort, err := netip.ParseAddrPort(*bind)
+	if *sysProxy && *bootstrap == "" && *upstream == "" {
+		u, err := warp.UseSystemProxy()
+		if err != nil {
+			fatal(l, fmt.Errorf("system proxy: %w", err))
+		}
+		if u != nil {
+			l.Info("using system proxy for warp api calls", "proxy", u.Redacted())
+		} else {
+			l.Info("no system proxy configured, reaching the warp api directly")
+		}
+	}
+
+	if len(bindAddrPorts) == 0 && (*auto || *probeIntv > 0) {
+		fatal(l, errors.New("--auto and --probe-interval probe the proxy on a bind address, they can't be used with unix sockets only"))
+	}
+
+	if *setProxy {
+		if !sysproxy.Supported() {
+			fatal(l, fmt.Errorf("--set-system-proxy: %w", sysproxy.ErrUnsupported))
+		}
+		if len(bindAddrPorts) == 0 {
+			fatal(l, errors.New("--set-system-proxy needs a bind address, the system proxy can't point at a unix socket"))
+		}
+		if *proxyUser != "" {
+			fatal(l, errors.New("--set-system-proxy can't be used with --proxy-user, the system proxy settings have no credentials"))
+		}
+	}
+	var osProxy systemProxy
+
+	preferFamily, err := parseFamily(*family)
+	if err != nil {
+		fatal(l, err)
+	}
+
+	if *tunConns < 0 {
+		fatal(l, errors.New("tunnel-max-conns must not be negative"))
+	}
+	stack := netstack.Tuning{
+		CongestionControl: *tcpCC,
+		DisableSACK:       *tcpNoSACK,
+		MaxConnections:    *tunConns,
+	}
+	if *tcpBuffer != "" {
+		size, err := wiresocks.ParseSize(*tcpBuffer)
+		if err != nil {
+			fatal(l, err)
+		}
+		stack.ReceiveBuffer, stack.SendBuffer = size, size
+	}
+
+	preferColos, err := app.ParseColos(splitList(*colos))
+	if err != nil {
+		fatal(l, err)
+	}
+	if len(preferColos) > 0 && *noVerify {
+		fatal(l, errors.New("--prefer-colo can't be used with --no-verify"))
+	}
+
+	var reservedBytes *[3]byte
+	if *reserved != "" {
+		b, err := wiresocks.ParseReserved(*reserved)
+		if err != nil {
+			fatal(l, err)
+		}
+		reservedBytes = &b
+	}
+
+	var hooks *app.HookOptions
+	if *onUp != "" || *onDown != "" {
+		hooks = &app.HookOptions{Up: *onUp, Down: *onDown}
+	}
+
+	var probe *app.ProbeOptions
+	if *probeIntv > 0 {
+		if *probeFail < 1 {
+			fatal(l, errors.New("probe-failures must be at least 1"))
+		}
+		probe = &app.ProbeOptions{
+			URLs:      splitList(*probeURLs),
+			Interval:  *probeIntv,
+			Failures:  *probeFail,
+			StatsPath: "./stuff/probes.jsonl",
+		}
+	}
+
+	var tunMTU, goolMTU int
+	if *mtu != "" {
+		if tunMTU, err = app.ParseMTU(*mtu); err != nil {
+			fatal(l, err)
+		}
+	}
+	if *innerMTU != "" {
+		if goolMTU, err = app.ParseMTU(*innerMTU); err != nil {
+			fatal(l, err)
+		}
+	}
+
+	// ports are picked from this list, weighted towards the hinted country
+	endpointPorts, err := parsePorts(*warpPorts)
 	if err != nil {
-		fatal(l, fmt.Errorf("invalid bind address: %w", err))
+		fatal(l, err)
+	}
+	if len(endpointPorts) == 0 {
+		endpointPorts = warp.WarpPorts()
+	}
+	var (
+		hintPorts    []uint16
+		countryPorts warp.CountryPorts
+	)
+	if *hint != "" {
+		if countryPorts, err = warp.ReadCountryPorts(countryPortsPath); err != nil {
+			fatal(l, err)
+		}
+		hintPorts = countryPorts.Preferred(*hint)
+		if len(hintPorts) > 0 {
+			l.Info("favoring warp ports that worked in country", "country", strings.ToUpper(*hint), "ports", hintPorts)
+			endpointPorts = warp.WeightPorts(endpointPorts, hintPorts)
+		} else {
+			l.Info("no warp ports learned for country yet", "country", strings.ToUpper(*hint))
+		}
+	}
+
+	control, err := iputils.SocketControl(*iface, *fwmark)
+	if err != nil {
+		fatal(l, err)
+	}
+	if control != nil {
+		conn.AddControlFn(control)
+	}
+
+	// rather than failing with a permission error mid-run
+	if err := checkPrivileges(bindAddrPorts, *iface, *fwmark, *scan && *scanICMP); err != nil {
+		fatal(l, err)
+	}
+
+	v6Source, v6Control, err := iputils.V6Source(*v6src)
+	if err != nil {
+		fatal(l, err)
+	}
+	if v6Control != nil {
+		conn.AddControlFn(v6Control)
+	}
+	if v6Source != nil {
+		conn.SetIPv6Source(v6Source)
+		l.Info("picking ipv6 source addresses of the tunnel sockets", "mode", *v6src)
+	}
+
+	if *affinity {
+		*balance = wiresocks.BalanceAffinity
 	}
 
 	opts := app.WarpOptions{
-		Bind:     bindAddrPort,
-		Endpoint: *endpoint,
-		License:  *key,
-		Gool:     *gool,
+		Bind:             bindAddrPorts,
+		Endpoint:         *endpoint,
+		Endpoint2:        *endpoint2,
+		License:          *key,
+		Gool:             *gool,
+		Auto:             *auto,
+		Multi:            *multi,
+		Balance:          *balance,
+		SeparateIdentity: *separate,
+		WireguardConfig:  *wgconf,
+		Proxy: wiresocks.ProxyOptions{
+			Coalesce:     *coalesce,
+			Username:     *proxyUser,
+			Password:     *proxyPass,
+			DNSRedirect:  *dnsRedir,
+			Limits:       wiresocks.NewRateLimits(upRate, downRate, *ratePerCl),
+			Conns:        mixed.NewConnLimiter(*maxConns, *maxPerIP),
+			IdleTimeout:  *idleTime,
+			DrainTimeout: *drainTime,
+			UnixSockets:  sockets,
+		},
+		MTU:              tunMTU,
+		InnerMTU:         goolMTU,
+		InnerRefresh:     *goolRefr,
+		InnerMaxRTT:      *goolRTT,
+		KeepAlive:        *keepalive,
+		HandshakeTimeout: *hsTimeout,
+		HandshakeRetries: *hsRetries,
+		Tricks: wiresocks.TrickConfig{
+			Count: *trickN,
+			Size:  *trickSize,
+			Delay: *trickGap,
+		},
+		Upstream:       upstreamProxy,
+		Reserved:       reservedBytes,
+		PreferFamily:   preferFamily,
+		Stack:          stack,
+		ReadyTimeout:   *ready,
+		SkipVerify:     *noVerify,
+		PreferColos:    preferColos,
+		StatusInterval: *status,
+		UAPI:           *uapi,
+		StatsPath:      "./stuff/stats.jsonl",
+		Probe:          probe,
+		RekeyInterval:  *rekey,
+		Hooks:          hooks,
+		OnReady: func(s app.Session) {
+			l.Info("warp-plus is ready", "mode", s.Mode, "addresses", s.Addresses, "sockets", s.Sockets)
+
+			if hasRandomPort(bindAddrPorts) {
+				if err := writeDiscovery(s.Addresses); err != nil {
+					l.Warn("failed to write proxy discovery file", "error", err)
+				}
+			}
+
+			if *setProxy {
+				osProxy.update(l, s.Addresses)
+			}
+
+			if countryPorts != nil {
+				recordCountryPorts(l, countryPorts, *hint, s.Endpoints)
+			}
+		},
+	}
+
+	if *cfon && !app.PsiphonSupported {
+		fatal(l, app.ErrNoPsiphon)
+	}
+
+	if len(*cfonRegs) > 0 && !*cfon {
+		fatal(l, errors.New("--cfon-regions requires --cfon"))
 	}
 
-	if *psiphon {
-		l.Info("psiphon mode enabled", "country", *country)
-		opts.Psiphon = &app.PsiphonOptions{Country: *country}
+	if *cfonHTTP != 0 && !*cfon {
+		fatal(l, errors.New("--cfon-http-port requires --cfon"))
+	}
+	if *cfonHTTP < 0 || *cfonHTTP > 65535 {
+		fatal(l, fmt.Errorf("invalid --cfon-http-port %d", *cfonHTTP))
+	}
+
+	// auto mode skips psiphon in builds without it
+	if (*cfon || *auto) && app.PsiphonSupported {
+		// validate the country against the regions psiphon had servers in
+		// when the list was last fetched, which is only fetched again
+		// through the tunnel, not directly while starting up
+		*country = strings.ToUpper(*country)
+		countries := keptCountries(l, "./stuff")
+		if !slices.Contains(countries, *country) {
+			fatal(l, fmt.Errorf("unsupported psiphon country %q, valid values: %s", *country, strings.Join(countries, ", ")))
+		}
+
+		// bare region ports listen next to the first bind address
+		regionHost := netip.AddrFrom4([4]byte{127, 0, 0, 1})
+		if len(bindAddrPorts) > 0 {
+			regionHost = bindAddrPorts[0].Addr()
+		}
+		regions, err := parsePsiphonRegions(*cfonRegs, regionHost)
+		if err != nil {
+			fatal(l, err)
+		}
+		for _, region := range regions {
+			if !slices.Contains(countries, region.Country) {
+				fatal(l, fmt.Errorf("unsupported psiphon country %q, valid values: %s", region.Country, strings.Join(countries, ", ")))
+			}
+			l.Info("psiphon region enabled", "country", region.Country, "address", region.Bind)
+		}
+
+		if *cfon {
+			l.Info("psiphon mode enabled", "country", *country)
+		}
+		var protocols []string
+		for _, p := range splitList(*cfonProto) {
+			protocols = append(protocols, strings.ToUpper(p))
+		}
+		opts.Psiphon = &app.PsiphonOptions{Country: *country, ConfigPath: *cfonConf, EmbeddedServerListPath: *cfonList, SponsorId: *cfonSpons, PropagationChannelId: *cfonChan, TunnelProtocols: protocols, Regions: regions, HTTPProxyPort: *cfonHTTP}
+
+		onReady := opts.OnReady
+		var refresh sync.Once
+		opts.OnReady = func(s app.Session) {
+			onReady(s)
+			if len(s.Addresses) > 0 {
+				refresh.Do(func() {
+					go refreshCountries(l, app.ProxyClient(s.Addresses[0], opts.Proxy), "./stuff", countriesMaxAge)
+				})
+			}
+		}
 	}
 
 	if *scan {
-		l.Info("scanner mode enabled", "max-rtt", rtt)
-		opts.Scan = &wiresocks.ScanOptions{V4: *v4, V6: *v6, MaxRTT: *rtt}
+		prefixes, err := parsePrefixes("scan-cidr", *cidrs)
+		if err != nil {
+			fatal(l, err)
+		}
+
+		scanPorts, err := parsePorts(*ports)
+		if err != nil {
+			fatal(l, err)
+		}
+		if len(scanPorts) == 0 {
+			scanPorts, _ = parsePorts(*warpPorts)
+		}
+
+		excluded, err := parsePrefixes("scan-exclude", *excludes)
+		if err != nil {
+			fatal(l, err)
+		}
+
+		l.Info("scanner mode enabled", "max-rtt", *rtt, "workers", *workers)
+		opts.Scan = &wiresocks.ScanOptions{
+			V4:       *v4,
+			V6:       *v6,
+			MaxRTT:   *rtt,
+			Workers:  *workers,
+			Prefixes: prefixes,
+			Ports:    scanPorts,
+			Exclude:  excluded,
+			ICMP:     *scanICMP,
+			Validate: *scanValid,
+			// favor the ports learned for the hinted country, if any
+			PreferredPorts: hintPorts,
+			// resume where the last scan stopped and skip known bad IPs
+			StatePath: "./stuff/scan-state.json",
+			// kept for bug reports about scans that find nothing
+			SummaryPath: "./stuff/scan-summary.json",
+			// the scanner must see the same route the tunnel will use
+			SocketControl: control,
+			Upstream:      upstreamProxy,
+		}
+
+		if *hotlist != "" {
+			if *hotlistPK == "" {
+				fatal(l, errors.New("must provide --scan-hotlist-key with --scan-hotlist"))
+			}
+			opts.Scan.Hotlist = &warp.HotlistOptions{
+				URL:       *hotlist,
+				PublicKey: *hotlistPK,
+				CacheDir:  "./stuff",
+				MaxAge:    24 * time.Hour,
+			}
+		}
 	}
 
-	// If the endpoint is not set, choose a random warp endpoint
-	if opts.Endpoint == "" {
+	// Start on the first listed endpoints of the enabled families and move
+	// through the rest
+	if *epFile != "" {
+		if *endpoint != "" || *endpoint2 != "" || *wgconf != "" || *scan {
+			fatal(l, errors.New("--endpoint-file can't be used with --endpoint, --endpoint2, --wgconf or --scan"))
+		}
+		listed, err := warp.ReadEndpointList(*epFile)
+		if err != nil {
+			fatal(l, err)
+		}
+		for _, e := range listed {
+			if e.Addr.Is4() && *v4 || e.Addr.Is6() && *v6 {
+				opts.Endpoints = append(opts.Endpoints, e.AddrPort().String())
+			}
+		}
+		if len(opts.Endpoints) == 0 {
+			fatal(l, fmt.Errorf("no endpoints of the enabled ip families in %s", *epFile))
+		}
+		opts.Endpoint = opts.Endpoints[0]
+		if len(opts.Endpoints) > 1 {
+			opts.Endpoint2 = opts.Endpoints[1]
+		}
+		l.Info("using endpoint list", "file", *epFile, "endpoints", len(opts.Endpoints))
+	}
+
+	// If the endpoint is not set, choose a random warp endpoint. A wireguard
+	// config brings its own endpoint.
+	if opts.Endpoint == "" && opts.WireguardConfig == "" {
 		addrPort, err := warp.RandomWarpEndpoint(*v4, *v6)
 		if err != nil {
 			fatal(l, err)
 		}
-		opts.Endpoint = addrPort.String()
+		opts.Endpoint = netip.AddrPortFrom(addrPort.Addr(), warp.RandomPort(endpointPorts)).String()
+	}
+
+	// Pick a fallback endpoint of the family the primary endpoint isn't
+	if *fallback == "auto" {
+		primary, err := netip.ParseAddrPort(opts.Endpoint)
+		if err != nil {
+			fatal(l, errors.New("--fallback-endpoint auto requires an ip endpoint"))
+		}
+		is4 := primary.Addr().Unmap().Is4()
+		addrPort, err := warp.RandomWarpEndpoint(!is4, is4)
+		if err != nil {
+			fatal(l, err)
+		}
+		opts.FallbackEndpoint = netip.AddrPortFrom(addrPort.Addr(), warp.RandomPort(endpointPorts)).String()
+	} else {
+		opts.FallbackEndpoint = *fallback
+	}
+
+	// In gool and multi mode pick a different random endpoint for the second
+	// tunnel
+	if (opts.Gool || opts.Auto || opts.Multi) && opts.Endpoint2 == "" {
+		for i := 0; i < 10 && (opts.Endpoint2 == "" || opts.Endpoint2 == opts.Endpoint); i++ {
+			addrPort, err := warp.RandomWarpEndpoint(*v4, *v6)
+			if err != nil {
+				fatal(l, err)
+			}
+			opts.Endpoint2 = netip.AddrPortFrom(addrPort.Addr(), warp.RandomPort(endpointPorts)).String()
+		}
+	}
+
+	if *profile != "" {
+		if *ephemeral {
+			fatal(l, errors.New("can't use ephemeral identities with a profile"))
+		}
+		if opts.IdentityDir, err = existingProfileDir(*profile); err != nil {
+			fatal(l, err)
+		}
+		l.Info("using profile", "profile", *profile, "dir", opts.IdentityDir)
+	}
+
+	if *ephemeral {
+		if *wgconf != "" {
+			fatal(l, errors.New("can't use ephemeral identities with a wireguard config"))
+		}
+
+		// unregister what a previous run that was killed left behind
+		if err := app.RemoveIdentities(context.Background(), l, ephemeralDir); err != nil {
+			l.Warn("failed to remove leftover ephemeral identities, reusing them", "error", err)
+		}
+		opts.IdentityDir = ephemeralDir
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if *once {
+		status := runOnce(ctx, l, opts)
+		if *ephemeral {
+			removeEphemeral(l)
+		}
+		os.Exit(status)
 	}
 
-	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	started := make(chan *app.Instance, 1)
 	go func() {
-		if err := app.RunWarp(ctx, l, opts); err != nil {
+		inst, err := app.StartWarp(ctx, l, opts)
+		if err != nil {
 			fatal(l, err)
 		}
+		started <- inst
+
+		if *config != "" {
+			go watchConfig(ctx, l, *config, levels, inst, configAtStart)
+		}
+
+		if *dashAddr != "" {
+			serveDashboard(ctx, l, *dashAddr, inst)
+		}
 	}()
 
 	<-ctx.Done()
+	// a second signal kills the process instead of waiting for the drain
+	stop()
+
+	// new connections go direct again while the open ones drain
+	osProxy.reset(l)
+
+	select {
+	case inst := <-started:
+		inst.Stop()
+		drainCtx, cancel := context.WithTimeout(context.Background(), *drainTime+time.Second)
+		if err := inst.Wait(drainCtx); err != nil {
+			l.Warn("tunnels did not shut down in time", "error", err)
+		}
+		cancel()
+	default:
+	}
+
+	if hasRandomPort(bindAddrPorts) {
+		_ = os.Remove(discoveryPath)
+	}
+
+	if *ephemeral {
+		removeEphemeral(l)
+	}
+}
+
+// ephemeralDir keeps the identities registered with --ephemeral.
+const ephemeralDir = "./stuff/ephemeral"
+
+func removeEphemeral(l *slog.Logger) {
+	if err := app.RemoveIdentities(context.Background(), l, ephemeralDir); err != nil {
+		l.Warn("failed to remove ephemeral identities, they are removed on the next run with --ephemeral", "error", err)
+	}
+}
+
+// countryPortsPath keeps the warp ports that worked per --country-hint.
+const countryPortsPath = "./stuff/countryports.json"
+
+// recordCountryPorts counts the ports of the endpoints of a ready session as
+// working in country.
+func recordCountryPorts(l *slog.Logger, c warp.CountryPorts, country string, endpoints []string) {
+	for _, endpoint := range endpoints {
+		if addr, err := netip.ParseAddrPort(endpoint); err == nil {
+			c.Record(country, addr.Port())
+		}
+	}
+	if err := c.Write(countryPortsPath); err != nil {
+		l.Warn("failed to save the warp ports of the country", "error", err)
+	}
+}
+
+// checkPrivileges checks that the process has the privileges the features in
+// use need, naming the flag of a feature it lacks them for.
+func checkPrivileges(bind []netip.AddrPort, iface string, mark int, icmp bool) error {
+	for _, addr := range bind {
+		if err := iputils.CheckBind(addr); err != nil {
+			return fmt.Errorf("--bind %s: %w", addr, err)
+		}
+	}
+	if err := iputils.CheckSocketControl(iface, 0); err != nil {
+		return fmt.Errorf("--interface %s: %w", iface, err)
+	}
+	if err := iputils.CheckSocketControl("", mark); err != nil {
+		return fmt.Errorf("--fwmark %d: %w", mark, err)
+	}
+	if icmp {
+		if err := iputils.CheckICMP(); err != nil {
+			return fmt.Errorf("--scan-icmp: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseBindAddresses parses the bind addresses, falling back to the default
+// one if none are given. Those of the form unix:PATH, e.g.
+// unix:///run/warp-plus.sock, are returned as unix socket paths.
+func parseBindAddresses(values []string) ([]netip.AddrPort, []string, error) {
+	values = splitList(values)
+	if len(values) == 0 {
+		values = []string{"127.0.0.1:8086"}
+	}
+
+	var addrs []netip.AddrPort
+	var sockets []string
+	for _, v := range values {
+		if path, ok := strings.CutPrefix(v, "unix:"); ok {
+			path = strings.TrimPrefix(path, "//")
+			if path == "" {
+				return nil, nil, fmt.Errorf("invalid bind address %q: missing socket path", v)
+			}
+			sockets = append(sockets, path)
+			continue
+		}
+
+		addr, err := netip.ParseAddrPort(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid bind address: %w", err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, sockets, nil
+}
+
+// parsePsiphonRegions parses port=country or address=country mappings, bare
+// ports listening on host.
+func parsePsiphonRegions(values []string, host netip.Addr) ([]app.PsiphonRegion, error) {
+	var regions []app.PsiphonRegion
+	for _, v := range splitList(values) {
+		addr, country, ok := strings.Cut(v, "=")
+		if !ok || country == "" {
+			return nil, fmt.Errorf("invalid psiphon region %q, expected port=country", v)
+		}
+
+		bind, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			port, portErr := strconv.ParseUint(addr, 10, 16)
+			if portErr != nil {
+				return nil, fmt.Errorf("invalid psiphon region %q: %w", v, err)
+			}
+			bind = netip.AddrPortFrom(host, uint16(port))
+		}
+
+		regions = append(regions, app.PsiphonRegion{Bind: bind, Country: strings.ToUpper(strings.TrimSpace(country))})
+	}
+	return regions, nil
+}
+
+// parseFamily parses an ip family preference, zero meaning auto.
+func parseFamily(value string) (int, error) {
+	switch value {
+	case "auto", "":
+		return 0, nil
+	case "4":
+		return 4, nil
+	case "6":
+		return 6, nil
+	}
+	return 0, fmt.Errorf("invalid --prefer-family %q, must be 4, 6 or auto", value)
+}
+
+func parsePrefixes(flag string, values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range splitList(values) {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %w", flag, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func parsePorts(values []string) ([]uint16, error) {
+	var ports []uint16
+	for _, v := range splitList(values) {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port: %q", v)
+		}
+		ports = append(ports, uint16(port))
+	}
+	return ports, nil
+}
+
+// splitList flattens repeated and comma separated flag values.
+func splitList(values []string) []string {
+	var res []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
 }
 
 func fatal(l *slog.Logger, err error) {
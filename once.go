@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/netip"
+	"os"
+
+	"github.com/bepass-org/warp-plus/app"
+)
+
+// onceResult is the outcome of a --once run, printed as JSON.
+type onceResult struct {
+	OK        bool     `json:"ok"`
+	Mode      string   `json:"mode,omitempty"`
+	Endpoints []string `json:"endpoints,omitempty"`
+	IP        string   `json:"ip,omitempty"`
+	Colo      string   `json:"colo,omitempty"`
+	Location  string   `json:"loc,omitempty"`
+	Warp      string   `json:"warp,omitempty"`
+	RTTMS     int64    `json:"rtt_ms,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// runOnce brings up opts, fetches the cloudflare trace through the proxy,
+// prints the result as JSON to stdout and returns the exit status: 0 if the
+// trace went through the tunnel, 1 otherwise.
+func runOnce(ctx context.Context, l *slog.Logger, opts app.WarpOptions) int {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var res onceResult
+	var addresses []netip.AddrPort
+	opts.OnReady = func(s app.Session) {
+		res.Mode, res.Endpoints = s.Mode, s.Endpoints
+		addresses = s.Addresses
+	}
+
+	err := app.RunWarp(ctx, l, opts)
+	if err == nil {
+		var trace app.Trace
+		trace, err = app.RunTrace(ctx, addresses[0], opts.Proxy)
+		res.IP, res.Colo, res.Location, res.Warp = trace.IP, trace.Colo, trace.Location, trace.Warp
+		res.RTTMS = trace.RTT.Milliseconds()
+	}
+
+	switch {
+	case err != nil:
+		res.Error = err.Error()
+	case res.Mode != "psiphon" && res.Mode != "gool-psiphon" && res.Warp != "on" && res.Warp != "plus":
+		// psiphon exits through its own servers, every other mode must
+		// reach cloudflare through warp
+		res.Error = "traffic is not going through warp"
+	default:
+		res.OK = true
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		l.Error(err.Error())
+		return 1
+	}
+
+	if !res.OK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,5 @@
+//go:build !minimal
+
+package main
+
+import _ "net/http/pprof"
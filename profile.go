@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/warp"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+const profileUsage = `usage: warp-plus profile <list|create|delete> [name] [flags]
+
+Keep several named profiles, each with its own identities, license and last
+working endpoints. Run one with warp-plus --profile <name>.`
+
+// profileDir returns the identity directory of the profile name. An empty
+// name is the default profile.
+func profileDir(name string) (string, error) {
+	return warp.ProfileDir("./stuff", name)
+}
+
+// existingProfileDir is profileDir for a profile that must have been created.
+func existingProfileDir(name string) (string, error) {
+	dir, err := profileDir(name)
+	if err != nil {
+		return "", err
+	}
+	if name == "" || name == warp.DefaultProfile {
+		return dir, nil
+	}
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("profile %q doesn't exist, create it with warp-plus profile create %s", name, name)
+	}
+	return dir, nil
+}
+
+// primaryDir returns dir, or the primary identity directory of profile if
+// one is given.
+func primaryDir(profile, dir string) (string, error) {
+	if profile == "" {
+		return dir, nil
+	}
+	pdir, err := existingProfileDir(profile)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(pdir, "primary"), nil
+}
+
+// runProfileCommand implements the "profile list", "profile create" and
+// "profile delete" subcommands.
+func runProfileCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New(profileUsage)
+	}
+
+	// the name comes before the flags, which stop at the first argument
+	command, args := args[0], args[1:]
+	var name string
+	if command != "list" && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	fs := ff.NewFlagSet("warp-plus profile " + command)
+	var (
+		key  = fs.String('k', "key", "", "warp+ license the identity of the new profile is registered with")
+		keep = fs.BoolLong("keep-devices", "delete the profile without removing its devices from the warp account")
+	)
+
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("WARP_PLUS"))
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if command == "list" {
+		return listProfiles()
+	}
+
+	if name == "" || len(fs.GetArgs()) > 0 {
+		return errors.New(profileUsage)
+	}
+	if name == warp.DefaultProfile {
+		return fmt.Errorf("the %s profile is always there", warp.DefaultProfile)
+	}
+	dir, err := profileDir(name)
+	if err != nil {
+		return err
+	}
+
+	l := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	switch command {
+	case "create":
+		if _, err := os.Stat(dir); err == nil {
+			return fmt.Errorf("profile %q already exists", name)
+		}
+
+		if err := warp.LoadOrCreateIdentity(context.Background(), l, filepath.Join(dir, "primary"), *key); err != nil {
+			_ = os.RemoveAll(dir)
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "profile %s created in %s\n", name, dir)
+	case "delete":
+		if _, err := existingProfileDir(name); err != nil {
+			return err
+		}
+
+		if *keep {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		} else if err := app.RemoveIdentities(context.Background(), l, dir); err != nil {
+			return fmt.Errorf("%w, use --keep-devices to delete the profile anyway", err)
+		}
+
+		fmt.Fprintf(os.Stderr, "profile %s deleted\n", name)
+	default:
+		return errors.New(profileUsage)
+	}
+
+	return nil
+}
+
+// listProfiles prints the profiles with the account of their primary
+// identity and the endpoint they last connected on.
+func listProfiles() error {
+	names, err := warp.Profiles("./stuff")
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tACCOUNT\tDEVICE\tLAST ENDPOINT")
+	for _, name := range names {
+		dir, _ := profileDir(name)
+
+		account, device := "-", "-"
+		if i, err := warp.LoadIdentity(filepath.Join(dir, "primary")); err == nil {
+			account, device = i.Account.AccountType, i.ID
+			if i.Team != "" {
+				account = "team " + i.Team
+			}
+		}
+
+		endpoint := "-"
+		if wc, err := app.LoadWorkingConfig(dir); err == nil && len(wc.Tunnels) > 0 {
+			endpoint = wc.Tunnels[0].Endpoint
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, account, device, endpoint)
+	}
+	return w.Flush()
+}
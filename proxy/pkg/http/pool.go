@@ -0,0 +1,96 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+// hopHeaders are meaningful only for a single connection and must not be
+// forwarded, see RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, k := range h.Values("Connection") {
+		h.Del(k)
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// readerConn reads from r, which holds data already buffered from Conn.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// serveWithTransport serves plain proxy requests on conn through s.Transport,
+// which reuses upstream connections across requests and clients. Requests
+// that need a raw tunnel (CONNECT, protocol upgrades) are handed over to
+// handleHTTP.
+func (s *Server) serveWithTransport(conn net.Conn, reader *bufio.Reader, req *http.Request) error {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	for {
+		if req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" {
+			return s.handleHTTP(&readerConn{Conn: conn, r: reader}, req, req.Method == http.MethodConnect)
+		}
+
+		if !s.authorized(req) {
+			return s.requireAuth(conn)
+		}
+
+		if req.URL.Host == "" {
+			http.Error(NewHTTPResponseWriter(conn), "missing host in request uri", http.StatusBadRequest)
+			return errors.New("missing host in proxy request")
+		}
+
+		// the client's wish to close applies to its own connection only, the
+		// upstream connection goes back to the pool
+		keepAlive := !req.Close
+		req.Close = false
+		req.RequestURI = ""
+		removeHopHeaders(req.Header)
+
+		resp, err := s.Transport.RoundTrip(req.WithContext(s.Context))
+		if err != nil {
+			http.Error(NewHTTPResponseWriter(conn), err.Error(), http.StatusServiceUnavailable)
+			return err
+		}
+
+		removeHopHeaders(resp.Header)
+		resp.Close = !keepAlive
+		err = resp.Write(conn)
+		_ = resp.Body.Close()
+		if err != nil || !keepAlive {
+			return err
+		}
+
+		req, err = http.ReadRequest(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+	qt "github.com/frankban/quicktest"
+)
+
+// coalescingServer returns a server pooling plain requests through a
+// transport, the url of its upstream, how many requests reached it and how
+// often the server called its user handler.
+func coalescingServer(t *testing.T) (*Server, string, *atomic.Int32, *atomic.Int32) {
+	var upstream, handled atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.Add(1)
+		fmt.Fprint(w, "hello")
+	}))
+	t.Cleanup(backend.Close)
+
+	s := NewServer(
+		WithContext(context.Background()),
+		WithCredentials(&statute.Credentials{Username: "user", Password: "pass"}),
+		WithConnectHandle(func(req *statute.ProxyRequest) error {
+			handled.Add(1)
+			if req.Serve == nil {
+				return fmt.Errorf("plain request to %s not served by the transport", req.Destination)
+			}
+			return req.Serve(req.Conn)
+		}),
+	)
+	s.Transport = &http.Transport{}
+	return s, backend.URL, &upstream, &handled
+}
+
+func proxyGet(t *testing.T, conn net.Conn, r *bufio.Reader, target string, auth bool) *http.Response {
+	u, err := url.Parse(target)
+	qt.Assert(t, err, qt.IsNil)
+	req := &http.Request{Method: "GET", URL: u, Host: u.Host, Header: http.Header{}}
+	if auth {
+		req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	}
+	qt.Assert(t, req.WriteProxy(conn), qt.IsNil)
+
+	resp, err := http.ReadResponse(r, req)
+	qt.Assert(t, err, qt.IsNil)
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func TestCoalescedAuthFirst(t *testing.T) {
+	s, _, upstream, handled := coalescingServer(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _ = s.ServeConn(server) }()
+
+	// nothing reaches the handler or upstream before authentication
+	resp := proxyGet(t, client, bufio.NewReader(client), "http://example.com/", false)
+	qt.Assert(t, resp.StatusCode, qt.Equals, http.StatusProxyAuthRequired)
+	qt.Assert(t, handled.Load(), qt.Equals, int32(0))
+	qt.Assert(t, upstream.Load(), qt.Equals, int32(0))
+}
+
+func TestCoalescedThroughHandler(t *testing.T) {
+	s, backend, upstream, handled := coalescingServer(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _ = s.ServeConn(server) }()
+	r := bufio.NewReader(client)
+
+	for i := 0; i < 2; i++ {
+		resp := proxyGet(t, client, r, backend, true)
+		qt.Assert(t, resp.StatusCode, qt.Equals, http.StatusOK)
+	}
+
+	// both requests went through one handler call
+	qt.Assert(t, handled.Load(), qt.Equals, int32(1))
+	qt.Assert(t, upstream.Load(), qt.Equals, int32(2))
+
+	// a later request without credentials is refused on the same connection
+	resp := proxyGet(t, client, r, backend, false)
+	qt.Assert(t, resp.StatusCode, qt.Equals, http.StatusProxyAuthRequired)
+	qt.Assert(t, upstream.Load(), qt.Equals, int32(2))
+}
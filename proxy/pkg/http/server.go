@@ -3,11 +3,14 @@ package http
 import (
 	"bufio"
 	"context"
+	"encoding/base64"
+	"errors"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 )
@@ -29,6 +32,12 @@ type Server struct {
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// Credentials, if set, are required from clients using Basic
+	// authentication
+	Credentials *statute.Credentials
+	// Transport, if set, carries plain (non CONNECT) requests so upstream
+	// connections are pooled and shared between clients
+	Transport http.RoundTripper
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -124,6 +133,18 @@ func WithContext(ctx context.Context) ServerOption {
 	}
 }
 
+func WithCredentials(credentials *statute.Credentials) ServerOption {
+	return func(s *Server) {
+		s.Credentials = credentials
+	}
+}
+
+func WithTransport(transport http.RoundTripper) ServerOption {
+	return func(s *Server) {
+		s.Transport = transport
+	}
+}
+
 func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	return func(s *Server) {
 		s.BytesPool = bytesPool
@@ -137,6 +158,36 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return err
 	}
 
+	if !s.authorized(req) {
+		return s.requireAuth(conn)
+	}
+
+	if s.Transport != nil && req.Method != http.MethodConnect && req.Header.Get("Upgrade") == "" {
+		if s.UserConnectHandle == nil {
+			return s.serveWithTransport(conn, reader, req)
+		}
+
+		// the user handler still sees the connection, to count and limit
+		// it, but the transport serves it instead of a dialed connection
+		targetAddr, host, port, err := requestTarget(req, false)
+		if err != nil {
+			return err
+		}
+		rconn := &readerConn{Conn: conn, r: reader}
+		return s.UserConnectHandle(&statute.ProxyRequest{
+			Conn:        rconn,
+			Reader:      rconn,
+			Writer:      rconn,
+			Network:     "tcp",
+			Destination: targetAddr,
+			DestHost:    host,
+			DestPort:    port,
+			Serve: func(c net.Conn) error {
+				return s.serveWithTransport(c, bufio.NewReader(c), req)
+			},
+		})
+	}
+
 	return s.handleHTTP(conn, req, req.Method == http.MethodConnect)
 }
 
@@ -158,6 +209,27 @@ func (s *Server) handleHTTP(conn net.Conn, req *http.Request, isConnectMethod bo
 		conn = cConn
 	}
 
+	targetAddr, host, port, err := requestTarget(req, isConnectMethod)
+	if err != nil {
+		return err
+	}
+
+	proxyReq := &statute.ProxyRequest{
+		Conn:        conn,
+		Reader:      io.Reader(conn),
+		Writer:      io.Writer(conn),
+		Network:     "tcp",
+		Destination: targetAddr,
+		DestHost:    host,
+		DestPort:    port,
+	}
+
+	return s.UserConnectHandle(proxyReq)
+}
+
+// requestTarget returns the address req is for, defaulting the port by its
+// scheme.
+func requestTarget(req *http.Request, isConnectMethod bool) (string, string, int32, error) {
 	targetAddr := req.URL.Host
 	host, portStr, err := net.SplitHostPort(targetAddr)
 	if err != nil {
@@ -172,21 +244,9 @@ func (s *Server) handleHTTP(conn net.Conn, req *http.Request, isConnectMethod bo
 
 	portInt, err := strconv.Atoi(portStr)
 	if err != nil {
-		return err // Handle the error if the port string is not a valid integer.
-	}
-	port := int32(portInt)
-
-	proxyReq := &statute.ProxyRequest{
-		Conn:        conn,
-		Reader:      io.Reader(conn),
-		Writer:      io.Writer(conn),
-		Network:     "tcp",
-		Destination: targetAddr,
-		DestHost:    host,
-		DestPort:    port,
+		return "", "", 0, err // Handle the error if the port string is not a valid integer.
 	}
-
-	return s.UserConnectHandle(proxyReq)
+	return targetAddr, host, int32(portInt), nil
 }
 
 func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMethod bool) error {
@@ -244,3 +304,41 @@ func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMeth
 	}
 	return statute.Tunnel(s.Context, target, conn, buf1, buf2)
 }
+
+// authorized reports whether req carries valid proxy credentials, or whether
+// none are required.
+func (s *Server) authorized(req *http.Request) bool {
+	if s.Credentials == nil {
+		return true
+	}
+
+	username, password, ok := parseBasicAuth(req.Header.Get("Proxy-Authorization"))
+	return ok && s.Credentials.Valid(username, password)
+}
+
+// requireAuth answers with 407 and closes conn.
+func (s *Server) requireAuth(conn net.Conn) error {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	w := NewHTTPResponseWriter(conn)
+	w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+	http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+	return errors.New("http proxy authentication failed")
+}
+
+// parseBasicAuth parses a Basic authorization header value.
+func parseBasicAuth(auth string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(c), ":")
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"log/slog"
 	"net"
+	"net/http"
+	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 )
@@ -98,3 +100,39 @@ func WithBytesPool(bytesPool statute.BytesPool) Option {
 		p.httpProxy.BytesPool = bytesPool
 	}
 }
+
+// WithHTTPTransport makes the http proxy send plain (non CONNECT) requests
+// through transport, so upstream connections are pooled between clients.
+func WithHTTPTransport(transport http.RoundTripper) Option {
+	return func(p *Proxy) {
+		p.httpProxy.Transport = transport
+	}
+}
+
+// WithCredentials requires clients to authenticate with credentials, using
+// username/password authentication for socks5 and Basic authentication for
+// http. Socks4 clients are refused.
+func WithCredentials(credentials *statute.Credentials) Option {
+	return func(p *Proxy) {
+		p.credentials = credentials
+		p.socks5Proxy.Credentials = credentials
+		p.httpProxy.Credentials = credentials
+	}
+}
+
+// WithConnLimiter refuses client connections over the limits of limiter,
+// which may be shared by several proxies.
+func WithConnLimiter(limiter *ConnLimiter) Option {
+	return func(p *Proxy) {
+		p.connLimiter = limiter
+	}
+}
+
+// WithIdleTimeout closes the connections passed to the user handlers once
+// nothing was sent or received on them for timeout. It applies to socks5
+// UDP associations too.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.idleTimeout = timeout
+	}
+}
@@ -0,0 +1,166 @@
+package mixed
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+var (
+	errTooManyConns      = errors.New("too many connections")
+	errTooManyConnsPerIP = errors.New("too many connections from this address")
+)
+
+// ConnLimiter caps the client connections of one or more proxies, in total
+// and per client address. It is safe for concurrent use.
+type ConnLimiter struct {
+	max, perIP int
+
+	mu     sync.Mutex
+	total  int
+	byAddr map[netip.Addr]int
+}
+
+// NewConnLimiter allows max connections in total and perIP connections from
+// one client address, zero meaning no limit. It returns nil if neither is
+// limited.
+func NewConnLimiter(max, perIP int) *ConnLimiter {
+	if max <= 0 && perIP <= 0 {
+		return nil
+	}
+	return &ConnLimiter{max: max, perIP: perIP, byAddr: make(map[netip.Addr]int)}
+}
+
+// acquire counts a connection from addr, unless it is over a limit. It always
+// succeeds on a nil limiter.
+func (c *ConnLimiter) acquire(addr netip.Addr) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.max > 0 && c.total >= c.max {
+		return errTooManyConns
+	}
+	if c.perIP > 0 && c.byAddr[addr] >= c.perIP {
+		return errTooManyConnsPerIP
+	}
+	c.total++
+	c.byAddr[addr]++
+	return nil
+}
+
+// release forgets a connection counted by acquire.
+func (c *ConnLimiter) release(addr netip.Addr) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total--
+	if c.byAddr[addr]--; c.byAddr[addr] <= 0 {
+		delete(c.byAddr, addr)
+	}
+}
+
+// remoteAddr returns the client address of conn, unmapped.
+func remoteAddr(conn net.Conn) netip.Addr {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// idleHandler closes the connection of a request once it was idle for
+// timeout, then waits for handler.
+func idleHandler(handler userHandler, timeout time.Duration) userHandler {
+	return func(req *statute.ProxyRequest) error {
+		conn := newIdleConn(req.Conn, timeout)
+		defer conn.stop()
+
+		req.Conn, req.Reader, req.Writer = conn, conn, conn
+		return handler(req)
+	}
+}
+
+// idleConn closes its connection once nothing was read from or written to it
+// for timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	// last is when the connection was last used, in unix nanoseconds
+	last atomic.Int64
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration) *idleConn {
+	c := &idleConn{Conn: conn, timeout: timeout}
+	c.last.Store(time.Now().UnixNano())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = time.AfterFunc(timeout, c.check)
+	return c
+}
+
+// check closes the connection if it is idle, or else checks again when it
+// would be.
+func (c *idleConn) check() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+
+	idle := time.Since(time.Unix(0, c.last.Load()))
+	if idle >= c.timeout {
+		_ = c.Conn.Close()
+		return
+	}
+	c.timer.Reset(c.timeout - idle)
+}
+
+// stop stops watching the connection.
+func (c *idleConn) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	c.timer.Stop()
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// SourceAddr returns the source address of the connection, if it has one,
+// or else its remote address.
+func (c *idleConn) SourceAddr() net.Addr {
+	if src, ok := c.Conn.(interface{ SourceAddr() net.Addr }); ok {
+		return src.SourceAddr()
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,48 @@
+package mixed
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestConnLimiter(t *testing.T) {
+	qt.Assert(t, NewConnLimiter(0, 0), qt.IsNil)
+
+	a, b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	l := NewConnLimiter(3, 2)
+
+	qt.Assert(t, l.acquire(a), qt.IsNil)
+	qt.Assert(t, l.acquire(a), qt.IsNil)
+	qt.Assert(t, l.acquire(a), qt.Equals, errTooManyConnsPerIP)
+	qt.Assert(t, l.acquire(b), qt.IsNil)
+	qt.Assert(t, l.acquire(b), qt.Equals, errTooManyConns)
+
+	l.release(a)
+	qt.Assert(t, l.acquire(b), qt.IsNil)
+	qt.Assert(t, l.acquire(a), qt.Equals, errTooManyConns)
+}
+
+func TestIdleConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := newIdleConn(server, 100*time.Millisecond)
+	defer conn.stop()
+
+	// activity keeps the connection open past the timeout
+	go io.Copy(io.Discard, client)
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, err := conn.Write([]byte("x"))
+		qt.Assert(t, err, qt.IsNil)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	_, err := conn.Write([]byte("x"))
+	qt.Assert(t, err, qt.ErrorIs, io.ErrClosedPipe)
+}
@@ -3,8 +3,10 @@ package mixed
 import (
 	"bufio"
 	"context"
+	"errors"
 	"log/slog"
 	"net"
+	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/http"
 	"github.com/bepass-org/warp-plus/proxy/pkg/socks4"
@@ -38,6 +40,14 @@ type Proxy struct {
 	logger *slog.Logger
 	// ctx is default context
 	ctx context.Context
+	// credentials, if set, are required from clients; socks4 is refused as
+	// it can't carry a password
+	credentials *statute.Credentials
+	// connLimiter, if set, refuses connections over its limits
+	connLimiter *ConnLimiter
+	// idleTimeout, if set, closes the connections of user handlers once
+	// they are idle for that long
+	idleTimeout time.Duration
 }
 
 func NewProxy(options ...Option) *Proxy {
@@ -55,6 +65,10 @@ func NewProxy(options ...Option) *Proxy {
 		option(p)
 	}
 
+	if p.idleTimeout > 0 {
+		p.wrapIdleTimeout()
+	}
+
 	return p
 }
 
@@ -79,6 +93,18 @@ func (c *SwitchConn) Read(p []byte) (n int, err error) {
 	return c.reader.Read(p)
 }
 
+// NetConn returns the net.Conn. It may only be read directly once Buffered
+// is zero.
+func (c *SwitchConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Buffered returns the number of bytes read from the net.Conn but not yet
+// from c.
+func (c *SwitchConn) Buffered() int {
+	return c.reader.Buffered()
+}
+
 func (p *Proxy) ListenAndServe() error {
 	// Create a new listener
 	if p.listener == nil {
@@ -113,9 +139,17 @@ func (p *Proxy) ListenAndServe() error {
 				continue
 			}
 
+			addr := remoteAddr(conn)
+			if err := p.connLimiter.acquire(addr); err != nil {
+				p.logger.Debug("refusing connection", "client", conn.RemoteAddr(), "error", err)
+				_ = conn.Close()
+				continue
+			}
+
 			// Start a new goroutine to handle each connection
 			// This way, the server can handle multiple connections concurrently
 			go func() {
+				defer p.connLimiter.release(addr)
 				err := p.handleConnection(conn)
 				if err != nil {
 					p.logger.Error(err.Error()) // Log errors from ServeConn
@@ -125,6 +159,22 @@ func (p *Proxy) ListenAndServe() error {
 	}
 }
 
+// wrapIdleTimeout makes the user handlers close idle connections.
+func (p *Proxy) wrapIdleTimeout() {
+	if h := p.socks5Proxy.UserConnectHandle; h != nil {
+		p.socks5Proxy.UserConnectHandle = statute.UserConnectHandler(idleHandler(userHandler(h), p.idleTimeout))
+	}
+	if h := p.socks5Proxy.UserAssociateHandle; h != nil {
+		p.socks5Proxy.UserAssociateHandle = statute.UserAssociateHandler(idleHandler(userHandler(h), p.idleTimeout))
+	}
+	if h := p.socks4Proxy.UserConnectHandle; h != nil {
+		p.socks4Proxy.UserConnectHandle = statute.UserConnectHandler(idleHandler(userHandler(h), p.idleTimeout))
+	}
+	if h := p.httpProxy.UserConnectHandle; h != nil {
+		p.httpProxy.UserConnectHandle = statute.UserConnectHandler(idleHandler(userHandler(h), p.idleTimeout))
+	}
+}
+
 func (p *Proxy) handleConnection(conn net.Conn) error {
 	// Create a SwitchConn
 	switchConn := NewSwitchConn(conn)
@@ -145,6 +195,9 @@ func (p *Proxy) handleConnection(conn net.Conn) error {
 	switch {
 	case buf[0] == 5:
 		err = p.socks5Proxy.ServeConn(switchConn)
+	case buf[0] == 4 && p.credentials != nil:
+		_ = switchConn.Close()
+		err = errors.New("socks4 refused, authentication is required")
 	case buf[0] == 4:
 		err = p.socks4Proxy.ServeConn(switchConn)
 	default:
@@ -0,0 +1,193 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// UDPAssociate asks the socks5 server at proxyAddr to relay UDP for us and
+// returns a PacketConn whose datagrams go through that relay. The
+// association lasts until the returned conn is closed or the server drops
+// the control connection.
+func UDPAssociate(ctx context.Context, proxyAddr string, credentials *statute.Credentials) (net.PacketConn, error) {
+	ctrl, err := (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 15 * time.Second}).DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	relay, err := associate(ctx, ctrl, credentials)
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, fmt.Errorf("socks5 udp associate with %s: %w", proxyAddr, err)
+	}
+
+	// servers answering with an unspecified address relay on the address
+	// they were reached at
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	udp, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, err
+	}
+
+	c := &udpClientConn{udp: udp, ctrl: ctrl}
+	go c.watch()
+	return c, nil
+}
+
+// associate authenticates on ctrl and sends the UDP ASSOCIATE request,
+// returning the relay address of the server.
+func associate(ctx context.Context, ctrl net.Conn, credentials *statute.Credentials) (*net.UDPAddr, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = ctrl.SetDeadline(deadline)
+	} else {
+		_ = ctrl.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+	defer func() {
+		_ = ctrl.SetDeadline(time.Time{})
+	}()
+
+	method := noAuth
+	if credentials != nil {
+		method = userPassAuth
+	}
+	if _, err := ctrl.Write([]byte{socks5Version, 1, byte(method)}); err != nil {
+		return nil, err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(ctrl, resp[:]); err != nil {
+		return nil, err
+	}
+	if resp[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", resp[0])
+	}
+	if authMethod(resp[1]) != method {
+		return nil, errNoSupportedAuth
+	}
+
+	if method == userPassAuth {
+		if len(credentials.Username) > 255 || len(credentials.Password) > 255 {
+			return nil, errStringTooLong
+		}
+		req := []byte{userPassAuthVersion, byte(len(credentials.Username))}
+		req = append(req, credentials.Username...)
+		req = append(req, byte(len(credentials.Password)))
+		req = append(req, credentials.Password...)
+		if _, err := ctrl.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(ctrl, resp[:]); err != nil {
+			return nil, err
+		}
+		if resp[1] != authSuccess {
+			return nil, errAuthFailed
+		}
+	}
+
+	// we don't know the address our datagrams will come from, so leave it
+	// unspecified
+	req := bytes.NewBuffer([]byte{socks5Version, byte(AssociateCommand), 0})
+	if err := writeAddr(req, nil); err != nil {
+		return nil, err
+	}
+	if _, err := ctrl.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(ctrl, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+	if reply(header[1]) != successReply {
+		return nil, errors.New(reply(header[1]).String())
+	}
+
+	addr, err := readAddr(ctrl)
+	if err != nil {
+		return nil, err
+	}
+	if addr.Name != "" {
+		return net.ResolveUDPAddr("udp", addr.Address())
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+}
+
+// udpClientConn is the client side of a UDP association. Datagrams are
+// sent to the relay behind a socks5 UDP request header naming their
+// destination.
+type udpClientConn struct {
+	udp  *net.UDPConn
+	ctrl net.Conn
+}
+
+// watch closes the conn once the server drops the control connection,
+// which ends the association.
+func (c *udpClientConn) watch() {
+	_, _ = io.Copy(io.Discard, c.ctrl)
+	_ = c.udp.Close()
+}
+
+func (c *udpClientConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, err := c.udp.Read(b)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// drop fragments, which we never ask for, and malformed datagrams
+		if n < 3 || b[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(b[3:n])
+		addr, err := readAddr(r)
+		if err != nil || addr.IP == nil {
+			continue
+		}
+
+		payload := b[n-r.Len() : n]
+		return copy(b, payload), &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+	}
+}
+
+func (c *udpClientConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unsupported address type %T", addr)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 3, 3+1+net.IPv6len+2+len(b)))
+	if err := writeAddr(buf, &address{IP: udpAddr.IP, Port: udpAddr.Port}); err != nil {
+		return 0, err
+	}
+	buf.Write(b)
+
+	if _, err := c.udp.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *udpClientConn) Close() error {
+	err := c.udp.Close()
+	_ = c.ctrl.Close()
+	return err
+}
+
+func (c *udpClientConn) LocalAddr() net.Addr                { return c.udp.LocalAddr() }
+func (c *udpClientConn) SetDeadline(t time.Time) error      { return c.udp.SetDeadline(t) }
+func (c *udpClientConn) SetReadDeadline(t time.Time) error  { return c.udp.SetReadDeadline(t) }
+func (c *udpClientConn) SetWriteDeadline(t time.Time) error { return c.udp.SetWriteDeadline(t) }
@@ -0,0 +1,55 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestUDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	credentials := &statute.Credentials{Username: "user", Password: "pass"}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	srv := NewServer(WithCredentials(credentials))
+	srv.Listener = ln
+	go func() { _ = srv.ListenAndServe() }()
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = UDPAssociate(ctx, ln.Addr().String(), &statute.Credentials{Username: "user", Password: "wrong"})
+	qt.Assert(t, err, qt.ErrorIs, errAuthFailed)
+
+	c, err := UDPAssociate(ctx, ln.Addr().String(), credentials)
+	qt.Assert(t, err, qt.IsNil)
+	defer c.Close()
+
+	_, err = c.WriteTo([]byte("ping"), echo.LocalAddr())
+	qt.Assert(t, err, qt.IsNil)
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, addr, err := c.ReadFrom(buf)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(buf[:n]), qt.Equals, "ping")
+	qt.Assert(t, addr.String(), qt.Equals, echo.LocalAddr().String())
+}
@@ -16,6 +16,7 @@ import (
 var (
 	errStringTooLong        = errors.New("string too long")
 	errNoSupportedAuth      = errors.New("no supported authentication mechanism")
+	errAuthFailed           = errors.New("socks5 authentication failed")
 	errUnrecognizedAddrType = errors.New("unrecognized address type")
 )
 
@@ -138,9 +139,16 @@ type authMethod byte
 
 const (
 	noAuth       authMethod = 0x00 // no authentication required
+	userPassAuth authMethod = 0x02 // username/password authentication, RFC 1929
 	noAcceptable authMethod = 0xff // no acceptable authentication methods
 )
 
+const (
+	userPassAuthVersion = 0x01
+	authSuccess         = 0x00
+	authFailure         = 0x01
+)
+
 func readBytes(r io.Reader) ([]byte, error) {
 	var buf [1]byte
 	_, err := r.Read(buf[:])
@@ -319,6 +327,12 @@ func (cc *udpCustomConn) RemoteAddr() net.Addr {
 	return cc.targetAddr
 }
 
+// SourceAddr returns the address of the client the datagrams are relayed
+// for.
+func (cc *udpCustomConn) SourceAddr() net.Addr {
+	return cc.sourceAddr
+}
+
 func (cc *udpCustomConn) asyncReadPackets() {
 	go func() {
 		for {
@@ -36,6 +36,9 @@ type Server struct {
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// Credentials, if set, are required from clients using username/password
+	// authentication
+	Credentials *statute.Credentials
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -151,6 +154,12 @@ func WithContext(ctx context.Context) ServerOption {
 	}
 }
 
+func WithCredentials(credentials *statute.Credentials) ServerOption {
+	return func(s *Server) {
+		s.Credentials = credentials
+	}
+}
+
 func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	return func(s *Server) {
 		s.BytesPool = bytesPool
@@ -176,12 +185,21 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return err
 	}
 
-	if bytes.IndexByte(methods, byte(noAuth)) != -1 {
+	switch {
+	case s.Credentials != nil && bytes.IndexByte(methods, byte(userPassAuth)) != -1:
+		_, err := conn.Write([]byte{socks5Version, byte(userPassAuth)})
+		if err != nil {
+			return err
+		}
+		if err := s.authenticate(conn); err != nil {
+			return err
+		}
+	case s.Credentials == nil && bytes.IndexByte(methods, byte(noAuth)) != -1:
 		_, err := conn.Write([]byte{socks5Version, byte(noAuth)})
 		if err != nil {
 			return err
 		}
-	} else {
+	default:
 		_, err := conn.Write([]byte{socks5Version, byte(noAcceptable)})
 		if err != nil {
 			return err
@@ -220,6 +238,35 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	return nil
 }
 
+// authenticate runs the username/password subnegotiation of RFC 1929.
+func (s *Server) authenticate(conn net.Conn) error {
+	version, err := readByte(conn)
+	if err != nil {
+		return err
+	}
+	if version != userPassAuthVersion {
+		return fmt.Errorf("unsupported authentication version: %d", version)
+	}
+
+	username, err := readBytes(conn)
+	if err != nil {
+		return err
+	}
+
+	password, err := readBytes(conn)
+	if err != nil {
+		return err
+	}
+
+	if !s.Credentials.Valid(string(username), string(password)) {
+		_, _ = conn.Write([]byte{userPassAuthVersion, authFailure})
+		return errAuthFailed
+	}
+
+	_, err = conn.Write([]byte{userPassAuthVersion, authSuccess})
+	return err
+}
+
 func (s *Server) handle(req *request) error {
 	switch req.Command {
 	case ConnectCommand:
@@ -2,6 +2,7 @@ package statute
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
 	"io"
 	"net"
@@ -30,6 +31,10 @@ type ProxyRequest struct {
 	Destination string
 	DestHost    string
 	DestPort    int32
+	// Serve, if set, serves the request on conn without a connection to
+	// Destination, e.g. plain http requests sent through a pooled transport.
+	// Handlers call it with the Conn they wrapped in place of dialing.
+	Serve func(conn net.Conn) error
 }
 
 // UserConnectHandler is used for socks5, socks4 and http
@@ -74,3 +79,18 @@ func DefaultContext() context.Context {
 }
 
 const DefaultBindAddress = "127.0.0.1:1080"
+
+// Credentials are the username and password proxy clients must authenticate
+// with.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Valid reports whether username and password match c. The comparison takes
+// constant time.
+func (c *Credentials) Valid(username, password string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(c.Username))
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(c.Password))
+	return userOK&passOK == 1
+}
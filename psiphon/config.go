@@ -0,0 +1,128 @@
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const remoteServerListSignaturePublicKey = "MIICIDANBgkqhkiG9w0BAQEFAAOCAg0AMIICCAKCAgEAt7Ls+/39r+T6zNW7GiVpJfzq/xvL9SBH5rIFnk0RXYEYavax3WS6HOD35eTAqn8AniOwiH+DOkvgSKF2caqk/y1dfq47Pdymtwzp9ikpB1C5OfAysXzBiwVJlCdajBKvBZDerV1cMvRzCKvKwRmvDmHgphQQ7WfXIGbRbmmk6opMBh3roE42KcotLFtqp0RRwLtcBRNtCdsrVsjiI1Lqz/lH+T61sGjSjQ3CHMuZYSQJZo/KrvzgQXpkaCTdbObxHqb6/+i1qaVOfEsvjoiyzTxJADvSytVtcTjijhPEV6XskJVHE1Zgl+7rATr/pDQkw6DPCNBS1+Y6fy7GstZALQXwEDN/qhQI9kWkHijT8ns+i1vGg00Mk/6J75arLhqcodWsdeG/M/moWgqQAnlZAGVtJI1OgeF5fsPpXu4kctOfuZlGjVZXQNW34aOzm8r8S0eVZitPlbhcPiR4gT/aSMz/wd8lZlzZYsje/Jr8u/YtlwjjreZrGRmG8KMOzukV3lLmMppXFMvl4bxv6YFEmIuTsOhbLTwFgh7KYNjodLj/LsqRVfwz31PgWQFTEPICV7GCvgVlPRxnofqKSjgTWI4mxDhBpVcATvaoBl1L/6WLbFvBsoAUBItWwctO2xalKxF5szhGm8lccoc5MZr8kfE0uxMgsxz4er68iCID+rsCAQM="
+
+// Options customizes the psiphon client configuration.
+type Options struct {
+	// ConfigPath is a psiphon config JSON file whose keys are set over the
+	// built-in configuration. The listener, upstream proxy and egress region
+	// are always overridden.
+	ConfigPath string
+	// EmbeddedServerListPath is an encoded server entry list imported before
+	// connecting.
+	EmbeddedServerListPath string
+	// SponsorId and PropagationChannelId override the values in the config.
+	SponsorId            string
+	PropagationChannelId string
+	// TunnelProtocols limits the protocols psiphon may use, e.g. QUIC-OSSH.
+	// Empty means all protocols are allowed.
+	TunnelProtocols []string
+	// DataDir is where the tunnel keeps its files, defaults to the working
+	// directory. psiphon-tunnel-core opens a single datastore per process,
+	// so tunnels started while another runs share its datastore and only
+	// keep their other files here.
+	DataDir string
+	// HTTPProxyPort, if set, also runs psiphon's own http proxy on this
+	// port, on the interface of the socks proxy. Zero keeps it disabled.
+	HTTPProxyPort int
+}
+
+func (o Options) embeddedServerList() (string, error) {
+	if o.EmbeddedServerListPath == "" {
+		return "", nil
+	}
+
+	b, err := os.ReadFile(o.EmbeddedServerListPath)
+	if err != nil {
+		return "", fmt.Errorf("unable to read psiphon embedded server list: %w", err)
+	}
+	return string(b), nil
+}
+
+func defaultConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"DisableLocalHTTPProxy":                   true,
+		"PropagationChannelId":                    "FFFFFFFFFFFFFFFF",
+		"RemoteServerListDownloadFilename":        "remote_server_list",
+		"RemoteServerListSignaturePublicKey":      remoteServerListSignaturePublicKey,
+		"RemoteServerListUrl":                     remoteServerListURL,
+		"SponsorId":                               "FFFFFFFFFFFFFFFF",
+		"UseIndistinguishableTLS":                 true,
+		"AllowDefaultDNSResolverWithBindToDevice": true,
+	}
+}
+
+// buildConfig returns the psiphon config JSON for a client listening on
+// localSocksPort and tunneling through the socks proxy at wgBind.
+func buildConfig(wgBind, localSocksPort, country string, opts Options) ([]byte, error) {
+	host, port, err := net.SplitHostPort(localSocksPort)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(host, "127.0.0") {
+		host = ""
+	} else {
+		host = "any"
+	}
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid psiphon listen port: %w", err)
+	}
+
+	config := defaultConfig()
+	if opts.ConfigPath != "" {
+		b, err := os.ReadFile(opts.ConfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read psiphon config: %w", err)
+		}
+
+		var custom map[string]interface{}
+		if err := json.Unmarshal(b, &custom); err != nil {
+			return nil, fmt.Errorf("invalid psiphon config %s: %w", opts.ConfigPath, err)
+		}
+		for k, v := range custom {
+			config[k] = v
+		}
+	}
+
+	if opts.SponsorId != "" {
+		config["SponsorId"] = opts.SponsorId
+	}
+	if opts.PropagationChannelId != "" {
+		config["PropagationChannelId"] = opts.PropagationChannelId
+	}
+
+	if len(opts.TunnelProtocols) > 0 {
+		if err := protocol.TunnelProtocols(opts.TunnelProtocols).Validate(); err != nil {
+			return nil, fmt.Errorf("invalid psiphon tunnel protocols: %w", err)
+		}
+		config["LimitTunnelProtocols"] = opts.TunnelProtocols
+	}
+
+	if opts.HTTPProxyPort > 0 {
+		config["DisableLocalHTTPProxy"] = false
+		config["LocalHttpProxyPort"] = opts.HTTPProxyPort
+	}
+
+	config["EgressRegion"] = country
+	config["ListenInterface"] = host
+	config["LocalSocksProxyPort"] = portNum
+	config["UpstreamProxyURL"] = "socks5://" + wgBind
+	// the traffic of the tunnel is counted from these notices, see
+	// Tunnel.Stats
+	config["EmitBytesTransferred"] = true
+
+	return json.Marshal(config)
+}
@@ -0,0 +1,49 @@
+package psiphon
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestBuildConfigHTTPProxyPort(t *testing.T) {
+	config := func(opts Options) map[string]interface{} {
+		t.Helper()
+		raw, err := buildConfig("127.0.0.1:8086", "127.0.0.1:0", "DE", opts)
+		qt.Assert(t, err, qt.IsNil)
+		var c map[string]interface{}
+		qt.Assert(t, json.Unmarshal(raw, &c), qt.IsNil)
+		return c
+	}
+
+	c := config(Options{})
+	qt.Assert(t, c["DisableLocalHTTPProxy"], qt.Equals, true)
+	qt.Assert(t, c["LocalHttpProxyPort"], qt.IsNil)
+
+	c = config(Options{HTTPProxyPort: 8118})
+	qt.Assert(t, c["DisableLocalHTTPProxy"], qt.Equals, false)
+	qt.Assert(t, c["LocalHttpProxyPort"], qt.Equals, float64(8118))
+	qt.Assert(t, c["ListenInterface"], qt.Equals, "")
+	qt.Assert(t, c["LocalSocksProxyPort"], qt.Equals, float64(0))
+	qt.Assert(t, c["EgressRegion"], qt.Equals, "DE")
+}
+
+func TestBuildConfigCustom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	qt.Assert(t, os.WriteFile(path, []byte(`{"SponsorId": "0123456789ABCDEF", "EgressRegion": "US", "NetworkLatencyMultiplier": 2}`), 0o644), qt.IsNil)
+
+	raw, err := buildConfig("127.0.0.1:8086", "127.0.0.1:0", "DE", Options{ConfigPath: path, PropagationChannelId: "FEDCBA9876543210"})
+	qt.Assert(t, err, qt.IsNil)
+	var c map[string]interface{}
+	qt.Assert(t, json.Unmarshal(raw, &c), qt.IsNil)
+
+	// the custom keys are set over the defaults, which are kept otherwise
+	qt.Assert(t, c["SponsorId"], qt.Equals, "0123456789ABCDEF")
+	qt.Assert(t, c["NetworkLatencyMultiplier"], qt.Equals, float64(2))
+	qt.Assert(t, c["RemoteServerListUrl"], qt.Equals, remoteServerListURL)
+	qt.Assert(t, c["PropagationChannelId"], qt.Equals, "FEDCBA9876543210")
+	qt.Assert(t, c["EgressRegion"], qt.Equals, "DE")
+}
@@ -6,8 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"net"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -57,11 +57,34 @@ type Tunnel struct {
 	embeddedServerListWaitGroup sync.WaitGroup
 	controllerWaitGroup         sync.WaitGroup
 	stopController              context.CancelFunc
+	done                        chan struct{}
 
 	// The port on which the HTTP proxy is running
 	HTTPProxyPort int
 	// The port on which the SOCKS proxy is running
 	SOCKSProxyPort int
+
+	mu           sync.Mutex
+	serverRegion string
+	connected    bool
+	stopped      bool
+}
+
+// Traffic is what the psiphon tunnels of the process tunneled.
+type Traffic struct {
+	// BytesSent and BytesReceived count the bytes tunneled by every tunnel
+	// since the process started.
+	BytesSent, BytesReceived int64
+}
+
+// notices is what the tunnels learned from psiphon-tunnel-core's notices. It
+// has a single notice writer per process, the one of the tunnel started last,
+// which gets the notices of every tunnel with nothing telling them apart.
+var notices struct {
+	sync.Mutex
+	traffic Traffic
+	// running counts the tunnels that connected and weren't stopped yet
+	running int
 }
 
 // ParametersDelta allows for fine-grained modification of parameters.Parameters.
@@ -161,7 +184,7 @@ func StartTunnel(
 	errored := make(chan error, 1)
 
 	// Create the tunnel object
-	tunnel := new(Tunnel)
+	tunnel := &Tunnel{done: make(chan struct{})}
 
 	// Set up notice handling
 	psiphon.SetNoticeWriter(psiphon.NewNoticeReceiver(
@@ -190,6 +213,8 @@ func StartTunnel(
 				case errored <- ErrTimeout:
 				default:
 				}
+			} else if event.Type == "BytesTransferred" || event.Type == "ConnectedServerRegion" {
+				tunnel.record(event)
 			} else if event.Type == "Tunnels" {
 				count := event.Data["count"].(float64)
 				if count > 0 {
@@ -267,6 +292,7 @@ func StartTunnel(
 	tunnel.controllerWaitGroup.Add(1)
 	go func() {
 		defer tunnel.controllerWaitGroup.Done()
+		defer close(tunnel.done)
 
 		// Start the tunnel. Only returns on error (or internal timeout).
 		controller.Run(controllerCtx)
@@ -294,6 +320,7 @@ func StartTunnel(
 	// Wait for an active tunnel or error
 	select {
 	case <-connected:
+		tunnel.setConnected()
 		return tunnel, nil
 	case err := <-errored:
 		tunnel.Stop()
@@ -304,6 +331,68 @@ func StartTunnel(
 	}
 }
 
+// record counts the bytes of a BytesTransferred notice as traffic of the
+// process, and takes the region of a ConnectedServerRegion notice as the
+// tunnel's while the notice can only be about it: while it connects, or once
+// it is the only tunnel running.
+func (tunnel *Tunnel) record(event NoticeEvent) {
+	switch event.Type {
+	case "BytesTransferred":
+		sent, _ := event.Data["sent"].(float64)
+		received, _ := event.Data["received"].(float64)
+		notices.Lock()
+		notices.traffic.BytesSent += int64(sent)
+		notices.traffic.BytesReceived += int64(received)
+		notices.Unlock()
+	case "ConnectedServerRegion":
+		region, _ := event.Data["serverRegion"].(string)
+		notices.Lock()
+		running := notices.running
+		notices.Unlock()
+
+		tunnel.mu.Lock()
+		if !tunnel.connected || running == 1 {
+			tunnel.serverRegion = region
+		}
+		tunnel.mu.Unlock()
+	}
+}
+
+// setConnected counts the tunnel as running once it connected.
+func (tunnel *Tunnel) setConnected() {
+	tunnel.mu.Lock()
+	defer tunnel.mu.Unlock()
+	tunnel.connected = true
+
+	notices.Lock()
+	notices.running++
+	notices.Unlock()
+}
+
+// ServerRegion returns the region of the psiphon server the tunnel connected
+// to. With other tunnels running it is the region it connected to first, as
+// their notices can't be told apart from its own.
+func (tunnel *Tunnel) ServerRegion() string {
+	tunnel.mu.Lock()
+	defer tunnel.mu.Unlock()
+	return tunnel.serverRegion
+}
+
+// ProcessTraffic returns the bytes tunneled by every psiphon tunnel of the
+// process. psiphon-tunnel-core reports them for all tunnels together, so
+// there is no figure per tunnel.
+func ProcessTraffic() Traffic {
+	notices.Lock()
+	defer notices.Unlock()
+	return notices.traffic
+}
+
+// Done returns a channel that is closed once the tunnel's controller exits,
+// either because the tunnel was stopped or because it died.
+func (tunnel *Tunnel) Done() <-chan struct{} {
+	return tunnel.done
+}
+
 // Stop stops/disconnects/shuts down the tunnel. It is safe to call when not connected.
 // Not safe to call concurrently with Start.
 func (tunnel *Tunnel) Stop() {
@@ -311,38 +400,44 @@ func (tunnel *Tunnel) Stop() {
 		return
 	}
 	tunnel.stopController()
+
+	tunnel.mu.Lock()
+	if tunnel.connected && !tunnel.stopped {
+		notices.Lock()
+		notices.running--
+		notices.Unlock()
+	}
+	tunnel.stopped = true
+	tunnel.mu.Unlock()
+
 	tunnel.controllerWaitGroup.Wait()
 	tunnel.embeddedServerListWaitGroup.Wait()
 	psiphon.CloseDataStore()
 }
 
-func RunPsiphon(ctx context.Context, l *slog.Logger, wgBind, localSocksPort, country string) error {
-	// Embedded configuration
-	host, port, err := net.SplitHostPort(localSocksPort)
+// RunPsiphon starts a psiphon tunnel through the socks proxy at wgBind with
+// its local socks proxy on localSocksPort. A zero port in localSocksPort picks
+// a random port, see Tunnel.SOCKSProxyPort. The caller must Stop the returned
+// tunnel once it is no longer needed.
+func RunPsiphon(ctx context.Context, l *slog.Logger, wgBind, localSocksPort, country string, opts Options) (*Tunnel, error) {
+	if !IsValidCountry(country) {
+		return nil, fmt.Errorf("unsupported psiphon country %q, valid values: %s", country, strings.Join(Countries(), ", "))
+	}
+
+	configJSON, err := buildConfig(wgBind, localSocksPort, country, opts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	embeddedServerList, err := opts.embeddedServerList()
+	if err != nil {
+		return nil, err
 	}
-	if strings.HasPrefix(host, "127.0.0") {
-		host = ""
-	} else {
-		host = "any"
+
+	dir := opts.DataDir
+	if dir == "" {
+		dir = "."
 	}
-	configJSON := `{
-		"EgressRegion": "` + country + `",
-		"ListenInterface": "` + host + `",
-		"LocalSocksProxyPort": ` + port + `,
-		"UpstreamProxyURL": "socks5://` + wgBind + `",
-		"DisableLocalHTTPProxy": true,
-		"PropagationChannelId":"FFFFFFFFFFFFFFFF",
-		"RemoteServerListDownloadFilename":"remote_server_list",
-		"RemoteServerListSignaturePublicKey":"MIICIDANBgkqhkiG9w0BAQEFAAOCAg0AMIICCAKCAgEAt7Ls+/39r+T6zNW7GiVpJfzq/xvL9SBH5rIFnk0RXYEYavax3WS6HOD35eTAqn8AniOwiH+DOkvgSKF2caqk/y1dfq47Pdymtwzp9ikpB1C5OfAysXzBiwVJlCdajBKvBZDerV1cMvRzCKvKwRmvDmHgphQQ7WfXIGbRbmmk6opMBh3roE42KcotLFtqp0RRwLtcBRNtCdsrVsjiI1Lqz/lH+T61sGjSjQ3CHMuZYSQJZo/KrvzgQXpkaCTdbObxHqb6/+i1qaVOfEsvjoiyzTxJADvSytVtcTjijhPEV6XskJVHE1Zgl+7rATr/pDQkw6DPCNBS1+Y6fy7GstZALQXwEDN/qhQI9kWkHijT8ns+i1vGg00Mk/6J75arLhqcodWsdeG/M/moWgqQAnlZAGVtJI1OgeF5fsPpXu4kctOfuZlGjVZXQNW34aOzm8r8S0eVZitPlbhcPiR4gT/aSMz/wd8lZlzZYsje/Jr8u/YtlwjjreZrGRmG8KMOzukV3lLmMppXFMvl4bxv6YFEmIuTsOhbLTwFgh7KYNjodLj/LsqRVfwz31PgWQFTEPICV7GCvgVlPRxnofqKSjgTWI4mxDhBpVcATvaoBl1L/6WLbFvBsoAUBItWwctO2xalKxF5szhGm8lccoc5MZr8kfE0uxMgsxz4er68iCID+rsCAQM=",
-		"RemoteServerListUrl":"https://s3.amazonaws.com//psiphon/web/mjr4-p23r-puwl/server_list_compressed",
-		"SponsorId":"FFFFFFFFFFFFFFFF",
-		"UseIndistinguishableTLS":true,
-		"AllowDefaultDNSResolverWithBindToDevice":true
-	}`
-
-	dir := "."
 	ClientPlatform := "Android_4.0.4_com.example.exampleClientLibraryApp"
 	network := "test"
 	timeout := 60
@@ -363,21 +458,42 @@ func RunPsiphon(ctx context.Context, l *slog.Logger, wgBind, localSocksPort, cou
 	t := time.NewTicker(1 * time.Second)
 	defer t.Stop()
 
+	noticeReceiver := func(event NoticeEvent) {
+		if event.Type != "AvailableEgressRegions" {
+			return
+		}
+		regions, _ := event.Data["regions"].([]interface{})
+		codes := make([]string, 0, len(regions))
+		for _, r := range regions {
+			if code, ok := r.(string); ok && code != "" {
+				codes = append(codes, code)
+			}
+		}
+		setAvailableCountries(codes)
+	}
+
 	for {
 		select {
 		case <-childCtx.Done():
 			if errors.Is(childCtx.Err(), context.Canceled) {
-				return errors.New("psiphon handshake operation canceled")
+				return nil, errors.New("psiphon handshake operation canceled")
 			}
-			return errors.New("psiphon handshake maximum time exceeded")
+			if available := AvailableCountries(); len(available) > 0 && !slices.Contains(available, country) {
+				return nil, fmt.Errorf("psiphon has no servers available in %s%s", country, countryHint(country))
+			}
+			return nil, fmt.Errorf("psiphon handshake maximum time exceeded for %s%s", country, countryHint(country))
 		case <-t.C:
-			tunnel, err := StartTunnel(ctx, []byte(configJSON), "", p, nil, nil)
+			tunnel, err := StartTunnel(ctx, configJSON, embeddedServerList, p, nil, noticeReceiver)
 			if err != nil {
-				l.Info("Unable to start psiphon", err, "reconnecting...")
+				l.Info("unable to start psiphon, reconnecting...", "error", err)
 				continue
 			}
 			l.Info(fmt.Sprintf("Psiphon started successfully on port %d, handshake operation took %s", tunnel.SOCKSProxyPort, time.Since(t0)))
-			return nil
+			if tunnel.HTTPProxyPort != 0 {
+				l.Info("psiphon http proxy listening", "port", tunnel.HTTPProxyPort)
+			}
+			l.Info("psiphon connected", "country", country, "server_region", tunnel.ServerRegion())
+			return tunnel, nil
 		}
 	}
 }
@@ -0,0 +1,47 @@
+package psiphon
+
+import (
+	"encoding/json"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// notice parses a notice as psiphon-tunnel-core writes it.
+func notice(t *testing.T, raw string) NoticeEvent {
+	t.Helper()
+	var event NoticeEvent
+	qt.Assert(t, json.Unmarshal([]byte(raw), &event), qt.IsNil)
+	return event
+}
+
+func TestTunnelRecord(t *testing.T) {
+	t.Cleanup(func() {
+		notices.Lock()
+		notices.traffic, notices.running = Traffic{}, 0
+		notices.Unlock()
+	})
+
+	first := &Tunnel{}
+	first.record(notice(t, `{"noticeType":"ConnectedServerRegion","data":{"serverRegion":"DE"},"timestamp":"2024-01-01T00:00:00Z"}`))
+	first.record(notice(t, `{"noticeType":"BytesTransferred","data":{"diagnosticID":"a","sent":100,"received":1000},"timestamp":"2024-01-01T00:00:01Z"}`))
+	first.setConnected()
+	qt.Assert(t, first.ServerRegion(), qt.Equals, "DE")
+
+	// alone, a reconnect of the first tunnel is its own
+	first.record(notice(t, `{"noticeType":"ConnectedServerRegion","data":{"serverRegion":"AT"},"timestamp":"2024-01-01T00:00:02Z"}`))
+	qt.Assert(t, first.ServerRegion(), qt.Equals, "AT")
+
+	// the second tunnel now gets every notice
+	second := &Tunnel{}
+	second.record(notice(t, `{"noticeType":"ConnectedServerRegion","data":{"serverRegion":"US"},"timestamp":"2024-01-01T00:00:03Z"}`))
+	second.setConnected()
+	second.record(notice(t, `{"noticeType":"BytesTransferred","data":{"diagnosticID":"b","sent":5,"received":50},"timestamp":"2024-01-01T00:00:04Z"}`))
+	// either tunnel may have reconnected, so neither takes the region
+	second.record(notice(t, `{"noticeType":"ConnectedServerRegion","data":{"serverRegion":"CA"},"timestamp":"2024-01-01T00:00:05Z"}`))
+	qt.Assert(t, first.ServerRegion(), qt.Equals, "AT")
+	qt.Assert(t, second.ServerRegion(), qt.Equals, "US")
+
+	// the traffic of both is counted together
+	qt.Assert(t, ProcessTraffic(), qt.Equals, Traffic{BytesSent: 105, BytesReceived: 1050})
+}
@@ -0,0 +1,141 @@
+package psiphon
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type region struct {
+	Code      string
+	Name      string
+	Continent string
+}
+
+// regions is the embedded list of psiphon egress regions. It is used to
+// validate the requested country before any network activity and to suggest
+// alternatives when a region can't be reached.
+var regions = []region{
+	{"AT", "Austria", "EU"},
+	{"BE", "Belgium", "EU"},
+	{"BG", "Bulgaria", "EU"},
+	{"BR", "Brazil", "SA"},
+	{"CA", "Canada", "NA"},
+	{"CH", "Switzerland", "EU"},
+	{"CZ", "Czech Republic", "EU"},
+	{"DE", "Germany", "EU"},
+	{"DK", "Denmark", "EU"},
+	{"EE", "Estonia", "EU"},
+	{"ES", "Spain", "EU"},
+	{"FI", "Finland", "EU"},
+	{"FR", "France", "EU"},
+	{"GB", "United Kingdom", "EU"},
+	{"HU", "Hungary", "EU"},
+	{"IE", "Ireland", "EU"},
+	{"IN", "India", "AS"},
+	{"IT", "Italy", "EU"},
+	{"JP", "Japan", "AS"},
+	{"LV", "Latvia", "EU"},
+	{"NL", "Netherlands", "EU"},
+	{"NO", "Norway", "EU"},
+	{"PL", "Poland", "EU"},
+	{"RO", "Romania", "EU"},
+	{"RS", "Serbia", "EU"},
+	{"SE", "Sweden", "EU"},
+	{"SG", "Singapore", "AS"},
+	{"SK", "Slovakia", "EU"},
+	{"UA", "Ukraine", "EU"},
+	{"US", "United States", "NA"},
+}
+
+// availableRegions holds the egress regions most recently announced by
+// psiphon through the AvailableEgressRegions notice.
+var availableRegions struct {
+	sync.Mutex
+	codes []string
+}
+
+// Countries returns the country codes of all supported psiphon egress
+// regions: those of the server list once RefreshCountries succeeded, the
+// embedded ones before.
+func Countries() []string {
+	liveCountries.Lock()
+	live := slices.Clone(liveCountries.codes)
+	liveCountries.Unlock()
+	if live != nil {
+		return live
+	}
+
+	codes := make([]string, len(regions))
+	for i, r := range regions {
+		codes[i] = r.Code
+	}
+	return codes
+}
+
+// CountryName returns the english name of a supported country code.
+func CountryName(code string) (string, bool) {
+	for _, r := range regions {
+		if r.Code == code {
+			return r.Name, true
+		}
+	}
+	return "", false
+}
+
+// IsValidCountry reports whether code is a supported psiphon egress region.
+func IsValidCountry(code string) bool {
+	return slices.Contains(Countries(), code)
+}
+
+// AvailableCountries returns the egress regions announced by psiphon servers
+// during the last connection attempt, or nil if none were announced yet.
+func AvailableCountries() []string {
+	availableRegions.Lock()
+	defer availableRegions.Unlock()
+	return slices.Clone(availableRegions.codes)
+}
+
+func setAvailableCountries(codes []string) {
+	sort.Strings(codes)
+
+	availableRegions.Lock()
+	defer availableRegions.Unlock()
+	availableRegions.codes = codes
+}
+
+// NearbyCountries returns supported countries on the same continent as code,
+// excluding code itself. If psiphon has announced its available regions, the
+// result is restricted to them.
+func NearbyCountries(code string) []string {
+	var continent string
+	for _, r := range regions {
+		if r.Code == code {
+			continent = r.Continent
+		}
+	}
+
+	available := AvailableCountries()
+
+	var res []string
+	for _, r := range regions {
+		if r.Code == code || r.Continent != continent {
+			continue
+		}
+		if len(available) > 0 && !slices.Contains(available, r.Code) {
+			continue
+		}
+		res = append(res, r.Code)
+	}
+	return res
+}
+
+// countryHint formats a suggestion listing nearby alternatives to code.
+func countryHint(code string) string {
+	nearby := NearbyCountries(code)
+	if len(nearby) == 0 {
+		return ""
+	}
+	return "; nearby alternatives: " + strings.Join(nearby, ", ")
+}
@@ -0,0 +1,170 @@
+package psiphon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	remoteServerListURL = "https://s3.amazonaws.com//psiphon/web/mjr4-p23r-puwl/server_list_compressed"
+
+	// countriesFile keeps the egress regions of the last server list fetch
+	// in the directory passed to RefreshCountries.
+	countriesFile = "psiphon-countries.json"
+
+	// maxServerListSize bounds the download, the list is a few megabytes.
+	maxServerListSize = 64 << 20
+)
+
+// liveCountries holds the egress regions of the psiphon server list set by
+// RefreshCountries, nil until it succeeds.
+var liveCountries struct {
+	sync.Mutex
+	codes []string
+}
+
+type countryCache struct {
+	Countries []string  `json:"countries"`
+	Updated   time.Time `json:"updated"`
+}
+
+// FetchCountries downloads psiphon's signed remote server list and returns
+// the egress regions its servers are in.
+func FetchCountries(ctx context.Context, c *http.Client) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", remoteServerListURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch psiphon server list: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch psiphon server list: status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxServerListSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch psiphon server list: %w", err)
+	}
+
+	list, err := common.ReadAuthenticatedDataPackage(data, true, remoteServerListSignaturePublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid psiphon server list: %w", err)
+	}
+
+	seen := make(map[string]struct{})
+	decoder := protocol.NewStreamingServerEntryDecoder(strings.NewReader(list), common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	for {
+		fields, err := decoder.Next()
+		if err != nil {
+			return nil, fmt.Errorf("invalid psiphon server list: %w", err)
+		}
+		if fields == nil {
+			break
+		}
+
+		if region, _ := fields["region"].(string); region != "" {
+			seen[strings.ToUpper(region)] = struct{}{}
+		}
+	}
+
+	if len(seen) == 0 {
+		return nil, errors.New("psiphon server list has no egress regions")
+	}
+
+	codes := make([]string, 0, len(seen))
+	for code := range seen {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes, nil
+}
+
+// RefreshCountries makes Countries return the egress regions of the current
+// psiphon server list and returns them. The list is fetched with c at most
+// once per maxAge and kept in dir. If fetching fails the last fetched list
+// is used, however old, and without one the embedded list.
+func RefreshCountries(ctx context.Context, l *slog.Logger, c *http.Client, dir string, maxAge time.Duration) []string {
+	path := filepath.Join(dir, countriesFile)
+	cache := readCountryCache(l, path)
+
+	if len(cache.Countries) == 0 || time.Since(cache.Updated) >= maxAge {
+		codes, err := FetchCountries(ctx, c)
+		if err == nil {
+			cache = countryCache{Countries: codes, Updated: time.Now()}
+			if err := writeCountryCache(path, cache); err != nil {
+				l.Warn("failed to save psiphon countries", "path", path, "error", err)
+			}
+		} else if len(cache.Countries) > 0 {
+			l.Warn("failed to refresh psiphon countries, using the list from "+cache.Updated.Format(time.DateOnly), "error", err)
+		} else {
+			l.Warn("failed to fetch psiphon countries, using the built-in list", "error", err)
+			return Countries()
+		}
+	}
+
+	return useCountries(cache.Countries)
+}
+
+// KeptCountries is RefreshCountries without fetching: it uses the list kept
+// in dir, however old, and without one the embedded list.
+func KeptCountries(l *slog.Logger, dir string) []string {
+	cache := readCountryCache(l, filepath.Join(dir, countriesFile))
+	if len(cache.Countries) == 0 {
+		return Countries()
+	}
+	return useCountries(cache.Countries)
+}
+
+// useCountries makes Countries return codes and returns them.
+func useCountries(codes []string) []string {
+	liveCountries.Lock()
+	liveCountries.codes = slices.Clone(codes)
+	liveCountries.Unlock()
+
+	return slices.Clone(codes)
+}
+
+// readCountryCache reads the country list kept at path, empty if there is
+// none.
+func readCountryCache(l *slog.Logger, path string) countryCache {
+	var cache countryCache
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &cache); err != nil {
+			l.Warn("ignoring invalid psiphon country cache", "path", path, "error", err)
+			return countryCache{}
+		}
+	}
+	return cache
+}
+
+func writeCountryCache(path string, cache countryCache) error {
+	b, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/logging"
+
+	"github.com/peterbourgon/ff/v4/ffjson"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 5 * time.Second
+
+// configAliases maps the short flag names a config file may use to the long
+// ones.
+var configAliases = map[string]string{
+	"v": "verbose",
+	"b": "bind",
+	"e": "endpoint",
+	"k": "key",
+	"c": "config",
+}
+
+// configValues are the flag values of a config file by long flag name.
+type configValues map[string][]string
+
+// readConfig reads the flag values of the config file at path.
+func readConfig(path string) (configValues, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := configValues{}
+	err = ffjson.Parse(f, func(name, value string) error {
+		if long, ok := configAliases[name]; ok {
+			name = long
+		}
+		values[name] = append(values[name], value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// watchConfig applies changes to the config file at path to inst whenever
+// the process gets SIGHUP or the file is modified, until ctx is done. The
+// endpoint, bind addresses and log levels are applied at runtime, changes to
+// other flags are logged as needing a restart. current are the values the
+// instance was started with.
+func watchConfig(ctx context.Context, l *slog.Logger, path string, levels *logging.Levels, inst *app.Instance, current configValues) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	t := time.NewTicker(configPollInterval)
+	defer t.Stop()
+
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			l.Info("got SIGHUP, reloading config", "path", path)
+		case <-t.C:
+			fi, err := os.Stat(path)
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			l.Info("config file changed, reloading", "path", path)
+		}
+
+		values, err := readConfig(path)
+		if err != nil {
+			l.Warn("failed to reload config, keeping the current one", "error", err)
+			continue
+		}
+		applyConfig(l, levels, inst, current, values)
+		current = values
+	}
+}
+
+// applyConfig applies the flags that differ between old and values.
+func applyConfig(l *slog.Logger, levels *logging.Levels, inst *app.Instance, old, values configValues) {
+	var changed []string
+	for name := range old {
+		if _, ok := values[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	for name, v := range values {
+		if !slices.Equal(old[name], v) {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+
+	if len(changed) == 0 {
+		l.Info("config unchanged")
+		return
+	}
+
+	for _, name := range changed {
+		v := values[name]
+
+		var err error
+		switch name {
+		case "verbose":
+			err = applyVerbose(levels, v)
+		case "log-level":
+			err = applyLogLevels(levels, v)
+		case "endpoint":
+			if len(v) == 0 || v[len(v)-1] == "" {
+				err = errors.New("removing the endpoint needs a restart")
+				break
+			}
+			err = inst.SwitchEndpoint(v[len(v)-1])
+		case "bind":
+			binds, sockets, bindErr := parseBindAddresses(v)
+			if bindErr != nil {
+				err = bindErr
+				break
+			}
+			err = inst.SwitchBind(binds, sockets...)
+		default:
+			l.Warn("config change needs a restart to take effect", "flag", name)
+			continue
+		}
+
+		if err != nil {
+			l.Warn("failed to apply config change", "flag", name, "error", err)
+			continue
+		}
+		l.Info("applied config change", "flag", name, "value", v)
+	}
+}
+
+// applyVerbose switches the default level between info and debug.
+func applyVerbose(levels *logging.Levels, values []string) error {
+	verbose := false
+	if len(values) > 0 {
+		var err error
+		if verbose, err = strconv.ParseBool(values[len(values)-1]); err != nil {
+			return err
+		}
+	}
+
+	if verbose {
+		levels.SetDefault(slog.LevelDebug)
+	} else {
+		levels.SetDefault(slog.LevelInfo)
+	}
+	return nil
+}
+
+// applyLogLevels sets the levels of specs, see logging.ParseLevels. Specs
+// without a default level keep the current one.
+func applyLogLevels(levels *logging.Levels, specs []string) error {
+	def, subsystems, err := logging.ParseLevels(specs)
+	if err != nil {
+		return err
+	}
+	if def != nil {
+		levels.SetDefault(*def)
+	}
+	levels.SetSubsystems(subsystems)
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+	"github.com/bepass-org/warp-plus/iputils"
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wiresocks"
+
+	"github.com/fatih/color"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+	"github.com/rodaine/table"
+)
+
+// scanResult is a scanned endpoint, printed as JSON by "scan --json".
+type scanResult struct {
+	Addr      string    `json:"addr"`
+	RTTMS     int64     `json:"rtt_ms"`
+	JitterMS  int64     `json:"jitter_ms"`
+	Loss      float64   `json:"loss"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// runScanCommand implements the "scan" subcommand, which scans for warp
+// endpoints and prints them without starting the proxy.
+func runScanCommand(args []string) error {
+	fs := ff.NewFlagSet("warp-plus scan")
+	var (
+		v4       = fs.BoolShort('4', "only scan IPv4 endpoints")
+		v6       = fs.BoolShort('6', "only scan IPv6 endpoints")
+		verbose  = fs.Bool('v', "verbose", "enable verbose logging")
+		dir      = fs.String('d', "dir", "./stuff/primary", "identity directory whose keys the warp pings use")
+		count    = fs.Int('n', "count", 5, "number of endpoints to find")
+		timeout  = fs.DurationLong("timeout", 2*time.Minute, "give up if fewer endpoints are found within this time")
+		rtt      = fs.DurationLong("rtt", time.Second, "scanner rtt limit")
+		workers  = fs.IntLong("workers", 8, "number of parallel scanner workers")
+		cidrs    = fs.StringListLong("cidr", "prefix to scan instead of the built-in warp prefixes (repeatable)")
+		excludes = fs.StringListLong("exclude", "prefix never to scan (repeatable)")
+		ports    = fs.StringListLong("ports", "ports to scan instead of the built-in warp ports (repeatable, comma separated)")
+		icmp     = fs.BoolLong("icmp", "skip IPs that don't answer an ICMP echo before the warp handshake ping")
+		validate = fs.BoolLong("validate", "require an answer through the tunnel after the handshake, skipping endpoints whose data packets are dropped")
+		jsonOut  = fs.BoolLong("json", "print the endpoints as JSON")
+		output   = fs.StringLong("output", "", "also write the endpoints to this endpoint list file, for --endpoint-file")
+	)
+
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("WARP_PLUS"))
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if *v4 && *v6 {
+		return errors.New("can't force v4 and v6 at the same time")
+	}
+	if !*v4 && !*v6 {
+		*v4, *v6 = true, true
+	}
+
+	if *count < 1 {
+		return errors.New("count must be at least 1")
+	}
+
+	prefixes, err := parsePrefixes("cidr", *cidrs)
+	if err != nil {
+		return err
+	}
+
+	excluded, err := parsePrefixes("exclude", *excludes)
+	if err != nil {
+		return err
+	}
+
+	scanPorts, err := parsePorts(*ports)
+	if err != nil {
+		return err
+	}
+
+	if *icmp {
+		if err := iputils.CheckICMP(); err != nil {
+			return fmt.Errorf("--icmp: %w", err)
+		}
+	}
+
+	profile := filepath.Join(*dir, "wgcf-profile.ini")
+	if _, err := os.Stat(profile); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no identity in %s, run warp-plus once to register one", *dir)
+	}
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	l := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	res, err := wiresocks.RunScan(ctx, l, wiresocks.ScanOptions{
+		V4:       *v4,
+		V6:       *v6,
+		MaxRTT:   *rtt,
+		Workers:  *workers,
+		Prefixes: prefixes,
+		Ports:    scanPorts,
+		Exclude:  excluded,
+		ICMP:     *icmp,
+		Validate: *validate,
+		Profile:  profile,
+		Count:    *count,
+		Timeout:  *timeout,
+		// next to the identity directories, like warp-plus itself keeps it
+		SummaryPath: filepath.Join(filepath.Dir(*dir), "scan-summary.json"),
+	})
+	if err != nil {
+		return err
+	}
+
+	if *output != "" {
+		if err := writeEndpointList(*output, res); err != nil {
+			return err
+		}
+	}
+
+	if *jsonOut {
+		return printScanJSON(res)
+	}
+
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+
+	tbl := table.New("Address", "RTT (ping)", "Jitter", "Loss (%)", "Time")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, info := range res {
+		tbl.AddRow(info.AddrPort, info.RTT, info.Jitter, info.Loss, info.CreatedAt.Format(time.DateTime))
+	}
+	tbl.Print()
+
+	return nil
+}
+
+// writeEndpointList writes the scanned endpoints to path as an endpoint list.
+func writeEndpointList(path string, res []ipscanner.IPInfo) error {
+	endpoints := make([]warp.ListedEndpoint, 0, len(res))
+	for _, info := range res {
+		endpoints = append(endpoints, warp.ListedEndpoint{
+			Addr:         info.AddrPort.Addr(),
+			Port:         info.AddrPort.Port(),
+			RTTMS:        info.RTT.Milliseconds(),
+			LastVerified: info.CreatedAt.UTC(),
+		})
+	}
+	if err := warp.WriteEndpointList(path, endpoints); err != nil {
+		return fmt.Errorf("failed to write endpoint list: %w", err)
+	}
+	return nil
+}
+
+func printScanJSON(res []ipscanner.IPInfo) error {
+	out := make([]scanResult, 0, len(res))
+	for _, info := range res {
+		out = append(out, scanResult{
+			Addr:      info.AddrPort.String(),
+			RTTMS:     info.RTT.Milliseconds(),
+			JitterMS:  info.Jitter.Milliseconds(),
+			Loss:      info.Loss,
+			CreatedAt: info.CreatedAt,
+		})
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -0,0 +1,44 @@
+package sysproxy
+
+import "strings"
+
+// proxyState is a proxy setting of a macos network service.
+type proxyState struct {
+	enabled bool
+	server  string
+	port    string
+}
+
+// networkServices parses the output of networksetup -listallnetworkservices
+// into the names of the enabled network services.
+func networkServices(out string) []string {
+	var services []string
+	for i, line := range strings.Split(out, "\n") {
+		// the first line explains the asterisk marking disabled services
+		line = strings.TrimSpace(line)
+		if i == 0 || line == "" || strings.HasPrefix(line, "*") {
+			continue
+		}
+		services = append(services, line)
+	}
+	return services
+}
+
+// parseProxyState parses the output of networksetup -getwebproxy and the
+// other proxy getters.
+func parseProxyState(out string) proxyState {
+	var s proxyState
+	for _, line := range strings.Split(out, "\n") {
+		key, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Enabled":
+			s.enabled = value == "Yes"
+		case "Server":
+			s.server = value
+		case "Port":
+			s.port = value
+		}
+	}
+	return s
+}
@@ -0,0 +1,32 @@
+package sysproxy
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestNetworkServices(t *testing.T) {
+	out := `An asterisk (*) denotes that a network service is disabled.
+Wi-Fi
+*Thunderbolt Bridge
+USB 10/100/1000 LAN
+`
+	qt.Assert(t, networkServices(out), qt.DeepEquals, []string{"Wi-Fi", "USB 10/100/1000 LAN"})
+}
+
+func TestParseProxyState(t *testing.T) {
+	out := `Enabled: Yes
+Server: 127.0.0.1
+Port: 8086
+Authenticated Proxy Enabled: 0
+`
+	qt.Assert(t, parseProxyState(out), qt.Equals, proxyState{enabled: true, server: "127.0.0.1", port: "8086"})
+
+	out = `Enabled: No
+Server: 
+Port: 0
+Authenticated Proxy Enabled: 0
+`
+	qt.Assert(t, parseProxyState(out), qt.Equals, proxyState{port: "0"})
+}
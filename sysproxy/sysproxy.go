@@ -0,0 +1,37 @@
+// Package sysproxy points the proxy settings of the operating system at a
+// local proxy and restores them afterwards.
+package sysproxy
+
+import (
+	"errors"
+	"log/slog"
+	"net/netip"
+)
+
+// ErrUnsupported is returned by Set on systems whose proxy settings it can't
+// change.
+var ErrUnsupported = errors.New("setting the system proxy is only supported on windows and macos")
+
+// Set points the proxy settings of the current user at the http and socks
+// proxy on addr and returns a func restoring the settings it replaced.
+// Settings left pointing at addr by a run that never restored them count as
+// no proxy. Settings that need more privileges than the process has, like the
+// machine wide WinHTTP proxy, are skipped with a warning on l.
+func Set(l *slog.Logger, addr netip.AddrPort) (func() error, error) {
+	if !Supported() {
+		return nil, ErrUnsupported
+	}
+	return set(l, localAddr(addr))
+}
+
+// localAddr returns addr with an unspecified address, which a proxy listens
+// on but clients can't connect to, replaced by the loopback address.
+func localAddr(addr netip.AddrPort) netip.AddrPort {
+	switch {
+	case addr.Addr() == netip.IPv4Unspecified():
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), addr.Port())
+	case addr.Addr() == netip.IPv6Unspecified():
+		return netip.AddrPortFrom(netip.IPv6Loopback(), addr.Port())
+	}
+	return addr
+}
@@ -0,0 +1,95 @@
+package sysproxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// proxyKinds are the proxies of a network service Set changes, by their
+// name in the networksetup -get<kind> and -set<kind> commands.
+var proxyKinds = []string{"webproxy", "securewebproxy", "socksfirewallproxy"}
+
+// Supported reports whether Set can change the proxy settings of this
+// system.
+func Supported() bool {
+	return true
+}
+
+func set(l *slog.Logger, addr netip.AddrPort) (func() error, error) {
+	out, err := networksetup("-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+	services := networkServices(out)
+	if len(services) == 0 {
+		return nil, errors.New("no enabled network services")
+	}
+
+	type saved struct {
+		service, kind string
+		state         proxyState
+	}
+	var old []saved
+	restore := func() error {
+		var errs []error
+		for _, s := range old {
+			errs = append(errs, restoreProxy(s.service, s.kind, s.state))
+		}
+		return errors.Join(errs...)
+	}
+
+	host, port := addr.Addr().String(), strconv.Itoa(int(addr.Port()))
+	for _, service := range services {
+		for _, kind := range proxyKinds {
+			out, err := networksetup("-get"+kind, service)
+			if err != nil {
+				return nil, errors.Join(err, restore())
+			}
+			state := parseProxyState(out)
+			if state.server == host && state.port == port {
+				// left behind by a run that didn't restore it
+				state = proxyState{}
+			}
+
+			if _, err := networksetup("-set"+kind, service, host, port); err != nil {
+				return nil, errors.Join(err, restore())
+			}
+			old = append(old, saved{service: service, kind: kind, state: state})
+		}
+		l.Debug("set system proxy", "service", service, "address", addr)
+	}
+	return restore, nil
+}
+
+// restoreProxy sets the kind proxy of service back to s.
+func restoreProxy(service, kind string, s proxyState) error {
+	if s.server != "" {
+		// setting a proxy also enables it
+		if _, err := networksetup("-set"+kind, service, s.server, s.port); err != nil {
+			return err
+		}
+	}
+	if s.enabled {
+		return nil
+	}
+	_, err := networksetup("-set"+kind+"state", service, "off")
+	return err
+}
+
+// networksetup runs networksetup with args and returns its output.
+func networksetup(args ...string) (string, error) {
+	out, err := exec.Command("networksetup", args...).CombinedOutput()
+	// some errors only show in the output
+	if err == nil && strings.HasPrefix(string(out), "** Error") {
+		err = errors.New("failed")
+	}
+	if err != nil {
+		return "", fmt.Errorf("networksetup %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
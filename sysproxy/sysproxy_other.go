@@ -0,0 +1,18 @@
+//go:build !windows && !darwin
+
+package sysproxy
+
+import (
+	"log/slog"
+	"net/netip"
+)
+
+// Supported reports whether Set can change the proxy settings of this
+// system.
+func Supported() bool {
+	return false
+}
+
+func set(*slog.Logger, netip.AddrPort) (func() error, error) {
+	return nil, ErrUnsupported
+}
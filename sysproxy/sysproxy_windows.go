@@ -0,0 +1,219 @@
+package sysproxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// internetSettings is the registry key of the current user's proxy
+// settings, those of the "Proxy" page of the windows settings.
+const internetSettings = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// bypass are the hosts reached directly rather than through the proxy,
+// <local> being those without a dot.
+const bypass = "localhost;127.*;10.*;172.16.*;192.168.*;169.254.*;[::1];<local>"
+
+const (
+	internetOptionRefresh         = 37
+	internetOptionSettingsChanged = 39
+
+	winhttpAccessTypeNamedProxy = 3
+)
+
+var (
+	modwininet                              = windows.NewLazySystemDLL("wininet.dll")
+	modwinhttp                              = windows.NewLazySystemDLL("winhttp.dll")
+	modkernel32                             = windows.NewLazySystemDLL("kernel32.dll")
+	procInternetSetOptionW                  = modwininet.NewProc("InternetSetOptionW")
+	procWinHttpGetDefaultProxyConfiguration = modwinhttp.NewProc("WinHttpGetDefaultProxyConfiguration")
+	procWinHttpSetDefaultProxyConfiguration = modwinhttp.NewProc("WinHttpSetDefaultProxyConfiguration")
+	procGlobalFree                          = modkernel32.NewProc("GlobalFree")
+)
+
+// Supported reports whether Set can change the proxy settings of this
+// system.
+func Supported() bool {
+	return true
+}
+
+// ieSettings are the proxy values of the internetSettings key, with nil for
+// values that aren't set.
+type ieSettings struct {
+	enable   *uint32
+	server   *string
+	override *string
+}
+
+func set(l *slog.Logger, addr netip.AddrPort) (func() error, error) {
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettings, registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open internet settings: %w", err)
+	}
+	defer k.Close()
+
+	old, err := readIESettings(k)
+	if err != nil {
+		return nil, err
+	}
+
+	server, enable, override := addr.String(), uint32(1), bypass
+	if old.server != nil && *old.server == server {
+		// left behind by a run that didn't restore them
+		old = ieSettings{}
+	}
+	if err := writeIESettings(k, ieSettings{enable: &enable, server: &server, override: &override}); err != nil {
+		return nil, err
+	}
+	notifySettingsChanged()
+
+	restoreWinHTTP, err := setWinHTTP(server)
+	if err != nil {
+		l.Warn("failed to set the winhttp proxy, which needs administrator rights, services using it aren't proxied", "error", err)
+	}
+
+	return func() error {
+		k, err := registry.OpenKey(registry.CURRENT_USER, internetSettings, registry.SET_VALUE)
+		if err != nil {
+			return fmt.Errorf("failed to open internet settings: %w", err)
+		}
+		defer k.Close()
+
+		disabled := uint32(0)
+		if old.enable == nil {
+			old.enable = &disabled
+		}
+		err = writeIESettings(k, old)
+		notifySettingsChanged()
+
+		if restoreWinHTTP != nil {
+			err = errors.Join(err, restoreWinHTTP())
+		}
+		return err
+	}, nil
+}
+
+// readIESettings reads the proxy values of k.
+func readIESettings(k registry.Key) (ieSettings, error) {
+	var s ieSettings
+	if v, _, err := k.GetIntegerValue("ProxyEnable"); err == nil {
+		enable := uint32(v)
+		s.enable = &enable
+	} else if !errors.Is(err, registry.ErrNotExist) {
+		return s, fmt.Errorf("failed to read ProxyEnable: %w", err)
+	}
+
+	for name, v := range map[string]**string{"ProxyServer": &s.server, "ProxyOverride": &s.override} {
+		value, _, err := k.GetStringValue(name)
+		if errors.Is(err, registry.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return s, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		*v = &value
+	}
+	return s, nil
+}
+
+// writeIESettings writes s to k, deleting its nil values.
+func writeIESettings(k registry.Key, s ieSettings) error {
+	var errs []error
+	if s.enable != nil {
+		errs = append(errs, k.SetDWordValue("ProxyEnable", *s.enable))
+	}
+	for name, v := range map[string]*string{"ProxyServer": s.server, "ProxyOverride": s.override} {
+		if v == nil {
+			if err := k.DeleteValue(name); err != nil && !errors.Is(err, registry.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		errs = append(errs, k.SetStringValue(name, *v))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to write internet settings: %w", err)
+	}
+	return nil
+}
+
+// notifySettingsChanged has running programs reload the internet settings.
+func notifySettingsChanged() {
+	procInternetSetOptionW.Call(0, internetOptionSettingsChanged, 0, 0)
+	procInternetSetOptionW.Call(0, internetOptionRefresh, 0, 0)
+}
+
+// winhttpProxyInfo is WINHTTP_PROXY_INFO.
+type winhttpProxyInfo struct {
+	accessType  uint32
+	proxy       *uint16
+	proxyBypass *uint16
+}
+
+// setWinHTTP sets the default WinHTTP proxy, which services and other
+// programs that don't read the user's settings use, to server and returns a
+// func restoring the previous one.
+func setWinHTTP(server string) (func() error, error) {
+	var old winhttpProxyInfo
+	if r, _, err := procWinHttpGetDefaultProxyConfiguration.Call(uintptr(unsafe.Pointer(&old))); r == 0 {
+		return nil, err
+	}
+	oldAccessType := old.accessType
+	oldProxy, oldBypass := utf16String(old.proxy), utf16String(old.proxyBypass)
+	globalFree(old.proxy, old.proxyBypass)
+	if oldProxy == server {
+		// left behind by a run that didn't restore it
+		oldAccessType, oldProxy, oldBypass = 1, "", ""
+	}
+
+	if err := setDefaultProxy(winhttpAccessTypeNamedProxy, server, bypass); err != nil {
+		return nil, err
+	}
+	return func() error {
+		if err := setDefaultProxy(oldAccessType, oldProxy, oldBypass); err != nil {
+			return fmt.Errorf("failed to restore the winhttp proxy: %w", err)
+		}
+		return nil
+	}, nil
+}
+
+// setDefaultProxy sets the default WinHTTP proxy configuration.
+func setDefaultProxy(accessType uint32, proxy, proxyBypass string) error {
+	info := winhttpProxyInfo{accessType: accessType}
+	var err error
+	if proxy != "" {
+		if info.proxy, err = windows.UTF16PtrFromString(proxy); err != nil {
+			return err
+		}
+	}
+	if proxyBypass != "" {
+		if info.proxyBypass, err = windows.UTF16PtrFromString(proxyBypass); err != nil {
+			return err
+		}
+	}
+	if r, _, err := procWinHttpSetDefaultProxyConfiguration.Call(uintptr(unsafe.Pointer(&info))); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func utf16String(s *uint16) string {
+	if s == nil {
+		return ""
+	}
+	return windows.UTF16PtrToString(s)
+}
+
+// globalFree frees the strings winhttp allocated.
+func globalFree(strings ...*uint16) {
+	for _, s := range strings {
+		if s != nil {
+			procGlobalFree.Call(uintptr(unsafe.Pointer(s)))
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log/slog"
+	"net/netip"
+	"sync"
+
+	"github.com/bepass-org/warp-plus/sysproxy"
+)
+
+// systemProxy points the system proxy settings at the first proxy address
+// while warp-plus runs, see --set-system-proxy.
+type systemProxy struct {
+	mu      sync.Mutex
+	addr    netip.AddrPort
+	restore func() error
+}
+
+// update points the system proxy at the first of addrs, unless it already
+// points there. It is called whenever the proxy is ready, so a restart on
+// other bind addresses moves the setting along.
+func (p *systemProxy) update(l *slog.Logger, addrs []netip.AddrPort) {
+	if len(addrs) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.restore != nil && p.addr == addrs[0] {
+		return
+	}
+	p.resetLocked(l)
+
+	restore, err := sysproxy.Set(l, addrs[0])
+	if err != nil {
+		l.Warn("failed to set the system proxy", "error", err)
+		return
+	}
+	p.addr, p.restore = addrs[0], restore
+	l.Info("system proxy set", "address", addrs[0])
+}
+
+// reset restores the system proxy settings update replaced.
+func (p *systemProxy) reset(l *slog.Logger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resetLocked(l)
+}
+
+func (p *systemProxy) resetLocked(l *slog.Logger) {
+	if p.restore == nil {
+		return
+	}
+	if err := p.restore(); err != nil {
+		l.Warn("failed to restore the system proxy settings", "error", err)
+	} else {
+		l.Info("system proxy settings restored")
+	}
+	p.restore = nil
+}
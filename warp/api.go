@@ -0,0 +1,153 @@
+package warp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrAPIBlocked means the api could not be reached, neither fronted nor
+	// directly, which usually means the network blocks it.
+	ErrAPIBlocked = errors.New("warp api unreachable")
+	// ErrRateLimited means the api refused a request for being sent too
+	// often from this address.
+	ErrRateLimited = errors.New("warp api rate limit reached")
+	// ErrInvalidLicense means the api rejected a license key.
+	ErrInvalidLicense = errors.New("invalid license key")
+
+	// errAPIServer is a 5xx response, which is worth retrying.
+	errAPIServer = errors.New("warp api server error")
+)
+
+const (
+	// apiAttempts is how often a request is sent through the fronted client
+	// before falling back to a direct connection.
+	apiAttempts = 4
+	apiTimeout  = 30 * time.Second
+)
+
+// apiRetryDelay is the delay before the first retry, doubled for every
+// further one.
+var apiRetryDelay = time.Second
+
+// directClient reaches the api by its real address with regular TLS, for
+// networks that block the fronting addresses but not the api.
+var directClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if bootstrapProxy != nil {
+				return bootstrapProxy.Dial(network, addr)
+			}
+			return (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, network, addr)
+		},
+		TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	Timeout: apiTimeout,
+}
+
+// sendAPIRequest sends the request newRequest builds, retrying with
+// exponential backoff while the api is unreachable, rate limits or fails,
+// and finally once over a direct connection if it stays unreachable. The
+// caller handles responses other than 429 and 5xx. The requests and the
+// waits between them end once ctx is done.
+func sendAPIRequest(ctx context.Context, l *slog.Logger, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	var err error
+	delay := apiRetryDelay
+	for attempt := 1; attempt <= apiAttempts; attempt++ {
+		var resp *http.Response
+		resp, err = send(ctx, client, newRequest)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !errors.Is(err, ErrAPIBlocked) && !errors.Is(err, ErrRateLimited) && !errors.Is(err, errAPIServer) {
+			return nil, err
+		}
+
+		if attempt < apiAttempts {
+			l.Warn("warp api request failed, retrying", "attempt", attempt, "delay", delay, "error", err)
+			t := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			case <-t.C:
+			}
+			delay *= 2
+		}
+	}
+
+	if !errors.Is(err, ErrAPIBlocked) {
+		return nil, err
+	}
+
+	l.Warn("fronted warp api unreachable, trying a direct connection", "error", err)
+	resp, directErr := send(ctx, directClient, newRequest)
+	if directErr != nil {
+		return nil, fmt.Errorf("%w, direct: %w", err, directErr)
+	}
+	return resp, nil
+}
+
+// send sends the request newRequest builds with c, turning failures to
+// connect, 429 and 5xx responses into errors.
+func send(ctx context.Context, c *http.Client, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrAPIBlocked, err)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+
+		kind := errAPIServer
+		if resp.StatusCode == http.StatusTooManyRequests {
+			kind = ErrRateLimited
+		}
+		return nil, fmt.Errorf("%w: status %d %s", kind, resp.StatusCode, body)
+	}
+
+	return resp, nil
+}
+
+// licenseRejected reports whether a failed license update with status and
+// body was refused for the license itself. Other client errors, e.g. for an
+// unknown device or an expired token, leave the license in doubt.
+func licenseRejected(status int, body []byte) bool {
+	if status < 400 || status >= 500 {
+		return false
+	}
+
+	var resp struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return false
+	}
+	for _, e := range resp.Errors {
+		if strings.Contains(strings.ToLower(e.Message), "license") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package warp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestSendAPIRequestRetries(t *testing.T) {
+	responses := []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(responses[0])
+		responses = responses[1:]
+	}))
+	defer srv.Close()
+
+	testAPIClient(t, srv.Client())
+
+	resp, err := sendAPIRequest(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), func() (*http.Request, error) {
+		return http.NewRequest("GET", srv.URL, nil)
+	})
+	qt.Assert(t, err, qt.IsNil)
+	resp.Body.Close()
+	qt.Assert(t, resp.StatusCode, qt.Equals, http.StatusOK)
+	qt.Assert(t, responses, qt.HasLen, 0)
+}
+
+func TestSendAPIRequestRateLimited(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	testAPIClient(t, srv.Client())
+
+	_, err := sendAPIRequest(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), func() (*http.Request, error) {
+		return http.NewRequest("GET", srv.URL, nil)
+	})
+	qt.Assert(t, err, qt.ErrorIs, ErrRateLimited)
+}
+
+func TestSendAPIRequestCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	testAPIClient(t, srv.Client())
+	apiRetryDelay = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	_, err := sendAPIRequest(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), func() (*http.Request, error) {
+		return http.NewRequest("GET", srv.URL, nil)
+	})
+	qt.Assert(t, err, qt.ErrorIs, context.DeadlineExceeded)
+	qt.Assert(t, time.Since(t0) < time.Minute, qt.IsTrue)
+}
+
+func TestLicenseRejected(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		body   string
+		want   bool
+	}{
+		{http.StatusBadRequest, `{"success":false,"errors":[{"code":1,"message":"Invalid license"}]}`, true},
+		{http.StatusForbidden, `{"errors":[{"message":"License is not valid for this account"}]}`, true},
+		// an expired token or unknown device says nothing about the license
+		{http.StatusUnauthorized, `{"errors":[{"message":"Unauthorized"}]}`, false},
+		{http.StatusNotFound, `not found`, false},
+		{http.StatusInternalServerError, `{"errors":[{"message":"license service down"}]}`, false},
+	} {
+		qt.Check(t, licenseRejected(test.status, []byte(test.body)), qt.Equals, test.want, qt.Commentf("%d %s", test.status, test.body))
+	}
+}
+
+// failingDialer records the addresses it is asked to dial and fails.
+type failingDialer []string
+
+func (d *failingDialer) Dial(network, addr string) (net.Conn, error) {
+	*d = append(*d, addr)
+	return nil, errors.New("unreachable")
+}
+
+func TestPreferAPIAddrs(t *testing.T) {
+	t.Cleanup(func() { PreferAPIAddrs() })
+	PreferAPIAddrs(netip.MustParseAddr("188.114.96.1"), netip.MustParseAddr("188.114.96.1"))
+
+	var d failingDialer
+	for n := 0; n < 2; n++ {
+		_, err := (&Dialer{}).TLSDial(&d, "tcp", "api.cloudflareclient.com:443")
+		qt.Assert(t, err, qt.IsNotNil)
+	}
+
+	// the failed preferred address gives way to the fronting prefixes
+	qt.Assert(t, d, qt.HasLen, 2)
+	qt.Assert(t, d[0], qt.Equals, "188.114.96.1:443")
+	addr := netip.MustParseAddrPort(d[1])
+	qt.Assert(t, fronting.Prefixes[0].Contains(addr.Addr()), qt.IsTrue)
+}
+
+// testAPIClient makes the api requests of t go through c without delays.
+func testAPIClient(t *testing.T, c *http.Client) {
+	oldClient, oldDelay := client, apiRetryDelay
+	client, apiRetryDelay = c, 0
+	t.Cleanup(func() {
+		client, apiRetryDelay = oldClient, oldDelay
+	})
+}
@@ -0,0 +1,139 @@
+package warp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// backupTimeFormat names the backups, so sorting their names sorts them by
+// age.
+const backupTimeFormat = "20060102-150405.000"
+
+// backupLimit is how many backups are kept of each identity.
+var backupLimit = 5
+
+// KeepBackups sets how many backups are kept of each identity, see
+// BackupIdentity. Zero disables backups.
+func KeepBackups(n int) {
+	backupLimit = max(n, 0)
+}
+
+// backupDir returns the directory the backups of the identity in path are
+// kept in. It is outside of path, which is removed when an identity is
+// registered again.
+func backupDir(path string) string {
+	path = filepath.Clean(path)
+	return filepath.Join(filepath.Dir(path), "backups", filepath.Base(path))
+}
+
+// BackupIdentity copies the identity and profile in path to a new timestamped
+// backup and removes the oldest backups beyond the limit set with
+// KeepBackups. It returns the name of the backup, or "" if path holds no
+// identity or backups are disabled.
+func BackupIdentity(path string) (string, error) {
+	if backupLimit == 0 {
+		return "", nil
+	}
+
+	identity, err := os.ReadFile(filepath.Join(path, identityFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	name := time.Now().UTC().Format(backupTimeFormat)
+	dst := filepath.Join(backupDir(path), name)
+	if err := os.MkdirAll(dst, 0o700); err != nil {
+		return "", fmt.Errorf("failed to back up identity: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dst, identityFile), identity, 0o600); err != nil {
+		return "", fmt.Errorf("failed to back up identity: %w", err)
+	}
+
+	profile, err := os.ReadFile(filepath.Join(path, profileFile))
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dst, profileFile), profile, 0o600)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("failed to back up profile: %w", err)
+	}
+
+	backups, err := Backups(path)
+	if err != nil {
+		return "", err
+	}
+	for _, old := range backups[min(backupLimit, len(backups)):] {
+		if err := os.RemoveAll(filepath.Join(backupDir(path), old)); err != nil {
+			return "", fmt.Errorf("failed to remove old backup: %w", err)
+		}
+	}
+
+	return name, nil
+}
+
+// Backups returns the names of the backups of the identity in path, newest
+// first.
+func Backups(path string) ([]string, error) {
+	entries, err := os.ReadDir(backupDir(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if _, err := time.Parse(backupTimeFormat, e.Name()); e.IsDir() && err == nil {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	slices.Reverse(names)
+	return names, nil
+}
+
+// RestoreIdentity replaces the identity in path with the backup called name,
+// or the newest backup if name is empty. The replaced identity is backed up
+// first. It returns the name of the restored backup.
+func RestoreIdentity(path, name string) (string, error) {
+	if name == "" {
+		backups, err := Backups(path)
+		if err != nil {
+			return "", err
+		}
+		if len(backups) == 0 {
+			return "", fmt.Errorf("no backups of %s", path)
+		}
+		name = backups[0]
+	}
+
+	src := filepath.Join(backupDir(path), name)
+	i, err := readIdentity(filepath.Join(src, identityFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("no backup %q of %s", name, path)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := BackupIdentity(path); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return "", err
+	}
+	if err := writeIdentity(i, filepath.Join(path, identityFile)); err != nil {
+		return "", err
+	}
+	return name, createConf(i, path)
+}
@@ -0,0 +1,48 @@
+package warp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestBackupAndRestoreIdentity(t *testing.T) {
+	oldLimit := backupLimit
+	KeepBackups(2)
+	t.Cleanup(func() { backupLimit = oldLimit })
+
+	path := filepath.Join(t.TempDir(), "primary")
+	qt.Assert(t, os.MkdirAll(path, 0o700), qt.IsNil)
+	qt.Assert(t, os.WriteFile(filepath.Join(path, identityFile), []byte(testIdentity), 0o600), qt.IsNil)
+	want, err := readIdentity(filepath.Join(path, identityFile))
+	qt.Assert(t, err, qt.IsNil)
+
+	for n := 0; n < 3; n++ {
+		name, err := BackupIdentity(path)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, name, qt.Not(qt.Equals), "")
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	backups, err := Backups(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, backups, qt.HasLen, 2)
+	qt.Assert(t, backups[0] > backups[1], qt.IsTrue)
+
+	// a new registration replaces the directory
+	qt.Assert(t, os.RemoveAll(path), qt.IsNil)
+
+	name, err := RestoreIdentity(path, "")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, name, qt.Equals, backups[0])
+
+	got, err := LoadIdentity(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, got, qt.DeepEquals, want)
+
+	_, err = RestoreIdentity(path, "20000101-000000.000")
+	qt.Assert(t, err, qt.ErrorMatches, `no backup .*`)
+}
@@ -0,0 +1,153 @@
+package warp
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const bundleVersion = 1
+
+// ErrBundlePassword is returned when an encrypted bundle can't be opened with
+// the given password.
+var ErrBundlePassword = errors.New("wrong password or corrupted identity bundle")
+
+// bundle is the on-disk format used to move an identity between machines.
+// If Salt is set, Payload is sealed with a key derived from a password.
+type bundle struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt,omitempty"`
+	Nonce   []byte `json:"nonce,omitempty"`
+	Payload []byte `json:"payload"`
+}
+
+type bundlePayload struct {
+	Identity json.RawMessage `json:"identity"`
+	Profile  string          `json:"profile"`
+}
+
+// ExportIdentity writes the identity and profile stored in path to w as a
+// bundle. If password is not empty the bundle is encrypted.
+func ExportIdentity(path string, w io.Writer, password string) error {
+	if _, err := LoadIdentity(path); err != nil {
+		return fmt.Errorf("unable to load identity: %w", err)
+	}
+
+	identity, err := os.ReadFile(filepath.Join(path, identityFile))
+	if err != nil {
+		return err
+	}
+
+	profile, err := os.ReadFile(filepath.Join(path, profileFile))
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(bundlePayload{Identity: identity, Profile: string(profile)})
+	if err != nil {
+		return err
+	}
+
+	b := bundle{Version: bundleVersion, Payload: payload}
+	if password != "" {
+		b.Salt = make([]byte, 16)
+		if _, err := rand.Read(b.Salt); err != nil {
+			return err
+		}
+
+		aead, err := bundleCipher(password, b.Salt)
+		if err != nil {
+			return err
+		}
+
+		b.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(b.Nonce); err != nil {
+			return err
+		}
+		b.Payload = aead.Seal(nil, b.Nonce, payload, nil)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(b)
+}
+
+// ImportIdentity reads a bundle from r and stores its identity and profile in
+// path, replacing any existing identity there after backing it up.
+func ImportIdentity(path string, r io.Reader, password string) error {
+	var b bundle
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return fmt.Errorf("invalid identity bundle: %w", err)
+	}
+
+	if b.Version != bundleVersion {
+		return fmt.Errorf("unsupported identity bundle version %d", b.Version)
+	}
+
+	payload := b.Payload
+	if len(b.Salt) > 0 {
+		if password == "" {
+			return errors.New("identity bundle is encrypted, a password is required")
+		}
+
+		aead, err := bundleCipher(password, b.Salt)
+		if err != nil {
+			return err
+		}
+
+		if len(b.Nonce) != aead.NonceSize() {
+			return ErrBundlePassword
+		}
+
+		payload, err = aead.Open(nil, b.Nonce, b.Payload, nil)
+		if err != nil {
+			return ErrBundlePassword
+		}
+	}
+
+	var p bundlePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("invalid identity bundle payload: %w", err)
+	}
+
+	var i Identity
+	if err := json.Unmarshal(p.Identity, &i); err != nil {
+		return fmt.Errorf("invalid identity in bundle: %w", err)
+	}
+	if _, err := migrateIdentity(&i); err != nil {
+		return fmt.Errorf("identity in bundle: %w", err)
+	}
+	if err := i.validate(); err != nil {
+		return fmt.Errorf("invalid identity in bundle: %w", err)
+	}
+
+	if _, err := BackupIdentity(path); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(path, identityFile), p.Identity, 0o600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(path, profileFile), []byte(p.Profile), 0o600)
+}
+
+func bundleCipher(password string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(password), salt, 1<<15, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
@@ -0,0 +1,92 @@
+package warp
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+)
+
+// CountryPorts counts, per ISO 3166 country code, how often an endpoint on
+// each warp port worked for users in that country. No counts are shipped,
+// they are learned from the sessions of runs given the country as a hint and
+// kept in a file that can be shared with other users in the same country.
+type CountryPorts map[string]map[uint16]int
+
+// preferredPortWeight is how many times more often WeightPorts makes a
+// preferred port come up in a uniform pick.
+const preferredPortWeight = 4
+
+// ReadCountryPorts reads the country ports at path, which are empty if the
+// file doesn't exist yet.
+func ReadCountryPorts(path string) (CountryPorts, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return make(CountryPorts), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(CountryPorts)
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("invalid country ports %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Write writes the country ports to path.
+func (c CountryPorts) Write(path string) error {
+	raw, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(raw, '\n'), 0o644)
+}
+
+// Record counts port as working in country.
+func (c CountryPorts) Record(country string, port uint16) {
+	country = strings.ToUpper(country)
+	if c[country] == nil {
+		c[country] = make(map[uint16]int)
+	}
+	c[country][port]++
+}
+
+// Preferred returns the ports that worked in country, the most often
+// working first, or none if nothing was recorded for it yet.
+func (c CountryPorts) Preferred(country string) []uint16 {
+	counts := c[strings.ToUpper(country)]
+	ports := make([]uint16, 0, len(counts))
+	for port := range counts {
+		ports = append(ports, port)
+	}
+	slices.SortFunc(ports, func(a, b uint16) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		return cmp.Compare(a, b)
+	})
+	return ports
+}
+
+// WeightPorts returns ports with every port that is also in preferred
+// repeated, so picking uniformly from the result favors the preferred ports
+// while still trying the others.
+func WeightPorts(ports, preferred []uint16) []uint16 {
+	weighted := make([]uint16, 0, len(ports)+len(preferred)*(preferredPortWeight-1))
+	for _, port := range ports {
+		n := 1
+		if slices.Contains(preferred, port) {
+			n = preferredPortWeight
+		}
+		for i := 0; i < n; i++ {
+			weighted = append(weighted, port)
+		}
+	}
+	return weighted
+}
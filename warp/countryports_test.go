@@ -0,0 +1,34 @@
+package warp
+
+import (
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCountryPorts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "countryports.json")
+
+	c, err := ReadCountryPorts(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, c.Preferred("IR"), qt.HasLen, 0)
+
+	c.Record("ir", 1701)
+	c.Record("IR", 2408)
+	c.Record("IR", 2408)
+	c.Record("IR", 500)
+	c.Record("RU", 4500)
+	qt.Assert(t, c.Write(path), qt.IsNil)
+
+	c, err = ReadCountryPorts(path)
+	qt.Assert(t, err, qt.IsNil)
+	// the most often working first, ties by port
+	qt.Assert(t, c.Preferred("ir"), qt.DeepEquals, []uint16{2408, 500, 1701})
+	qt.Assert(t, c.Preferred("TM"), qt.HasLen, 0)
+}
+
+func TestWeightPorts(t *testing.T) {
+	weighted := WeightPorts([]uint16{500, 2408}, []uint16{2408})
+	qt.Assert(t, weighted, qt.DeepEquals, []uint16{500, 2408, 2408, 2408, 2408})
+}
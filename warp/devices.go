@@ -0,0 +1,140 @@
+package warp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Device is a device bound to the account of an identity, as listed by the
+// api.
+type Device struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Model   string `json:"model"`
+	Name    string `json:"name"`
+	Created string `json:"created"`
+	// Activated is when the device was last switched on, empty if never.
+	Activated string `json:"activated"`
+	Active    bool   `json:"active"`
+	// Role is "parent" for the device the account was created on and
+	// "child" for those bound to it with its license.
+	Role string `json:"role"`
+}
+
+// ListDevices returns the devices bound to the account of the identity with
+// accountID and accessToken, including itself. The api only reports the data
+// usage of the account as a whole, see GetAccount.
+func ListDevices(ctx context.Context, l *slog.Logger, accountID, accessToken string) ([]Device, error) {
+	return listDevices(ctx, l, regURL, accountID, accessToken)
+}
+
+func listDevices(ctx context.Context, l *slog.Logger, url, accountID, accessToken string) ([]Device, error) {
+	var devices []Device
+	if err := getAuthorized(ctx, l, fmt.Sprintf("%s/%s/account/devices", url, accountID), accessToken, &devices); err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	return devices, nil
+}
+
+// GetAccount returns the account of the identity with accountID and
+// accessToken, with its current quota and usage.
+func GetAccount(ctx context.Context, l *slog.Logger, accountID, accessToken string) (IdentityAccount, error) {
+	var account IdentityAccount
+	if err := getAuthorized(ctx, l, fmt.Sprintf("%s/%s/account", regURL, accountID), accessToken, &account); err != nil {
+		return IdentityAccount{}, fmt.Errorf("failed to get account: %w", err)
+	}
+	return account, nil
+}
+
+// RemoveBoundDevice unbinds the device deviceID from the account of the
+// identity with accountID and accessToken. Use RemoveDevice to remove the
+// identity's own device.
+func RemoveBoundDevice(ctx context.Context, l *slog.Logger, accountID, accessToken, deviceID string) error {
+	return removeBoundDevice(ctx, l, regURL, accountID, accessToken, deviceID)
+}
+
+func removeBoundDevice(ctx context.Context, l *slog.Logger, url, accountID, accessToken, deviceID string) error {
+	resp, err := sendAPIRequest(ctx, l, authorizedRequest("DELETE", fmt.Sprintf("%s/%s/account/reg/%s", url, accountID, deviceID), accessToken, nil))
+	if err != nil {
+		return fmt.Errorf("failed to remove device %s: %w", deviceID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		s, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("failed to remove device %s, status %d %s", deviceID, resp.StatusCode, s)
+	}
+	return nil
+}
+
+// StaleDevices returns the devices of devices that look like leftovers of
+// registrations by warp-plus: registered as an Android PC like it does, not
+// the parent device of the account, not in keep, not active and neither
+// created nor activated after now-minAge. Other machines running warp-plus on
+// the same license look the same while they are in use, so devices whose
+// creation or activation time can't be read are left out.
+func StaleDevices(devices []Device, keep []string, minAge time.Duration, now time.Time) []Device {
+	var stale []Device
+	for _, d := range devices {
+		if d.Type != "Android" || d.Model != "PC" || d.Role == "parent" || d.Active || slices.Contains(keep, d.ID) {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339Nano, d.Created)
+		if err != nil || now.Sub(created) < minAge {
+			continue
+		}
+		if d.Activated != "" {
+			activated, err := time.Parse(time.RFC3339Nano, d.Activated)
+			if err != nil || now.Sub(activated) < minAge {
+				continue
+			}
+		}
+		stale = append(stale, d)
+	}
+	return stale
+}
+
+// authorizedRequest returns a func building api requests with method to url
+// on behalf of the identity with accessToken, sending body if not nil.
+func authorizedRequest(method, url, accessToken string, body []byte) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, url, r)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range defaultHeaders {
+			req.Header.Set(k, v)
+		}
+		// set per request, defaultHeaders is shared by every request
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		return req, nil
+	}
+}
+
+// getAuthorized gets url on behalf of the identity with accessToken and
+// decodes the response into v.
+func getAuthorized(ctx context.Context, l *slog.Logger, url, accessToken string, v any) error {
+	resp, err := sendAPIRequest(ctx, l, authorizedRequest("GET", url, accessToken, nil))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		s, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("status %d %s", resp.StatusCode, s)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
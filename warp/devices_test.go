@@ -0,0 +1,74 @@
+package warp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestListAndRemoveDevices(t *testing.T) {
+	var removed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/self/account/devices":
+			fmt.Fprint(w, `[{"id": "self", "type": "Android", "model": "PC", "created": "2024-03-01T10:00:00.000Z", "active": true, "role": "child"},
+				{"id": "phone", "type": "iOS", "model": "iPhone", "created": "2023-01-01T10:00:00Z", "active": true, "role": "parent"}]`)
+		case r.Method == "DELETE" && r.URL.Path == "/self/account/reg/old":
+			removed = append(removed, "old")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	testAPIClient(t, srv.Client())
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	devices, err := listDevices(context.Background(), l, srv.URL, "self", "token")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, devices, qt.HasLen, 2)
+	qt.Assert(t, devices[0], qt.Equals, Device{ID: "self", Type: "Android", Model: "PC", Created: "2024-03-01T10:00:00.000Z", Active: true, Role: "child"})
+	qt.Assert(t, devices[1].Role, qt.Equals, "parent")
+
+	qt.Assert(t, removeBoundDevice(context.Background(), l, srv.URL, "self", "token", "old"), qt.IsNil)
+	qt.Assert(t, removed, qt.DeepEquals, []string{"old"})
+
+	err = removeBoundDevice(context.Background(), l, srv.URL, "self", "token", "missing")
+	qt.Assert(t, err, qt.ErrorMatches, `failed to remove device missing, status 404 .*`)
+
+	_, err = listDevices(context.Background(), l, srv.URL, "self", "wrong")
+	qt.Assert(t, err, qt.ErrorMatches, `failed to list devices: status 401 .*`)
+}
+
+func TestStaleDevices(t *testing.T) {
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	devices := []Device{
+		{ID: "primary", Type: "Android", Model: "PC", Created: "2024-02-01T00:00:00Z"},
+		{ID: "leftover", Type: "Android", Model: "PC", Created: "2024-02-01T00:00:00.123Z"},
+		{ID: "fresh", Type: "Android", Model: "PC", Created: "2024-03-02T11:30:00Z"},
+		{ID: "phone", Type: "Android", Model: "Pixel 8", Created: "2024-01-01T00:00:00Z"},
+		{ID: "owner", Type: "Android", Model: "PC", Created: "2024-01-01T00:00:00Z", Role: "parent"},
+		{ID: "unknown", Type: "Android", Model: "PC", Created: "yesterday"},
+		// other machines running warp-plus on the same license
+		{ID: "active", Type: "Android", Model: "PC", Created: "2024-01-01T00:00:00Z", Role: "child", Active: true},
+		{ID: "recent", Type: "Android", Model: "PC", Created: "2024-01-01T00:00:00Z", Role: "child", Activated: "2024-03-02T11:30:00Z"},
+		{ID: "idle", Type: "Android", Model: "PC", Created: "2024-01-01T00:00:00Z", Role: "child", Activated: "2024-02-01T00:00:00Z"},
+	}
+
+	stale := StaleDevices(devices, []string{"primary"}, time.Hour, now)
+	qt.Assert(t, stale, qt.HasLen, 2)
+	qt.Assert(t, stale[0].ID, qt.Equals, "leftover")
+	qt.Assert(t, stale[1].ID, qt.Equals, "idle")
+}
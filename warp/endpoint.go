@@ -102,7 +102,11 @@ func WarpPorts() []uint16 {
 }
 
 func RandomWarpPort() uint16 {
-	ports := WarpPorts()
+	return RandomPort(WarpPorts())
+}
+
+// RandomPort returns one of ports, which must not be empty.
+func RandomPort(ports []uint16) uint16 {
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	return ports[rng.Intn(len(ports))]
 }
@@ -0,0 +1,83 @@
+package warp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// endpointListVersion is the version of the endpoint list format written by
+// WriteEndpointList.
+const endpointListVersion = 1
+
+// ListedEndpoint is an endpoint of an endpoint list.
+type ListedEndpoint struct {
+	Addr netip.Addr `json:"addr"`
+	Port uint16     `json:"port"`
+	// RTTMS is the round trip time of the endpoint in milliseconds when it
+	// was last verified, zero if unknown.
+	RTTMS int64 `json:"rtt_ms,omitempty"`
+	// LastVerified is when the endpoint was last found working.
+	LastVerified time.Time `json:"last_verified"`
+}
+
+// AddrPort returns the address and port of the endpoint.
+func (e ListedEndpoint) AddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(e.Addr, e.Port)
+}
+
+// EndpointList is a file of working endpoints, as written by "warp-plus scan
+// --output" and shared to be read with --endpoint-file.
+type EndpointList struct {
+	Version   int              `json:"version"`
+	Endpoints []ListedEndpoint `json:"endpoints"`
+}
+
+// ReadEndpointList reads the endpoint list at path, in file order. A bare
+// array of endpoints is accepted as well, for hand-written lists.
+func ReadEndpointList(path string) ([]ListedEndpoint, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list EndpointList
+	if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '[' {
+		err = json.Unmarshal(raw, &list.Endpoints)
+	} else {
+		err = json.Unmarshal(raw, &list)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint list %s: %w", path, err)
+	}
+	if list.Version > endpointListVersion {
+		return nil, fmt.Errorf("endpoint list %s has unsupported version %d", path, list.Version)
+	}
+
+	for i, e := range list.Endpoints {
+		if !e.Addr.IsValid() || e.Port == 0 {
+			return nil, fmt.Errorf("endpoint list %s: entry %d needs an addr and a port", path, i+1)
+		}
+		list.Endpoints[i].Addr = e.Addr.Unmap()
+	}
+	if len(list.Endpoints) == 0 {
+		return nil, fmt.Errorf("endpoint list %s is empty", path)
+	}
+	return list.Endpoints, nil
+}
+
+// WriteEndpointList writes endpoints to path as an endpoint list.
+func WriteEndpointList(path string, endpoints []ListedEndpoint) error {
+	if len(endpoints) == 0 {
+		return errors.New("no endpoints to write")
+	}
+	raw, err := json.MarshalIndent(EndpointList{Version: endpointListVersion, Endpoints: endpoints}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(raw, '\n'), 0o644)
+}
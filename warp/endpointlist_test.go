@@ -0,0 +1,83 @@
+package warp
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestEndpointListRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	verified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	endpoints := []ListedEndpoint{
+		{Addr: netip.MustParseAddr("162.159.192.10"), Port: 2408, RTTMS: 84, LastVerified: verified},
+		{Addr: netip.MustParseAddr("2606:4700:d0::1"), Port: 500},
+	}
+	qt.Assert(t, WriteEndpointList(path, endpoints), qt.IsNil)
+
+	got, err := ReadEndpointList(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, got, qt.HasLen, 2)
+	qt.Assert(t, got[0].AddrPort().String(), qt.Equals, "162.159.192.10:2408")
+	qt.Assert(t, got[0].RTTMS, qt.Equals, int64(84))
+	qt.Assert(t, got[0].LastVerified.Equal(verified), qt.IsTrue)
+	qt.Assert(t, got[1].AddrPort().String(), qt.Equals, "[2606:4700:d0::1]:500")
+	qt.Assert(t, got[1].LastVerified.IsZero(), qt.IsTrue)
+}
+
+func TestReadEndpointList(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		err     string
+	}{
+		{
+			name:    "bare array",
+			content: `[{"addr": "188.114.96.1", "port": 878}, {"addr": "::ffff:162.159.192.1", "port": 2408}]`,
+			want:    []string{"188.114.96.1:878", "162.159.192.1:2408"},
+		},
+		{
+			name:    "missing port",
+			content: `{"version": 1, "endpoints": [{"addr": "188.114.96.1"}]}`,
+			err:     `endpoint list .*: entry 1 needs an addr and a port`,
+		},
+		{
+			name:    "empty",
+			content: `{"version": 1, "endpoints": []}`,
+			err:     `endpoint list .* is empty`,
+		},
+		{
+			name:    "newer version",
+			content: `{"version": 2, "endpoints": [{"addr": "188.114.96.1", "port": 878}]}`,
+			err:     `endpoint list .* has unsupported version 2`,
+		},
+		{
+			name:    "invalid",
+			content: `endpoints`,
+			err:     `invalid endpoint list .*`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "endpoints.json")
+			qt.Assert(t, os.WriteFile(path, []byte(test.content), 0o600), qt.IsNil)
+
+			got, err := ReadEndpointList(path)
+			if test.err != "" {
+				qt.Assert(t, err, qt.ErrorMatches, test.err)
+				return
+			}
+			qt.Assert(t, err, qt.IsNil)
+			var addrs []string
+			for _, e := range got {
+				addrs = append(addrs, e.AddrPort().String())
+			}
+			qt.Assert(t, addrs, qt.DeepEquals, test.want)
+		})
+	}
+}
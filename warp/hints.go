@@ -0,0 +1,63 @@
+package warp
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+)
+
+// EndpointHints returns the endpoint addresses and ports the warp api handed
+// out with the identity. Scanning them first usually finds a working
+// endpoint long before a walk over the warp prefixes does.
+func (c IdentityConfig) EndpointHints() ([]netip.Addr, []uint16) {
+	var addrs []netip.Addr
+	var ports []uint16
+	add := func(s string) {
+		addr, port, ok := parseHint(s)
+		if !ok {
+			return
+		}
+		if !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+		if port != 0 && !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+
+	for _, peer := range c.Peers {
+		add(peer.Endpoint.V4)
+		add(peer.Endpoint.V6)
+		// usually a host name, which is left to the scan
+		add(peer.Endpoint.Host)
+		for _, port := range peer.Endpoint.Ports {
+			if port != 0 && !slices.Contains(ports, port) {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return addrs, ports
+}
+
+// parseHint parses an address of an api endpoint, with or without a port.
+// The api sends port 0 where it has none.
+func parseHint(s string) (netip.Addr, uint16, bool) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), 0, true
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return netip.Addr{}, 0, false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, 0, false
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.Addr{}, 0, false
+	}
+	return addr.Unmap(), uint16(p), true
+}
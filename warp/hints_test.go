@@ -0,0 +1,33 @@
+package warp
+
+import (
+	"net/netip"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestEndpointHints(t *testing.T) {
+	c := IdentityConfig{Peers: []IdentityConfigPeer{{
+		Endpoint: IdentityConfigPeerEndpoint{
+			V4:    "162.159.192.5:0",
+			V6:    "[2606:4700:d0::a29f:c005]:0",
+			Host:  "engage.cloudflareclient.com:2408",
+			Ports: []uint16{2408, 500, 1701, 4500},
+		},
+	}, {
+		Endpoint: IdentityConfigPeerEndpoint{V4: "162.159.192.5:854", V6: "not an address"},
+	}}}
+
+	addrs, ports := c.EndpointHints()
+	qt.Assert(t, addrs, qt.CmpEquals(cmpopts.EquateComparable(netip.Addr{})), []netip.Addr{
+		netip.MustParseAddr("162.159.192.5"),
+		netip.MustParseAddr("2606:4700:d0::a29f:c005"),
+	})
+	qt.Assert(t, ports, qt.DeepEquals, []uint16{2408, 500, 1701, 4500, 854})
+
+	addrs, ports = IdentityConfig{}.EndpointHints()
+	qt.Assert(t, addrs, qt.HasLen, 0)
+	qt.Assert(t, ports, qt.HasLen, 0)
+}
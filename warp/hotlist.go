@@ -0,0 +1,179 @@
+package warp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const hotlistFile = "warp-hotlist.json"
+
+// Hotlist is a remotely published list of warp prefixes and ports that
+// complements the built-in WarpPrefixes and WarpPorts.
+type Hotlist struct {
+	Prefixes []netip.Prefix `json:"prefixes"`
+	Ports    []uint16       `json:"ports"`
+}
+
+// HotlistOptions configures where a hotlist is fetched from and how it is
+// verified and cached.
+type HotlistOptions struct {
+	// URL serves a signed hotlist document.
+	URL string
+	// PublicKey is the base64 encoded ed25519 key the hotlist is signed with.
+	PublicKey string
+	// CacheDir stores the last verified hotlist.
+	CacheDir string
+	// MaxAge is how long a cached hotlist is used before it is fetched again.
+	MaxAge time.Duration
+}
+
+// signedHotlist is the document served at HotlistOptions.URL. Signature is
+// an ed25519 signature of the raw Data bytes, which hold a JSON Hotlist.
+type signedHotlist struct {
+	Data      []byte `json:"data"`
+	Signature []byte `json:"signature"`
+}
+
+// LoadHotlist returns the hotlist described by opts. A cached copy is used
+// while it is younger than opts.MaxAge; otherwise the hotlist is fetched,
+// verified and cached. If fetching fails, a stale cached copy is returned.
+func LoadHotlist(ctx context.Context, l *slog.Logger, opts HotlistOptions) (Hotlist, error) {
+	key, err := base64.StdEncoding.DecodeString(opts.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return Hotlist{}, errors.New("invalid hotlist public key")
+	}
+
+	cachePath := filepath.Join(opts.CacheDir, hotlistFile)
+	cached, cacheErr := readSignedHotlist(cachePath, key)
+	if cacheErr == nil {
+		if fi, err := os.Stat(cachePath); err == nil && time.Since(fi.ModTime()) < opts.MaxAge {
+			return cached, nil
+		}
+	}
+
+	raw, h, err := fetchHotlist(ctx, opts.URL, key)
+	if err != nil {
+		if cacheErr == nil {
+			l.Warn("failed to update warp hotlist, using cached copy", "error", err)
+			return cached, nil
+		}
+		return Hotlist{}, err
+	}
+
+	if err := os.MkdirAll(opts.CacheDir, os.ModePerm); err != nil {
+		return Hotlist{}, err
+	}
+	if err := os.WriteFile(cachePath, raw, 0o600); err != nil {
+		l.Warn("failed to cache warp hotlist", "error", err)
+	}
+
+	l.Info("updated warp hotlist", "prefixes", len(h.Prefixes), "ports", len(h.Ports))
+	return h, nil
+}
+
+// RefreshHotlist fetches the hotlist of opts again every opts.MaxAge until
+// ctx is done, so the cached copy the scans of a long running session merge
+// doesn't go stale.
+func RefreshHotlist(ctx context.Context, l *slog.Logger, opts HotlistOptions) {
+	interval := max(opts.MaxAge, time.Minute)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := LoadHotlist(ctx, l, opts); err != nil {
+				l.Warn("failed to refresh warp hotlist", "error", err)
+			}
+		}
+	}
+}
+
+func fetchHotlist(ctx context.Context, url string, key ed25519.PublicKey) ([]byte, Hotlist, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, Hotlist{}, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, Hotlist{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, Hotlist{}, fmt.Errorf("hotlist fetch error, status %d", resp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, Hotlist{}, err
+	}
+
+	h, err := verifyHotlist(raw, key)
+	if err != nil {
+		return nil, Hotlist{}, err
+	}
+
+	return raw, h, nil
+}
+
+func readSignedHotlist(path string, key ed25519.PublicKey) (Hotlist, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Hotlist{}, err
+	}
+	return verifyHotlist(raw, key)
+}
+
+func verifyHotlist(raw []byte, key ed25519.PublicKey) (Hotlist, error) {
+	var s signedHotlist
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return Hotlist{}, fmt.Errorf("invalid hotlist document: %w", err)
+	}
+
+	if !ed25519.Verify(key, s.Data, s.Signature) {
+		return Hotlist{}, errors.New("invalid hotlist signature")
+	}
+
+	var h Hotlist
+	if err := json.Unmarshal(s.Data, &h); err != nil {
+		return Hotlist{}, fmt.Errorf("invalid hotlist: %w", err)
+	}
+
+	return h, nil
+}
+
+// Merge returns prefixes and ports extended with the entries of the hotlist
+// that are not already present.
+func (h Hotlist) Merge(prefixes []netip.Prefix, ports []uint16) ([]netip.Prefix, []uint16) {
+	prefixes = slices.Clone(prefixes)
+	for _, p := range h.Prefixes {
+		if p.IsValid() && !slices.Contains(prefixes, p.Masked()) {
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+
+	ports = slices.Clone(ports)
+	for _, p := range h.Ports {
+		if p != 0 && !slices.Contains(ports, p) {
+			ports = append(ports, p)
+		}
+	}
+
+	return prefixes, ports
+}
@@ -0,0 +1,80 @@
+package warp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func signHotlist(t *testing.T, priv ed25519.PrivateKey, h Hotlist) []byte {
+	data, err := json.Marshal(h)
+	qt.Assert(t, err, qt.IsNil)
+	doc, err := json.Marshal(signedHotlist{Data: data, Signature: ed25519.Sign(priv, data)})
+	qt.Assert(t, err, qt.IsNil)
+	return doc
+}
+
+func TestLoadHotlistRefresh(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	qt.Assert(t, err, qt.IsNil)
+
+	served := Hotlist{Prefixes: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}, Ports: []uint16{2408}}
+	fetches, fail := 0, false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(signHotlist(t, priv, served))
+	}))
+	defer srv.Close()
+
+	opts := HotlistOptions{
+		URL:       srv.URL,
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+		CacheDir:  t.TempDir(),
+		MaxAge:    time.Hour,
+	}
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	h, err := LoadHotlist(context.Background(), l, opts)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, h.Prefixes[0], qt.Equals, served.Prefixes[0])
+	qt.Assert(t, h.Ports, qt.DeepEquals, served.Ports)
+	qt.Assert(t, fetches, qt.Equals, 1)
+
+	// a fresh cached copy is used as is
+	_, err = LoadHotlist(context.Background(), l, opts)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, fetches, qt.Equals, 1)
+
+	// a stale one is fetched again
+	old := time.Now().Add(-2 * time.Hour)
+	qt.Assert(t, os.Chtimes(filepath.Join(opts.CacheDir, hotlistFile), old, old), qt.IsNil)
+	served.Ports = []uint16{2408, 500}
+	h, err = LoadHotlist(context.Background(), l, opts)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, h.Ports, qt.DeepEquals, []uint16{2408, 500})
+	qt.Assert(t, fetches, qt.Equals, 2)
+
+	// and kept if the fetch fails
+	qt.Assert(t, os.Chtimes(filepath.Join(opts.CacheDir, hotlistFile), old, old), qt.IsNil)
+	fail = true
+	h, err = LoadHotlist(context.Background(), l, opts)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, h.Ports, qt.DeepEquals, []uint16{2408, 500})
+	qt.Assert(t, fetches, qt.Equals, 3)
+}
@@ -0,0 +1,148 @@
+package warp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+)
+
+// identityVersion is the current layout of the saved identity. Identities
+// saved before versioning was introduced have version 0.
+const identityVersion = 1
+
+// readIdentity reads, migrates and validates the identity file at
+// identityPath. Migrated identities are written back.
+func readIdentity(identityPath string) (Identity, error) {
+	fileBytes, err := os.ReadFile(identityPath)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	var i Identity
+	if err := json.Unmarshal(fileBytes, &i); err != nil {
+		return Identity{}, fmt.Errorf("malformed identity %s: %w", identityPath, err)
+	}
+
+	migrated, err := migrateIdentity(&i)
+	if err != nil {
+		return Identity{}, fmt.Errorf("identity %s: %w", identityPath, err)
+	}
+
+	if err := i.validate(); err != nil {
+		return Identity{}, fmt.Errorf("invalid identity %s: %w", identityPath, err)
+	}
+
+	if migrated {
+		if _, err := BackupIdentity(filepath.Dir(identityPath)); err != nil {
+			return Identity{}, err
+		}
+		if err := writeIdentity(i, identityPath); err != nil {
+			return Identity{}, fmt.Errorf("failed to save migrated identity: %w", err)
+		}
+	}
+
+	return i, nil
+}
+
+// migrateIdentity upgrades i to identityVersion and reports whether anything
+// changed.
+func migrateIdentity(i *Identity) (bool, error) {
+	if i.Version > identityVersion {
+		return false, fmt.Errorf("version %d is newer than the supported version %d", i.Version, identityVersion)
+	}
+
+	migrated := false
+	for i.Version < identityVersion {
+		switch i.Version {
+		case 0:
+			// Unversioned identities share the layout of version 1, only the
+			// version field is missing.
+		}
+		i.Version++
+		migrated = true
+	}
+
+	return migrated, nil
+}
+
+// validate checks that i holds everything needed to build a wireguard
+// profile.
+func (i *Identity) validate() error {
+	if i.ID == "" {
+		return errors.New("missing device id")
+	}
+
+	// team devices are managed by their organization, not with the token
+	if i.Token == "" && i.Team == "" {
+		return errors.New("missing access token")
+	}
+
+	if _, err := ParseKey(i.PrivateKey); err != nil {
+		return fmt.Errorf("bad private key: %w", err)
+	}
+
+	if len(i.Config.Peers) < 1 {
+		return errors.New("missing peers")
+	}
+
+	for n, peer := range i.Config.Peers {
+		if _, err := ParseKey(peer.PublicKey); err != nil {
+			return fmt.Errorf("bad public key for peer %d: %w", n, err)
+		}
+		if peer.Endpoint.Host == "" {
+			return fmt.Errorf("missing endpoint for peer %d", n)
+		}
+	}
+
+	if addr, err := netip.ParseAddr(i.Config.Interface.Addresses.V4); err != nil || !addr.Is4() {
+		return fmt.Errorf("bad interface IPv4 address %q", i.Config.Interface.Addresses.V4)
+	}
+
+	if addr, err := netip.ParseAddr(i.Config.Interface.Addresses.V6); err != nil || !addr.Is6() {
+		return fmt.Errorf("bad interface IPv6 address %q", i.Config.Interface.Addresses.V6)
+	}
+
+	if _, err := i.Config.Reserved(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CloneIdentity copies the identity in src to dst with a new random client
+// ID, so a second tunnel can run without registering another device. Both
+// copies share the device and its keys.
+func CloneIdentity(src, dst string) error {
+	i, err := LoadIdentity(src)
+	if err != nil {
+		return err
+	}
+
+	clientID := make([]byte, 3)
+	if _, err := rand.Read(clientID); err != nil {
+		return err
+	}
+	i.Config.ClientID = base64.StdEncoding.EncodeToString(clientID)
+
+	// a separately registered identity in dst would be lost
+	if old, err := LoadIdentity(dst); err == nil && old.ID != i.ID {
+		if _, err := BackupIdentity(dst); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := writeIdentity(i, filepath.Join(dst, identityFile)); err != nil {
+		return err
+	}
+
+	return createConf(i, dst)
+}
@@ -0,0 +1,82 @@
+package warp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+const testIdentity = `{
+  "private_key": "aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=",
+  "token": "token",
+  "id": "id",
+  "config": {
+    "peers": [
+      {
+        "public_key": "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=",
+        "endpoint": {"host": "engage.cloudflareclient.com:2408"}
+      }
+    ],
+    "interface": {
+      "addresses": {"v4": "172.16.0.2", "v6": "2606:4700:110:8cc0:1ad3:9155:6742:ea8d"}
+    }
+  }
+}`
+
+func TestReadIdentityMigratesUnversioned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), identityFile)
+	qt.Assert(t, os.WriteFile(path, []byte(testIdentity), 0o600), qt.IsNil)
+
+	i, err := readIdentity(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, i.Version, qt.Equals, identityVersion)
+
+	// the migrated identity is written back
+	i, err = readIdentity(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, i.Version, qt.Equals, identityVersion)
+}
+
+func TestReadIdentityInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"malformed", `{"private_key":`, `malformed identity .*`},
+		{"newer version", `{"version": 99}`, `identity .*: version 99 is newer than the supported version 1`},
+		{"missing peers", `{"id": "id", "token": "token", "private_key": "aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw="}`, `invalid identity .*: missing peers`},
+		{"bad key", `{"id": "id", "token": "token", "private_key": "short"}`, `invalid identity .*: bad private key: .*`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), identityFile)
+			qt.Assert(t, os.WriteFile(path, []byte(tt.content), 0o600), qt.IsNil)
+
+			_, err := readIdentity(path)
+			qt.Assert(t, err, qt.ErrorMatches, tt.err)
+		})
+	}
+}
+
+func TestProfileReserved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), identityFile)
+	content := strings.Replace(testIdentity, `"config": {`, `"config": {"client_id": "DCI4",`, 1)
+	qt.Assert(t, os.WriteFile(path, []byte(content), 0o600), qt.IsNil)
+
+	i, err := readIdentity(path)
+	qt.Assert(t, err, qt.IsNil)
+
+	// only the profiles of warp-plus get the client id, the official apps
+	// reject unknown keys, and only exported ones get an mtu
+	saved := string(profile(i, false))
+	qt.Assert(t, saved, qt.Contains, "Reserved = 12, 34, 56\n")
+	qt.Assert(t, saved, qt.Not(qt.Contains), "MTU")
+	exported := string(profile(i, true))
+	qt.Assert(t, exported, qt.Not(qt.Contains), "Reserved")
+	qt.Assert(t, exported, qt.Contains, "MTU = 1280\n")
+}
@@ -82,3 +82,14 @@ func (k Key) PublicKey() Key {
 func (k Key) String() string {
 	return base64.StdEncoding.EncodeToString(k[:])
 }
+
+// ParseKey parses a Key from a base64-encoded string, as produced by the
+// Key.String method.
+func ParseKey(s string) (Key, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return Key{}, fmt.Errorf("wgtypes: failed to parse base64-encoded key: %w", err)
+	}
+
+	return NewKey(b)
+}
@@ -0,0 +1,47 @@
+package warp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// DefaultProfile names the identities kept directly in the root directory,
+// the named profiles are kept in its profiles directory.
+const DefaultProfile = "default"
+
+var validProfile = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// ProfileDir returns the directory the identities of the profile name are
+// kept in under root. An empty name is the default profile.
+func ProfileDir(root, name string) (string, error) {
+	if name == "" || name == DefaultProfile {
+		return root, nil
+	}
+	if !validProfile.MatchString(name) {
+		return "", fmt.Errorf("invalid profile name %q, use letters, digits, - and _", name)
+	}
+	return filepath.Join(root, "profiles", name), nil
+}
+
+// Profiles returns the names of the profiles under root, the default one
+// first and the others sorted.
+func Profiles(root string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(root, "profiles"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && validProfile.MatchString(e.Name()) && e.Name() != DefaultProfile {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return append([]string{DefaultProfile}, names...), nil
+}
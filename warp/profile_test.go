@@ -0,0 +1,52 @@
+package warp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestProfileDir(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  string
+	}{
+		{"", "stuff", ""},
+		{"default", "stuff", ""},
+		{"work", filepath.Join("stuff", "profiles", "work"), ""},
+		{"home_2-b", filepath.Join("stuff", "profiles", "home_2-b"), ""},
+		{"../work", "", `invalid profile name .*`},
+		{"-work", "", `invalid profile name .*`},
+		{"my work", "", `invalid profile name .*`},
+	}
+
+	for _, tt := range tests {
+		dir, err := ProfileDir("stuff", tt.name)
+		if tt.err != "" {
+			qt.Assert(t, err, qt.ErrorMatches, tt.err, qt.Commentf("%q", tt.name))
+			continue
+		}
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, dir, qt.Equals, tt.want)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	root := t.TempDir()
+
+	names, err := Profiles(root)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, names, qt.DeepEquals, []string{"default"})
+
+	for _, name := range []string{"work", "home", "default", ".hidden"} {
+		qt.Assert(t, os.MkdirAll(filepath.Join(root, "profiles", name), os.ModePerm), qt.IsNil)
+	}
+	qt.Assert(t, os.WriteFile(filepath.Join(root, "profiles", "notes"), nil, 0o600), qt.IsNil)
+
+	names, err = Profiles(root)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, names, qt.DeepEquals, []string{"default", "home", "work"})
+}
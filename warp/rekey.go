@@ -0,0 +1,139 @@
+package warp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// pendingIdentityFile holds the identity with its new key while the key is
+// sent to the server, so the key isn't lost if the identity can't be
+// replaced afterwards.
+const pendingIdentityFile = "wgcf-identity.pending.json"
+
+// RotateKey replaces the key of the identity in path with a newly generated
+// one. The public key is sent to the identity's existing registration, so the
+// device and its account stay the same, and the identity and its profile are
+// rewritten after backing up the old ones. The identities in clones that share
+// the device, see CloneIdentity, get the new key as well; the others are left
+// alone. It returns the rotated identity.
+//
+// Zero Trust devices are updated with the team's registration, which needs
+// the access token of the device; those enrolled without one can only get a
+// new key by enrolling again. The identity with the new key is written to a
+// pending file in path before the key is sent, and only removed once the
+// identity is replaced, so a failure in between doesn't lose the key the
+// server now expects.
+func RotateKey(ctx context.Context, l *slog.Logger, path string, clones ...string) (Identity, error) {
+	return rotateKey(ctx, l, regURL, teamRegURL, path, clones...)
+}
+
+func rotateKey(ctx context.Context, l *slog.Logger, url, teamURL, path string, clones ...string) (Identity, error) {
+	i, err := LoadIdentity(path)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	if i.Team != "" {
+		if i.Token == "" {
+			return Identity{}, fmt.Errorf("can't rotate the key of a device of team %s without an access token, enroll it again instead", i.Team)
+		}
+		url = teamURL
+	}
+
+	priv, err := GeneratePrivateKey()
+	if err != nil {
+		return Identity{}, err
+	}
+
+	i.PrivateKey = priv.String()
+	i.Key = priv.PublicKey().String()
+	pending := filepath.Join(path, pendingIdentityFile)
+	if err := writeIdentity(i, pending); err != nil {
+		return Identity{}, fmt.Errorf("failed to save the new key: %w", err)
+	}
+
+	reg, err := updateKey(ctx, l, url, i.ID, i.Token, i.Key)
+	if err != nil {
+		// the server may have taken the key before failing
+		return Identity{}, fmt.Errorf("%w, the new key is kept in %s", err, pending)
+	}
+
+	// the peer of the device may change along with its key
+	if len(reg.Config.Peers) > 0 {
+		clientID := i.Config.ClientID
+		i.Config = reg.Config
+		i.Config.ClientID = clientID
+	}
+	if err := i.validate(); err != nil {
+		return Identity{}, fmt.Errorf("key update returned an invalid identity: %w, the new key is kept in %s", err, pending)
+	}
+
+	if err := replaceIdentity(i, path); err != nil {
+		return Identity{}, fmt.Errorf("%w, the new key is kept in %s", err, pending)
+	}
+	if err := os.Remove(pending); err != nil && !errors.Is(err, os.ErrNotExist) {
+		l.Warn("failed to remove the pending identity", "path", pending, "error", err)
+	}
+	l.Info("rotated identity key", "id", i.ID, "path", path)
+
+	for _, clone := range clones {
+		c, err := LoadIdentity(clone)
+		if err != nil || c.ID != i.ID {
+			continue
+		}
+
+		clientID := c.Config.ClientID
+		c.PrivateKey, c.Key, c.Config = i.PrivateKey, i.Key, i.Config
+		c.Config.ClientID = clientID
+		if err := replaceIdentity(c, clone); err != nil {
+			return Identity{}, err
+		}
+	}
+
+	return i, nil
+}
+
+// replaceIdentity backs up the identity in path and writes i and its profile
+// in its place.
+func replaceIdentity(i Identity, path string) error {
+	if _, err := BackupIdentity(path); err != nil {
+		return err
+	}
+	if err := writeIdentity(i, filepath.Join(path, identityFile)); err != nil {
+		return err
+	}
+	return createConf(i, path)
+}
+
+// updateKey registers publicKey as the key of the device accountID and
+// returns the updated registration. The old key stops working right away.
+func updateKey(ctx context.Context, l *slog.Logger, url, accountID, accessToken, publicKey string) (Identity, error) {
+	jsonData, err := json.Marshal(map[string]string{"key": publicKey})
+	if err != nil {
+		return Identity{}, err
+	}
+
+	resp, err := sendAPIRequest(ctx, l, authorizedRequest("PATCH", fmt.Sprintf("%s/%s", url, accountID), accessToken, jsonData))
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to update key: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		s, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return Identity{}, fmt.Errorf("failed to update key, status %d %s", resp.StatusCode, s)
+	}
+
+	var reg Identity
+	if err := json.NewDecoder(resp.Body).Decode(&reg); err != nil {
+		return Identity{}, fmt.Errorf("failed to update key: %w", err)
+	}
+	return reg, nil
+}
@@ -0,0 +1,134 @@
+package warp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// writeTestIdentity writes testIdentity with id to dir, with its profile.
+func writeTestIdentity(t *testing.T, dir, id string) {
+	t.Helper()
+	qt.Assert(t, os.MkdirAll(dir, 0o700), qt.IsNil)
+
+	var i Identity
+	qt.Assert(t, json.Unmarshal([]byte(testIdentity), &i), qt.IsNil)
+	i.Version, i.ID = identityVersion, id
+	qt.Assert(t, writeIdentity(i, filepath.Join(dir, identityFile)), qt.IsNil)
+	qt.Assert(t, createConf(i, dir), qt.IsNil)
+}
+
+func TestRotateKey(t *testing.T) {
+	var sent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PATCH" || r.URL.Path != "/id" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sent = body["key"]
+		fmt.Fprintf(w, `{"id": "id", "key": %q}`, sent)
+	}))
+	defer srv.Close()
+
+	testAPIClient(t, srv.Client())
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	dir := t.TempDir()
+	primary, clone, other := filepath.Join(dir, "primary"), filepath.Join(dir, "secondary"), filepath.Join(dir, "other")
+	writeTestIdentity(t, primary, "id")
+	writeTestIdentity(t, other, "other")
+	qt.Assert(t, CloneIdentity(primary, clone), qt.IsNil)
+
+	old, err := LoadIdentity(primary)
+	qt.Assert(t, err, qt.IsNil)
+	oldClone, err := LoadIdentity(clone)
+	qt.Assert(t, err, qt.IsNil)
+
+	i, err := rotateKey(context.Background(), l, srv.URL, srv.URL+"/team", primary, clone, other)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, i.PrivateKey, qt.Not(qt.Equals), old.PrivateKey)
+	qt.Assert(t, i.Key, qt.Equals, sent)
+	// the response has no config, the old peer is kept
+	qt.Assert(t, i.Config, qt.DeepEquals, old.Config)
+
+	saved, err := LoadIdentity(primary)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, saved.PrivateKey, qt.Equals, i.PrivateKey)
+	backups, err := Backups(primary)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, backups, qt.HasLen, 1)
+	_, err = os.Stat(filepath.Join(primary, pendingIdentityFile))
+	qt.Assert(t, err, qt.ErrorIs, os.ErrNotExist)
+
+	c, err := LoadIdentity(clone)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, c.PrivateKey, qt.Equals, i.PrivateKey)
+	qt.Assert(t, c.Config.ClientID, qt.Equals, oldClone.Config.ClientID)
+
+	o, err := LoadIdentity(other)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, o.PrivateKey, qt.Equals, old.PrivateKey)
+
+	// the server refuses keys of other devices, the new key is kept in case
+	// it took it anyway
+	writeTestIdentity(t, primary, "unknown")
+	_, err = rotateKey(context.Background(), l, srv.URL, srv.URL+"/team", primary)
+	qt.Assert(t, err, qt.ErrorMatches, `failed to update key, status 404 .*, the new key is kept in .*`)
+	pending, err := readIdentity(filepath.Join(primary, pendingIdentityFile))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, pending.ID, qt.Equals, "unknown")
+	saved, err = LoadIdentity(primary)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, pending.PrivateKey, qt.Not(qt.Equals), saved.PrivateKey)
+}
+
+func TestRotateKeyTeam(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"id": "id", "key": %q}`, body["key"])
+	}))
+	defer srv.Close()
+
+	testAPIClient(t, srv.Client())
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	dir := t.TempDir()
+	writeTestIdentity(t, dir, "id")
+	i, err := LoadIdentity(dir)
+	qt.Assert(t, err, qt.IsNil)
+	i.Team = "example"
+	qt.Assert(t, writeIdentity(i, filepath.Join(dir, identityFile)), qt.IsNil)
+
+	// team devices are updated through the team's registration
+	_, err = rotateKey(context.Background(), l, srv.URL, srv.URL+"/team", dir)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, path, qt.Equals, "/team/id")
+
+	// without a token they can't be, and nothing is sent
+	i.Token = ""
+	qt.Assert(t, writeIdentity(i, filepath.Join(dir, identityFile)), qt.IsNil)
+	path = ""
+	_, err = rotateKey(context.Background(), l, srv.URL, srv.URL+"/team", dir)
+	qt.Assert(t, err, qt.ErrorMatches, `can't rotate the key of a device of team example without an access token.*`)
+	qt.Assert(t, path, qt.Equals, "")
+}
@@ -0,0 +1,164 @@
+package warp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// SystemProxy returns the proxy the system has configured for reaching the
+// API, or nil if it reaches it directly. The HTTPS_PROXY, HTTP_PROXY and
+// NO_PROXY environment variables come first, then on windows the proxy of
+// the current user's internet settings and the WinHTTP default.
+func SystemProxy() (*url.URL, error) {
+	apiLocation, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, err
+	}
+	u, err := httpproxy.FromEnvironment().ProxyFunc()(apiLocation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy environment: %w", err)
+	}
+	if u != nil {
+		return u, nil
+	}
+
+	raw, err := osProxy()
+	if err != nil {
+		return nil, err
+	}
+	return parseProxyList(raw), nil
+}
+
+// UseSystemProxy makes API connections go through the proxy SystemProxy
+// returns, if any, and returns it.
+func UseSystemProxy() (*url.URL, error) {
+	u, err := SystemProxy()
+	if err != nil || u == nil {
+		return nil, err
+	}
+	if err := UseBootstrapProxy(u.String()); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// parseProxyList parses a windows proxy list like "proxy:8080" or
+// "http=proxy:8080;https=proxy:8443;socks=proxy:1080" into the proxy for
+// https connections. Socks entries are skipped, windows speaks socks4 to
+// them.
+func parseProxyList(raw string) *url.URL {
+	var plain, httpsProxy, httpProxy string
+	for _, entry := range strings.FieldsFunc(raw, func(r rune) bool { return r == ';' || r == ' ' }) {
+		scheme, addr, found := strings.Cut(entry, "=")
+		switch {
+		case !found:
+			plain = entry
+		case strings.EqualFold(scheme, "https"):
+			httpsProxy = addr
+		case strings.EqualFold(scheme, "http"):
+			httpProxy = addr
+		}
+	}
+
+	for _, addr := range []string{httpsProxy, plain, httpProxy} {
+		if addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		if u, err := url.Parse(addr); err == nil && u.Host != "" {
+			return u
+		}
+	}
+	return nil
+}
+
+// httpProxyDialer reaches addresses through an http proxy with CONNECT
+// requests.
+type httpProxyDialer struct {
+	proxy   *url.URL
+	forward proxy.Dialer
+}
+
+func (d *httpProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	host := d.proxy.Host
+	if d.proxy.Port() == "" {
+		port := "80"
+		if d.proxy.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(d.proxy.Hostname(), port)
+	}
+
+	conn, err := d.forward.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if d.proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname(), MinVersion: tls.VersionTLS12})
+	}
+
+	br, err := d.connect(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %w", d.proxy.Redacted(), err)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// connect asks the proxy on conn to connect it to addr and returns the
+// reader of its response, which may hold data read past it.
+func (d *httpProxyDialer) connect(conn net.Conn, addr string) (*bufio.Reader, error) {
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("connect to %s refused: %s", addr, resp.Status)
+	}
+	return br, nil
+}
+
+// bufferedConn is a connection whose reads start with what r buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package warp
+
+// osProxy returns the proxy list of the operating system's settings. Only
+// windows has one beyond the environment.
+func osProxy() (string, error) {
+	return "", nil
+}
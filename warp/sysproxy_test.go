@@ -0,0 +1,112 @@
+package warp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseProxyList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"proxy:8080", "http://proxy:8080"},
+		{"http=proxy:8080;https=secure:8443", "http://secure:8443"},
+		{"http=proxy:8080; socks=socks:1080", "http://proxy:8080"},
+		{"socks=socks:1080", ""},
+		{"https://proxy:8443", "https://proxy:8443"},
+	}
+	for _, test := range tests {
+		u := parseProxyList(test.in)
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		qt.Check(t, got, qt.Equals, test.want, qt.Commentf("%q", test.in))
+	}
+}
+
+func TestSystemProxyEnvironment(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://proxy.example:3128")
+	t.Setenv("NO_PROXY", "")
+
+	u, err := SystemProxy()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, u.String(), qt.Equals, "http://proxy.example:3128")
+
+	t.Setenv("NO_PROXY", "cloudflareclient.com")
+	u, err = SystemProxy()
+	qt.Assert(t, err, qt.IsNil)
+	if u != nil {
+		// the proxy of the os settings, if the test machine has one
+		qt.Assert(t, u.Host, qt.Not(qt.Equals), "proxy.example:3128")
+	}
+}
+
+func TestHTTPProxyDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- req
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		_, _ = io.WriteString(conn, "hello")
+	}()
+
+	d := &httpProxyDialer{
+		proxy:   &url.URL{Scheme: "http", Host: ln.Addr().String(), User: url.UserPassword("user", "pass")},
+		forward: &net.Dialer{},
+	}
+	conn, err := d.Dial("tcp", "api.cloudflareclient.com:443")
+	qt.Assert(t, err, qt.IsNil)
+	defer conn.Close()
+
+	req := <-requests
+	qt.Assert(t, req.Method, qt.Equals, http.MethodConnect)
+	qt.Assert(t, req.Host, qt.Equals, "api.cloudflareclient.com:443")
+	qt.Assert(t, req.Header.Get("Proxy-Authorization"), qt.Equals, "Basic dXNlcjpwYXNz")
+
+	b, err := io.ReadAll(conn)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(b), qt.Equals, "hello")
+}
+
+func TestHTTPProxyDialerRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+			_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+		}
+	}()
+
+	d := &httpProxyDialer{proxy: &url.URL{Scheme: "http", Host: ln.Addr().String()}, forward: &net.Dialer{}}
+	_, err = d.Dial("tcp", "api.cloudflareclient.com:443")
+	qt.Assert(t, err, qt.ErrorMatches, `http proxy .*: connect to api.cloudflareclient.com:443 refused: 407 .*`)
+}
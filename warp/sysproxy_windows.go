@@ -0,0 +1,62 @@
+package warp
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modwinhttp                                = windows.NewLazySystemDLL("winhttp.dll")
+	modkernel32                               = windows.NewLazySystemDLL("kernel32.dll")
+	procWinHttpGetIEProxyConfigForCurrentUser = modwinhttp.NewProc("WinHttpGetIEProxyConfigForCurrentUser")
+	procWinHttpGetDefaultProxyConfiguration   = modwinhttp.NewProc("WinHttpGetDefaultProxyConfiguration")
+	procGlobalFree                            = modkernel32.NewProc("GlobalFree")
+)
+
+// winhttpCurrentUserIEProxyConfig is WINHTTP_CURRENT_USER_IE_PROXY_CONFIG.
+type winhttpCurrentUserIEProxyConfig struct {
+	autoDetect    uint32
+	autoConfigURL *uint16
+	proxy         *uint16
+	proxyBypass   *uint16
+}
+
+// winhttpProxyInfo is WINHTTP_PROXY_INFO.
+type winhttpProxyInfo struct {
+	accessType  uint32
+	proxy       *uint16
+	proxyBypass *uint16
+}
+
+// osProxy returns the proxy list of the current user's internet settings,
+// or else the one netsh winhttp set proxy configured. Proxy auto-config
+// scripts are not evaluated.
+func osProxy() (string, error) {
+	var ie winhttpCurrentUserIEProxyConfig
+	if r, _, _ := procWinHttpGetIEProxyConfigForCurrentUser.Call(uintptr(unsafe.Pointer(&ie))); r != 0 {
+		defer globalFree(ie.autoConfigURL, ie.proxy, ie.proxyBypass)
+		if ie.proxy != nil {
+			return windows.UTF16PtrToString(ie.proxy), nil
+		}
+	}
+
+	var info winhttpProxyInfo
+	if r, _, err := procWinHttpGetDefaultProxyConfiguration.Call(uintptr(unsafe.Pointer(&info))); r == 0 {
+		return "", err
+	}
+	defer globalFree(info.proxy, info.proxyBypass)
+	if info.proxy == nil {
+		return "", nil
+	}
+	return windows.UTF16PtrToString(info.proxy), nil
+}
+
+// globalFree frees the strings winhttp allocated.
+func globalFree(strings ...*uint16) {
+	for _, s := range strings {
+		if s != nil {
+			procGlobalFree.Call(uintptr(unsafe.Pointer(s)))
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package warp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// teamRegURL registers the devices of Zero Trust organizations.
+const teamRegURL = "https://zero-trust-client.cloudflareclient.com/" + apiVersion + "/reg"
+
+// validTeam matches the team names of Zero Trust organizations, the first
+// label of their <team>.cloudflareaccess.com domain.
+var validTeam = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// TeamEnrollURL returns the page the members of team log in on to get the
+// token EnrollTeam needs.
+func TeamEnrollURL(team string) string {
+	return fmt.Sprintf("https://%s.cloudflareaccess.com/warp", team)
+}
+
+// ParseTeamToken returns the JWT in raw, which is either the token itself or
+// the com.cloudflare.warp:// link the enrollment page opens the app with.
+// Tokens that expired are rejected, they are only valid for a few minutes.
+func ParseTeamToken(raw string) (string, error) {
+	token := strings.TrimSpace(raw)
+	if strings.Contains(token, "://") {
+		u, err := url.Parse(token)
+		if err != nil {
+			return "", fmt.Errorf("invalid team token link: %w", err)
+		}
+		token = u.Query().Get("token")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("invalid team token, expected a JWT like eyJ...")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("invalid team token, expected a JWT like eyJ...")
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", errors.New("invalid team token, expected a JWT like eyJ...")
+	}
+	if claims.Exp != 0 && time.Unix(claims.Exp, 0).Before(time.Now()) {
+		return "", fmt.Errorf("team token expired at %s, log in again for a new one", time.Unix(claims.Exp, 0).Format(time.RFC3339))
+	}
+	return token, nil
+}
+
+// EnrollTeam registers a device in the Zero Trust organization team with
+// token, a JWT from the enrollment page, and saves its identity and profile
+// to path. An identity already there is backed up first.
+func EnrollTeam(ctx context.Context, l *slog.Logger, path, team, token string) (Identity, error) {
+	if !validTeam.MatchString(team) {
+		return Identity{}, fmt.Errorf("invalid team name %q, expected the first label of <team>.cloudflareaccess.com", team)
+	}
+
+	priv, err := GeneratePrivateKey()
+	if err != nil {
+		return Identity{}, err
+	}
+
+	l.Info("enrolling device in team", "team", team)
+	i, err := register(ctx, l, teamRegURL, priv.PublicKey().String(), map[string]string{
+		"CF-Access-Jwt-Assertion": token,
+	})
+	if err != nil {
+		return Identity{}, fmt.Errorf("team enrollment failed: %w", err)
+	}
+
+	i.PrivateKey = priv.String()
+	i.Version = identityVersion
+	i.Team = team
+
+	if err := i.validate(); err != nil {
+		return Identity{}, fmt.Errorf("enrollment returned an invalid identity: %w", err)
+	}
+
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return Identity{}, err
+	}
+	if _, err := os.Stat(filepath.Join(path, identityFile)); err == nil {
+		backup, err := BackupIdentity(path)
+		if err != nil {
+			return Identity{}, err
+		}
+		if backup != "" {
+			l.Info("backed up the replaced identity", "backup", backup)
+		}
+	}
+
+	if err := saveIdentity(i, path); err != nil {
+		return Identity{}, err
+	}
+	if err := createConf(i, path); err != nil {
+		return Identity{}, err
+	}
+	return i, nil
+}
@@ -0,0 +1,68 @@
+package warp
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// testJWT returns an unsigned JWT expiring at exp.
+func testJWT(exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+	return "eyJhbGciOiJSUzI1NiJ9." + payload + ".c2ln"
+}
+
+func TestParseTeamToken(t *testing.T) {
+	valid := testJWT(time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name string
+		raw  string
+		want string
+		err  string
+	}{
+		{"jwt", " " + valid + "\n", valid, ""},
+		{"link", "com.cloudflare.warp://acme.cloudflareaccess.com/auth?token=" + valid, valid, ""},
+		{"expired", testJWT(time.Now().Add(-time.Hour)), "", `team token expired at .*`},
+		{"garbage", "not a token", "", `invalid team token, .*`},
+		{"link without token", "com.cloudflare.warp://acme.cloudflareaccess.com/auth", "", `invalid team token, .*`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := ParseTeamToken(tt.raw)
+			if tt.err != "" {
+				qt.Assert(t, err, qt.ErrorMatches, tt.err)
+				return
+			}
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, token, qt.Equals, tt.want)
+		})
+	}
+}
+
+func TestRegisterTeamHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("CF-Access-Jwt-Assertion") != "jwt" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"id": "device", "config": {"client_id": "DCI4"}}`)
+	}))
+	defer srv.Close()
+
+	testAPIClient(t, srv.Client())
+
+	i, err := register(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), srv.URL, "key", map[string]string{"CF-Access-Jwt-Assertion": "jwt"})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, i.ID, qt.Equals, "device")
+	qt.Assert(t, i.Config.ClientID, qt.Equals, "DCI4")
+}
@@ -3,17 +3,138 @@ package warp
 import (
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/netip"
+	"slices"
+	"sync"
 
 	"github.com/bepass-org/warp-plus/iputils"
 
 	tls "github.com/refraction-networking/utls"
+	"golang.org/x/net/proxy"
 )
 
 // Dialer is a struct that holds various options for custom dialing.
 type Dialer struct{}
 
+// nat64Prefix, if valid, is used to reach the IPv4-only API addresses from
+// IPv6-only networks.
+var nat64Prefix netip.Prefix
+
+// UseNAT64 makes API connections go through the NAT64 gateway with the given
+// /96 prefix.
+func UseNAT64(prefix netip.Prefix) {
+	nat64Prefix = prefix
+}
+
+// FrontingOptions control how API connections are fronted.
+type FrontingOptions struct {
+	// Prefixes hold the addresses the API is reached through, one is picked
+	// at random for every connection so retries rotate across them.
+	// Default 141.101.113.0/24.
+	Prefixes []netip.Prefix
+	// SNI is sent in place of the API host name if set.
+	SNI string
+	// Fingerprint is the TLS ClientHello to send, one of Fingerprints.
+	// Default "custom", a padded hello.
+	Fingerprint string
+}
+
+var fronting = FrontingOptions{
+	Prefixes:    []netip.Prefix{netip.MustParsePrefix("141.101.113.0/24")},
+	Fingerprint: "custom",
+}
+
+// preferredAddrs are edge addresses known to be reachable, tried before the
+// fronting prefixes, see PreferAPIAddrs.
+var preferredAddrs struct {
+	sync.Mutex
+	addrs []netip.Addr
+}
+
+// PreferAPIAddrs makes API connections go to addrs, e.g. endpoints the
+// scanner or a tunnel reached, before random addresses of the fronting
+// prefixes. An address is dropped once a connection to it fails, so the
+// prefixes take over when none is left.
+func PreferAPIAddrs(addrs ...netip.Addr) {
+	preferredAddrs.Lock()
+	defer preferredAddrs.Unlock()
+
+	preferredAddrs.addrs = preferredAddrs.addrs[:0]
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.IsValid() && !slices.Contains(preferredAddrs.addrs, addr) {
+			preferredAddrs.addrs = append(preferredAddrs.addrs, addr)
+		}
+	}
+}
+
+// preferredAddr returns the first preferred address, if any.
+func preferredAddr() (netip.Addr, bool) {
+	preferredAddrs.Lock()
+	defer preferredAddrs.Unlock()
+
+	if len(preferredAddrs.addrs) == 0 {
+		return netip.Addr{}, false
+	}
+	return preferredAddrs.addrs[0], true
+}
+
+// dropPreferredAddr stops preferring addr after a connection to it failed.
+func dropPreferredAddr(addr netip.Addr) {
+	preferredAddrs.Lock()
+	defer preferredAddrs.Unlock()
+
+	preferredAddrs.addrs = slices.DeleteFunc(preferredAddrs.addrs, func(a netip.Addr) bool {
+		return a == addr
+	})
+}
+
+// fingerprints are the ClientHellos Fingerprint may name besides "custom".
+var fingerprints = map[string]tls.ClientHelloID{
+	"chrome":     tls.HelloChrome_Auto,
+	"firefox":    tls.HelloFirefox_Auto,
+	"safari":     tls.HelloSafari_Auto,
+	"edge":       tls.HelloEdge_Auto,
+	"ios":        tls.HelloIOS_Auto,
+	"randomized": tls.HelloRandomizedNoALPN,
+}
+
+// Fingerprints returns the names of the supported ClientHello fingerprints.
+func Fingerprints() []string {
+	names := []string{"custom"}
+	for name := range fingerprints {
+		names = append(names, name)
+	}
+	slices.Sort(names[1:])
+	return names
+}
+
+// UseFronting makes API connections use opts. Zero fields keep their
+// defaults.
+func UseFronting(opts FrontingOptions) error {
+	if len(opts.Prefixes) > 0 {
+		fronting.Prefixes = nil
+		for _, prefix := range opts.Prefixes {
+			if !prefix.IsValid() {
+				return fmt.Errorf("invalid fronting prefix %s", prefix)
+			}
+			fronting.Prefixes = append(fronting.Prefixes, prefix.Masked())
+		}
+	}
+	if opts.SNI != "" {
+		fronting.SNI = opts.SNI
+	}
+	if opts.Fingerprint != "" {
+		if !slices.Contains(Fingerprints(), opts.Fingerprint) {
+			return fmt.Errorf("unsupported fingerprint %q", opts.Fingerprint)
+		}
+		fronting.Fingerprint = opts.Fingerprint
+	}
+	return nil
+}
+
 const (
 	extensionServerName   uint16 = 0x0
 	utlsExtensionSNICurve uint16 = 0x15
@@ -166,17 +287,30 @@ func (d *Dialer) makeTLSHelloPacketWithSNICurve(plainConn net.Conn, config *tls.
 }
 
 // TLSDial dials a TLS connection.
-func (d *Dialer) TLSDial(plainDialer *net.Dialer, network, addr string) (net.Conn, error) {
+func (d *Dialer) TLSDial(plainDialer proxy.Dialer, network, addr string) (net.Conn, error) {
 	sni, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
-	ip, err := iputils.RandomIPFromPrefix(netip.MustParsePrefix("141.101.113.0/24"))
-	if err != nil {
-		return nil, err
+	if fronting.SNI != "" {
+		sni = fronting.SNI
 	}
-	plainConn, err := plainDialer.Dial(network, ip.String()+":443")
+	ip, preferred := preferredAddr()
+	if !preferred {
+		ip, err = iputils.RandomIPFromPrefix(fronting.Prefixes[rand.Intn(len(fronting.Prefixes))])
+		if err != nil {
+			return nil, err
+		}
+	}
+	dialIP := ip
+	if nat64Prefix.IsValid() && ip.Is4() {
+		dialIP = iputils.SynthesizeNAT64(nat64Prefix, ip)
+	}
+	plainConn, err := plainDialer.Dial(network, netip.AddrPortFrom(dialIP, 443).String())
 	if err != nil {
+		if preferred {
+			dropPreferredAddr(ip)
+		}
 		return nil, err
 	}
 
@@ -187,10 +321,52 @@ func (d *Dialer) TLSDial(plainDialer *net.Dialer, network, addr string) (net.Con
 		MinVersion:         tls.VersionTLS10,
 	}
 
-	utlsConn, handshakeErr := d.makeTLSHelloPacketWithSNICurve(plainConn, &config, sni)
+	var (
+		utlsConn     *tls.UConn
+		handshakeErr error
+	)
+	if id, ok := fingerprints[fronting.Fingerprint]; ok {
+		utlsConn, handshakeErr = d.makeTLSHelloPacket(plainConn, &config, id)
+	} else {
+		utlsConn, handshakeErr = d.makeTLSHelloPacketWithSNICurve(plainConn, &config, sni)
+	}
 	if handshakeErr != nil {
 		_ = plainConn.Close()
+		if preferred {
+			dropPreferredAddr(ip)
+		}
 		return nil, handshakeErr
 	}
 	return utlsConn, nil
 }
+
+// makeTLSHelloPacket completes a TLS handshake with the ClientHello of id,
+// limited to http/1.1 as the API client doesn't speak h2 over it.
+func (d *Dialer) makeTLSHelloPacket(plainConn net.Conn, config *tls.Config, id tls.ClientHelloID) (*tls.UConn, error) {
+	if id == tls.HelloRandomizedNoALPN {
+		utlsConn := tls.UClient(plainConn, config, id)
+		if err := utlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("uTlsConn.Handshake() error: %w", err)
+		}
+		return utlsConn, nil
+	}
+
+	spec, err := tls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*tls.ALPNExtension); ok {
+			alpn.AlpnProtocols = []string{"http/1.1"}
+		}
+	}
+
+	utlsConn := tls.UClient(plainConn, config, tls.HelloCustom)
+	if err := utlsConn.ApplyPreset(&spec); err != nil {
+		return nil, fmt.Errorf("uTlsConn.Handshake() error: %w", err)
+	}
+	if err := utlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("uTlsConn.Handshake() error: %w", err)
+	}
+	return utlsConn, nil
+}
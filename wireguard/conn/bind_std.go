@@ -120,7 +120,16 @@ func (e *StdNetEndpoint) DstToString() string {
 }
 
 func listenNet(network string, port int) (*net.UDPConn, int, error) {
-	conn, err := listenConfig().ListenPacket(context.Background(), network, ":"+strconv.Itoa(port))
+	addr := ":" + strconv.Itoa(port)
+	if network == "udp6" && ipv6Source != nil {
+		src, err := ipv6Source()
+		if err != nil {
+			return nil, 0, err
+		}
+		addr = net.JoinHostPort(src.String(), strconv.Itoa(port))
+	}
+
+	conn, err := listenConfig().ListenPacket(context.Background(), network, addr)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -7,6 +7,7 @@ package conn
 
 import (
 	"net"
+	"net/netip"
 	"syscall"
 )
 
@@ -41,3 +42,21 @@ func listenConfig() *net.ListenConfig {
 		},
 	}
 }
+
+// AddControlFn registers fn to be applied to every socket opened by
+// StdNetBind, e.g. to bind it to an interface or set a firewall mark. It must
+// be called before any bind is opened.
+func AddControlFn(fn func(network, address string, c syscall.RawConn) error) {
+	controlFns = append(controlFns, fn)
+}
+
+// ipv6Source, if set, picks the local address of every IPv6 socket opened
+// by StdNetBind.
+var ipv6Source func() (netip.Addr, error)
+
+// SetIPv6Source makes StdNetBind bind its IPv6 sockets to the address fn
+// returns, called anew for every socket. It must be called before any bind
+// is opened.
+func SetIPv6Source(fn func() (netip.Addr, error)) {
+	ipv6Source = fn
+}
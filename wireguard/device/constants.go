@@ -35,6 +35,7 @@ const (
 /* Implementation constants */
 
 const (
-	UnderLoadAfterTime = time.Second // how long does the device remain under load after detected
-	MaxPeers           = 1 << 16     // maximum number of configured peers
+	UnderLoadAfterTime      = time.Second // how long does the device remain under load after detected
+	MaxPeers                = 1 << 16     // maximum number of configured peers
+	FallbackAfterHandshakes = 3           // failed handshake retries before switching to the fallback endpoint
 )
@@ -86,6 +86,9 @@ type Device struct {
 		mtu    atomic.Int32
 	}
 
+	// obfs are the AmneziaWG parameters, never nil
+	obfs atomic.Pointer[obfuscation]
+
 	ipcMutex sync.RWMutex
 	closed   chan struct{}
 	log      *Logger
@@ -286,6 +289,7 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device.state.state.Store(uint32(deviceStateDown))
 	device.closed = make(chan struct{})
 	device.log = logger
+	device.obfs.Store(&defaultObfuscation)
 	device.net.bind = bind
 	device.tun.device = tunDevice
 	mtu, err := device.tun.device.MTU()
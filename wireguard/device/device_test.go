@@ -203,6 +203,133 @@ func TestTwoDevicePing(t *testing.T) {
 	})
 }
 
+func TestTwoDevicePingObfuscated(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	for i := range pair {
+		err := pair[i].dev.IpcSet(uapiCfg(
+			"jc", "4",
+			"jmin", "10",
+			"jmax", "50",
+			"s1", "15",
+			"s2", "20",
+			"h1", "1020325451",
+			"h2", "3288052141",
+			"h3", "1766607858",
+			"h4", "2528465083",
+		))
+		if err != nil {
+			t.Fatalf("failed to configure obfuscation of device %d: %v", i, err)
+		}
+	}
+	t.Run("ping 1.0.0.1", func(t *testing.T) {
+		pair.Send(t, Ping, nil)
+	})
+	t.Run("ping 1.0.0.2", func(t *testing.T) {
+		pair.Send(t, Pong, nil)
+	})
+}
+
+func TestTwoDevicePingReserved(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	for i := range pair {
+		pub := pair[i^1].dev.staticIdentity.publicKey
+		err := pair[i].dev.IpcSet(uapiCfg(
+			"public_key", hex.EncodeToString(pub[:]),
+			"reserved", fmt.Sprintf("%d,%d,%d", 42+i, 43, 44),
+		))
+		if err != nil {
+			t.Fatalf("failed to configure reserved bytes of device %d: %v", i, err)
+		}
+	}
+	t.Run("ping 1.0.0.1", func(t *testing.T) {
+		pair.Send(t, Ping, nil)
+	})
+	t.Run("ping 1.0.0.2", func(t *testing.T) {
+		pair.Send(t, Pong, nil)
+	})
+}
+
+// TestTwoDevicePingReconfigure changes the tricks and reserved bytes of a
+// peer while it is sending, which -race catches if they aren't synchronized.
+func TestTwoDevicePingReconfigure(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	pub := pair[1].dev.staticIdentity.publicKey
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			err := pair[0].dev.IpcSet(uapiCfg(
+				"public_key", hex.EncodeToString(pub[:]),
+				"trick_count", "0",
+				"trick_size", fmt.Sprintf("%d", 1+i%100),
+				"reserved", fmt.Sprintf("%d,%d,%d", i%256, 43, 44),
+			))
+			if err != nil {
+				t.Errorf("failed to reconfigure device 0: %v", err)
+				return
+			}
+			if _, err := pair[0].dev.IpcGet(); err != nil {
+				t.Errorf("failed to read configuration of device 0: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		pair.Send(t, Ping, nil)
+		pair.Send(t, Pong, nil)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestFallbackEndpoint(t *testing.T) {
+	cfg, _ := genConfigs(t)
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.IpcSet(cfg[0] + uapiCfg(
+		"endpoint", "127.0.0.1:1",
+		"fallback_endpoint", "127.0.0.1:3",
+	)); err != nil {
+		t.Fatalf("failed to configure device: %v", err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatalf("failed to bring up device: %v", err)
+	}
+
+	var peer *Peer
+	for _, p := range dev.peers.keyMap {
+		peer = p
+	}
+	endpoints := func() (string, string) {
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		return peer.endpoint.val.DstToString(), peer.endpoint.fallback.DstToString()
+	}
+
+	// the peer switches to the fallback endpoint after every
+	// FallbackAfterHandshakes timed out handshakes, and back again
+	for try := 1; try <= 2*FallbackAfterHandshakes; try++ {
+		expiredRetransmitHandshake(peer)
+		want, wantFallback := "127.0.0.1:1", "127.0.0.1:3"
+		if try >= FallbackAfterHandshakes && try < 2*FallbackAfterHandshakes {
+			want, wantFallback = wantFallback, want
+		}
+		if got, gotFallback := endpoints(); got != want || gotFallback != wantFallback {
+			t.Errorf("after %d handshakes: endpoint %s, fallback %s, want %s, %s", try, got, gotFallback, want, wantFallback)
+		}
+	}
+}
+
 func TestUpDown(t *testing.T) {
 	goroutineLeakCheck(t)
 	const itrials = 50
@@ -0,0 +1,153 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	maxJunkCount = 128
+	maxJunkSize  = 1280
+)
+
+// obfuscation holds the AmneziaWG parameters of a device. Both ends of a
+// tunnel must agree on the paddings and headers; the junk packets are
+// dropped by the receiver. The default is plain wireguard.
+type obfuscation struct {
+	junkCount        int // Jc, junk packets sent ahead of each initiation
+	junkMin, junkMax int // Jmin and Jmax, size range of the junk packets
+
+	initPadding     int // S1, random bytes prepended to initiations
+	responsePadding int // S2, random bytes prepended to responses
+
+	// headers replace the message types 1 to 4 on the wire (H1-H4)
+	headers [4]uint32
+}
+
+var defaultObfuscation = obfuscation{
+	headers: [4]uint32{
+		MessageInitiationType,
+		MessageResponseType,
+		MessageCookieReplyType,
+		MessageTransportType,
+	},
+}
+
+func (o *obfuscation) validate() error {
+	if o.junkCount < 0 || o.junkCount > maxJunkCount {
+		return errors.New("jc must be between 0 and 128")
+	}
+	if o.junkMin < 0 || o.junkMin > o.junkMax || o.junkMax > maxJunkSize {
+		return errors.New("jmin and jmax must satisfy 0 <= jmin <= jmax <= 1280")
+	}
+	if o.initPadding < 0 || o.initPadding > maxJunkSize-MessageInitiationSize {
+		return errors.New("s1 must be between 0 and 1132")
+	}
+	if o.responsePadding < 0 || o.responsePadding > maxJunkSize-MessageResponseSize {
+		return errors.New("s2 must be between 0 and 1188")
+	}
+	// the receiver tells initiations and responses apart by their size
+	if MessageInitiationSize+o.initPadding == MessageResponseSize+o.responsePadding {
+		return errors.New("s1 + 56 must not equal s2")
+	}
+	for i, h := range o.headers {
+		for _, other := range o.headers[i+1:] {
+			if h == other {
+				return errors.New("h1 to h4 must be distinct")
+			}
+		}
+	}
+	return nil
+}
+
+// header returns the header msgType is sent with.
+func (o *obfuscation) header(msgType uint32) uint32 {
+	return o.headers[msgType-1]
+}
+
+// plainHeaders reports whether messages are sent with the wireguard message
+// types, whose headers have three reserved bytes after the type.
+func (o *obfuscation) plainHeaders() bool {
+	return o.headers == defaultObfuscation.headers
+}
+
+// classify returns the message type of a received packet and the packet
+// without its padding, or 0 if the packet is not a message.
+func (o *obfuscation) classify(packet []byte) (uint32, []byte) {
+	// handshakes are padded, so their size tells where their header is
+	if len(packet) == MessageInitiationSize+o.initPadding &&
+		o.isHeader(packet[o.initPadding:], o.headers[0]) {
+		return MessageInitiationType, packet[o.initPadding:]
+	}
+	if len(packet) == MessageResponseSize+o.responsePadding &&
+		o.isHeader(packet[o.responsePadding:], o.headers[1]) {
+		return MessageResponseType, packet[o.responsePadding:]
+	}
+
+	switch {
+	case o.isHeader(packet, o.headers[2]):
+		return MessageCookieReplyType, packet
+	case o.isHeader(packet, o.headers[3]):
+		return MessageTransportType, packet
+	}
+	return 0, packet
+}
+
+// isHeader reports whether message starts with header. Plain headers match
+// whatever their reserved bytes hold, e.g. the client id cloudflare echoes
+// back, and have them cleared for the handshake checks and macs.
+func (o *obfuscation) isHeader(message []byte, header uint32) bool {
+	if !o.plainHeaders() {
+		return binary.LittleEndian.Uint32(message) == header
+	}
+	if uint32(message[0]) != header {
+		return false
+	}
+	message[1], message[2], message[3] = 0, 0, 0
+	return true
+}
+
+// setReserved writes the reserved bytes of peer into the plain header at the
+// start of message. It is done after the macs are added, as the receiver
+// clears them before checking.
+func (peer *Peer) setReserved(message []byte, o *obfuscation) {
+	if reserved := peer.reserved.Load(); *reserved != [3]byte{} && o.plainHeaders() {
+		copy(message[1:4], reserved[:])
+	}
+}
+
+// pad returns packet behind n random bytes.
+func pad(packet []byte, n int) ([]byte, error) {
+	if n == 0 {
+		return packet, nil
+	}
+
+	padded := make([]byte, n+len(packet))
+	if _, err := rand.Read(padded[:n]); err != nil {
+		return nil, err
+	}
+	copy(padded[n:], packet)
+	return padded, nil
+}
+
+// sendJunkPackets sends the junk packets that precede an initiation.
+func (peer *Peer) sendJunkPackets(o *obfuscation) error {
+	if o.junkCount == 0 {
+		return nil
+	}
+
+	junk := make([][]byte, o.junkCount)
+	for i := range junk {
+		junk[i] = make([]byte, randomInt(o.junkMin, o.junkMax))
+		if _, err := rand.Read(junk[i]); err != nil {
+			return err
+		}
+	}
+	return peer.SendBuffers(junk)
+}
@@ -28,7 +28,8 @@ type Peer struct {
 	endpoint struct {
 		sync.Mutex
 		val            conn.Endpoint
-		clearSrcOnTx   bool // signal to val.ClearSrc() prior to next packet transmission
+		fallback       conn.Endpoint // swapped with val when handshakes time out
+		clearSrcOnTx   bool          // signal to val.ClearSrc() prior to next packet transmission
 		disableRoaming bool
 	}
 
@@ -53,8 +54,14 @@ type Peer struct {
 		inbound  *autodrainingInboundQueue            // sequential ordering of tun writing
 	}
 
-	trick  bool
-	stopCh chan int
+	// trick, tricks and reserved are set over the uapi while the peer is
+	// sending, so they are swapped whole rather than written in place
+	trick  atomic.Bool
+	tricks atomic.Pointer[trickParams]
+	// reserved fill the reserved bytes of the message headers, which some
+	// servers identify clients by, e.g. cloudflare warp with its client id
+	reserved atomic.Pointer[[3]byte]
+	stopCh   chan int
 
 	cookieGenerator             CookieGenerator
 	trieEntries                 list.List
@@ -81,6 +88,9 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	// create peer
 	peer := new(Peer)
 	peer.stopCh = make(chan int, 1)
+	tricks := defaultTrickParams
+	peer.tricks.Store(&tricks)
+	peer.reserved.Store(new([3]byte))
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
@@ -134,8 +134,7 @@ func (device *Device) RoutineReceiveIncoming(maxBatchSize int, recv conn.Receive
 
 			// check size of packet
 
-			packet := bufsArrs[i][:size]
-			msgType := binary.LittleEndian.Uint32(packet[:4])
+			msgType, packet := device.obfs.Load().classify(bufsArrs[i][:size])
 
 			switch msgType {
 
@@ -10,6 +10,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"math/big"
 	"net"
 	"os"
@@ -87,12 +88,38 @@ func randomInt(min, max int) int {
 	return int(nBig.Int64()) + min
 }
 
+// trickRange is an inclusive range the junk packets of a trick are shaped by.
+type trickRange struct {
+	min, max int
+}
+
+func (r trickRange) random() int {
+	return randomInt(r.min, r.max)
+}
+
+func (r trickRange) String() string {
+	return fmt.Sprintf("%d-%d", r.min, r.max)
+}
+
+// trickParams shape the junk packets a peer with trick enabled sends ahead of
+// handshakes and keepalives.
+type trickParams struct {
+	count trickRange // packets per burst
+	size  trickRange // bytes per packet
+	delay trickRange // milliseconds between packets
+}
+
+var defaultTrickParams = trickParams{
+	count: trickRange{8, 15},
+	size:  trickRange{40, 100},
+	delay: trickRange{20, 250},
+}
+
 func (peer *Peer) sendRandomPackets() {
-	// Generate a random number of packets between 5 and 10
-	numPackets := randomInt(8, 15)
+	tricks := peer.tricks.Load()
+	numPackets := tricks.count.random()
 	for i := 0; i < numPackets; i++ {
-		// Generate a random packet size between 10 and 40 bytes
-		packetSize := randomInt(40, 100)
+		packetSize := tricks.size.random()
 		randomPacket := make([]byte, packetSize)
 		_, err := rand.Read(randomPacket)
 		if err != nil {
@@ -108,8 +135,7 @@ func (peer *Peer) sendRandomPackets() {
 		if i < numPackets-1 && peer.isRunning.Load() && !peer.device.isClosed() {
 			select {
 			case <-peer.stopCh:
-			// Wait for a random duration between 20 and 250 milliseconds
-			case <-time.After(time.Duration(randomInt(20, 250)) * time.Millisecond):
+			case <-time.After(time.Duration(tricks.delay.random()) * time.Millisecond):
 			}
 		}
 	}
@@ -120,7 +146,7 @@ func (peer *Peer) sendRandomPackets() {
 func (peer *Peer) SendKeepalive() {
 	if len(peer.queue.staged) == 0 && peer.isRunning.Load() {
 		// Send some random packets on every keepalive
-		if peer.trick {
+		if peer.trick.Load() {
 			peer.device.log.Verbosef("%v - Running tricks! (keepalive)", peer)
 			peer.sendRandomPackets()
 		}
@@ -159,11 +185,16 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	}
 
 	// send some random packets on handshake
-	if peer.trick {
+	if peer.trick.Load() {
 		peer.device.log.Verbosef("%v - Running tricks! (handshake)", peer)
 		peer.sendRandomPackets()
 	}
 
+	obfs := peer.device.obfs.Load()
+	if err := peer.sendJunkPackets(obfs); err != nil {
+		peer.device.log.Verbosef("%v - Failed to send junk packets: %v", peer, err)
+	}
+
 	peer.handshake.lastSentHandshake = time.Now()
 	peer.handshake.mutex.Unlock()
 
@@ -180,6 +211,12 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	binary.Write(writer, binary.LittleEndian, msg)
 	packet := writer.Bytes()
 	peer.cookieGenerator.AddMacs(packet)
+	peer.setReserved(packet, obfs)
+	packet, err = pad(packet, obfs.initPadding)
+	if err != nil {
+		peer.device.log.Errorf("%v - Failed to pad initiation message: %v", peer, err)
+		return err
+	}
 
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
@@ -211,6 +248,13 @@ func (peer *Peer) SendHandshakeResponse() error {
 	binary.Write(writer, binary.LittleEndian, response)
 	packet := writer.Bytes()
 	peer.cookieGenerator.AddMacs(packet)
+	obfs := peer.device.obfs.Load()
+	peer.setReserved(packet, obfs)
+	packet, err = pad(packet, obfs.responsePadding)
+	if err != nil {
+		peer.device.log.Errorf("%v - Failed to pad response message: %v", peer, err)
+		return err
+	}
 
 	err = peer.BeginSymmetricSession()
 	if err != nil {
@@ -239,6 +283,7 @@ func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement)
 		device.log.Errorf("Failed to create cookie reply: %v", err)
 		return err
 	}
+	reply.Type = device.obfs.Load().header(MessageCookieReplyType)
 
 	var buf [MessageCookieReplySize]byte
 	writer := bytes.NewBuffer(buf[:0])
@@ -508,7 +553,9 @@ func (device *Device) RoutineEncryption(id int) {
 			fieldReceiver := header[4:8]
 			fieldNonce := header[8:16]
 
-			binary.LittleEndian.PutUint32(fieldType, MessageTransportType)
+			obfs := device.obfs.Load()
+			binary.LittleEndian.PutUint32(fieldType, obfs.header(MessageTransportType))
+			elem.peer.setReserved(header, obfs)
 			binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
 			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
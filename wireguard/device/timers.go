@@ -102,10 +102,27 @@ func expiredRetransmitHandshake(peer *Peer) {
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
 		peer.markEndpointSrcForClearing()
 
+		if peer.timers.handshakeAttempts.Load()%FallbackAfterHandshakes == 0 {
+			peer.swapFallbackEndpoint()
+		}
+
 		peer.SendHandshakeInitiation(true)
 	}
 }
 
+// swapFallbackEndpoint moves the peer to its fallback endpoint, if it has
+// one, keeping the current endpoint as the fallback.
+func (peer *Peer) swapFallbackEndpoint() {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+
+	if peer.endpoint.fallback == nil {
+		return
+	}
+	peer.endpoint.val, peer.endpoint.fallback = peer.endpoint.fallback, peer.endpoint.val
+	peer.device.log.Verbosef("%s - Switching to fallback endpoint %s", peer, peer.endpoint.val.DstToString())
+}
+
 func expiredSendKeepalive(peer *Peer) {
 	peer.SendKeepalive()
 	if peer.timers.needAnotherKeepalive.Load() {
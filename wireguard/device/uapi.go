@@ -18,6 +18,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/bepass-org/warp-plus/wireguard/conn"
 	"github.com/bepass-org/warp-plus/wireguard/ipc"
 )
 
@@ -97,6 +98,17 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("fwmark=%d", device.net.fwmark)
 		}
 
+		if obfs := device.obfs.Load(); *obfs != defaultObfuscation {
+			sendf("jc=%d", obfs.junkCount)
+			sendf("jmin=%d", obfs.junkMin)
+			sendf("jmax=%d", obfs.junkMax)
+			sendf("s1=%d", obfs.initPadding)
+			sendf("s2=%d", obfs.responsePadding)
+			for i, h := range obfs.headers {
+				sendf("h%d=%d", i+1, h)
+			}
+		}
+
 		for _, peer := range device.peers.keyMap {
 			// Serialize peer state.
 			peer.handshake.mutex.RLock()
@@ -108,6 +120,9 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			if peer.endpoint.val != nil {
 				sendf("endpoint=%s", peer.endpoint.val.DstToString())
 			}
+			if peer.endpoint.fallback != nil {
+				sendf("fallback_endpoint=%s", peer.endpoint.fallback.DstToString())
+			}
 			peer.endpoint.Unlock()
 
 			nano := peer.lastHandshakeNano.Load()
@@ -119,7 +134,14 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("tx_bytes=%d", peer.txBytes.Load())
 			sendf("rx_bytes=%d", peer.rxBytes.Load())
 			sendf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval.Load())
-			sendf("trick=%t", peer.trick)
+			sendf("trick=%t", peer.trick.Load())
+			tricks := peer.tricks.Load()
+			sendf("trick_count=%s", tricks.count)
+			sendf("trick_size=%s", tricks.size)
+			sendf("trick_delay=%s", tricks.delay)
+			if reserved := peer.reserved.Load(); *reserved != [3]byte{} {
+				sendf("reserved=%d,%d,%d", reserved[0], reserved[1], reserved[2])
+			}
 
 			device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
 				sendf("allowed_ip=%s", prefix.String())
@@ -150,12 +172,16 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 
 	peer := new(ipcSetPeer)
 	deviceConfig := true
+	obfs := *device.obfs.Load()
 
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if line == "" {
 			// Blank line means terminate operation.
+			if deviceConfig {
+				return device.setObfuscation(obfs)
+			}
 			peer.handlePostConfig()
 			return nil
 		}
@@ -167,6 +193,9 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 		if key == "public_key" {
 			if deviceConfig {
 				deviceConfig = false
+				if err := device.setObfuscation(obfs); err != nil {
+					return err
+				}
 			}
 			peer.handlePostConfig()
 			// Load/create the peer we are now configuring.
@@ -179,7 +208,7 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 
 		var err error
 		if deviceConfig {
-			err = device.handleDeviceLine(key, value)
+			err = device.handleDeviceLine(key, value, &obfs)
 		} else {
 			err = device.handlePeerLine(peer, key, value)
 		}
@@ -192,10 +221,28 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 	if err := scanner.Err(); err != nil {
 		return ipcErrorf(ipc.IpcErrorIO, "failed to read input: %w", err)
 	}
+	if deviceConfig {
+		return device.setObfuscation(obfs)
+	}
 	return nil
 }
 
-func (device *Device) handleDeviceLine(key, value string) error {
+// setObfuscation validates and applies the AmneziaWG parameters of an IPC
+// set operation.
+func (device *Device) setObfuscation(obfs obfuscation) error {
+	if obfs == *device.obfs.Load() {
+		return nil
+	}
+	if err := obfs.validate(); err != nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, "invalid obfuscation parameters: %w", err)
+	}
+
+	device.log.Verbosef("UAPI: Updating obfuscation parameters")
+	device.obfs.Store(&obfs)
+	return nil
+}
+
+func (device *Device) handleDeviceLine(key, value string, obfs *obfuscation) error {
 	switch key {
 	case "private_key":
 		var sk NoisePrivateKey
@@ -234,6 +281,31 @@ func (device *Device) handleDeviceLine(key, value string) error {
 			return ipcErrorf(ipc.IpcErrorPortInUse, "failed to update fwmark: %w", err)
 		}
 
+	case "jc", "jmin", "jmax", "s1", "s2":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse %s: %w", key, err)
+		}
+		switch key {
+		case "jc":
+			obfs.junkCount = n
+		case "jmin":
+			obfs.junkMin = n
+		case "jmax":
+			obfs.junkMax = n
+		case "s1":
+			obfs.initPadding = n
+		case "s2":
+			obfs.responsePadding = n
+		}
+
+	case "h1", "h2", "h3", "h4":
+		h, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse %s: %w", key, err)
+		}
+		obfs.headers[key[1]-'1'] = uint32(h)
+
 	case "replace_peers":
 		if value != "true" {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set replace_peers, invalid value: %v", value)
@@ -348,6 +420,20 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		defer peer.endpoint.Unlock()
 		peer.endpoint.val = endpoint
 
+	case "fallback_endpoint":
+		device.log.Verbosef("%v - UAPI: Updating fallback endpoint", peer.Peer)
+		var endpoint conn.Endpoint
+		if value != "" {
+			var err error
+			endpoint, err = device.net.bind.ParseEndpoint(value)
+			if err != nil {
+				return ipcErrorf(ipc.IpcErrorInvalid, "failed to set fallback endpoint %v: %w", value, err)
+			}
+		}
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		peer.endpoint.fallback = endpoint
+
 	case "persistent_keepalive_interval":
 		device.log.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer.Peer)
 
@@ -393,7 +479,32 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		if err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "invalid trick value: %v", value)
 		}
-		peer.trick = parsedBool
+		peer.trick.Store(parsedBool)
+
+	case "trick_count", "trick_size", "trick_delay":
+		device.log.Verbosef("%v - UAPI: Setting %s: %s", peer.Peer, key, value)
+		tricks := *peer.tricks.Load()
+		var err error
+		switch key {
+		case "trick_count":
+			tricks.count, err = parseTrickRange(value, 0, 64)
+		case "trick_size":
+			tricks.size, err = parseTrickRange(value, 1, 1280)
+		case "trick_delay":
+			tricks.delay, err = parseTrickRange(value, 0, 5000)
+		}
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid %s value %v: %w", key, value, err)
+		}
+		peer.tricks.Store(&tricks)
+
+	case "reserved":
+		device.log.Verbosef("%v - UAPI: Setting reserved: %s", peer.Peer, value)
+		reserved, err := parseReserved(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid reserved value %v: %w", value, err)
+		}
+		peer.reserved.Store(&reserved)
 
 	default:
 		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI peer key: %v", key)
@@ -464,3 +575,44 @@ func (device *Device) IpcHandle(socket net.Conn) {
 		buffered.Flush()
 	}
 }
+
+// parseTrickRange parses "min-max", or a single value for a fixed range,
+// within lo and hi.
+func parseTrickRange(value string, lo, hi int) (trickRange, error) {
+	minValue, maxValue, found := strings.Cut(value, "-")
+	if !found {
+		maxValue = minValue
+	}
+
+	var r trickRange
+	var err error
+	if r.min, err = strconv.Atoi(minValue); err != nil {
+		return trickRange{}, err
+	}
+	if r.max, err = strconv.Atoi(maxValue); err != nil {
+		return trickRange{}, err
+	}
+
+	if r.min < lo || r.max > hi || r.min > r.max {
+		return trickRange{}, fmt.Errorf("must be a range within %d-%d", lo, hi)
+	}
+	return r, nil
+}
+
+// parseReserved parses the three reserved bytes of the message headers, given
+// as comma separated numbers like "12,34,56".
+func parseReserved(value string) ([3]byte, error) {
+	var reserved [3]byte
+	fields := strings.Split(value, ",")
+	if len(fields) != len(reserved) {
+		return reserved, errors.New("must be three comma separated bytes")
+	}
+	for i, field := range fields {
+		b, err := strconv.ParseUint(strings.TrimSpace(field), 10, 8)
+		if err != nil {
+			return reserved, err
+		}
+		reserved[i] = byte(b)
+	}
+	return reserved, nil
+}
@@ -19,6 +19,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -47,6 +48,11 @@ type netTun struct {
 	mtu            int
 	dnsServers     []netip.Addr
 	hasV4, hasV6   bool
+	dns64          netip.Prefix
+	preferFamily   int
+	// conns holds a token for every connection DialContext opened that is
+	// still open, nil if they aren't limited
+	conns chan struct{}
 }
 
 type Net netTun
@@ -487,6 +493,7 @@ var (
 	errNumericPort                  = errors.New("port must be numeric")
 	errNoSuitableAddress            = errors.New("no suitable address found")
 	errMissingAddress               = errors.New("missing address")
+	errTooManyConns                 = errors.New("too many open connections")
 )
 
 func (net *Net) LookupHost(host string) (addrs []string, err error) {
@@ -808,6 +815,141 @@ func (tnet *Net) tryOneName(ctx context.Context, name string, qtype dnsmessage.T
 	return dnsmessage.Parser{}, "", lastErr
 }
 
+// EnableDNS64 makes IPv4 destinations reachable from an interface without an
+// IPv4 address, by synthesizing IPv6 addresses in the /96 prefix for them as
+// DNS64 does (RFC 6147). A NAT64 gateway for prefix must be reachable through
+// the tunnel. It has no effect if the interface has an IPv4 address and must
+// be called before tnet is used.
+func (tnet *Net) EnableDNS64(prefix netip.Prefix) {
+	if prefix.Addr().Is6() && prefix.Bits() == 96 {
+		tnet.dns64 = prefix.Masked()
+	}
+}
+
+// PreferFamily makes resolved destinations try their IPv4 addresses first
+// for family 4, or their IPv6 ones for 6, before those of the other family.
+// Zero keeps the default of IPv6 first if the interface has an IPv6 address.
+// It must be called before tnet is used.
+func (tnet *Net) PreferFamily(family int) {
+	tnet.preferFamily = family
+}
+
+// Tuning adjusts the transport protocols of a stack to the links it runs
+// over. The zero value keeps the defaults, which are made for low latency
+// links and hold back TCP on links with a large bandwidth-delay product.
+type Tuning struct {
+	// ReceiveBuffer is the largest TCP receive buffer in bytes. Connections
+	// start with the default of 1 MiB, or ReceiveBuffer if smaller, and
+	// grow their buffer with the data in flight up to it.
+	ReceiveBuffer int
+	// SendBuffer is the TCP send buffer in bytes, 1 MiB by default.
+	SendBuffer int
+	// CongestionControl is the TCP congestion control algorithm, "reno",
+	// the default, or "cubic".
+	CongestionControl string
+	// DisableSACK turns TCP selective acknowledgements off.
+	DisableSACK bool
+	// MaxConnections bounds the connections DialContext has open at once,
+	// dials beyond it fail. Zero means no limit. The connections of the
+	// other Dial and Listen methods aren't counted.
+	MaxConnections int
+}
+
+// CongestionControls returns the valid values of Tuning.CongestionControl.
+func CongestionControls() []string {
+	return []string{"reno", "cubic"}
+}
+
+// Tune applies t to the stack of tnet. It must be called before tnet is
+// used.
+func (tnet *Net) Tune(t Tuning) error {
+	if t.ReceiveBuffer != 0 {
+		if t.ReceiveBuffer < tcp.MinBufferSize {
+			return fmt.Errorf("tcp receive buffer of %d bytes is below the minimum of %d", t.ReceiveBuffer, tcp.MinBufferSize)
+		}
+		opt := tcpip.TCPReceiveBufferSizeRangeOption{
+			Min:     tcp.MinBufferSize,
+			Default: min(t.ReceiveBuffer, tcp.DefaultReceiveBufferSize),
+			Max:     t.ReceiveBuffer,
+		}
+		if err := tnet.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("could not set the TCP receive buffer: %v", err)
+		}
+		moderate := tcpip.TCPModerateReceiveBufferOption(true)
+		if err := tnet.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &moderate); err != nil {
+			return fmt.Errorf("could not enable TCP receive buffer moderation: %v", err)
+		}
+	}
+	if t.SendBuffer != 0 {
+		if t.SendBuffer < tcp.MinBufferSize {
+			return fmt.Errorf("tcp send buffer of %d bytes is below the minimum of %d", t.SendBuffer, tcp.MinBufferSize)
+		}
+		opt := tcpip.TCPSendBufferSizeRangeOption{
+			Min:     tcp.MinBufferSize,
+			Default: t.SendBuffer,
+			Max:     max(t.SendBuffer, tcp.MaxBufferSize),
+		}
+		if err := tnet.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("could not set the TCP send buffer: %v", err)
+		}
+	}
+	if t.CongestionControl != "" {
+		opt := tcpip.CongestionControlOption(t.CongestionControl)
+		if err := tnet.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("unknown TCP congestion control %q, valid values: %s", t.CongestionControl, strings.Join(CongestionControls(), ", "))
+		}
+	}
+	if t.DisableSACK {
+		opt := tcpip.TCPSACKEnabled(false)
+		if err := tnet.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("could not disable TCP SACK: %v", err)
+		}
+	}
+	if t.MaxConnections > 0 {
+		tnet.conns = make(chan struct{}, t.MaxConnections)
+	}
+	return nil
+}
+
+// acquireConn takes a token for a new connection, if they are limited, and
+// returns the func that gives it back.
+func (tnet *Net) acquireConn() (release func(), err error) {
+	if tnet.conns == nil {
+		return func() {}, nil
+	}
+	select {
+	case tnet.conns <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-tnet.conns }) }, nil
+	default:
+		return nil, errTooManyConns
+	}
+}
+
+// limitedConn gives back its connection token once closed.
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	defer c.release()
+	return c.Conn.Close()
+}
+
+// useDNS64 reports whether IPv4 addresses are synthesized into IPv6 ones.
+func (tnet *Net) useDNS64() bool {
+	return tnet.dns64.IsValid() && tnet.hasV6 && !tnet.hasV4
+}
+
+// synthesizeDNS64 embeds the IPv4 address addr in the DNS64 prefix.
+func (tnet *Net) synthesizeDNS64(addr netip.Addr) netip.Addr {
+	b := tnet.dns64.Addr().As16()
+	v4 := addr.As4()
+	copy(b[12:], v4[:])
+	return netip.AddrFrom16(b)
+}
+
 func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string, error) {
 	if host == "" || (!tnet.hasV6 && !tnet.hasV4) {
 		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
@@ -819,6 +961,9 @@ func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string,
 		}
 	}
 	if ip, err := netip.ParseAddr(host[:zlen]); err == nil {
+		if ip.Is4() && tnet.useDNS64() {
+			return []string{tnet.synthesizeDNS64(ip).String()}, nil
+		}
 		return []string{ip.String()}, nil
 	}
 
@@ -831,8 +976,10 @@ func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string,
 		error
 	}
 	var addrsV4, addrsV6 []netip.Addr
+	// with DNS64 A records are still needed to synthesize from
+	queryV4 := tnet.hasV4 || tnet.useDNS64()
 	lanes := 0
-	if tnet.hasV4 {
+	if queryV4 {
 		lanes++
 	}
 	if tnet.hasV6 {
@@ -840,7 +987,7 @@ func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string,
 	}
 	lane := make(chan result, lanes)
 	var lastErr error
-	if tnet.hasV4 {
+	if queryV4 {
 		go func() {
 			p, server, err := tnet.tryOneName(ctx, host+".", dnsmessage.TypeA)
 			lane <- result{p, server, err}
@@ -912,9 +1059,28 @@ func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string,
 			}
 		}
 	}
-	// We don't do RFC6724. Instead just put V6 addresses first if an IPv6 address is enabled
+	// As DNS64 synthesize only if there are no AAAA records. The IPv4
+	// addresses themselves are unreachable.
+	if tnet.useDNS64() {
+		if len(addrsV6) == 0 {
+			for _, a := range addrsV4 {
+				addrsV6 = append(addrsV6, tnet.synthesizeDNS64(a))
+			}
+		}
+		addrsV4 = nil
+	}
+
+	// We don't do RFC6724. Instead just put V6 addresses first if an IPv6 address is enabled,
+	// unless a family is preferred
+	v6First := tnet.hasV6
+	switch tnet.preferFamily {
+	case 4:
+		v6First = false
+	case 6:
+		v6First = true
+	}
 	var addrs []netip.Addr
-	if tnet.hasV6 {
+	if v6First {
 		addrs = append(addrsV6, addrsV4...)
 	} else {
 		addrs = append(addrsV4, addrsV6...)
@@ -998,6 +1164,11 @@ func (tnet *Net) DialContext(ctx context.Context, network, address string) (net.
 		return nil, &net.OpError{Op: "dial", Err: errNoSuitableAddress}
 	}
 
+	release, err := tnet.acquireConn()
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Err: err}
+	}
+
 	var firstErr error
 	for i, addr := range addrs {
 		select {
@@ -1008,6 +1179,7 @@ func (tnet *Net) DialContext(ctx context.Context, network, address string) (net.
 			} else if err == context.DeadlineExceeded {
 				err = errTimeout
 			}
+			release()
 			return nil, &net.OpError{Op: "dial", Err: err}
 		default:
 		}
@@ -1038,12 +1210,16 @@ func (tnet *Net) DialContext(ctx context.Context, network, address string) (net.
 			c, err = tnet.DialPingAddr(netip.Addr{}, addr.Addr())
 		}
 		if err == nil {
+			if tnet.conns != nil {
+				c = &limitedConn{Conn: c, release: release}
+			}
 			return c, nil
 		}
 		if firstErr == nil {
 			firstErr = err
 		}
 	}
+	release()
 	if firstErr == nil {
 		firstErr = &net.OpError{Op: "dial", Err: errMissingAddress}
 	}
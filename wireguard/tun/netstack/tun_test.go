@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun"
+)
+
+const testMTU = 1420
+
+func TestTuneRejectsInvalidValues(t *testing.T) {
+	for _, tuning := range []Tuning{
+		{ReceiveBuffer: 1024},
+		{SendBuffer: 1024},
+		{CongestionControl: "bbr"},
+	} {
+		_, tnet, err := CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil, testMTU)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tnet.Tune(tuning); err == nil {
+			t.Errorf("Tune(%+v) succeeded", tuning)
+		}
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	_, tnet, err := CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil, testMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tnet.Tune(Tuning{MaxConnections: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// udp sockets open without a packet on the wire
+	c, err := tnet.DialContext(context.Background(), "udp", "10.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tnet.DialContext(context.Background(), "udp", "10.0.0.2:53"); !errors.Is(err, errTooManyConns) {
+		t.Fatalf("second dial: got %v, want %v", err, errTooManyConns)
+	}
+
+	c.Close()
+	c.Close()
+	c, err = tnet.DialContext(context.Background(), "udp", "10.0.0.2:53")
+	if err != nil {
+		t.Fatalf("dial after close: %v", err)
+	}
+	c.Close()
+}
+
+// link hands the packets the stack of from sends to the stack of to after
+// delay.
+func link(from, to tun.Device, delay time.Duration) {
+	type packet struct {
+		data []byte
+		at   time.Time
+	}
+	queue := make(chan packet, 8192)
+
+	go func() {
+		defer close(queue)
+		sizes := make([]int, 1)
+		for {
+			buf := make([]byte, testMTU)
+			if _, err := from.Read([][]byte{buf}, sizes, 0); err != nil {
+				return
+			}
+			queue <- packet{buf[:sizes[0]], time.Now().Add(delay)}
+		}
+	}()
+	go func() {
+		for p := range queue {
+			time.Sleep(time.Until(p.at))
+			to.Write([][]byte{p.data}, 0)
+		}
+	}()
+}
+
+// benchmarkThroughput measures a TCP upload between two stacks tuned with
+// tuning over a link with rtt.
+func benchmarkThroughput(b *testing.B, tuning Tuning, rtt time.Duration) {
+	clientAddr, serverAddr := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	clientDev, client, err := CreateNetTUN([]netip.Addr{clientAddr}, nil, testMTU)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer clientDev.Close()
+	serverDev, server, err := CreateNetTUN([]netip.Addr{serverAddr}, nil, testMTU)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer serverDev.Close()
+	for _, tnet := range []*Net{client, server} {
+		if err := tnet.Tune(tuning); err != nil {
+			b.Fatal(err)
+		}
+	}
+	link(clientDev, serverDev, rtt/2)
+	link(serverDev, clientDev, rtt/2)
+
+	ln, err := server.ListenTCPAddrPort(netip.AddrPortFrom(serverAddr, 80))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			received <- err
+			return
+		}
+		defer c.Close()
+		_, err = io.Copy(io.Discard, c)
+		received <- err
+	}()
+
+	conn, err := client.DialContextTCPAddrPort(context.Background(), netip.AddrPortFrom(serverAddr, 80))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 64<<10)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// the upload is done once the server has read it all
+	if err := conn.CloseWrite(); err != nil {
+		b.Fatal(err)
+	}
+	if err := <-received; err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkTCPThroughput compares the default stack with one tuned for a
+// link with a large bandwidth-delay product, e.g.
+//
+//	go test -bench TCPThroughput -benchtime 64x ./wireguard/tun/netstack
+func BenchmarkTCPThroughput(b *testing.B) {
+	tuned := Tuning{
+		ReceiveBuffer:     16 << 20,
+		SendBuffer:        16 << 20,
+		CongestionControl: "cubic",
+	}
+	for _, rtt := range []time.Duration{0, 50 * time.Millisecond, 200 * time.Millisecond} {
+		b.Run("default/rtt="+rtt.String(), func(b *testing.B) {
+			benchmarkThroughput(b, Tuning{}, rtt)
+		})
+		b.Run("tuned/rtt="+rtt.String(), func(b *testing.B) {
+			benchmarkThroughput(b, tuned, rtt)
+		})
+	}
+}
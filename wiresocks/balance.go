@@ -0,0 +1,281 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// Ways StartBalancedProxy spreads requests over its tunnels.
+const (
+	// BalanceRoundRobin sends each request to the next tunnel.
+	BalanceRoundRobin = "round-robin"
+	// BalanceAffinity maps each destination host to the same tunnel for as
+	// long as the set of tunnels doesn't change, so the destination always
+	// sees the same egress address.
+	BalanceAffinity = "affinity"
+	// BalanceLatency sends new destination hosts to the tunnels in proportion
+	// to how fast and reliably they connect, and keeps a host on its tunnel
+	// while it is in use.
+	BalanceLatency = "latency"
+)
+
+// BalanceModes returns the valid modes of StartBalancedProxy.
+func BalanceModes() []string {
+	return []string{BalanceRoundRobin, BalanceAffinity, BalanceLatency}
+}
+
+const (
+	// stickyTTL is how long a destination host stays on its tunnel in latency
+	// mode after its last request.
+	stickyTTL = 10 * time.Minute
+	// maxSticky bounds the hosts remembered in latency mode.
+	maxSticky = 4096
+	// failureHalfLife is how fast dial failures of a tunnel are forgotten.
+	failureHalfLife = 30 * time.Second
+)
+
+// pathStats is what latency mode knows about a tunnel.
+type pathStats struct {
+	// rtt is a moving average of the time TCP connections through the
+	// tunnel take to open, which is about a round trip to the destination.
+	rtt time.Duration
+	// failures counts recent dial failures, halving every failureHalfLife
+	// since updated.
+	failures float64
+	updated  time.Time
+}
+
+// recentFailures returns the failures decayed to now.
+func (p *pathStats) recentFailures(now time.Time) float64 {
+	if p.failures == 0 {
+		return 0
+	}
+	return p.failures * math.Exp2(-float64(now.Sub(p.updated))/float64(failureHalfLife))
+}
+
+// stickyPath is the tunnel a destination host is kept on.
+type stickyPath struct {
+	index   int
+	expires time.Time
+}
+
+// balancer spreads proxy requests over several tunnels.
+type balancer struct {
+	tunnels []*VirtualTun
+	mode    string
+	next    atomic.Uint32
+
+	mu     sync.Mutex
+	paths  []pathStats
+	sticky map[string]stickyPath
+}
+
+func newBalancer(tunnels []*VirtualTun, mode string) *balancer {
+	return &balancer{
+		tunnels: tunnels,
+		mode:    mode,
+		paths:   make([]pathStats, len(tunnels)),
+		sticky:  make(map[string]stickyPath),
+	}
+}
+
+// pick returns the index of the tunnel for a request to destination.
+func (b *balancer) pick(destination string) int {
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = destination
+	}
+
+	switch b.mode {
+	case BalanceAffinity:
+		// the highest hash of host and tunnel index wins. The tunnels of a
+		// balancer never change, so a host keeps its tunnel, across restarts
+		// too as long as the tunnels are passed in the same order
+		best, bestScore := 0, uint64(0)
+		for i := range b.tunnels {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(host + "#" + strconv.Itoa(i)))
+			if score := h.Sum64(); i == 0 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		return best
+	case BalanceLatency:
+		return b.pickByLatency(host, time.Now())
+	default:
+		return int((b.next.Add(1) - 1) % uint32(len(b.tunnels)))
+	}
+}
+
+// pickByLatency returns the tunnel host is kept on or else picks one at
+// random, weighted by the inverse of its round trip time and recent failures.
+func (b *balancer) pickByLatency(host string, now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s, ok := b.sticky[host]; ok && now.Before(s.expires) {
+		s.expires = now.Add(stickyTTL)
+		b.sticky[host] = s
+		return s.index
+	}
+
+	// tunnels without a measurement yet compete with the fastest one, so
+	// they get traffic to be measured with
+	var fastest time.Duration
+	for _, p := range b.paths {
+		if p.rtt > 0 && (fastest == 0 || p.rtt < fastest) {
+			fastest = p.rtt
+		}
+	}
+	if fastest == 0 {
+		fastest = time.Millisecond
+	}
+
+	weights := make([]float64, len(b.paths))
+	var total float64
+	for i, p := range b.paths {
+		rtt := p.rtt
+		if rtt == 0 {
+			rtt = fastest
+		}
+		f := 1 + p.recentFailures(now)
+		weights[i] = 1 / (rtt.Seconds() * f * f)
+		total += weights[i]
+	}
+
+	index, r := len(weights)-1, rand.Float64()*total
+	for i, w := range weights {
+		if r < w {
+			index = i
+			break
+		}
+		r -= w
+	}
+
+	if len(b.sticky) >= maxSticky {
+		for h, s := range b.sticky {
+			if !now.Before(s.expires) {
+				delete(b.sticky, h)
+			}
+		}
+		if len(b.sticky) >= maxSticky {
+			clear(b.sticky)
+		}
+	}
+	b.sticky[host] = stickyPath{index: index, expires: now.Add(stickyTTL)}
+
+	return index
+}
+
+// record adds a dial through tunnel index to host that took d and failed with
+// err, if not nil. A failed host is moved on to a new pick.
+func (b *balancer) record(index int, host, network string, d time.Duration, err error) {
+	if b.mode != BalanceLatency {
+		return
+	}
+
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p := &b.paths[index]
+	p.failures = p.recentFailures(now)
+	p.updated = now
+	if err != nil {
+		p.failures++
+		if s, ok := b.sticky[host]; ok && s.index == index {
+			delete(b.sticky, host)
+		}
+		return
+	}
+
+	// datagram sockets open without a round trip
+	if !strings.HasPrefix(network, "tcp") {
+		return
+	}
+	if p.rtt == 0 {
+		p.rtt = d
+	} else {
+		p.rtt = (7*p.rtt + d) / 8
+	}
+}
+
+// dialer returns a dialFunc through the tunnel at index that records its
+// dials.
+func (b *balancer) dialer(index int) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+
+		start := time.Now()
+		conn, err := b.tunnels[index].Tnet.DialContext(ctx, network, address)
+		b.record(index, host, network, time.Since(start), err)
+		return conn, err
+	}
+}
+
+// StartBalancedProxy serves the mixed proxy on bindAddresses and spreads
+// requests over tunnels as mode, one of BalanceModes, says. The tunnels are
+// stopped once ctx is done and the proxy connections finished or
+// opts.DrainTimeout passed.
+func StartBalancedProxy(ctx context.Context, l *slog.Logger, bindAddresses []netip.AddrPort, tunnels []*VirtualTun, mode string, opts ProxyOptions) ([]netip.AddrPort, error) {
+	if len(tunnels) == 0 {
+		return nil, errors.New("no tunnels to balance")
+	}
+	switch mode {
+	case "":
+		mode = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceAffinity, BalanceLatency:
+	default:
+		return nil, fmt.Errorf("unknown balance mode %q", mode)
+	}
+
+	b := newBalancer(tunnels, mode)
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return b.dialer(b.pick(address))(ctx, network, address)
+	}
+	var drain drainGroup
+	bound, err := serveMixed(ctx, bindAddresses, opts.UnixSockets, append([]mixed.Option{
+		mixed.WithLogger(l.With("subsystem", "proxy")),
+		mixed.WithContext(ctx),
+		mixed.WithUserHandler(func(request *statute.ProxyRequest) error {
+			defer drain.track()()
+			i := b.pick(request.Destination)
+			vt := tunnels[i]
+			opts.redirectDNS(l, request, vt.DNS)
+			defer opts.Stats.track(request)()
+			opts.Limits.limit(request)
+			return vt.handle(request, b.dialer(i))
+		}),
+	}, opts.mixedOptions(dial)...))
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		drain.wait(l, opts.DrainTimeout)
+		for _, vt := range tunnels {
+			vt.Stop()
+		}
+	}()
+
+	return bound, nil
+}
@@ -0,0 +1,72 @@
+package wiresocks
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestBalancerAffinity(t *testing.T) {
+	b := newBalancer(make([]*VirtualTun, 3), BalanceAffinity)
+	for i := 0; i < 20; i++ {
+		host := "host" + strconv.Itoa(i) + ".example"
+		qt.Assert(t, b.pick(host+":443"), qt.Equals, b.pick(host+":80"))
+	}
+}
+
+func TestBalancerLatency(t *testing.T) {
+	b := newBalancer(make([]*VirtualTun, 2), BalanceLatency)
+	b.record(0, "a.example", "tcp", 200*time.Millisecond, nil)
+	b.record(1, "b.example", "tcp", 10*time.Millisecond, nil)
+	// udp sockets don't say anything about latency
+	b.record(1, "b.example", "udp", time.Second, nil)
+
+	var fast int
+	for i := 0; i < 1000; i++ {
+		if b.pick("host"+strconv.Itoa(i)+".example:443") == 1 {
+			fast++
+		}
+	}
+	qt.Assert(t, fast > 900, qt.IsTrue, qt.Commentf("%d of 1000 on the fast tunnel", fast))
+
+	// hosts stay on their tunnel
+	for i := 0; i < 50; i++ {
+		host := "host" + strconv.Itoa(i) + ".example"
+		qt.Assert(t, b.pick(host+":80"), qt.Equals, b.pick(host+":443"))
+	}
+
+	// until a connection through it fails
+	host := "host0.example"
+	index := b.pick(host + ":443")
+	for i := 0; i < 5; i++ {
+		b.record(index, host, "tcp", 0, errors.New("timeout"))
+	}
+	b.mu.Lock()
+	_, ok := b.sticky[host]
+	b.mu.Unlock()
+	qt.Assert(t, ok, qt.IsFalse)
+
+	b = newBalancer(make([]*VirtualTun, 2), BalanceLatency)
+	b.record(0, "a.example", "tcp", 10*time.Millisecond, nil)
+	b.record(1, "b.example", "tcp", 10*time.Millisecond, nil)
+	for i := 0; i < 3; i++ {
+		b.record(1, "b.example", "tcp", 0, errors.New("refused"))
+	}
+	var reliable int
+	for i := 0; i < 1000; i++ {
+		if b.pick("host"+strconv.Itoa(i)+".example:443") == 0 {
+			reliable++
+		}
+	}
+	qt.Assert(t, reliable > 800, qt.IsTrue, qt.Commentf("%d of 1000 on the reliable tunnel", reliable))
+}
+
+func TestPathStatsFailuresDecay(t *testing.T) {
+	now := time.Now()
+	p := pathStats{failures: 4, updated: now}
+	qt.Assert(t, p.recentFailures(now), qt.Equals, 4.0)
+	qt.Assert(t, p.recentFailures(now.Add(failureHalfLife)), qt.Equals, 2.0)
+}
@@ -0,0 +1,60 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+	"golang.org/x/net/proxy"
+)
+
+// StartChainProxy serves the mixed proxy on bindAddresses and forwards every
+// tcp request to the socks5 proxy at upstream. It lets modes whose final hop
+// is a third-party socks server (e.g. psiphon) present the same local
+// interface as the other modes.
+func StartChainProxy(ctx context.Context, l *slog.Logger, bindAddresses []netip.AddrPort, upstream netip.AddrPort, opts ProxyOptions) ([]netip.AddrPort, error) {
+	dialer, err := proxy.SOCKS5("tcp", upstream.String(), nil, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+
+	return serveMixed(ctx, bindAddresses, opts.UnixSockets, append([]mixed.Option{
+		mixed.WithLogger(l.With("subsystem", "proxy")),
+		mixed.WithContext(ctx),
+		mixed.WithUserHandler(func(req *statute.ProxyRequest) error {
+			// the upstream's resolvers are unknown, fall back to the
+			// defaults
+			opts.redirectDNS(l, req, nil)
+			defer opts.Stats.track(req)()
+			opts.Limits.limit(req)
+			return chainHandler(l, dialer, req)
+		}),
+	}, opts.mixedOptions(dialer.(proxy.ContextDialer).DialContext)...))
+}
+
+func chainHandler(l *slog.Logger, dialer proxy.Dialer, req *statute.ProxyRequest) error {
+	defer req.Conn.Close()
+
+	if req.Network != "tcp" {
+		return fmt.Errorf("unsupported network %s for chained proxy", req.Network)
+	}
+
+	if req.Serve != nil {
+		return req.Serve(req.Conn)
+	}
+
+	l.Debug("handling connection", "protocol", req.Network, "destination", req.Destination)
+	conn, err := dialer.Dial(req.Network, req.Destination)
+	if err != nil {
+		return err
+	}
+
+	if err := relay(req.Conn, conn); err != nil {
+		l.Debug(err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package wiresocks
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// ClientStats counts the connections and traffic of the proxy clients. It
+// is safe for concurrent use and may be shared by several proxies.
+type ClientStats struct {
+	mu      sync.Mutex
+	clients map[netip.Addr]*clientCounters
+	conns   map[*countingConn]struct{}
+}
+
+type clientCounters struct {
+	active, total    int
+	rxBytes, txBytes uint64
+	lastSeen         time.Time
+}
+
+// ClientTraffic is the traffic of one client address. TxBytes were sent by
+// the client through the proxy, RxBytes came back to it.
+type ClientTraffic struct {
+	Addr        netip.Addr
+	Active      int
+	Connections int
+	RxBytes     uint64
+	TxBytes     uint64
+	LastSeen    time.Time
+}
+
+// ConnTraffic is the traffic of one open proxy connection so far.
+type ConnTraffic struct {
+	Client      netip.AddrPort
+	Network     string
+	Destination string
+	Started     time.Time
+	RxBytes     uint64
+	TxBytes     uint64
+}
+
+// NewClientStats returns empty client stats.
+func NewClientStats() *ClientStats {
+	return &ClientStats{
+		clients: make(map[netip.Addr]*clientCounters),
+		conns:   make(map[*countingConn]struct{}),
+	}
+}
+
+// Clients returns the traffic of every client seen so far, busiest first.
+func (s *ClientStats) Clients() []ClientTraffic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]ClientTraffic, 0, len(s.clients))
+	for addr, c := range s.clients {
+		res = append(res, ClientTraffic{
+			Addr:        addr,
+			Active:      c.active,
+			Connections: c.total,
+			RxBytes:     c.rxBytes,
+			TxBytes:     c.txBytes,
+			LastSeen:    c.lastSeen,
+		})
+	}
+	// the bytes of open connections are only added once they close
+	for conn := range s.conns {
+		i := slices.IndexFunc(res, func(c ClientTraffic) bool { return c.Addr == conn.client.Addr() })
+		res[i].RxBytes += conn.rx.Load()
+		res[i].TxBytes += conn.tx.Load()
+	}
+
+	slices.SortFunc(res, func(a, b ClientTraffic) int {
+		switch {
+		case a.RxBytes+a.TxBytes > b.RxBytes+b.TxBytes:
+			return -1
+		case a.RxBytes+a.TxBytes < b.RxBytes+b.TxBytes:
+			return 1
+		default:
+			return a.Addr.Compare(b.Addr)
+		}
+	})
+	return res
+}
+
+// Conns returns the traffic of the open connections, oldest first.
+func (s *ClientStats) Conns() []ConnTraffic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]ConnTraffic, 0, len(s.conns))
+	for conn := range s.conns {
+		res = append(res, ConnTraffic{
+			Client:      conn.client,
+			Network:     conn.network,
+			Destination: conn.destination,
+			Started:     conn.started,
+			RxBytes:     conn.rx.Load(),
+			TxBytes:     conn.tx.Load(),
+		})
+	}
+
+	slices.SortFunc(res, func(a, b ConnTraffic) int {
+		return a.Started.Compare(b.Started)
+	})
+	return res
+}
+
+// track counts the traffic of req from now until the returned func is
+// called. It does nothing on nil stats.
+func (s *ClientStats) track(req *statute.ProxyRequest) func() {
+	if s == nil {
+		return func() {}
+	}
+
+	conn := &countingConn{
+		Conn:        req.Conn,
+		stats:       s,
+		client:      clientAddr(req.Conn),
+		network:     req.Network,
+		destination: req.Destination,
+		started:     time.Now(),
+	}
+
+	s.mu.Lock()
+	c, ok := s.clients[conn.client.Addr()]
+	if !ok {
+		c = &clientCounters{}
+		s.clients[conn.client.Addr()] = c
+	}
+	c.active++
+	c.total++
+	c.lastSeen = conn.started
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	req.Conn, req.Reader, req.Writer = conn, conn, conn
+	return conn.finish
+}
+
+// done moves the traffic of conn to its client once it is finished.
+func (s *ClientStats) done(conn *countingConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+	c := s.clients[conn.client.Addr()]
+	c.active--
+	c.rxBytes += conn.rx.Load()
+	c.txBytes += conn.tx.Load()
+	c.lastSeen = time.Now()
+}
+
+// clientAddr returns the address of the client on the other end of conn.
+// The datagram connections of socks5 UDP associate report the client as
+// their source address.
+func clientAddr(conn net.Conn) netip.AddrPort {
+	addr := conn.RemoteAddr()
+	if src, ok := conn.(interface{ SourceAddr() net.Addr }); ok {
+		addr = src.SourceAddr()
+	}
+
+	var addrPort netip.AddrPort
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		addrPort = a.AddrPort()
+	case *net.UDPAddr:
+		addrPort = a.AddrPort()
+	}
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
+
+// countingConn counts the bytes read from and written to a client
+// connection.
+type countingConn struct {
+	net.Conn
+	stats *ClientStats
+
+	client      netip.AddrPort
+	network     string
+	destination string
+	started     time.Time
+
+	tx, rx     atomic.Uint64
+	finishOnce sync.Once
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.tx.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.rx.Add(uint64(n))
+	return n, err
+}
+
+// finish moves the traffic of the connection to its client. It is called
+// once the handler returned rather than on Close, as a spliced relay counts
+// the bytes it copied after the connection is closed.
+func (c *countingConn) finish() {
+	c.finishOnce.Do(func() { c.stats.done(c) })
+}
@@ -0,0 +1,53 @@
+package wiresocks
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClientStats(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	qt.Assert(t, err, qt.IsNil)
+	defer client.Close()
+
+	server, err := ln.Accept()
+	qt.Assert(t, err, qt.IsNil)
+
+	stats := NewClientStats()
+	req := &statute.ProxyRequest{Conn: server, Network: "tcp", Destination: "example.com:443"}
+	finish := stats.track(req)
+
+	_, err = client.Write([]byte("hello"))
+	qt.Assert(t, err, qt.IsNil)
+	_, err = io.ReadFull(req.Conn, make([]byte, 5))
+	qt.Assert(t, err, qt.IsNil)
+	_, err = req.Conn.Write([]byte("hi"))
+	qt.Assert(t, err, qt.IsNil)
+
+	conns := stats.Conns()
+	qt.Assert(t, conns, qt.HasLen, 1)
+	qt.Assert(t, conns[0].Destination, qt.Equals, "example.com:443")
+	qt.Assert(t, conns[0].TxBytes, qt.Equals, uint64(5))
+	qt.Assert(t, conns[0].RxBytes, qt.Equals, uint64(2))
+
+	qt.Assert(t, req.Conn.Close(), qt.IsNil)
+	finish()
+
+	qt.Assert(t, stats.Conns(), qt.HasLen, 0)
+	clients := stats.Clients()
+	qt.Assert(t, clients, qt.HasLen, 1)
+	qt.Assert(t, clients[0].Addr, qt.Equals, netip.MustParseAddr("127.0.0.1"))
+	qt.Assert(t, clients[0].Active, qt.Equals, 0)
+	qt.Assert(t, clients[0].Connections, qt.Equals, 1)
+	qt.Assert(t, clients[0].TxBytes, qt.Equals, uint64(5))
+	qt.Assert(t, clients[0].RxBytes, qt.Equals, uint64(2))
+}
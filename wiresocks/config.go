@@ -5,8 +5,13 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/netip"
+	"strconv"
+	"strings"
 
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
 	"github.com/go-ini/ini"
 )
 
@@ -14,9 +19,54 @@ type PeerConfig struct {
 	PublicKey    string
 	PreSharedKey string
 	Endpoint     string
-	KeepAlive    int
-	AllowedIPs   []netip.Prefix
-	Trick        bool
+	// FallbackEndpoint, if set, is switched to when handshakes with Endpoint
+	// time out, and back again if it fails too. It is meant for an endpoint
+	// of the other IP family.
+	FallbackEndpoint string
+	KeepAlive        int
+	AllowedIPs       []netip.Prefix
+	Trick            bool
+	Tricks           TrickConfig // shapes the junk packets sent with Trick
+	// Reserved fills the reserved bytes of the message headers, e.g. with
+	// the client id of a warp identity. It can't be combined with H1 to H4.
+	Reserved [3]byte
+}
+
+// TrickConfig shapes the junk packets a peer with Trick sends ahead of
+// handshakes and keepalives. Every field is a "min-max" range or a single
+// number, empty keeps the default.
+type TrickConfig struct {
+	Count string `json:"count,omitempty"` // packets per burst, default 8-15
+	Size  string `json:"size,omitempty"`  // bytes per packet, default 40-100
+	Delay string `json:"delay,omitempty"` // milliseconds between packets, default 20-250
+}
+
+// Validate checks the syntax of the ranges. Their bounds are checked when
+// the tunnel starts.
+func (c TrickConfig) Validate() error {
+	for _, field := range []struct{ name, value string }{
+		{"count", c.Count},
+		{"size", c.Size},
+		{"delay", c.Delay},
+	} {
+		if field.value == "" {
+			continue
+		}
+
+		minValue, maxValue, found := strings.Cut(field.value, "-")
+		if !found {
+			maxValue = minValue
+		}
+		lo, err := strconv.Atoi(minValue)
+		if err != nil {
+			return fmt.Errorf("invalid trick %s %q", field.name, field.value)
+		}
+		hi, err := strconv.Atoi(maxValue)
+		if err != nil || lo < 0 || lo > hi {
+			return fmt.Errorf("invalid trick %s %q", field.name, field.value)
+		}
+	}
+	return nil
 }
 
 type InterfaceConfig struct {
@@ -24,11 +74,70 @@ type InterfaceConfig struct {
 	Addresses  []netip.Addr
 	DNS        []netip.Addr
 	MTU        int
+	// DNS64 is the NAT64 prefix IPv4 destinations are mapped into if none
+	// of Addresses is IPv4, defaults to iputils.WellKnownNAT64Prefix.
+	DNS64 netip.Prefix
+	// PreferFamily, 4 or 6, is the IP family of a destination host's
+	// addresses dialed first. Zero dials IPv6 first if one of Addresses is
+	// IPv6.
+	PreferFamily int
+	// Amnezia obfuscates the tunnel the way AmneziaWG does; the peers must
+	// use the same parameters.
+	Amnezia AmneziaConfig
+}
+
+// AmneziaConfig holds the AmneziaWG obfuscation parameters of an interface,
+// named as in AmneziaWG profiles. Zero fields keep the wireguard defaults.
+type AmneziaConfig struct {
+	Jc   int // junk packets sent ahead of each handshake initiation
+	Jmin int // minimum junk packet size
+	Jmax int // maximum junk packet size
+	S1   int // random bytes prepended to handshake initiations
+	S2   int // random bytes prepended to handshake responses
+	// H1 to H4 replace the message types of initiations, responses,
+	// cookie replies and transport packets.
+	H1, H2, H3, H4 uint32
+}
+
+// hasHeaders reports whether the message types are replaced.
+func (c AmneziaConfig) hasHeaders() bool {
+	return c.H1 != 0 || c.H2 != 0 || c.H3 != 0 || c.H4 != 0
+}
+
+// ipcKeys returns the uapi device keys of the fields that are set.
+func (c AmneziaConfig) ipcKeys() []string {
+	var keys []string
+	for _, field := range []struct {
+		key   string
+		value int64
+	}{
+		{"jc", int64(c.Jc)},
+		{"jmin", int64(c.Jmin)},
+		{"jmax", int64(c.Jmax)},
+		{"s1", int64(c.S1)},
+		{"s2", int64(c.S2)},
+		{"h1", int64(c.H1)},
+		{"h2", int64(c.H2)},
+		{"h3", int64(c.H3)},
+		{"h4", int64(c.H4)},
+	} {
+		if field.value != 0 {
+			keys = append(keys, fmt.Sprintf("%s=%d", field.key, field.value))
+		}
+	}
+	return keys
 }
 
 type Configuration struct {
 	Interface *InterfaceConfig
 	Peers     []PeerConfig
+	// Upstream, if set, relays the tunnel's datagrams through a socks5 proxy
+	Upstream *UpstreamProxy
+	// UAPI, if set, is the name of the uapi socket the device is exposed on,
+	// e.g. for wg show
+	UAPI string
+	// Stack tunes the TCP of the tunnel's netstack
+	Stack netstack.Tuning
 }
 
 func encodeBase64ToHex(key string) (string, error) {
@@ -42,65 +151,144 @@ func encodeBase64ToHex(key string) (string, error) {
 	return hex.EncodeToString(decoded), nil
 }
 
+const (
+	// minConfigMTU and maxConfigMTU bound the MTU of a config: IPv6 needs
+	// 1280, and nothing larger than 65535 fits in an IP packet.
+	minConfigMTU = 1280
+	maxConfigMTU = 65535
+)
+
+// defaultDNS is used by configs without a DNS key.
+var defaultDNS = []netip.Addr{netip.MustParseAddr("1.1.1.1")}
+
+// parseErrors collects the problems found in a config, so all of them are
+// reported at once instead of only the first.
+type parseErrors []error
+
+func (e *parseErrors) addf(format string, args ...any) {
+	*e = append(*e, fmt.Errorf(format, args...))
+}
+
+func (e parseErrors) err() error {
+	return errors.Join(e...)
+}
+
+// singleKey returns the key name of section, which may appear only once, or
+// nil if it is missing. A repeated key is reported to errs.
+func singleKey(section *ini.Section, label, name string, errs *parseErrors) *ini.Key {
+	key, err := section.GetKey(name)
+	if err != nil {
+		return nil
+	}
+	if n := len(key.ValueWithShadows()); n > 1 {
+		errs.addf("%s: %s is set %d times", label, name, n)
+	}
+	return key
+}
+
+// intKey parses the key name of section as an integer between lo and hi,
+// reporting problems to errs. It returns def if the key is missing.
+func intKey(section *ini.Section, label, name string, lo, hi, def int, errs *parseErrors) int {
+	key := singleKey(section, label, name, errs)
+	if key == nil {
+		return def
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(key.String()))
+	if err != nil || value < lo || value > hi {
+		errs.addf("%s: %s must be a number between %d and %d, got %q", label, name, lo, hi, key.String())
+		return def
+	}
+	return value
+}
+
 // ParseInterface parses the [Interface] section
 func ParseInterface(cfg *ini.File) (InterfaceConfig, error) {
-	device := InterfaceConfig{}
 	interfaces, err := cfg.SectionsByName("Interface")
 	if len(interfaces) != 1 || err != nil {
 		return InterfaceConfig{}, errors.New("only one [Interface] is expected")
 	}
 	iface := interfaces[0]
 
-	key := iface.Key("Address")
-	if key == nil {
-		return InterfaceConfig{}, nil
+	const label = "[Interface]"
+	var (
+		device InterfaceConfig
+		errs   parseErrors
+	)
+
+	if key := singleKey(iface, label, "PrivateKey", &errs); key == nil {
+		errs.addf("%s: PrivateKey is required", label)
+	} else if device.PrivateKey, err = encodeBase64ToHex(key.String()); err != nil {
+		errs.addf("%s: PrivateKey: %w", label, err)
 	}
 
-	var addresses []netip.Addr
-	for _, str := range key.StringsWithShadows(",") {
-		prefix, err := netip.ParsePrefix(str)
-		if err != nil {
-			return InterfaceConfig{}, err
+	if key, err := iface.GetKey("Address"); err != nil {
+		errs.addf("%s: Address is required", label)
+	} else {
+		for _, str := range key.StringsWithShadows(",") {
+			prefix, err := netip.ParsePrefix(str)
+			if err != nil {
+				errs.addf("%s: invalid Address %q, expected an address with a prefix length like 172.16.0.2/32", label, str)
+				continue
+			}
+			device.Addresses = append(device.Addresses, prefix.Addr())
+		}
+		if len(key.StringsWithShadows(",")) == 0 {
+			errs.addf("%s: Address is empty", label)
 		}
-
-		addresses = append(addresses, prefix.Addr())
 	}
-	device.Addresses = addresses
 
-	key = iface.Key("PrivateKey")
-	if key == nil {
-		return InterfaceConfig{}, errors.New("PrivateKey should not be empty")
+	if key, err := iface.GetKey("DNS"); err == nil {
+		for _, str := range key.StringsWithShadows(",") {
+			ip, err := netip.ParseAddr(str)
+			if err != nil {
+				errs.addf("%s: invalid DNS %q, expected an IP address", label, str)
+				continue
+			}
+			device.DNS = append(device.DNS, ip)
+		}
 	}
-
-	privateKeyHex, err := encodeBase64ToHex(key.String())
-	if err != nil {
-		return InterfaceConfig{}, err
+	if len(device.DNS) == 0 {
+		device.DNS = defaultDNS
 	}
-	device.PrivateKey = privateKeyHex
 
-	key = iface.Key("DNS")
-	if key == nil {
-		return InterfaceConfig{}, nil
-	}
+	device.MTU = intKey(iface, label, "MTU", minConfigMTU, maxConfigMTU, 0, &errs)
 
-	addresses = []netip.Addr{}
-	for _, str := range key.StringsWithShadows(",") {
-		ip, err := netip.ParseAddr(str)
-		if err != nil {
-			return InterfaceConfig{}, err
-		}
-		addresses = append(addresses, ip)
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{
+		{"Jc", &device.Amnezia.Jc},
+		{"Jmin", &device.Amnezia.Jmin},
+		{"Jmax", &device.Amnezia.Jmax},
+		{"S1", &device.Amnezia.S1},
+		{"S2", &device.Amnezia.S2},
+	} {
+		*field.value = intKey(iface, label, field.name, 0, math.MaxUint16, 0, &errs)
 	}
-	device.DNS = addresses
 
-	if sectionKey, err := iface.GetKey("MTU"); err == nil {
-		value, err := sectionKey.Int()
-		if err != nil {
-			return InterfaceConfig{}, err
+	for _, field := range []struct {
+		name  string
+		value *uint32
+	}{
+		{"H1", &device.Amnezia.H1},
+		{"H2", &device.Amnezia.H2},
+		{"H3", &device.Amnezia.H3},
+		{"H4", &device.Amnezia.H4},
+	} {
+		if key := singleKey(iface, label, field.name, &errs); key != nil {
+			value, err := strconv.ParseUint(strings.TrimSpace(key.String()), 10, 32)
+			if err != nil {
+				errs.addf("%s: %s must be a number between 0 and %d, got %q", label, field.name, uint32(math.MaxUint32), key.String())
+				continue
+			}
+			*field.value = uint32(value)
 		}
-		device.MTU = value
 	}
 
+	if err := errs.err(); err != nil {
+		return InterfaceConfig{}, err
+	}
 	return device, nil
 }
 
@@ -111,60 +299,128 @@ func ParsePeers(cfg *ini.File) ([]PeerConfig, error) {
 		return nil, errors.New("at least one [Peer] is expected")
 	}
 
+	var errs parseErrors
 	peers := make([]PeerConfig, len(sections))
 	for i, section := range sections {
+		label := "[Peer]"
+		if len(sections) > 1 {
+			label = fmt.Sprintf("[Peer] %d", i+1)
+		}
+
 		peer := PeerConfig{
 			PreSharedKey: "0000000000000000000000000000000000000000000000000000000000000000",
 			KeepAlive:    0,
 		}
 
-		if sectionKey, err := section.GetKey("PublicKey"); err == nil {
-			value, err := encodeBase64ToHex(sectionKey.String())
-			if err != nil {
-				return nil, err
-			}
-			peer.PublicKey = value
+		if key := singleKey(section, label, "PublicKey", &errs); key == nil {
+			errs.addf("%s: PublicKey is required", label)
+		} else if peer.PublicKey, err = encodeBase64ToHex(key.String()); err != nil {
+			errs.addf("%s: PublicKey: %w", label, err)
 		}
 
-		if sectionKey, err := section.GetKey("PreSharedKey"); err == nil {
-			value, err := encodeBase64ToHex(sectionKey.String())
+		if key := singleKey(section, label, "PreSharedKey", &errs); key != nil {
+			value, err := encodeBase64ToHex(key.String())
 			if err != nil {
-				return nil, err
+				errs.addf("%s: PreSharedKey: %w", label, err)
+			} else {
+				peer.PreSharedKey = value
 			}
-			peer.PreSharedKey = value
 		}
 
-		if sectionKey, err := section.GetKey("PersistentKeepalive"); err == nil {
-			value, err := sectionKey.Int()
-			if err != nil {
-				return nil, err
-			}
-			peer.KeepAlive = value
-		}
+		peer.KeepAlive = intKey(section, label, "PersistentKeepalive", 0, math.MaxUint16, 0, &errs)
 
-		if sectionKey, err := section.GetKey("AllowedIPs"); err == nil {
-			var ips []netip.Prefix
-			for _, str := range sectionKey.StringsWithShadows(",") {
+		if key, err := section.GetKey("AllowedIPs"); err == nil {
+			for _, str := range key.StringsWithShadows(",") {
 				prefix, err := netip.ParsePrefix(str)
 				if err != nil {
-					return nil, err
+					errs.addf("%s: invalid AllowedIPs %q, expected a prefix like 0.0.0.0/0", label, str)
+					continue
 				}
-				ips = append(ips, prefix)
+				peer.AllowedIPs = append(peer.AllowedIPs, prefix)
 			}
-			peer.AllowedIPs = ips
 		}
 
-		if sectionKey, err := section.GetKey("Endpoint"); err == nil {
-			peer.Endpoint = sectionKey.String()
+		if key := singleKey(section, label, "Reserved", &errs); key != nil {
+			reserved, err := ParseReserved(key.String())
+			if err != nil {
+				errs.addf("%s: %w", label, err)
+			} else {
+				peer.Reserved = reserved
+			}
+		}
+
+		if key := singleKey(section, label, "Endpoint", &errs); key != nil {
+			host, port, err := net.SplitHostPort(key.String())
+			if _, portErr := strconv.ParseUint(port, 10, 16); err != nil || host == "" || portErr != nil {
+				errs.addf("%s: invalid Endpoint %q, expected host:port", label, key.String())
+			} else {
+				peer.Endpoint = key.String()
+			}
 		}
 
 		peers[i] = peer
 	}
 
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
 	return peers, nil
 }
 
-// ParseConfig takes the path of a configuration file and parses it into Configuration
+// ParseReserved parses the reserved bytes of a peer, given as three comma
+// separated numbers like "12,34,56" or as a base64 warp client id.
+func ParseReserved(value string) ([3]byte, error) {
+	var reserved [3]byte
+	invalid := fmt.Errorf("invalid reserved bytes %q, expected three numbers like 12,34,56 or a base64 client id", value)
+
+	fields := strings.Split(value, ",")
+	if len(fields) == 1 {
+		id, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(id) != len(reserved) {
+			return reserved, invalid
+		}
+		copy(reserved[:], id)
+		return reserved, nil
+	}
+
+	if len(fields) != len(reserved) {
+		return reserved, invalid
+	}
+	for i, field := range fields {
+		b, err := strconv.ParseUint(strings.TrimSpace(field), 10, 8)
+		if err != nil {
+			return reserved, invalid
+		}
+		reserved[i] = byte(b)
+	}
+	return reserved, nil
+}
+
+// SetReserved replaces the reserved bytes of every peer, see
+// PeerConfig.Reserved.
+func (c *Configuration) SetReserved(reserved [3]byte) error {
+	for i := range c.Peers {
+		c.Peers[i].Reserved = reserved
+	}
+	return c.checkReserved()
+}
+
+// checkReserved checks that no peer has reserved bytes if the message types
+// are replaced, as the headers then have none.
+func (c *Configuration) checkReserved() error {
+	if !c.Interface.Amnezia.hasHeaders() {
+		return nil
+	}
+	for _, peer := range c.Peers {
+		if peer.Reserved != [3]byte{} {
+			return errors.New("reserved bytes can't be combined with H1 to H4, the headers have none")
+		}
+	}
+	return nil
+}
+
+// ParseConfig takes the path of a configuration file and parses it into Configuration.
+// A non-empty endpoint replaces the endpoints of all peers.
 func ParseConfig(path string, endpoint string) (*Configuration, error) {
 	iniOpt := ini.LoadOptions{
 		Insensitive:            true,
@@ -177,19 +433,21 @@ func ParseConfig(path string, endpoint string) (*Configuration, error) {
 		return nil, err
 	}
 
-	iface, err := ParseInterface(cfg)
-	if err != nil {
-		return nil, err
-	}
-
-	peers, err := ParsePeers(cfg)
-	if err != nil {
-		return nil, err
+	iface, ifaceErr := ParseInterface(cfg)
+	peers, peersErr := ParsePeers(cfg)
+	if err := errors.Join(ifaceErr, peersErr); err != nil {
+		return nil, fmt.Errorf("invalid wireguard config %s:\n%w", path, err)
 	}
-	for i, peer := range peers {
-		peer.Endpoint = endpoint
-		peers[i] = peer
+	if endpoint != "" {
+		for i, peer := range peers {
+			peer.Endpoint = endpoint
+			peers[i] = peer
+		}
 	}
 
-	return &Configuration{Interface: &iface, Peers: peers}, nil
+	conf := &Configuration{Interface: &iface, Peers: peers}
+	if err := conf.checkReserved(); err != nil {
+		return nil, fmt.Errorf("invalid wireguard config %s:\n[Peer]: %w", path, err)
+	}
+	return conf, nil
 }
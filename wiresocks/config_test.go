@@ -2,6 +2,7 @@ package wiresocks
 
 import (
 	"net/netip"
+	"strings"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
@@ -49,7 +50,7 @@ func TestParseInterface(t *testing.T) {
 		DNS: []netip.Addr{netip.MustParseAddr("8.8.8.8")},
 		MTU: 0,
 	}
-	qt.Assert(t, device, qt.CmpEquals(cmpopts.EquateComparable(netip.Addr{})), want)
+	qt.Assert(t, device, qt.CmpEquals(cmpopts.EquateComparable(netip.Addr{}, netip.Prefix{})), want)
 	t.Logf("%+v", device)
 }
 
@@ -80,3 +81,137 @@ func TestParsePeers(t *testing.T) {
 	qt.Assert(t, peers, qt.CmpEquals(cmpopts.EquateComparable(netip.Prefix{})), want)
 	t.Logf("%+v", peers)
 }
+
+func TestParseInterfaceAmnezia(t *testing.T) {
+	opts := ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+	}
+
+	cfg, err := ini.LoadSources(opts, []byte(strings.Replace(testConfig, "[Peer]", `Jc = 4
+Jmin = 40
+Jmax = 70
+S1 = 15
+S2 = 68
+H1 = 1020325451
+H2 = 3288052141
+H3 = 1766607858
+H4 = 2528465083
+[Peer]`, 1)))
+	qt.Assert(t, err, qt.IsNil)
+
+	device, err := ParseInterface(cfg)
+	qt.Assert(t, err, qt.IsNil)
+
+	want := AmneziaConfig{
+		Jc: 4, Jmin: 40, Jmax: 70, S1: 15, S2: 68,
+		H1: 1020325451, H2: 3288052141, H3: 1766607858, H4: 2528465083,
+	}
+	qt.Assert(t, device.Amnezia, qt.Equals, want)
+}
+
+func TestParsePeersReserved(t *testing.T) {
+	opts := ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+	}
+
+	for _, tt := range []struct {
+		value string
+		want  [3]byte
+		err   string
+	}{
+		{value: "12, 34, 56", want: [3]byte{12, 34, 56}},
+		{value: "DCI4", want: [3]byte{12, 34, 56}},
+		{value: "12, 34", err: `\[Peer\]: invalid reserved bytes "12, 34", .*`},
+		{value: "12, 34, 256", err: `\[Peer\]: invalid reserved bytes "12, 34, 256", .*`},
+		{value: "DCI4DCI4", err: `\[Peer\]: invalid reserved bytes "DCI4DCI4", .*`},
+	} {
+		cfg, err := ini.LoadSources(opts, []byte(testConfig+"Reserved = "+tt.value+"\n"))
+		qt.Assert(t, err, qt.IsNil)
+
+		peers, err := ParsePeers(cfg)
+		if tt.err != "" {
+			qt.Assert(t, err, qt.ErrorMatches, tt.err)
+			continue
+		}
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, peers[0].Reserved, qt.Equals, tt.want)
+	}
+}
+
+func TestSetReservedAmnezia(t *testing.T) {
+	conf := &Configuration{
+		Interface: &InterfaceConfig{Amnezia: AmneziaConfig{H1: 5, H2: 6, H3: 7, H4: 8}},
+		Peers:     []PeerConfig{{}},
+	}
+	qt.Assert(t, conf.SetReserved([3]byte{}), qt.IsNil)
+	qt.Assert(t, conf.SetReserved([3]byte{1, 2, 3}), qt.ErrorMatches, `reserved bytes can't be combined with H1 to H4.*`)
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	opts := ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+	}
+
+	cfg, err := ini.LoadSources(opts, []byte(`
+[Interface]
+PrivateKey = not base64
+PrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=
+Address = 172.16.0.2
+MTU = 99999
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+Endpoint = 162.159.192.1
+`))
+	qt.Assert(t, err, qt.IsNil)
+
+	_, err = ParseInterface(cfg)
+	qt.Assert(t, err, qt.ErrorMatches, `(?s)\[Interface\]: PrivateKey is set 2 times.*`+
+		`\[Interface\]: PrivateKey: invalid base64 string.*`+
+		`\[Interface\]: invalid Address "172.16.0.2".*`+
+		`\[Interface\]: MTU must be a number between 1280 and 65535, got "99999"`)
+
+	_, err = ParsePeers(cfg)
+	qt.Assert(t, err, qt.ErrorMatches, `\[Peer\]: invalid Endpoint "162.159.192.1", expected host:port`)
+}
+
+func FuzzParseConfig(f *testing.F) {
+	opts := ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+	}
+
+	f.Add([]byte(testConfig))
+	f.Add([]byte(strings.Replace(testConfig, "[Peer]", "MTU = 1280\nJc = 4\nH1 = 5\n[Peer]\nPersistentKeepalive = 25", 1)))
+	f.Add([]byte("[Interface]\nPrivateKey = =\nAddress = ,\n[Peer]\n[Peer]\nEndpoint = :"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cfg, err := ini.LoadSources(opts, data)
+		if err != nil {
+			return
+		}
+
+		if device, err := ParseInterface(cfg); err == nil {
+			if len(device.PrivateKey) != 64 || len(device.Addresses) == 0 || len(device.DNS) == 0 {
+				t.Fatalf("incomplete interface without an error: %+v", device)
+			}
+			if device.MTU != 0 && (device.MTU < minConfigMTU || device.MTU > maxConfigMTU) {
+				t.Fatalf("mtu %d out of range", device.MTU)
+			}
+		}
+
+		if peers, err := ParsePeers(cfg); err == nil {
+			for _, peer := range peers {
+				if len(peer.PublicKey) != 64 || len(peer.PreSharedKey) != 64 {
+					t.Fatalf("invalid peer keys without an error: %+v", peer)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package wiresocks
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// DNS redirect modes, see ProxyOptions.DNSRedirect.
+const (
+	// DNSRedirectOff forwards DNS queries to the resolver the client asked
+	// for.
+	DNSRedirectOff = "off"
+	// DNSRedirectTunnel sends DNS queries for resolvers other than the
+	// tunnel's own to the tunnel's resolvers.
+	DNSRedirectTunnel = "tunnel"
+	// DNSRedirectCloudflare sends every DNS query to 1.1.1.1.
+	DNSRedirectCloudflare = "cloudflare"
+)
+
+// DNSRedirectModes returns the valid values of ProxyOptions.DNSRedirect.
+func DNSRedirectModes() []string {
+	return []string{DNSRedirectOff, DNSRedirectTunnel, DNSRedirectCloudflare}
+}
+
+var cloudflareDNS = netip.MustParseAddr("1.1.1.1")
+
+// redirectDNS returns the destination a proxy request for dest is sent to.
+// Requests to port 53 are moved to resolvers, or to defaultDNS without any,
+// according to mode; other requests keep their destination.
+func redirectDNS(mode, dest string, resolvers []netip.Addr) string {
+	if mode == "" || mode == DNSRedirectOff {
+		return dest
+	}
+
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil || port != "53" {
+		return dest
+	}
+
+	if mode == DNSRedirectCloudflare {
+		return netip.AddrPortFrom(cloudflareDNS, 53).String()
+	}
+
+	if len(resolvers) == 0 {
+		resolvers = defaultDNS
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err == nil && slices.Contains(resolvers, addr.Unmap()) {
+		return dest
+	}
+
+	// stay in the family the client asked for, if the tunnel has a
+	// resolver of it
+	resolver := resolvers[0]
+	for _, r := range resolvers {
+		if err == nil && r.Is4() == addr.Unmap().Is4() {
+			resolver = r
+			break
+		}
+	}
+	return netip.AddrPortFrom(resolver, 53).String()
+}
+
+// redirectDNS points req at the resolver redirectDNS picks for it.
+func (o ProxyOptions) redirectDNS(l *slog.Logger, req *statute.ProxyRequest, resolvers []netip.Addr) {
+	dest := redirectDNS(o.DNSRedirect, req.Destination, resolvers)
+	if dest != req.Destination {
+		l.Debug("redirecting dns query", "protocol", req.Network, "from", req.Destination, "to", dest)
+		req.Destination = dest
+	}
+}
@@ -0,0 +1,35 @@
+package wiresocks
+
+import (
+	"net/netip"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRedirectDNS(t *testing.T) {
+	resolvers := []netip.Addr{
+		netip.MustParseAddr("1.1.1.1"),
+		netip.MustParseAddr("2606:4700:4700::1111"),
+	}
+
+	tests := []struct {
+		mode, dest, want string
+	}{
+		{DNSRedirectOff, "192.168.1.1:53", "192.168.1.1:53"},
+		{DNSRedirectTunnel, "192.168.1.1:53", "1.1.1.1:53"},
+		{DNSRedirectTunnel, "[2001:4860:4860::8888]:53", "[2606:4700:4700::1111]:53"},
+		{DNSRedirectTunnel, "dns.google:53", "1.1.1.1:53"},
+		{DNSRedirectTunnel, "[2606:4700:4700::1111]:53", "[2606:4700:4700::1111]:53"},
+		{DNSRedirectTunnel, "8.8.8.8:443", "8.8.8.8:443"},
+		{DNSRedirectCloudflare, "[2001:4860:4860::8888]:53", "1.1.1.1:53"},
+	}
+
+	for _, test := range tests {
+		got := redirectDNS(test.mode, test.dest, resolvers)
+		qt.Check(t, got, qt.Equals, test.want, qt.Commentf("%s %s", test.mode, test.dest))
+	}
+
+	// tunnels without resolvers fall back to the defaults
+	qt.Assert(t, redirectDNS(DNSRedirectTunnel, "9.9.9.9:53", nil), qt.Equals, "1.1.1.1:53")
+}
@@ -0,0 +1,42 @@
+package wiresocks
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// drainGroup counts the connections a proxy is serving, so the tunnels
+// behind it can stay up until they are done.
+type drainGroup struct {
+	active atomic.Int64
+}
+
+// track counts a connection until the returned func is called.
+func (g *drainGroup) track() func() {
+	g.active.Add(1)
+	return func() { g.active.Add(-1) }
+}
+
+// wait waits up to timeout for the tracked connections to finish and reports
+// whether they did.
+func (g *drainGroup) wait(l *slog.Logger, timeout time.Duration) bool {
+	if g.active.Load() == 0 {
+		return true
+	}
+	if timeout <= 0 {
+		return false
+	}
+
+	l.Info("draining proxy connections", "active", g.active.Load(), "timeout", timeout)
+
+	deadline := time.Now().Add(timeout)
+	for g.active.Load() > 0 {
+		if time.Now().After(deadline) {
+			l.Warn("drain timed out, closing proxy connections", "active", g.active.Load())
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,27 @@
+package wiresocks
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDrainGroup(t *testing.T) {
+	l := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var g drainGroup
+	qt.Assert(t, g.wait(l, 0), qt.IsTrue)
+
+	done := g.track()
+	qt.Assert(t, g.wait(l, 0), qt.IsFalse)
+	qt.Assert(t, g.wait(l, 150*time.Millisecond), qt.IsFalse)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		done()
+	}()
+	qt.Assert(t, g.wait(l, time.Second), qt.IsTrue)
+}
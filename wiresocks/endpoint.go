@@ -0,0 +1,103 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+// PingWarp completes a warp handshake with endpoint through the tunnel, with
+// the peer key of the wireguard profile at profile, and returns its round
+// trip time. The handshake uses a throwaway private key: one of the
+// identity's own would make warp roam its live session to the probe.
+func (vt *VirtualTun) PingWarp(ctx context.Context, endpoint netip.AddrPort, profile string) (time.Duration, error) {
+	_, publicKey, err := profileKeys(profile)
+	if err != nil {
+		return 0, err
+	}
+	privateKey, err := warp.GeneratePrivateKey()
+	if err != nil {
+		return 0, err
+	}
+
+	local := netip.IPv4Unspecified()
+	if endpoint.Addr().Is6() && !endpoint.Addr().Is4In6() {
+		local = netip.IPv6Unspecified()
+	}
+	listen := func(context.Context) (net.PacketConn, error) {
+		return vt.Tnet.ListenUDPAddrPort(netip.AddrPortFrom(local, 0))
+	}
+
+	return ipscanner.PingWarp(ctx, endpoint, privateKey.String(), publicKey, listen)
+}
+
+// UpdateEndpoint points the peer of the tunnel at endpoint and handshakes
+// with it right away. The netstack and the connections on it stay up, they
+// only see a short stall while the new session is set up.
+func (vt *VirtualTun) UpdateEndpoint(endpoint netip.AddrPort) error {
+	peers, err := vt.PeerStatus()
+	if err != nil {
+		return err
+	}
+	if len(peers) != 1 {
+		return fmt.Errorf("can't update the endpoint of a tunnel with %d peers", len(peers))
+	}
+
+	request := fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", peers[0].PublicKey, endpoint)
+	if err := vt.Dev.IpcSet(request); err != nil {
+		return fmt.Errorf("failed to set endpoint: %w", err)
+	}
+
+	var key device.NoisePublicKey
+	if err := key.FromHex(peers[0].PublicKey); err != nil {
+		return err
+	}
+	peer := vt.Dev.LookupPeer(key)
+	if peer == nil {
+		return errors.New("peer was removed while updating its endpoint")
+	}
+
+	// the session keys belong to the old endpoint, which may be a different
+	// server, so start over instead of waiting for the rekey timeout
+	peer.ExpireCurrentKeypairs()
+	return peer.SendHandshakeInitiation(false)
+}
+
+// SetPrivateKey replaces the private key of the tunnel with key, in base64,
+// and handshakes with the new key right away. Like UpdateEndpoint it keeps
+// the netstack and its connections up.
+func (vt *VirtualTun) SetPrivateKey(key string) error {
+	hexKey, err := encodeBase64ToHex(key)
+	if err != nil {
+		return err
+	}
+	if err := vt.Dev.IpcSet(fmt.Sprintf("private_key=%s\n", hexKey)); err != nil {
+		return fmt.Errorf("failed to set private key: %w", err)
+	}
+
+	peers, err := vt.PeerStatus()
+	if err != nil {
+		return err
+	}
+	for _, p := range peers {
+		var pub device.NoisePublicKey
+		if err := pub.FromHex(p.PublicKey); err != nil {
+			return err
+		}
+		if peer := vt.Dev.LookupPeer(pub); peer != nil {
+			// the sessions of the old key are refused by the server
+			peer.ExpireCurrentKeypairs()
+			if err := peer.SendHandshakeInitiation(false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
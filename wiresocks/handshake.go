@@ -0,0 +1,55 @@
+package wiresocks
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"time"
+)
+
+// WaitHandshake blocks until every peer of the tunnel has completed a
+// handshake, or until ctx is done.
+func (vt *VirtualTun) WaitHandshake(ctx context.Context) error {
+	t := time.NewTicker(250 * time.Millisecond)
+	defer t.Stop()
+
+	for {
+		ok, err := vt.handshakeCompleted()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// handshakeCompleted reports whether all peers have a non-zero last
+// handshake time.
+func (vt *VirtualTun) handshakeCompleted() (bool, error) {
+	state, err := vt.Dev.IpcGet()
+	if err != nil {
+		return false, err
+	}
+
+	peers := 0
+	scanner := bufio.NewScanner(strings.NewReader(state))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != "last_handshake_time_sec" {
+			continue
+		}
+		if value == "0" {
+			return false, nil
+		}
+		peers++
+	}
+
+	return peers > 0, scanner.Err()
+}
@@ -0,0 +1,131 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// ProxyOptions configures the local proxy served by StartProxy,
+// StartChainProxy and StartBalancedProxy.
+type ProxyOptions struct {
+	// Coalesce sends plain HTTP proxy requests over a shared pool of
+	// keep-alive upstream connections, saving a handshake through the
+	// tunnel for every client connection. CONNECT requests are not affected.
+	Coalesce bool
+	// Username and Password, if Username is set, are required from proxy
+	// clients through socks5 username/password or http basic authentication.
+	Username string
+	Password string
+	// DNSRedirect keeps clients from reaching resolvers of their own
+	// choosing, see the DNSRedirect modes. Empty means DNSRedirectOff.
+	DNSRedirect string
+	// Stats, if set, counts the connections and traffic of every client.
+	// A connection served by Coalesce counts towards the destination of its
+	// first request.
+	Stats *ClientStats
+	// Limits, if set, caps the throughput of the clients.
+	Limits *RateLimits
+	// Conns, if set, caps the number of client connections.
+	Conns *mixed.ConnLimiter
+	// IdleTimeout, if set, closes client connections nothing was sent or
+	// received on for that long. Their relay can't be spliced.
+	IdleTimeout time.Duration
+	// DrainTimeout is how long the tunnels stay up for the open client
+	// connections to finish once the proxy stops accepting new ones, unless
+	// they are stopped first, as restarts do. Zero stops them at once.
+	DrainTimeout time.Duration
+	// UnixSockets are paths of unix domain sockets the proxy listens on
+	// besides the bind addresses. Clients connecting through them have no
+	// address, so they share the per address limits and statistics, and
+	// can't use socks5 UDP associate.
+	UnixSockets []string
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// mixedOptions returns the mixed proxy options for o, with upstream
+// connections opened by dial.
+func (o ProxyOptions) mixedOptions(dial dialFunc) []mixed.Option {
+	var opts []mixed.Option
+	if o.Coalesce {
+		opts = append(opts, mixed.WithHTTPTransport(&http.Transport{
+			DialContext:         dial,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+			DisableCompression:  true,
+		}))
+	}
+	if o.Conns != nil {
+		opts = append(opts, mixed.WithConnLimiter(o.Conns))
+	}
+	if o.IdleTimeout > 0 {
+		opts = append(opts, mixed.WithIdleTimeout(o.IdleTimeout))
+	}
+	if o.Username != "" {
+		opts = append(opts, mixed.WithCredentials(&statute.Credentials{
+			Username: o.Username,
+			Password: o.Password,
+		}))
+	}
+	return opts
+}
+
+// serveMixed serves a mixed proxy with opts on a listener per address in
+// bindAddresses and per unix socket path in sockets until ctx is done, and
+// returns the addresses actually bound. Either all listeners are bound or
+// none are.
+func serveMixed(ctx context.Context, bindAddresses []netip.AddrPort, sockets []string, opts []mixed.Option) ([]netip.AddrPort, error) {
+	if len(bindAddresses) == 0 && len(sockets) == 0 {
+		return nil, errors.New("no bind address")
+	}
+
+	listeners := make([]net.Listener, 0, len(bindAddresses)+len(sockets))
+	closeAll := func() {
+		for _, ln := range listeners {
+			_ = ln.Close()
+		}
+	}
+
+	for _, bindAddress := range bindAddresses {
+		ln, err := net.Listen("tcp", bindAddress.String())
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	for _, path := range sockets {
+		ln, err := listenUnix(path)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	bound := make([]netip.AddrPort, 0, len(bindAddresses))
+	for _, ln := range listeners {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			bound = append(bound, addr.AddrPort())
+		}
+
+		proxy := mixed.NewProxy(append([]mixed.Option{mixed.WithListener(ln)}, opts...)...)
+		go func() {
+			_ = proxy.ListenAndServe()
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		closeAll()
+	}()
+
+	return bound, nil
+}
@@ -2,10 +2,10 @@ package wiresocks
 
 import (
 	"context"
-	"io"
 	"log/slog"
 	"net"
 	"net/netip"
+	"sync"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
@@ -15,77 +15,86 @@ import (
 
 // VirtualTun stores a reference to netstack network and DNS configuration
 type VirtualTun struct {
-	Tnet      *netstack.Net
-	Logger    *slog.Logger
-	Dev       *device.Device
-	Ctx       context.Context
-}
+	Tnet   *netstack.Net
+	Logger *slog.Logger
+	Dev    *device.Device
+	Ctx    context.Context
+	// DNS are the resolvers of the tunnel's interface
+	DNS []netip.Addr
 
-// StartProxy spawns a socks5 server.
-func (vt *VirtualTun) StartProxy(bindAddress netip.AddrPort) (netip.AddrPort, error) {
-	ln, err := net.Listen("tcp", bindAddress.String())
-	if err != nil {
-		return netip.AddrPort{}, err // Return error if binding was unsuccessful
-	}
+	// uapi, if set, serves the uapi socket of Dev
+	uapi     net.Listener
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
 
-	proxy := mixed.NewProxy(
-		mixed.WithListener(ln),
-		mixed.WithLogger(vt.Logger),
+// StartProxy spawns a socks5 server on each of bindAddresses. Once vt.Ctx is
+// done the listeners are closed and the tunnel is stopped, after the proxy
+// connections finished or opts.DrainTimeout passed.
+func (vt *VirtualTun) StartProxy(bindAddresses []netip.AddrPort, opts ProxyOptions) ([]netip.AddrPort, error) {
+	var drain drainGroup
+	bound, err := serveMixed(vt.Ctx, bindAddresses, opts.UnixSockets, append([]mixed.Option{
+		mixed.WithLogger(vt.Logger.With("subsystem", "proxy")),
 		mixed.WithContext(vt.Ctx),
 		mixed.WithUserHandler(func(request *statute.ProxyRequest) error {
+			defer drain.track()()
+			opts.redirectDNS(vt.Logger, request, vt.DNS)
+			defer opts.Stats.track(request)()
+			opts.Limits.limit(request)
 			return vt.generalHandler(request)
 		}),
-	)
-	go func() {
-		_ = proxy.ListenAndServe()
-	}()
+	}, opts.mixedOptions(vt.Tnet.DialContext)...))
+	if err != nil {
+		return nil, err // Return error if binding was unsuccessful
+	}
+
 	go func() {
 		<-vt.Ctx.Done()
+		drain.wait(vt.Logger, opts.DrainTimeout)
 		vt.Stop()
 	}()
 
-	return ln.Addr().(*net.TCPAddr).AddrPort(), nil
+	return bound, nil
 }
 
 func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest) error {
+	return vt.handle(req, vt.Tnet.DialContext)
+}
+
+// handle serves req, connecting to its destination with dial.
+func (vt *VirtualTun) handle(req *statute.ProxyRequest, dial dialFunc) error {
+	if req.Serve != nil {
+		return req.Serve(req.Conn)
+	}
+
 	vt.Logger.Info("handling connection", "protocol", req.Network, "destination", req.Destination)
-	conn, err := vt.Tnet.Dial(req.Network, req.Destination)
+	conn, err := dial(context.Background(), req.Network, req.Destination)
 	if err != nil {
 		return err
 	}
-	// Close the connections when this function exits
-	defer conn.Close()
-	defer req.Conn.Close()
-	// Channel to notify when copy operation is done
-	done := make(chan error, 1)
-	// Copy data from req.Conn to conn
-	go func() {
-		_, err := io.Copy(conn, req.Conn)
-		done <- err
-	}()
-	// Copy data from conn to req.Conn
-	go func() {
-		_, err := io.Copy(req.Conn, conn)
-		done <- err
-	}()
-	// Wait for one of the copy operations to finish
-	err = <-done
-	if err != nil {
+	// relay closes both connections once either side is done
+	if err := relay(req.Conn, conn); err != nil {
 		vt.Logger.Warn(err.Error())
 	}
 
-	// Close connections and wait for the other copy operation to finish
-	conn.Close()
-	req.Conn.Close()
-	<-done
-
 	return nil
 }
 
 func (vt *VirtualTun) Stop() {
-	if vt.Dev != nil {
-		if err := vt.Dev.Down(); err != nil {
-			vt.Logger.Warn(err.Error())
+	vt.stopOnce.Do(func() {
+		if vt.uapi != nil {
+			_ = vt.uapi.Close()
 		}
-	}
+		if vt.Dev != nil {
+			if err := vt.Dev.Down(); err != nil {
+				vt.Logger.Warn(err.Error())
+			}
+		}
+		close(vt.stopped)
+	})
+}
+
+// Done returns a channel that is closed once the tunnel is stopped.
+func (vt *VirtualTun) Done() <-chan struct{} {
+	return vt.stopped
 }
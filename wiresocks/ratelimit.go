@@ -0,0 +1,176 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+	"golang.org/x/time/rate"
+)
+
+// minRateBurst is the smallest burst of a rate limit, so slow limits don't
+// cut the copy loops into tiny reads and writes.
+const minRateBurst = 16 << 10
+
+// RateLimits caps the throughput of the proxy clients with token buckets.
+// It is safe for concurrent use and may be shared by several proxies.
+type RateLimits struct {
+	up, down  int
+	perClient bool
+
+	mu      sync.Mutex
+	shared  *rateBuckets
+	clients map[netip.Addr]*rateBuckets
+}
+
+// rateBuckets are the buckets of one group of connections, nil for an
+// unlimited direction.
+type rateBuckets struct {
+	up, down *rate.Limiter
+}
+
+// NewRateLimits limits the bytes per second sent by the clients to up and
+// received by them to down, zero meaning no limit. The limits are shared by
+// all clients, or with perClient apply to every client address on its own.
+// It returns nil if neither direction is limited.
+func NewRateLimits(up, down int, perClient bool) *RateLimits {
+	if up <= 0 && down <= 0 {
+		return nil
+	}
+
+	r := &RateLimits{up: up, down: down, perClient: perClient}
+	if perClient {
+		r.clients = make(map[netip.Addr]*rateBuckets)
+	} else {
+		r.shared = r.newBuckets()
+	}
+	return r
+}
+
+func (r *RateLimits) newBuckets() *rateBuckets {
+	b := &rateBuckets{}
+	if r.up > 0 {
+		b.up = rate.NewLimiter(rate.Limit(r.up), max(r.up, minRateBurst))
+	}
+	if r.down > 0 {
+		b.down = rate.NewLimiter(rate.Limit(r.down), max(r.down, minRateBurst))
+	}
+	return b
+}
+
+// buckets returns the buckets of the client at addr.
+func (r *RateLimits) buckets(addr netip.Addr) *rateBuckets {
+	if !r.perClient {
+		return r.shared
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.clients[addr]
+	if !ok {
+		b = r.newBuckets()
+		r.clients[addr] = b
+	}
+	return b
+}
+
+// limit makes the connection of req wait for the buckets of its client. It
+// does nothing on nil limits.
+func (r *RateLimits) limit(req *statute.ProxyRequest) {
+	if r == nil {
+		return
+	}
+
+	conn := &limitedConn{Conn: req.Conn, buckets: r.buckets(clientAddr(req.Conn).Addr())}
+	req.Conn, req.Reader, req.Writer = conn, conn, conn
+}
+
+// ParseRate parses a rate in bytes per second with an optional K, M or G
+// suffix, powers of 1024, e.g. "512K" or "2M".
+func ParseRate(raw string) (int, error) {
+	n, ok := parseBytes(raw)
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q, expected bytes per second like 512K or 2M", raw)
+	}
+	return n, nil
+}
+
+// ParseSize parses a size in bytes with an optional K, M or G suffix, powers
+// of 1024, e.g. "256K" or "4M".
+func ParseSize(raw string) (int, error) {
+	n, ok := parseBytes(raw)
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q, expected bytes like 256K or 4M", raw)
+	}
+	return n, nil
+}
+
+// parseBytes parses a number of bytes with an optional K, M or G suffix and
+// an optional B after it.
+func parseBytes(raw string) (int, bool) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(raw)), "B")
+
+	unit := 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return int(n * float64(unit)), true
+}
+
+// limitedConn is a client connection whose reads wait for the up bucket and
+// writes for the down bucket.
+type limitedConn struct {
+	net.Conn
+	buckets *rateBuckets
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if c.buckets.up == nil {
+		return c.Conn.Read(b)
+	}
+
+	n, err := c.Conn.Read(b[:min(len(b), c.buckets.up.Burst())])
+	if n > 0 {
+		_ = c.buckets.up.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	if c.buckets.down == nil {
+		return c.Conn.Write(b)
+	}
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), c.buckets.down.Burst())]
+		_ = c.buckets.down.WaitN(context.Background(), len(chunk))
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,36 @@
+package wiresocks
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"1000", 1000},
+		{"512K", 512 << 10},
+		{"2m", 2 << 20},
+		{"1.5MB", 3 << 19},
+		{"1G", 1 << 30},
+	}
+	for _, test := range tests {
+		got, err := ParseRate(test.in)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Check(t, got, qt.Equals, test.want, qt.Commentf("%s", test.in))
+	}
+
+	for _, in := range []string{"", "fast", "-1M", "2T"} {
+		_, err := ParseRate(in)
+		qt.Check(t, err, qt.IsNotNil, qt.Commentf("%s", in))
+	}
+
+	size, err := ParseSize("4M")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, size, qt.Equals, 4<<20)
+	_, err = ParseSize("4 megs")
+	qt.Assert(t, err, qt.ErrorMatches, `invalid size "4 megs".*`)
+}
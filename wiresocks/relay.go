@@ -0,0 +1,134 @@
+package wiresocks
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"sync"
+)
+
+const (
+	// relayBufferSize is the size of the pooled buffers connections are
+	// relayed with, the same as io.Copy allocates for every copy.
+	relayBufferSize = 32 << 10
+	// spliceChunk is how much a spliced copy moves between updates of the
+	// client's traffic counters.
+	spliceChunk = 1 << 20
+)
+
+// canSplice reports whether copies between kernel TCP sockets are done by
+// the kernel, without reading the data into user space.
+const canSplice = runtime.GOOS == "linux"
+
+var relayBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, relayBufferSize)
+		return &b
+	},
+}
+
+// relay copies between client and upstream in both directions until one of
+// them ends, then closes both connections and waits for the other direction.
+// It returns the error that ended the first direction, nil on EOF.
+func relay(client, upstream net.Conn) error {
+	var (
+		once     sync.Once
+		firstErr error
+	)
+	finish := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			client.Close()
+			upstream.Close()
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		finish(relayCopy(upstream, client))
+	}()
+	finish(relayCopy(client, upstream))
+	<-done
+
+	return firstErr
+}
+
+// relayCopy copies from src to dst until EOF. Kernel TCP sockets on both
+// ends are spliced, anything else is copied through a pooled buffer.
+func relayCopy(dst, src net.Conn) error {
+	if canSplice {
+		if d, s, count := spliceable(dst, src); d != nil {
+			return spliceCopy(d, s, count)
+		}
+	}
+
+	bufp := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(bufp)
+
+	// hide ReadFrom and WriteTo, whose generic fallbacks allocate a buffer
+	// per copy
+	_, err := io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *bufp)
+	return err
+}
+
+// spliceable returns the kernel TCP sockets under dst and src, and a func
+// that adds copied bytes to the counters of a client connection among them.
+// It returns nil sockets if either connection is something else, e.g. a
+// tunnel connection or a rate limited one.
+func spliceable(dst, src net.Conn) (*net.TCPConn, *net.TCPConn, func(int64)) {
+	count := func(int64) {}
+
+	// the bytes a client sends are read from its connection, the bytes it
+	// receives are written to it
+	if c, ok := src.(*countingConn); ok {
+		src, count = c.Conn, func(n int64) { c.tx.Add(uint64(n)) }
+	} else if c, ok := dst.(*countingConn); ok {
+		dst, count = c.Conn, func(n int64) { c.rx.Add(uint64(n)) }
+	}
+	dst, src = rawConn(dst, false), rawConn(src, true)
+
+	d, ok := dst.(*net.TCPConn)
+	if !ok {
+		return nil, nil, nil
+	}
+	s, ok := src.(*net.TCPConn)
+	if !ok {
+		return nil, nil, nil
+	}
+	return d, s, count
+}
+
+// rawConn returns the connection under a client connection of the mixed
+// proxy, or conn itself. A connection that is read keeps its wrapper while
+// the wrapper has buffered bytes left.
+func rawConn(conn net.Conn, reading bool) net.Conn {
+	c, ok := conn.(interface {
+		NetConn() net.Conn
+		Buffered() int
+	})
+	if !ok || reading && c.Buffered() > 0 {
+		return conn
+	}
+	return c.NetConn()
+}
+
+// spliceCopy copies from src to dst until EOF in chunks of spliceChunk,
+// calling count after each.
+func spliceCopy(dst, src *net.TCPConn, count func(int64)) error {
+	for {
+		n, err := io.Copy(dst, &io.LimitedReader{R: src, N: spliceChunk})
+		count(n)
+		if err != nil || n < spliceChunk {
+			return err
+		}
+	}
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
@@ -0,0 +1,167 @@
+package wiresocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+	qt "github.com/frankban/quicktest"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+
+	a, err := net.Dial("tcp", ln.Addr().String())
+	qt.Assert(t, err, qt.IsNil)
+	b, err := ln.Accept()
+	qt.Assert(t, err, qt.IsNil)
+	return a, b
+}
+
+// opaqueConn hides the type of a connection, so it isn't spliced.
+type opaqueConn struct {
+	net.Conn
+}
+
+func TestRelay(t *testing.T) {
+	for _, spliced := range []bool{true, false} {
+		client, proxyIn := tcpPair(t)
+		proxyOut, server := tcpPair(t)
+		defer client.Close()
+		defer server.Close()
+		if !spliced {
+			proxyOut = opaqueConn{proxyOut}
+		}
+
+		// clients of the mixed proxy come wrapped
+		stats := NewClientStats()
+		req := &statute.ProxyRequest{Conn: mixed.NewSwitchConn(proxyIn), Network: "tcp"}
+		finish := stats.track(req)
+
+		done := make(chan error, 1)
+		go func() { done <- relay(req.Conn, proxyOut) }()
+
+		// larger than a splice chunk
+		up := bytes.Repeat([]byte("u"), 3*spliceChunk/2)
+		go client.Write(up)
+		got := make([]byte, len(up))
+		_, err := io.ReadFull(server, got)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, bytes.Equal(got, up), qt.IsTrue)
+
+		down := []byte("response")
+		_, err = server.Write(down)
+		qt.Assert(t, err, qt.IsNil)
+		got = make([]byte, len(down))
+		_, err = io.ReadFull(client, got)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, string(got), qt.Equals, "response")
+
+		qt.Assert(t, client.Close(), qt.IsNil)
+		qt.Assert(t, <-done, qt.IsNil)
+		finish()
+
+		clients := stats.Clients()
+		qt.Assert(t, clients, qt.HasLen, 1)
+		qt.Check(t, clients[0].TxBytes, qt.Equals, uint64(len(up)), qt.Commentf("spliced %v", spliced))
+		qt.Check(t, clients[0].RxBytes, qt.Equals, uint64(len(down)), qt.Commentf("spliced %v", spliced))
+
+		// the server side was closed by the relay
+		_, err = server.Read(make([]byte, 1))
+		qt.Assert(t, err, qt.Equals, io.EOF)
+	}
+}
+
+// ioCopyPair is how connections were relayed before relay, kept to compare.
+func ioCopyPair(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+func benchmarkRelay(b *testing.B, wrap func(net.Conn) net.Conn, relayFn func(a, b net.Conn)) {
+	client, proxyIn := tcpPair(b)
+	proxyOut, server := tcpPair(b)
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		relayFn(wrap(proxyIn), wrap(proxyOut))
+		close(done)
+	}()
+
+	const size = 64 << 10
+	buf := make([]byte, size)
+	sink := make([]byte, size)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		go client.Write(buf)
+		if _, err := io.ReadFull(server, sink); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	client.Close()
+	<-done
+}
+
+func BenchmarkRelay(b *testing.B) {
+	plain := func(c net.Conn) net.Conn { return c }
+	opaque := func(c net.Conn) net.Conn { return opaqueConn{c} }
+	pooled := func(a, b net.Conn) { relay(a, b) }
+
+	b.Run("splice", func(b *testing.B) { benchmarkRelay(b, plain, pooled) })
+	b.Run("buffered", func(b *testing.B) { benchmarkRelay(b, opaque, pooled) })
+	b.Run("io.Copy", func(b *testing.B) { benchmarkRelay(b, opaque, ioCopyPair) })
+}
+
+// BenchmarkRelayConns relays short connections, where the buffers of every
+// connection matter more than the copy itself.
+func BenchmarkRelayConns(b *testing.B) {
+	bench := func(b *testing.B, relayFn func(a, b net.Conn)) {
+		msg := []byte("ping")
+		buf := make([]byte, len(msg))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			client, proxyIn := net.Pipe()
+			proxyOut, server := net.Pipe()
+
+			done := make(chan struct{})
+			go func() {
+				relayFn(proxyIn, proxyOut)
+				close(done)
+			}()
+
+			go client.Write(msg)
+			if _, err := io.ReadFull(server, buf); err != nil {
+				b.Fatal(err)
+			}
+			client.Close()
+			server.Close()
+			<-done
+		}
+	}
+
+	b.Run("relay", func(b *testing.B) { bench(b, func(a, b net.Conn) { relay(a, b) }) })
+	b.Run("io.Copy", func(b *testing.B) { bench(b, ioCopyPair) })
+}
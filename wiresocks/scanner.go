@@ -2,9 +2,15 @@ package wiresocks
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
 	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner"
@@ -13,25 +19,116 @@ import (
 )
 
 type ScanOptions struct {
-	V4     bool
-	V6     bool
-	MaxRTT time.Duration
+	V4       bool
+	V6       bool
+	MaxRTT   time.Duration
+	Workers  int
+	Prefixes []netip.Prefix       // prefixes to scan, defaults to warp.WarpPrefixes()
+	Ports    []uint16             // ports to scan, defaults to warp.WarpPorts()
+	Hotlist  *warp.HotlistOptions // remote prefixes and ports merged into the defaults
+	// Profile is the wireguard profile whose keys are used for warp pings,
+	// defaults to the primary identity's profile
+	Profile string
+	// SocketControl is applied to every ping socket, see iputils.SocketControl
+	SocketControl func(network, address string, c syscall.RawConn) error
+	// Exclude are prefixes never to scan
+	Exclude []netip.Prefix
+	// StatePath, if set, keeps the scan position and known bad IPs across runs
+	StatePath string
+	// ICMP drops IPs that don't answer an ICMP echo before the warp ping
+	ICMP bool
+	// Validate drops endpoints that complete the handshake but don't answer
+	// a ping through the tunnel after it
+	Validate bool
+	// PreferredPorts are picked more often than the other ports, see
+	// warp.CountryPorts
+	PreferredPorts []uint16
+	// Upstream, if set, relays the warp pings through a socks5 proxy
+	Upstream *UpstreamProxy
+	// Count is how many endpoints with distinct addresses to find, defaults
+	// to 2
+	Count int
+	// Timeout bounds the scan, defaults to two minutes
+	Timeout time.Duration
+	// SummaryPath, if set, is where the summary of the last scan is saved
+	// for bug reports, see ScanSummary
+	SummaryPath string
 }
 
-func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ipscanner.IPInfo, err error) {
-	cfg, err := ini.Load("./stuff/primary/wgcf-profile.ini")
+// ScanSummary describes a finished scan: how its pings went and the best
+// endpoints it found.
+type ScanSummary struct {
+	ipscanner.Summary
+	Error     string         `json:"error,omitempty"`
+	Endpoints []ScanEndpoint `json:"endpoints"`
+}
+
+// ScanEndpoint is a candidate endpoint of a scan, lower scores are better.
+type ScanEndpoint struct {
+	Addr   netip.AddrPort `json:"addr"`
+	RTT    time.Duration  `json:"rtt_ns"`
+	Jitter time.Duration  `json:"jitter_ns"`
+	Loss   float64        `json:"loss"`
+	Score  time.Duration  `json:"score_ns"`
+	Chosen bool           `json:"chosen"`
+}
+
+// summaryEndpoints is how many of the best candidates a scan summary lists.
+const summaryEndpoints = 8
+
+func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) ([]ipscanner.IPInfo, error) {
+	profile := opts.Profile
+	if profile == "" {
+		profile = "./stuff/primary/wgcf-profile.ini"
+	}
+
+	privateKey, publicKey, err := profileKeys(profile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+		return nil, err
 	}
 
-	// Reading the private key from the 'Interface' section
-	privateKey := cfg.Section("Interface").Key("PrivateKey").String()
+	prefixes := opts.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = warp.WarpPrefixes()
+	}
 
-	// Reading the public key from the 'Peer' section
-	publicKey := cfg.Section("Peer").Key("PublicKey").String()
+	ports := opts.Ports
+	if len(ports) == 0 {
+		ports = warp.WarpPorts()
+	}
+
+	if opts.Hotlist != nil {
+		h, err := warp.LoadHotlist(ctx, l.With("subsystem", "warp/hotlist"), *opts.Hotlist)
+		if err != nil {
+			l.Warn("failed to load warp hotlist, scanning built-in ranges only", "error", err)
+		} else {
+			if len(opts.Prefixes) == 0 {
+				prefixes, _ = h.Merge(prefixes, nil)
+			}
+			if len(opts.Ports) == 0 {
+				_, ports = h.Merge(nil, ports)
+			}
+		}
+	}
+
+	// the endpoints the api handed out with the identity are tried first,
+	// unless the prefixes to scan leave them out
+	seeds, seedPorts := identityHints(profile)
+	if len(opts.Prefixes) > 0 {
+		seeds = slices.DeleteFunc(seeds, func(ip netip.Addr) bool {
+			return !slices.ContainsFunc(opts.Prefixes, func(p netip.Prefix) bool { return p.Contains(ip) })
+		})
+	}
+	if len(seeds) > 0 {
+		l.Debug("scanning the endpoints of the identity first", "addresses", seeds, "ports", seedPorts)
+	}
+
+	if preferred := append(slices.Clone(opts.PreferredPorts), seedPorts...); len(preferred) > 0 {
+		ports = warp.WeightPorts(ports, preferred)
+	}
 
 	// new scanner
-	scanner := ipscanner.NewScanner(
+	scanOpts := []ipscanner.Option{
 		ipscanner.WithLogger(l.With(slog.String("subsystem", "scanner"))),
 		ipscanner.WithWarpPing(),
 		ipscanner.WithWarpPrivateKey(privateKey),
@@ -39,27 +136,84 @@ func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ip
 		ipscanner.WithUseIPv4(opts.V4),
 		ipscanner.WithUseIPv6(opts.V6),
 		ipscanner.WithMaxDesirableRTT(opts.MaxRTT),
-		ipscanner.WithCidrList(warp.WarpPrefixes()),
-	)
+		ipscanner.WithCidrList(prefixes),
+		ipscanner.WithSeedIPs(seeds...),
+		ipscanner.WithWarpPorts(ports),
+		ipscanner.WithConcurrency(opts.Workers),
+		ipscanner.WithSocketControl(opts.SocketControl),
+		ipscanner.WithExcludeList(opts.Exclude),
+		ipscanner.WithStateFile(opts.StatePath),
+	}
+	if opts.Upstream != nil {
+		scanOpts = append(scanOpts, ipscanner.WithPacketListener(opts.Upstream.ListenPacket))
+	}
+	if opts.Validate {
+		source, err := profileAddr(profile)
+		if err != nil {
+			return nil, err
+		}
+		scanOpts = append(scanOpts, ipscanner.WithFullWarpValidation(source))
+	}
+	if opts.ICMP {
+		if opts.Upstream != nil {
+			// an echo answered directly says nothing about the proxy's route
+			l.Warn("icmp pings can't go through the upstream proxy, skipping them")
+		} else {
+			scanOpts = append(scanOpts, ipscanner.WithICMPPing())
+		}
+	}
+	scanner := ipscanner.NewScanner(scanOpts...)
+
+	count := opts.Count
+	if count <= 0 {
+		count = 2
+	}
 
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	scanner.Run(ctx)
 
+	res, err := waitForScan(ctx, scanner, count, opts.V4 && opts.V6)
+	logScanSummary(l, opts.SummaryPath, scanner, res, err)
+	return res, err
+}
+
+// familyWait is how long a dual-stack scan that found enough endpoints of
+// one IP family waits for one of the other.
+const familyWait = 10 * time.Second
+
+// waitForScan waits until scanner found count endpoints with distinct
+// addresses. With mix, see distinctIPs, it waits up to familyWait longer for
+// the endpoints to include both IP families.
+func waitForScan(ctx context.Context, scanner *ipscanner.IPScanner, count int, mix bool) ([]ipscanner.IPInfo, error) {
 	t := time.NewTicker(1 * time.Second)
 	defer t.Stop()
 
+	var found time.Time
 	for {
-		ipList := scanner.GetAvailableIPs()
-		if len(ipList) > 1 {
-			for i := 0; i < 2; i++ {
-				result = append(result, ipList[i])
+		if result := distinctIPs(scanner.GetAvailableIPs(), count, mix); len(result) == count {
+			if !mix || count < 2 || hasBothFamilies(result) {
+				return result, nil
+			}
+			if found.IsZero() {
+				found = time.Now()
+			} else if time.Since(found) >= familyWait {
+				return result, nil
 			}
-			return result, nil
 		}
 
 		select {
+		case <-scanner.Done():
+			if err := scanner.Err(); err != nil {
+				return nil, fmt.Errorf("scan failed: %w", err)
+			}
+			return nil, errors.New("user canceled the operation")
 		case <-ctx.Done():
 			// Context is done - canceled externally
 			return nil, errors.New("user canceled the operation")
@@ -69,3 +223,141 @@ func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ip
 		}
 	}
 }
+
+// logScanSummary logs the summary of a finished scan as a single record and
+// saves it to path, if set.
+func logScanSummary(l *slog.Logger, path string, scanner *ipscanner.IPScanner, res []ipscanner.IPInfo, scanErr error) {
+	summary := ScanSummary{Summary: scanner.Summary()}
+	if scanErr != nil {
+		summary.Error = scanErr.Error()
+	}
+
+	candidates := scanner.GetAvailableIPs()
+	endpoints := make([]slog.Attr, 0, summaryEndpoints)
+	for _, info := range candidates[:min(len(candidates), summaryEndpoints)] {
+		chosen := slices.ContainsFunc(res, func(r ipscanner.IPInfo) bool { return r.AddrPort == info.AddrPort })
+		summary.Endpoints = append(summary.Endpoints, ScanEndpoint{
+			Addr:   info.AddrPort,
+			RTT:    info.RTT,
+			Jitter: info.Jitter,
+			Loss:   info.Loss,
+			Score:  info.Score(),
+			Chosen: chosen,
+		})
+		endpoints = append(endpoints, slog.Group(info.AddrPort.String(), "score", info.Score(), "chosen", chosen))
+	}
+
+	level := slog.LevelInfo
+	if scanErr != nil || len(res) == 0 {
+		level = slog.LevelWarn
+	}
+	l.Log(context.Background(), level, "scan summary",
+		"scan", summary.Summary,
+		slog.Attr{Key: "endpoints", Value: slog.GroupValue(endpoints...)},
+		"error", summary.Error,
+	)
+
+	if path == "" {
+		return
+	}
+	if err := saveScanSummary(path, summary); err != nil {
+		l.Warn("failed to save scan summary", "error", err)
+	}
+}
+
+func saveScanSummary(path string, summary ScanSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// profileKeys returns the base64 private key and peer public key of the
+// wireguard profile at path.
+func profileKeys(path string) (string, string, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read file: %w", err)
+	}
+
+	// Reading the private key from the 'Interface' section
+	privateKey := cfg.Section("Interface").Key("PrivateKey").String()
+
+	// Reading the public key from the 'Peer' section
+	publicKey := cfg.Section("Peer").Key("PublicKey").String()
+
+	return privateKey, publicKey, nil
+}
+
+// profileAddr returns the IPv4 interface address of the wireguard profile at
+// path, which the pings through the tunnels of scanned endpoints come from.
+func profileAddr(path string) (netip.Addr, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	for _, str := range cfg.Section("Interface").Key("Address").Strings(",") {
+		if prefix, err := netip.ParsePrefix(str); err == nil && prefix.Addr().Is4() {
+			return prefix.Addr(), nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("%s has no ipv4 interface address to validate endpoints from", path)
+}
+
+// distinctIPs returns up to n of the best candidates in ipList, skipping
+// entries whose address was already picked on a different port. With mix, the
+// candidates alternate between the IP families while both have some left,
+// starting with the best one, so the two tunnels of gool and multi mode run
+// over one family each.
+func distinctIPs(ipList []ipscanner.IPInfo, n int, mix bool) []ipscanner.IPInfo {
+	var result []ipscanner.IPInfo
+	seen := make(map[netip.Addr]struct{})
+	for len(result) < n {
+		next := -1
+		for i, info := range ipList {
+			if _, ok := seen[info.AddrPort.Addr()]; ok {
+				continue
+			}
+			if next < 0 {
+				next = i
+			}
+			// ipList is sorted, the first entry of the other family is its best
+			if !mix || len(result) == 0 || is4(info) != is4(result[len(result)-1]) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+
+		seen[ipList[next].AddrPort.Addr()] = struct{}{}
+		result = append(result, ipList[next])
+	}
+	return result
+}
+
+// hasBothFamilies reports whether ipList has candidates of both IP families.
+func hasBothFamilies(ipList []ipscanner.IPInfo) bool {
+	return slices.ContainsFunc(ipList, is4) && slices.ContainsFunc(ipList, func(info ipscanner.IPInfo) bool { return !is4(info) })
+}
+
+func is4(info ipscanner.IPInfo) bool {
+	return info.AddrPort.Addr().Unmap().Is4()
+}
+
+// identityHints returns the endpoint hints of the identity next to profile,
+// none if it is a wireguard config of its own.
+func identityHints(profile string) ([]netip.Addr, []uint16) {
+	identity, err := warp.LoadIdentity(filepath.Dir(profile))
+	if err != nil {
+		return nil, nil
+	}
+	return identity.Config.EndpointHints()
+}
@@ -0,0 +1,30 @@
+package wiresocks
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDistinctIPs(t *testing.T) {
+	var ipList []ipscanner.IPInfo
+	for _, addr := range []string{"162.159.192.1:2408", "162.159.192.1:500", "162.159.192.2:2408", "[2606:4700:d0::1]:2408", "[2606:4700:d0::2]:2408"} {
+		ipList = append(ipList, ipscanner.IPInfo{AddrPort: netip.MustParseAddrPort(addr)})
+	}
+	addrs := func(res []ipscanner.IPInfo) []string {
+		var s []string
+		for _, info := range res {
+			s = append(s, info.AddrPort.String())
+		}
+		return s
+	}
+
+	qt.Assert(t, addrs(distinctIPs(ipList, 3, false)), qt.DeepEquals, []string{"162.159.192.1:2408", "162.159.192.2:2408", "[2606:4700:d0::1]:2408"})
+	qt.Assert(t, addrs(distinctIPs(ipList, 4, true)), qt.DeepEquals, []string{"162.159.192.1:2408", "[2606:4700:d0::1]:2408", "162.159.192.2:2408", "[2606:4700:d0::2]:2408"})
+	// once a family runs out the other one fills up the rest
+	qt.Assert(t, addrs(distinctIPs(ipList[:3], 2, true)), qt.DeepEquals, []string{"162.159.192.1:2408", "162.159.192.2:2408"})
+	qt.Assert(t, hasBothFamilies(distinctIPs(ipList[:3], 2, true)), qt.IsFalse)
+}
@@ -0,0 +1,130 @@
+package wiresocks
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PeerStatus is the state of a tunnel peer as reported by the device.
+type PeerStatus struct {
+	// PublicKey is hex encoded, as in the uapi.
+	PublicKey string
+	Endpoint  string
+	// FallbackEndpoint is the endpoint the peer switches to if handshakes
+	// time out, empty if it has none.
+	FallbackEndpoint string
+	// LastHandshake is zero until a handshake completes.
+	LastHandshake time.Time
+	RxBytes       uint64
+	TxBytes       uint64
+	// KeepAlive is the persistent keepalive interval in seconds.
+	KeepAlive int
+	// Tricks are the junk packet parameters in use, nil if the peer sends
+	// no junk packets.
+	Tricks *TrickConfig
+}
+
+// Family returns the IP family of the endpoint in use, "v4" or "v6", or
+// an empty string if the endpoint is unknown.
+func (p PeerStatus) Family() string {
+	addr, err := netip.ParseAddrPort(p.Endpoint)
+	switch {
+	case err != nil:
+		return ""
+	case addr.Addr().Unmap().Is4():
+		return "v4"
+	default:
+		return "v6"
+	}
+}
+
+// PeerStatus returns the state of every peer of the tunnel.
+func (vt *VirtualTun) PeerStatus() ([]PeerStatus, error) {
+	state, err := vt.Dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+	return parsePeerStatus(state)
+}
+
+// parsePeerStatus parses the output of a uapi get operation.
+func parsePeerStatus(state string) ([]PeerStatus, error) {
+	var (
+		peers     []PeerStatus
+		sec, nsec int64
+		trick     bool
+		tricks    TrickConfig
+		peer      *PeerStatus
+	)
+
+	// the handshake time and tricks are split over several keys, finish
+	// them once all are in
+	flush := func() {
+		if peer != nil && sec != 0 {
+			peer.LastHandshake = time.Unix(sec, nsec)
+		}
+		if peer != nil && trick {
+			t := tricks
+			peer.Tricks = &t
+		}
+		sec, nsec = 0, 0
+		trick, tricks = false, TrickConfig{}
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(state))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		if key == "public_key" {
+			flush()
+			peers = append(peers, PeerStatus{PublicKey: value})
+			peer = &peers[len(peers)-1]
+			continue
+		}
+		if peer == nil {
+			continue
+		}
+
+		var err error
+		switch key {
+		case "endpoint":
+			peer.Endpoint = value
+		case "fallback_endpoint":
+			peer.FallbackEndpoint = value
+		case "last_handshake_time_sec":
+			sec, err = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsec, err = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			peer.RxBytes, err = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			peer.TxBytes, err = strconv.ParseUint(value, 10, 64)
+		case "persistent_keepalive_interval":
+			peer.KeepAlive, err = strconv.Atoi(value)
+		case "trick":
+			trick, err = strconv.ParseBool(value)
+		case "trick_count":
+			tricks.Count = value
+		case "trick_size":
+			tricks.Size = value
+		case "trick_delay":
+			tricks.Delay = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s: %w", key, err)
+		}
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
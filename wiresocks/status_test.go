@@ -0,0 +1,58 @@
+package wiresocks
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParsePeerStatus(t *testing.T) {
+	state := `private_key=aa
+listen_port=51820
+public_key=bb
+endpoint=162.159.192.1:2408
+fallback_endpoint=[2606:4700:d0::1]:2408
+last_handshake_time_sec=1700000000
+last_handshake_time_nsec=500
+rx_bytes=1024
+tx_bytes=2048
+persistent_keepalive_interval=25
+trick=true
+trick_count=8-15
+trick_size=40-100
+trick_delay=20-250
+public_key=cc
+endpoint=[2606:4700:d1::1]:500
+last_handshake_time_sec=0
+last_handshake_time_nsec=0
+rx_bytes=0
+tx_bytes=0
+errno=0
+`
+
+	peers, err := parsePeerStatus(state)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, peers, qt.DeepEquals, []PeerStatus{{
+		PublicKey:        "bb",
+		Endpoint:         "162.159.192.1:2408",
+		FallbackEndpoint: "[2606:4700:d0::1]:2408",
+		LastHandshake:    time.Unix(1700000000, 500),
+		RxBytes:          1024,
+		TxBytes:          2048,
+		KeepAlive:        25,
+		Tricks:           &TrickConfig{Count: "8-15", Size: "40-100", Delay: "20-250"},
+	}, {
+		PublicKey: "cc",
+		Endpoint:  "[2606:4700:d1::1]:500",
+	}})
+
+	qt.Assert(t, peers[0].Family(), qt.Equals, "v4")
+	qt.Assert(t, peers[1].Family(), qt.Equals, "v6")
+	qt.Assert(t, PeerStatus{}.Family(), qt.Equals, "")
+}
+
+func TestParsePeerStatusMalformed(t *testing.T) {
+	_, err := parsePeerStatus("public_key=bb\nrx_bytes=lots\n")
+	qt.Assert(t, err, qt.ErrorMatches, "malformed rx_bytes: .*")
+}
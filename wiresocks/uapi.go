@@ -0,0 +1,19 @@
+package wiresocks
+
+import (
+	"net"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+// serveUAPI answers the configuration requests on l with dev until l is
+// closed, so wg(8) can show the device.
+func serveUAPI(l net.Listener, dev *device.Device) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go dev.IpcHandle(conn)
+	}
+}
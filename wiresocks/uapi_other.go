@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !windows
+
+package wiresocks
+
+import (
+	"errors"
+	"net"
+)
+
+// listenUAPI is not supported on this platform.
+func listenUAPI(string) (net.Listener, error) {
+	return nil, errors.New("uapi sockets are not supported on this platform")
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package wiresocks
+
+import (
+	"net"
+
+	"github.com/bepass-org/warp-plus/wireguard/ipc"
+)
+
+// listenUAPI listens on the uapi socket of the device name, in
+// /var/run/wireguard like wg(8) expects.
+func listenUAPI(name string) (net.Listener, error) {
+	file, err := ipc.UAPIOpen(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ipc.UAPIListen(name, file)
+}
@@ -0,0 +1,13 @@
+package wiresocks
+
+import (
+	"net"
+
+	"github.com/bepass-org/warp-plus/wireguard/ipc"
+)
+
+// listenUAPI listens on the named pipe of the device name that wg.exe
+// expects, which only administrators can open.
+func listenUAPI(name string) (net.Listener, error) {
+	return ipc.UAPIListen(name)
+}
@@ -2,73 +2,379 @@ package wiresocks
 
 import (
 	"context"
+	"errors"
+	"log/slog"
 	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 )
 
-func NewVtunUDPForwarder(ctx context.Context, localBind netip.AddrPort, dest string, vtun *VirtualTun, mtu int) (netip.AddrPort, error) {
-	destAddr, err := net.ResolveUDPAddr("udp", dest)
+const (
+	// udpFlowTimeout is how long a forwarded flow may be idle before its
+	// tunnel socket is closed.
+	udpFlowTimeout = 2 * time.Minute
+	// udpQueueSize is how many datagrams wait to be sent in each direction
+	// before more are dropped.
+	udpQueueSize = 512
+	// maxJitterGap is the longest gap between datagrams the jitter is
+	// measured over, longer ones are idle time rather than jitter.
+	maxJitterGap = time.Second
+)
+
+// udpFlow is the tunnel socket of one local sender.
+type udpFlow struct {
+	conn *gonet.UDPConn
+
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+func (f *udpFlow) touch() {
+	f.mu.Lock()
+	f.lastSeen = time.Now()
+	f.mu.Unlock()
+}
+
+func (f *udpFlow) idle() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Since(f.lastSeen)
+}
+
+// udpPacket is a queued datagram of client, stamped with when it arrived.
+type udpPacket struct {
+	client  netip.AddrPort
+	buffer  *[]byte
+	n       int
+	arrived time.Time
+}
+
+// UDPDirectionStats are the counters of one direction of a UDPForwarder.
+type UDPDirectionStats struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	// Drops are the datagrams dropped because the queue was full
+	Drops uint64 `json:"drops"`
+	// Errors are the datagrams that failed to be sent
+	Errors uint64 `json:"errors"`
+	// Jitter is the smoothed variation of the gaps between arriving
+	// datagrams, as in RFC 3550, ignoring idle gaps
+	Jitter time.Duration `json:"jitter_ns"`
+	// QueueDelay is the smoothed time datagrams waited to be sent
+	QueueDelay time.Duration `json:"queue_delay_ns"`
+}
+
+// LogValue logs the counters as a group.
+func (s UDPDirectionStats) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("packets", s.Packets),
+		slog.Uint64("bytes", s.Bytes),
+		slog.Uint64("drops", s.Drops),
+		slog.Uint64("errors", s.Errors),
+		slog.Duration("jitter", s.Jitter),
+		slog.Duration("queue_delay", s.QueueDelay),
+	)
+}
+
+// UDPForwarderStats are the counters of a UDPForwarder, Up for the datagrams
+// of the local senders and Down for their replies.
+type UDPForwarderStats struct {
+	Up   UDPDirectionStats `json:"up"`
+	Down UDPDirectionStats `json:"down"`
+}
+
+// udpDirection queues and counts the datagrams of one direction.
+type udpDirection struct {
+	queue chan udpPacket
+
+	packets, bytes, drops, errors atomic.Uint64
+
+	mu          sync.Mutex
+	lastArrival time.Time
+	lastGap     time.Duration
+	jitter      time.Duration
+	delay       time.Duration
+}
+
+func newUDPDirection() *udpDirection {
+	return &udpDirection{queue: make(chan udpPacket, udpQueueSize)}
+}
+
+// push queues p, or drops it if the queue is full, and updates the jitter
+// with its arrival time. It reports whether p was queued.
+func (d *udpDirection) push(p udpPacket) bool {
+	d.mu.Lock()
+	if !d.lastArrival.IsZero() {
+		gap := p.arrived.Sub(d.lastArrival)
+		if gap > maxJitterGap {
+			// start over after idle time
+			gap = 0
+		} else if d.lastGap != 0 {
+			variation := gap - d.lastGap
+			if variation < 0 {
+				variation = -variation
+			}
+			d.jitter += (variation - d.jitter) / 16
+		}
+		d.lastGap = gap
+	}
+	d.lastArrival = p.arrived
+	d.mu.Unlock()
+
+	select {
+	case d.queue <- p:
+		return true
+	default:
+		d.drops.Add(1)
+		return false
+	}
+}
+
+// sent counts p as sent at now, or as failed if err is set.
+func (d *udpDirection) sent(p udpPacket, now time.Time, err error) {
 	if err != nil {
-		return netip.AddrPort{}, err
+		d.errors.Add(1)
+		return
 	}
+	d.packets.Add(1)
+	d.bytes.Add(uint64(p.n))
 
-	listener, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localBind))
+	d.mu.Lock()
+	d.delay += (now.Sub(p.arrived) - d.delay) / 16
+	d.mu.Unlock()
+}
+
+func (d *udpDirection) stats() UDPDirectionStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return UDPDirectionStats{
+		Packets:    d.packets.Load(),
+		Bytes:      d.bytes.Load(),
+		Drops:      d.drops.Load(),
+		Errors:     d.errors.Load(),
+		Jitter:     d.jitter,
+		QueueDelay: d.delay,
+	}
+}
+
+// UDPForwarder relays datagrams between local senders and dest through a
+// tunnel. Every sender gets its own tunnel socket so replies go back to the
+// sender they belong to. Each direction goes through a bounded queue, so a
+// stalled tunnel drops and counts datagrams instead of hiding the loss.
+type UDPForwarder struct {
+	listener *net.UDPConn
+	vtun     *VirtualTun
+	mtu      int
+	buffers  sync.Pool
+
+	up, down *udpDirection
+
+	mu    sync.Mutex
+	dest  *net.UDPAddr
+	flows map[netip.AddrPort]*udpFlow
+}
+
+// NewVtunUDPForwarder listens on localBind and forwards the datagrams of
+// every local sender to dest through vtun until ctx is done.
+func NewVtunUDPForwarder(ctx context.Context, localBind netip.AddrPort, dest string, vtun *VirtualTun, mtu int) (*UDPForwarder, error) {
+	destAddr, err := net.ResolveUDPAddr("udp", dest)
 	if err != nil {
-		return netip.AddrPort{}, err
+		return nil, err
 	}
 
-	rconn, err := vtun.Tnet.DialUDP(nil, destAddr)
+	listener, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localBind))
 	if err != nil {
-		return netip.AddrPort{}, err
+		return nil, err
 	}
 
-	var clientAddr *net.UDPAddr
-	var wg sync.WaitGroup
-	wg.Add(2)
+	f := &UDPForwarder{
+		listener: listener,
+		dest:     destAddr,
+		vtun:     vtun,
+		mtu:      mtu,
+		up:       newUDPDirection(),
+		down:     newUDPDirection(),
+		flows:    make(map[netip.AddrPort]*udpFlow),
+	}
+	f.buffers.New = func() any {
+		b := make([]byte, mtu)
+		return &b
+	}
 
+	go f.serve()
+	go f.sendUp(ctx)
+	go f.sendDown(ctx)
+	go f.evict(ctx)
 	go func() {
-		buffer := make([]byte, mtu)
-		for {
-			select {
-			case <-ctx.Done():
-				wg.Done()
-				return
-			default:
-				n, cAddr, err := listener.ReadFrom(buffer)
-				if err != nil {
-					continue
-				}
+		<-ctx.Done()
+		_ = listener.Close()
+		f.closeFlows(0)
+	}()
 
-				clientAddr = cAddr.(*net.UDPAddr)
+	return f, nil
+}
 
-				rconn.WriteTo(buffer[:n], destAddr)
+// Addr returns the address the forwarder listens on.
+func (f *UDPForwarder) Addr() netip.AddrPort {
+	return f.listener.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// Dest returns the address datagrams are forwarded to.
+func (f *UDPForwarder) Dest() netip.AddrPort {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dest.AddrPort()
+}
+
+// SetDest forwards the datagrams of all senders to dest from now on. The
+// open flows are closed, the next datagram of each sender opens a new one.
+func (f *UDPForwarder) SetDest(dest netip.AddrPort) {
+	f.mu.Lock()
+	f.dest = net.UDPAddrFromAddrPort(dest)
+	f.mu.Unlock()
+
+	f.closeFlows(0)
+}
+
+// Stats returns the counters of both directions.
+func (f *UDPForwarder) Stats() UDPForwarderStats {
+	return UDPForwarderStats{Up: f.up.stats(), Down: f.down.stats()}
+}
+
+// serve reads from the listener until it is closed and queues every datagram
+// to be sent on the flow of its sender.
+func (f *UDPForwarder) serve() {
+	for {
+		buffer := f.buffers.Get().(*[]byte)
+		n, client, err := f.listener.ReadFromUDPAddrPort(*buffer)
+		if err != nil {
+			f.buffers.Put(buffer)
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
+			continue
 		}
-	}()
-	go func() {
-		buffer := make([]byte, mtu)
-		for {
-			select {
-			case <-ctx.Done():
-				wg.Done()
-				return
-			default:
-				n, _, err := rconn.ReadFrom(buffer)
-				if err != nil {
-					continue
-				}
-				if clientAddr != nil {
-					listener.WriteTo(buffer[:n], clientAddr)
-				}
+
+		if !f.up.push(udpPacket{client: client, buffer: buffer, n: n, arrived: time.Now()}) {
+			f.buffers.Put(buffer)
+		}
+	}
+}
+
+// sendUp sends the queued datagrams of the local senders through the tunnel
+// until ctx is done.
+func (f *UDPForwarder) sendUp(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-f.up.queue:
+			flow, err := f.flow(p.client)
+			if err != nil {
+				f.vtun.Logger.Debug("failed to open udp flow", "client", p.client, "error", err)
+			} else {
+				flow.touch()
+				_, err = flow.conn.Write((*p.buffer)[:p.n])
 			}
+			f.up.sent(p, time.Now(), err)
+			f.buffers.Put(p.buffer)
 		}
+	}
+}
+
+// sendDown sends the queued replies back to the local senders until ctx is
+// done.
+func (f *UDPForwarder) sendDown(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-f.down.queue:
+			_, err := f.listener.WriteToUDPAddrPort((*p.buffer)[:p.n], p.client)
+			f.down.sent(p, time.Now(), err)
+			f.buffers.Put(p.buffer)
+		}
+	}
+}
+
+// flow returns the flow of client, opening it on first use.
+func (f *UDPForwarder) flow(client netip.AddrPort) (*udpFlow, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if flow, ok := f.flows[client]; ok {
+		return flow, nil
+	}
+
+	conn, err := f.vtun.Tnet.DialUDP(nil, f.dest)
+	if err != nil {
+		return nil, err
+	}
+
+	flow := &udpFlow{conn: conn, lastSeen: time.Now()}
+	f.flows[client] = flow
+	go f.reply(client, flow)
+
+	return flow, nil
+}
+
+// reply queues what arrives on the tunnel socket of flow to be sent back to
+// client until the socket is closed.
+func (f *UDPForwarder) reply(client netip.AddrPort, flow *udpFlow) {
+	defer func() {
+		f.mu.Lock()
+		if f.flows[client] == flow {
+			delete(f.flows, client)
+		}
+		f.mu.Unlock()
+		_ = flow.conn.Close()
 	}()
-	go func() {
-		wg.Wait()
-		_ = listener.Close()
-		_ = rconn.Close()
-	}()
 
-	return listener.LocalAddr().(*net.UDPAddr).AddrPort(), nil
+	for {
+		buffer := f.buffers.Get().(*[]byte)
+		n, err := flow.conn.Read(*buffer)
+		if err != nil {
+			f.buffers.Put(buffer)
+			return
+		}
+
+		flow.touch()
+		if !f.down.push(udpPacket{client: client, buffer: buffer, n: n, arrived: time.Now()}) {
+			f.buffers.Put(buffer)
+		}
+	}
+}
+
+// evict closes the flows that have been idle for udpFlowTimeout until ctx is
+// done.
+func (f *UDPForwarder) evict(ctx context.Context) {
+	t := time.NewTicker(udpFlowTimeout / 4)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			f.closeFlows(udpFlowTimeout)
+		}
+	}
+}
+
+// closeFlows closes the flows idle for at least idle. Their reply loops
+// remove them from the table.
+func (f *UDPForwarder) closeFlows(idle time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, flow := range f.flows {
+		if flow.idle() >= idle {
+			_ = flow.conn.Close()
+		}
+	}
 }
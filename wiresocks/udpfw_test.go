@@ -0,0 +1,43 @@
+package wiresocks
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestUDPDirection(t *testing.T) {
+	d := newUDPDirection()
+
+	// a steady stream has no jitter, a full queue drops
+	start := time.Now()
+	for i := 0; i < udpQueueSize+3; i++ {
+		d.push(udpPacket{n: 100, arrived: start.Add(time.Duration(i) * 10 * time.Millisecond)})
+	}
+	stats := d.stats()
+	qt.Assert(t, stats.Drops, qt.Equals, uint64(3))
+	qt.Assert(t, stats.Jitter, qt.Equals, time.Duration(0))
+
+	for i := 0; i < 10; i++ {
+		p := <-d.queue
+		d.sent(p, p.arrived.Add(16*time.Millisecond), nil)
+	}
+	d.sent(<-d.queue, time.Now(), errors.New("closed"))
+
+	stats = d.stats()
+	qt.Assert(t, stats.Packets, qt.Equals, uint64(10))
+	qt.Assert(t, stats.Bytes, qt.Equals, uint64(1000))
+	qt.Assert(t, stats.Errors, qt.Equals, uint64(1))
+	qt.Assert(t, stats.QueueDelay > 0 && stats.QueueDelay < 16*time.Millisecond, qt.IsTrue)
+
+	// uneven gaps are jitter, idle ones aren't
+	last := start.Add(time.Duration(udpQueueSize+2) * 10 * time.Millisecond)
+	d.push(udpPacket{arrived: last.Add(50 * time.Millisecond)})
+	jitter := d.stats().Jitter
+	qt.Assert(t, jitter, qt.Equals, 40*time.Millisecond/16)
+
+	d.push(udpPacket{arrived: last.Add(time.Hour)})
+	qt.Assert(t, d.stats().Jitter, qt.Equals, jitter)
+}
@@ -0,0 +1,46 @@
+package wiresocks
+
+import (
+	"io/fs"
+	"net"
+	"os"
+	"time"
+)
+
+// listenUnix listens on the unix domain socket at path, which only the user
+// running the proxy may connect to. A socket file left behind by a process
+// that didn't shut down cleanly is replaced. The file is removed once the
+// listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil && staleSocket(path) {
+		if rmErr := os.Remove(path); rmErr == nil {
+			ln, err = net.Listen("unix", path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// staleSocket reports whether path is a unix domain socket nothing listens
+// on anymore.
+func staleSocket(path string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&fs.ModeSocket == 0 {
+		return false
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return true
+	}
+	_ = conn.Close()
+	return false
+}
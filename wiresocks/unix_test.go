@@ -0,0 +1,34 @@
+package wiresocks
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wp.sock")
+
+	// a socket file left behind by a crashed process
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	qt.Assert(t, err, qt.IsNil)
+	stale.SetUnlinkOnClose(false)
+	qt.Assert(t, stale.Close(), qt.IsNil)
+
+	ln, err := listenUnix(path)
+	qt.Assert(t, err, qt.IsNil)
+	fi, err := os.Stat(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, fi.Mode().Perm(), qt.Equals, os.FileMode(0o600))
+
+	// a socket in use is left alone
+	_, err = listenUnix(path)
+	qt.Assert(t, err, qt.ErrorMatches, ".*address already in use")
+
+	qt.Assert(t, ln.Close(), qt.IsNil)
+	_, err = os.Stat(path)
+	qt.Assert(t, os.IsNotExist(err), qt.IsTrue)
+}
@@ -0,0 +1,96 @@
+package wiresocks
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/socks5"
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestUpstreamBindReassociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	srv := socks5.NewServer()
+	srv.Listener = ln
+	go func() { _ = srv.ListenAndServe() }()
+	defer ln.Close()
+
+	b := newUpstreamBind(slog.New(slog.NewTextHandler(io.Discard, nil)), &UpstreamProxy{Addr: ln.Addr().String()})
+	fns, _, err := b.Open(0)
+	qt.Assert(t, err, qt.IsNil)
+	defer b.Close()
+
+	ep := &conn.StdNetEndpoint{AddrPort: netip.MustParseAddrPort(echo.LocalAddr().String())}
+	roundTrip := func() {
+		t.Helper()
+		qt.Assert(t, b.Send([][]byte{[]byte("ping")}, ep), qt.IsNil)
+		packets, sizes, eps := [][]byte{make([]byte, 1500)}, make([]int, 1), make([]conn.Endpoint, 1)
+		n, err := fns[0](packets, sizes, eps)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, n, qt.Equals, 1)
+		qt.Assert(t, string(packets[0][:sizes[0]]), qt.Equals, "ping")
+	}
+	roundTrip()
+
+	// the association ends as it does when the proxy drops its control
+	// connection, the next read associates again
+	b.mu.Lock()
+	old := b.conn
+	b.mu.Unlock()
+	qt.Assert(t, old.Close(), qt.IsNil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		packets, sizes, eps := [][]byte{make([]byte, 1500)}, make([]int, 1), make([]conn.Endpoint, 1)
+		_, err := fns[0](packets, sizes, eps)
+		qt.Check(t, err, qt.IsNil)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		b.mu.Lock()
+		replaced := b.conn != old
+		b.mu.Unlock()
+		if replaced {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the association wasn't replaced")
+		}
+	}
+	qt.Assert(t, b.Send([][]byte{[]byte("ping")}, ep), qt.IsNil)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no datagram through the new association")
+	}
+
+	// closing the bind ends the receive func instead of associating again
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = b.Close()
+	}()
+	packets, sizes, eps := [][]byte{make([]byte, 1500)}, make([]int, 1), make([]conn.Endpoint, 1)
+	_, err = fns[0](packets, sizes, eps)
+	qt.Assert(t, err, qt.ErrorIs, net.ErrClosed)
+}
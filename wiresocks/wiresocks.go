@@ -5,7 +5,10 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/netip"
 
+	"github.com/bepass-org/warp-plus/iputils"
 	"github.com/bepass-org/warp-plus/wireguard/conn"
 	"github.com/bepass-org/warp-plus/wireguard/device"
 	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
@@ -16,13 +19,31 @@ func StartWireguard(ctx context.Context, l *slog.Logger, conf *Configuration) (*
 	var request bytes.Buffer
 
 	request.WriteString(fmt.Sprintf("private_key=%s\n", conf.Interface.PrivateKey))
+	for _, key := range conf.Interface.Amnezia.ipcKeys() {
+		request.WriteString(key + "\n")
+	}
 
 	for _, peer := range conf.Peers {
 		request.WriteString(fmt.Sprintf("public_key=%s\n", peer.PublicKey))
 		request.WriteString(fmt.Sprintf("persistent_keepalive_interval=%d\n", peer.KeepAlive))
 		request.WriteString(fmt.Sprintf("preshared_key=%s\n", peer.PreSharedKey))
 		request.WriteString(fmt.Sprintf("endpoint=%s\n", peer.Endpoint))
+		if peer.FallbackEndpoint != "" {
+			request.WriteString(fmt.Sprintf("fallback_endpoint=%s\n", peer.FallbackEndpoint))
+		}
 		request.WriteString(fmt.Sprintf("trick=%t\n", peer.Trick))
+		if peer.Reserved != [3]byte{} {
+			request.WriteString(fmt.Sprintf("reserved=%d,%d,%d\n", peer.Reserved[0], peer.Reserved[1], peer.Reserved[2]))
+		}
+		for _, trick := range []struct{ key, value string }{
+			{"trick_count", peer.Tricks.Count},
+			{"trick_size", peer.Tricks.Size},
+			{"trick_delay", peer.Tricks.Delay},
+		} {
+			if trick.value != "" {
+				request.WriteString(fmt.Sprintf("%s=%s\n", trick.key, trick.value))
+			}
+		}
 
 		for _, cidr := range peer.AllowedIPs {
 			request.WriteString(fmt.Sprintf("allowed_ip=%s\n", cidr))
@@ -34,7 +55,27 @@ func StartWireguard(ctx context.Context, l *slog.Logger, conf *Configuration) (*
 		return nil, err
 	}
 
-	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewSLogger(l.With("subsystem", "wireguard-go")))
+	// keep IPv4 destinations reachable from an IPv6-only interface
+	if !hasIPv4(conf.Interface.Addresses) {
+		prefix := conf.Interface.DNS64
+		if !prefix.IsValid() {
+			prefix = iputils.WellKnownNAT64Prefix
+		}
+		l.Info("interface has no IPv4 address, mapping IPv4 destinations with dns64", "prefix", prefix)
+		tnet.EnableDNS64(prefix)
+	}
+	tnet.PreferFamily(conf.Interface.PreferFamily)
+	if err := tnet.Tune(conf.Stack); err != nil {
+		tun.Close()
+		return nil, err
+	}
+
+	bind := conn.NewDefaultBind()
+	if conf.Upstream != nil {
+		bind = newUpstreamBind(l.With("subsystem", "upstream"), conf.Upstream)
+	}
+
+	dev := device.NewDevice(tun, bind, device.NewSLogger(l.With("subsystem", "wireguard-go")))
 	err = dev.IpcSet(request.String())
 	if err != nil {
 		return nil, err
@@ -45,10 +86,33 @@ func StartWireguard(ctx context.Context, l *slog.Logger, conf *Configuration) (*
 		return nil, err
 	}
 
+	var uapi net.Listener
+	if conf.UAPI != "" {
+		if uapi, err = listenUAPI(conf.UAPI); err != nil {
+			dev.Close()
+			return nil, fmt.Errorf("uapi socket %s: %w", conf.UAPI, err)
+		}
+		l.Info("serving uapi socket", "name", conf.UAPI)
+		go serveUAPI(uapi, dev)
+	}
+
 	return &VirtualTun{
-		Tnet:      tnet,
-		Logger:    l.With("subsystem", "vtun"),
-		Dev:       dev,
-		Ctx:       ctx,
+		Tnet:    tnet,
+		Logger:  l.With("subsystem", "vtun"),
+		Dev:     dev,
+		Ctx:     ctx,
+		DNS:     conf.Interface.DNS,
+		uapi:    uapi,
+		stopped: make(chan struct{}),
 	}, nil
 }
+
+// hasIPv4 reports whether any of addrs is an IPv4 address.
+func hasIPv4(addrs []netip.Addr) bool {
+	for _, addr := range addrs {
+		if addr.Is4() {
+			return true
+		}
+	}
+	return false
+}